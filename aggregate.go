@@ -0,0 +1,324 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// aggKind is the kind of an aggregate function.
+type aggKind int
+
+const (
+	aggCount aggKind = iota
+	aggSum
+	aggMin
+	aggMax
+	aggAvg
+)
+
+// Aggregation is an aggregate function over a JSON path of the values.
+type Aggregation struct {
+	Name string
+	path string
+	kind aggKind
+}
+
+/*
+Group is the result of the aggregations over one group of values.
+Key is the value of the group by path (nil when there is no group by),
+Values holds the result of every aggregation by its name.
+Min, Max and Avg are left out when the group has no numbers for their path.
+*/
+type Group struct {
+	Key    any
+	Values map[string]float64
+	Count  int
+}
+
+// aggregator keeps the state of the aggregations of a bucket, group by group.
+type aggregator struct {
+	groups  map[string]*groupState
+	bucket  string
+	groupBy string
+	aggs    []Aggregation
+}
+
+// groupState is the running state of the aggregations of one group.
+type groupState struct {
+	key     gjson.Result
+	sums    []float64
+	numbers []int
+	seen    []map[float64]int
+	count   int
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+Count counts the values.
+*/
+func Count() Aggregation {
+	return Aggregation{Name: "count", kind: aggCount}
+}
+
+/*
+Sum sums the numbers on a path.
+*/
+func Sum(path string) Aggregation {
+	return Aggregation{Name: "sum(" + path + ")", path: path, kind: aggSum}
+}
+
+/*
+Min returns the lowest number on a path.
+*/
+func Min(path string) Aggregation {
+	return Aggregation{Name: "min(" + path + ")", path: path, kind: aggMin}
+}
+
+/*
+Max returns the highest number on a path.
+*/
+func Max(path string) Aggregation {
+	return Aggregation{Name: "max(" + path + ")", path: path, kind: aggMax}
+}
+
+/*
+Avg returns the average of the numbers on a path.
+*/
+func Avg(path string) Aggregation {
+	return Aggregation{Name: "avg(" + path + ")", path: path, kind: aggAvg}
+}
+
+/*
+As renames the aggregation in the results.
+*/
+func (agg Aggregation) As(name string) Aggregation {
+	agg.Name = name
+
+	return agg
+}
+
+/*
+Aggregate evaluates the aggregations over the values of a bucket, grouped by a JSON path.
+An empty groupBy puts all the values in one group.
+The groups are sorted by their key.
+*/
+func (fdb *DB) Aggregate(bucket, groupBy string, aggs ...Aggregation) ([]*Group, error) {
+	if len(aggs) == 0 {
+		return nil, errors.New("aggregate->no aggregations")
+	}
+
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	agr := newAggregator(bucket, groupBy, aggs)
+	for _, value := range sh.live(bucket, time.Now()) {
+		agr.update(value, 1)
+	}
+
+	return agr.results(), nil
+}
+
+/*
+Materialize creates an aggregate with a name, that is kept up to date on every Set and Del.
+It lives in memory only, so it has to be created after every Open.
+*/
+func (fdb *DB) Materialize(name, bucket, groupBy string, aggs ...Aggregation) error {
+	if len(aggs) == 0 {
+		return errors.New("materialize->no aggregations")
+	}
+
+	// a name is unique over all the buckets
+	fdb.DropMaterialized(name)
+
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	agr := newAggregator(bucket, groupBy, aggs)
+	for _, value := range sh.keys[bucket] {
+		agr.update(value, 1)
+	}
+
+	sh.materialized[name] = agr
+
+	return nil
+}
+
+/*
+Materialized returns the current results of a materialized aggregate.
+*/
+func (fdb *DB) Materialized(name string) ([]*Group, error) {
+	for _, sh := range fdb.shards {
+		sh.mu.RLock()
+
+		agr, found := sh.materialized[name]
+		if found {
+			groups := agr.results()
+			sh.mu.RUnlock()
+
+			return groups, nil
+		}
+
+		sh.mu.RUnlock()
+	}
+
+	return nil, fmt.Errorf("materialized aggregate (%s) not found", name)
+}
+
+/*
+DropMaterialized removes a materialized aggregate.
+*/
+func (fdb *DB) DropMaterialized(name string) {
+	for _, sh := range fdb.shards {
+		sh.mu.Lock()
+		delete(sh.materialized, name)
+		sh.mu.Unlock()
+	}
+}
+
+/*
+updateMaterialized replaces the old value of a key by the new one in the materialized aggregates.
+A nil value means the key didn't exist (old) or is deleted (new).
+The caller should hold the lock.
+*/
+func (sh *shard) updateMaterialized(bucket string, oldValue, newValue []byte) {
+	for _, agr := range sh.materialized {
+		if agr.bucket != bucket {
+			continue
+		}
+
+		if oldValue != nil {
+			agr.update(oldValue, -1)
+		}
+
+		if newValue != nil {
+			agr.update(newValue, 1)
+		}
+	}
+}
+
+/*
+newAggregator returns an aggregator without any values.
+*/
+func newAggregator(bucket, groupBy string, aggs []Aggregation) *aggregator {
+	return &aggregator{
+		bucket:  bucket,
+		groupBy: groupBy,
+		aggs:    slices.Clone(aggs),
+		groups:  map[string]*groupState{},
+	}
+}
+
+/*
+update adds (sign 1) or removes (sign -1) a value from its group.
+*/
+func (agr *aggregator) update(value []byte, sign int) {
+	var groupKey gjson.Result
+	if agr.groupBy != "" {
+		groupKey = gjson.GetBytes(value, agr.groupBy)
+	}
+
+	entry := indexKey(groupKey)
+
+	group, found := agr.groups[entry]
+	if !found {
+		group = &groupState{
+			key:     groupKey,
+			sums:    make([]float64, len(agr.aggs)),
+			numbers: make([]int, len(agr.aggs)),
+			seen:    make([]map[float64]int, len(agr.aggs)),
+		}
+		agr.groups[entry] = group
+	}
+
+	group.count += sign
+
+	for i, agg := range agr.aggs {
+		if agg.kind == aggCount {
+			continue
+		}
+
+		res := gjson.GetBytes(value, agg.path)
+		if res.Type != gjson.Number {
+			continue
+		}
+
+		group.numbers[i] += sign
+		group.sums[i] += float64(sign) * res.Num
+
+		if agg.kind == aggMin || agg.kind == aggMax {
+			group.remember(i, res.Num, sign)
+		}
+	}
+
+	if group.count == 0 {
+		delete(agr.groups, entry)
+	}
+}
+
+/*
+results returns the groups with the results of the aggregations, sorted by key.
+*/
+func (agr *aggregator) results() []*Group {
+	states := slices.SortedFunc(maps.Values(agr.groups), func(a, b *groupState) int {
+		return compareResults(a.key, b.key)
+	})
+
+	groups := make([]*Group, len(states))
+
+	for count, state := range states {
+		group := &Group{Key: state.key.Value(), Count: state.count, Values: map[string]float64{}}
+
+		for i, agg := range agr.aggs {
+			switch agg.kind {
+			case aggCount:
+				group.Values[agg.Name] = float64(state.count)
+			case aggSum:
+				group.Values[agg.Name] = state.sums[i]
+			case aggAvg:
+				if state.numbers[i] > 0 {
+					group.Values[agg.Name] = state.sums[i] / float64(state.numbers[i])
+				}
+			case aggMin:
+				if len(state.seen[i]) > 0 {
+					group.Values[agg.Name] = slices.Min(slices.Collect(maps.Keys(state.seen[i])))
+				}
+			case aggMax:
+				if len(state.seen[i]) > 0 {
+					group.Values[agg.Name] = slices.Max(slices.Collect(maps.Keys(state.seen[i])))
+				}
+			}
+		}
+
+		groups[count] = group
+	}
+
+	return groups
+}
+
+/*
+remember counts how often a number is seen for an aggregation,
+so min and max stay correct when values are removed.
+*/
+func (group *groupState) remember(agg int, number float64, sign int) {
+	if group.seen[agg] == nil {
+		group.seen[agg] = map[float64]int{}
+	}
+
+	group.seen[agg][number] += sign
+
+	if group.seen[agg][number] <= 0 {
+		delete(group.seen[agg], number)
+	}
+}
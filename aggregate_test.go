@@ -0,0 +1,89 @@
+package fastdb_test
+
+import (
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Aggregate(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	fillQueryUsers(t, store, 9)
+
+	groups, err := store.Aggregate("user", "Email",
+		fastdb.Count(), fastdb.Sum("Age"), fastdb.Min("Age"), fastdb.Max("Age"), fastdb.Avg("Age").As("average"))
+	require.NoError(t, err)
+	require.Len(t, groups, 3)
+
+	// user0 has the ids 3, 6 and 9
+	assert.Equal(t, "user0@example.com", groups[0].Key)
+	assert.Equal(t, 3, groups[0].Count)
+	assert.InDelta(t, 3.0, groups[0].Values["count"], 0)
+	assert.InDelta(t, 23.0+26+29, groups[0].Values["sum(Age)"], 0)
+	assert.InDelta(t, 23.0, groups[0].Values["min(Age)"], 0)
+	assert.InDelta(t, 29.0, groups[0].Values["max(Age)"], 0)
+	assert.InDelta(t, 26.0, groups[0].Values["average"], 0)
+
+	groups, err = store.Aggregate("user", "", fastdb.Sum("ID"), fastdb.Min("Missing"))
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Nil(t, groups[0].Key)
+	assert.InDelta(t, 45.0, groups[0].Values["sum(ID)"], 0)
+	assert.NotContains(t, groups[0].Values, "min(Missing)")
+
+	groups, err = store.Aggregate("nothing", "Email", fastdb.Count())
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+
+	_, err = store.Aggregate("user", "Email")
+	require.Error(t, err)
+}
+
+func Test_Materialize(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	fillQueryUsers(t, store, 9)
+
+	err = store.Materialize("ages", "user", "Email", fastdb.Count(), fastdb.Min("Age"), fastdb.Max("Age"))
+	require.NoError(t, err)
+
+	// remove the youngest and the oldest of user0
+	_, err = store.Del("user", 3)
+	require.NoError(t, err)
+
+	err = store.Set("user", 9, []byte(`{"ID":9,"Email":"user1@example.com","Age":99}`))
+	require.NoError(t, err)
+
+	err = store.Set("other", 1, []byte(`{"ID":1,"Email":"user0@example.com","Age":1}`))
+	require.NoError(t, err)
+
+	groups, err := store.Materialized("ages")
+	require.NoError(t, err)
+	require.Len(t, groups, 3)
+	assert.Equal(t, 1, groups[0].Count)
+	assert.InDelta(t, 26.0, groups[0].Values["min(Age)"], 0)
+	assert.InDelta(t, 26.0, groups[0].Values["max(Age)"], 0)
+	assert.Equal(t, 4, groups[1].Count)
+	assert.InDelta(t, 99.0, groups[1].Values["max(Age)"], 0)
+
+	_, err = store.Del("user", 6)
+	require.NoError(t, err)
+
+	groups, err = store.Materialized("ages")
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "user1@example.com", groups[0].Key)
+
+	store.DropMaterialized("ages")
+
+	_, err = store.Materialized("ages")
+	require.Error(t, err)
+
+	err = store.Materialize("none", "user", "")
+	require.Error(t, err)
+}
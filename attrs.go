@@ -0,0 +1,223 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Attrs are the attributes of a key, like the flags of a memcached item.
+// They belong to the value: a set or del removes them.
+type Attrs map[string]string
+
+// Entry is a value with the moment it expires (the zero time when it doesn't) and its attributes.
+type Entry struct {
+	Expires time.Time
+	Attrs   Attrs
+	Value   []byte
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+SetEntry stores a value with its expiry and attributes, they are written in one batch.
+*/
+func (fdb *DB) SetEntry(bucket string, key int, entry Entry) error {
+	return fdb.SetEntryCtx(context.Background(), bucket, key, entry)
+}
+
+/*
+SetEntryCtx stores a value with its expiry and attributes like SetEntry,
+it stops waiting for the sync when the context ends.
+*/
+func (fdb *DB) SetEntryCtx(ctx context.Context, bucket string, key int, entry Entry) error {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	return fdb.setEntry(ctx, sh, bucket, key, entry)
+}
+
+/*
+GetEntry returns the value of a key like Get, with its expiry and attributes.
+*/
+func (fdb *DB) GetEntry(bucket string, key int) (Entry, bool) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	var entry Entry
+
+	found := sh.exists(bucket, key, time.Now())
+	if found {
+		entry = sh.entry(bucket, key)
+	}
+
+	entry.Value, found = fdb.hooks.Load().interceptGet(bucket, key, entry.Value, found)
+	if !found {
+		return Entry{}, false
+	}
+
+	return entry, true
+}
+
+/*
+Attrs returns the attributes of a key, nil when it has none.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) Attrs(bucket string, key int) (Attrs, bool) {
+	entry, found := fdb.GetEntry(bucket, key)
+
+	return entry.Attrs, found
+}
+
+/*
+SetAttrs replaces the attributes of an existing key, empty attributes remove them.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) SetAttrs(bucket string, key int, attrs Attrs) (bool, error) {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	now := time.Now()
+
+	if !sh.exists(bucket, key, now) {
+		return false, nil
+	}
+
+	if fdb.aof != nil {
+		err := fdb.aof.Append(persist.AttrsInstruction(bucket, key, attrs, now))
+		if err != nil {
+			return false, fmt.Errorf("attrs->write error: %w", err)
+		}
+	}
+
+	fdb.setAttrs(sh, bucket, key, attrs)
+
+	return true, nil
+}
+
+/*
+setEntry stores a value like set, with its expiry and attributes (unless they are empty).
+The value, its expiry and its attributes are written in one batch.
+*/
+func (fdb *DB) setEntry(ctx context.Context, sh *shard, bucket string, key int, entry Entry) error {
+	if key < 0 {
+		return errors.New("set->key should be positive")
+	}
+
+	hks := fdb.hooks.Load()
+
+	value, err := hks.beforeSetValue(bucket, key, entry.Value)
+	if err != nil {
+		return err
+	}
+
+	err = sh.validate(bucket, key, value)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	var syncErr error
+
+	if fdb.aof != nil {
+		err = fdb.aof.AppendCtx(ctx, entryLines(bucket, key, value, entry, now))
+		if errors.Is(err, persist.ErrNotSynced) {
+			syncErr = fmt.Errorf("set->write error: %w", err)
+		} else if err != nil {
+			return fmt.Errorf("set->write error: %w", err)
+		}
+	}
+
+	fdb.applySet(sh, hks, bucket, key, value, now)
+	fdb.setExpiry(sh, bucket, key, entry.Expires)
+	fdb.setAttrs(sh, bucket, key, entry.Attrs)
+
+	return syncErr
+}
+
+/*
+entryLines returns the lines that store a value, in a batch when it has an expiry or attributes.
+*/
+func entryLines(bucket string, key int, value []byte, entry Entry, now time.Time) string {
+	lines := []string{persist.SetInstruction(bucket, key, value, now)}
+
+	if !entry.Expires.IsZero() {
+		lines = append(lines, persist.ExpireInstruction(bucket, key, entry.Expires, now))
+	}
+
+	if len(entry.Attrs) > 0 {
+		lines = append(lines, persist.AttrsInstruction(bucket, key, entry.Attrs, now))
+	}
+
+	if len(lines) == 1 {
+		return lines[0]
+	}
+
+	return persist.BatchInstruction(now, lines...)
+}
+
+/*
+setAttrs keeps the attributes of a key in memory, empty attributes remove them.
+The caller should hold the lock of the shard.
+*/
+func (fdb *DB) setAttrs(sh *shard, bucket string, key int, attrs Attrs) {
+	if len(attrs) == 0 {
+		if _, found := sh.attrs[bucket][key]; !found {
+			return
+		}
+
+		delete(sh.attrs[bucket], key)
+
+		if len(sh.attrs[bucket]) == 0 {
+			delete(sh.attrs, bucket)
+		}
+	} else {
+		if _, found := sh.attrs[bucket]; !found {
+			sh.attrs[bucket] = map[int]Attrs{}
+		}
+
+		sh.attrs[bucket][key] = maps.Clone(attrs)
+	}
+
+	if fdb.aof != nil {
+		fdb.aof.SetAttrs(bucket, key, attrs)
+	}
+}
+
+/*
+loadAttrs keeps the attributes of the keys that were read from the file.
+*/
+func (fdb *DB) loadAttrs(attrs map[string]map[int]map[string]string) {
+	for bucket, keys := range attrs {
+		sh := fdb.shardFor(bucket)
+
+		for key, keyAttrs := range keys {
+			if _, found := sh.keys[bucket][key]; found {
+				fdb.setAttrs(sh, bucket, key, keyAttrs)
+			}
+		}
+	}
+}
+
+/*
+entry returns the value of a key with its expiry and a copy of its attributes.
+The caller should hold the lock of the shard.
+*/
+func (sh *shard) entry(bucket string, key int) Entry {
+	return Entry{
+		Value:   sh.keys[bucket][key],
+		Expires: sh.expiry(bucket, key),
+		Attrs:   maps.Clone(sh.attrs[bucket][key]),
+	}
+}
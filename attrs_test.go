@@ -0,0 +1,119 @@
+package fastdb_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetEntry(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	later := time.Now().Add(time.Hour)
+	entry := fastdb.Entry{Value: []byte("one"), Expires: later, Attrs: fastdb.Attrs{"flags": "3"}}
+	require.NoError(t, store.SetEntry("text", 1, entry))
+
+	got, found := store.GetEntry("text", 1)
+	assert.True(t, found)
+	assert.Equal(t, entry, got)
+
+	// the attributes are a copy
+	got.Attrs["flags"] = "4"
+	attrs, found := store.Attrs("text", 1)
+	assert.True(t, found)
+	assert.Equal(t, fastdb.Attrs{"flags": "3"}, attrs)
+
+	// an update keeps them, a set removes them
+	require.NoError(t, store.Update("text", 1, func([]byte, bool) ([]byte, error) { return []byte("uno"), nil }))
+	got, _ = store.GetEntry("text", 1)
+	assert.Equal(t, entry.Attrs, got.Attrs)
+	assert.Equal(t, "uno", string(got.Value))
+
+	require.NoError(t, store.Set("text", 1, []byte("one")))
+	attrs, found = store.Attrs("text", 1)
+	assert.True(t, found)
+	assert.Nil(t, attrs)
+
+	ok, err := store.SetAttrs("text", 1, fastdb.Attrs{"flags": "5"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	attrs, _ = store.Attrs("text", 1)
+	assert.Equal(t, fastdb.Attrs{"flags": "5"}, attrs)
+
+	ok, err = store.SetAttrs("text", 2, fastdb.Attrs{"flags": "5"})
+	require.NoError(t, err)
+	assert.False(t, ok, "the key doesn't exist")
+
+	_, err = store.Del("text", 1)
+	require.NoError(t, err)
+
+	_, found = store.GetEntry("text", 1)
+	assert.False(t, found)
+
+	require.NoError(t, store.Set("text", 1, []byte("one")))
+	attrs, _ = store.Attrs("text", 1)
+	assert.Nil(t, attrs, "a del removes the attributes")
+
+	err = store.SetEntry("text", -1, fastdb.Entry{Value: []byte("one")})
+	require.Error(t, err)
+}
+
+func Test_SetEntry_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attrs.db")
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Hour).Round(0)
+	require.NoError(t, store.SetEntry("text", 1, fastdb.Entry{Value: []byte("one"), Attrs: fastdb.Attrs{"flags": "1"}}))
+	require.NoError(t, store.SetEntry("text", 2, fastdb.Entry{Value: []byte("two"), Expires: later, Attrs: fastdb.Attrs{"flags": "2"}}))
+	require.NoError(t, store.SetEntry("text", 3, fastdb.Entry{Value: []byte("three"), Attrs: fastdb.Attrs{"flags": "3"}}))
+
+	ok, err := store.SetAttrs("text", 3, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// a value with line breaks is kept as it is, also in a batch and after a defrag
+	require.NoError(t, store.Set("text", 4, []byte("two\nlines")))
+	require.NoError(t, store.NewBatch().Set("text", 5, []byte("five\r")).Set("text", 6, []byte("\x00\r\n")).Commit())
+
+	require.NoError(t, store.Defrag())
+	require.NoError(t, store.Close())
+
+	store, err = fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	attrs, _ := store.Attrs("text", 1)
+	assert.Equal(t, fastdb.Attrs{"flags": "1"}, attrs)
+
+	entry, found := store.GetEntry("text", 2)
+	assert.True(t, found)
+	assert.True(t, later.Equal(entry.Expires))
+	assert.Equal(t, fastdb.Attrs{"flags": "2"}, entry.Attrs)
+
+	attrs, found = store.Attrs("text", 3)
+	assert.True(t, found)
+	assert.Nil(t, attrs)
+
+	for key, value := range map[int]string{4: "two\nlines", 5: "five\r", 6: "\x00\r\n"} {
+		stored, found := store.Get("text", key)
+		assert.True(t, found)
+		assert.Equal(t, value, string(stored))
+	}
+}
@@ -0,0 +1,284 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+/*
+WriteBatch collects sets and deletes, that are written with one append to the file.
+They are applied all at once, or (when one of them fails) not at all.
+*/
+type WriteBatch struct {
+	db  *DB
+	ops []batchOp
+}
+
+// Conflict tells what happens when a key that is set already exists.
+type Conflict int
+
+// batchOp is one change in a batch.
+type batchOp struct {
+	value      []byte
+	bucket     string
+	key        int
+	onConflict Conflict
+	deleted    bool
+}
+
+// batchResult holds the number of changes a batch applied.
+type batchResult struct {
+	set     int
+	deleted int
+}
+
+// batchKey identifies a key over all the buckets.
+type batchKey struct {
+	bucket string
+	key    int
+}
+
+const (
+	// Upsert overwrites the existing value.
+	Upsert Conflict = iota
+	// Skip keeps the existing value, and leaves the new one out.
+	Skip
+	// Fail rejects the whole batch with ErrKeyExists.
+	Fail
+)
+
+// ErrKeyExists is returned when a key already exists, and that is not allowed.
+var ErrKeyExists = errors.New("key already exists")
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+NewBatch returns an empty batch for the database.
+*/
+func (fdb *DB) NewBatch() *WriteBatch {
+	return &WriteBatch{db: fdb}
+}
+
+/*
+Set adds the setting of a value to the batch.
+*/
+func (wb *WriteBatch) Set(bucket string, key int, value []byte) *WriteBatch {
+	wb.ops = append(wb.ops, batchOp{bucket: bucket, key: key, value: value})
+
+	return wb
+}
+
+/*
+SetNew adds the setting of a value to the batch, with what to do when the key already exists.
+*/
+func (wb *WriteBatch) SetNew(bucket string, key int, value []byte, onConflict Conflict) *WriteBatch {
+	wb.ops = append(wb.ops, batchOp{bucket: bucket, key: key, value: value, onConflict: onConflict})
+
+	return wb
+}
+
+/*
+Del adds the deletion of a key to the batch, a key that doesn't exist is skipped.
+*/
+func (wb *WriteBatch) Del(bucket string, key int) *WriteBatch {
+	wb.ops = append(wb.ops, batchOp{bucket: bucket, key: key, deleted: true})
+
+	return wb
+}
+
+/*
+Len returns the number of changes in the batch.
+*/
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+/*
+Commit writes the batch and applies it to the database.
+*/
+func (wb *WriteBatch) Commit() error {
+	return wb.CommitCtx(context.Background())
+}
+
+/*
+CommitCtx writes the batch like Commit, but stops when the context ends (see SetCtx).
+*/
+func (wb *WriteBatch) CommitCtx(ctx context.Context) error {
+	_, err := wb.commit(ctx)
+
+	return err
+}
+
+/*
+SetMany sets the values of the keys in a bucket, with one append to the file.
+*/
+func (fdb *DB) SetMany(bucket string, values map[int][]byte) error {
+	batch := fdb.NewBatch()
+
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		batch.Set(bucket, key, values[key])
+	}
+
+	return batch.Commit()
+}
+
+/*
+DelMany deletes the keys from a bucket, with one append to the file.
+It returns the number of keys that were deleted.
+*/
+func (fdb *DB) DelMany(bucket string, keys []int) (int, error) {
+	batch := fdb.NewBatch()
+
+	for _, key := range keys {
+		batch.Del(bucket, key)
+	}
+
+	result, err := batch.commit(context.Background())
+
+	return result.deleted, err
+}
+
+/*
+commit runs the hooks and the validation of all the changes, writes them and applies them.
+It returns the number of set and deleted keys.
+*/
+func (wb *WriteBatch) commit(ctx context.Context) (batchResult, error) {
+	var result batchResult
+
+	if len(wb.ops) == 0 {
+		return result, nil
+	}
+
+	fdb := wb.db
+
+	buckets := make([]string, 0, len(wb.ops))
+	for _, op := range wb.ops {
+		buckets = append(buckets, op.bucket)
+	}
+
+	defer fdb.lockBuckets(buckets)()
+
+	hks := fdb.hooks.Load()
+
+	ops, err := wb.prepare(hks)
+	if err != nil {
+		return result, err
+	}
+
+	if len(ops) == 0 {
+		return result, nil
+	}
+
+	now := time.Now()
+
+	var syncErr error
+
+	if fdb.aof != nil {
+		instructions := make([]string, 0, len(ops))
+
+		for _, op := range ops {
+			if op.deleted {
+				instructions = append(instructions, persist.DelInstruction(op.bucket, op.key, now))
+			} else {
+				instructions = append(instructions, persist.SetInstruction(op.bucket, op.key, op.value, now))
+			}
+		}
+
+		err = fdb.aof.AppendCtx(ctx, persist.BatchInstruction(now, instructions...))
+		if errors.Is(err, persist.ErrNotSynced) {
+			syncErr = fmt.Errorf("batch->write error: %w", err)
+		} else if err != nil {
+			return result, fmt.Errorf("batch->write error: %w", err)
+		}
+	}
+
+	for _, op := range ops {
+		sh := fdb.shardFor(op.bucket)
+
+		if op.deleted {
+			fdb.applyDel(sh, hks, op.bucket, op.key, now)
+			result.deleted++
+		} else {
+			fdb.applySet(sh, hks, op.bucket, op.key, op.value, now)
+			result.set++
+		}
+	}
+
+	return result, syncErr
+}
+
+/*
+prepare runs the before hooks and the validation of the changes, in the order of the batch.
+It returns the changes that have to be written, deletes of missing keys
+(and sets of existing keys that should be skipped) are left out.
+The caller should hold the locks of the shards.
+*/
+func (wb *WriteBatch) prepare(hks *hooks) ([]batchOp, error) {
+	// exists keeps track of the keys that are set or deleted earlier in the batch
+	exists := map[batchKey]bool{}
+	ops := make([]batchOp, 0, len(wb.ops))
+
+	for _, op := range wb.ops {
+		sh := wb.db.shardFor(op.bucket)
+		bkey := batchKey{bucket: op.bucket, key: op.key}
+
+		found, seen := exists[bkey]
+		if !seen {
+			_, found = sh.keys[op.bucket][op.key]
+		}
+
+		if op.deleted {
+			if !found {
+				continue
+			}
+
+			err := hks.beforeDelKey(op.bucket, op.key)
+			if err != nil {
+				return nil, err
+			}
+
+			exists[bkey] = false
+			ops = append(ops, op)
+
+			continue
+		}
+
+		if op.key < 0 {
+			return nil, errors.New("batch->key should be positive")
+		}
+
+		if found && op.onConflict == Skip {
+			continue
+		}
+
+		if found && op.onConflict == Fail {
+			return nil, fmt.Errorf("batch->key (%s_%d) error: %w", op.bucket, op.key, ErrKeyExists)
+		}
+
+		value, err := hks.beforeSetValue(op.bucket, op.key, op.value)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sh.validate(op.bucket, op.key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		op.value = value
+		exists[bkey] = true
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,148 @@
+package fastdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetMany_DelMany(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.db")
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	values := map[int][]byte{}
+	for key := range 100 {
+		values[key] = []byte(strconv.Itoa(key))
+	}
+
+	err = store.SetMany("texts", values)
+	require.NoError(t, err)
+
+	records, err := store.GetAll("texts")
+	require.NoError(t, err)
+	assert.Len(t, records, 100)
+
+	count, err := store.DelMany("texts", []int{1, 2, 3, 1000})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	require.NoError(t, store.Close())
+
+	// batch line + 100 sets + commit line, batch line + 3 dels + commit line
+	checkFileLines(t, path, 1+100*3+1+1+3*2+1)
+
+	store, err = fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	records, err = store.GetAll("texts")
+	require.NoError(t, err)
+	assert.Len(t, records, 97)
+
+	_, ok := store.Get("texts", 2)
+	assert.False(t, ok)
+}
+
+func Test_WriteBatch_atomic(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("texts", 1, []byte("one")))
+
+	store.OnBeforeSet("texts", func(_ string, key int, value []byte) ([]byte, error) {
+		if key == 3 {
+			return nil, errors.New("no three")
+		}
+
+		return value, nil
+	})
+
+	err = store.NewBatch().
+		Set("texts", 2, []byte("two")).
+		Del("texts", 1).
+		Set("texts", 3, []byte("three")).
+		Commit()
+	require.Error(t, err)
+
+	// nothing of the batch is applied
+	_, ok := store.Get("texts", 2)
+	assert.False(t, ok)
+
+	_, ok = store.Get("texts", 1)
+	assert.True(t, ok)
+
+	batch := store.NewBatch().
+		Set("texts", 2, []byte("two")).
+		Del("texts", 2).
+		Set("other", 1, []byte("other")).
+		Del("texts", 5)
+	assert.Equal(t, 4, batch.Len())
+
+	err = batch.Commit()
+	require.NoError(t, err)
+
+	_, ok = store.Get("texts", 2)
+	assert.False(t, ok)
+
+	value, ok := store.Get("other", 1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("other"), value)
+}
+
+func Test_WriteBatch_incomplete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.db")
+
+	// the file ends inside a batch, like after a crash
+	err := os.WriteFile(path, []byte("set\ntexts_1\none\nbatch 1\nset 1\ntexts_2\ntwo\ndel 1\n"), 0o600)
+	require.NoError(t, err)
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	records, err := store.GetAll("texts")
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	require.NoError(t, store.Set("texts", 3, []byte("three")))
+	require.NoError(t, store.Close())
+
+	store, err = fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	records, err = store.GetAll("texts")
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, []byte("three"), records[3])
+}
+
+func Benchmark_SetMany_Memory(b *testing.B) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(b, err)
+
+	values := map[int][]byte{}
+	for key := range 1000 {
+		values[key] = []byte(strconv.Itoa(key))
+	}
+
+	b.ResetTimer()
+
+	for range b.N {
+		err = store.SetMany("texts", values)
+		require.NoError(b, err)
+	}
+}
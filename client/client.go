@@ -0,0 +1,516 @@
+// Package client is a Go client for the KeyValueStore RPC service of a fastdb cluster.
+//
+// It finds the leader from any node of the cluster, calls every node over one
+// connection of the transport package (net/rpc for an older node), retries when
+// a node can't be reached or isn't the leader anymore, and turns the errors of
+// the server into the errors of this package.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultRetries = 3
+
+	// Deprecated: the calls to a node share one connection, WithPoolSize doesn't change it.
+	DefaultPoolSize = 4
+
+	firstBackoff = 50 * time.Millisecond
+	maxBackoff   = time.Second
+)
+
+type (
+	// GetResult is a value, with the node it was read from.
+	GetResult = replicationmanager.GetResult
+	// ClusterInfo describes the cluster as one node sees it.
+	ClusterInfo = replicationmanager.ClusterInfo
+	// ReadPreference tells where a value is read.
+	ReadPreference = replicationmanager.ReadPreference
+	// Record is a key with its value.
+	Record = replicationmanager.Record
+	// TypedValue is a value with its content type.
+	TypedValue = replicationmanager.TypedValue
+	// ContentType is the type of a value.
+	ContentType = replicationmanager.ContentType
+)
+
+const (
+	ReadFromLeader = replicationmanager.ReadFromLeader
+	ReadFromLocal  = replicationmanager.ReadFromLocal
+)
+
+const (
+	ContentRaw    = replicationmanager.ContentRaw
+	ContentString = replicationmanager.ContentString
+	ContentJSON   = replicationmanager.ContentJSON
+	ContentInt    = replicationmanager.ContentInt
+	ContentFloat  = replicationmanager.ContentFloat
+	ContentBool   = replicationmanager.ContentBool
+)
+
+var (
+	// ErrNotFound is returned when a key doesn't exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrNotLeader is returned when a write reached a node that isn't the leader, also after the retries.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrNoLeader is returned when the cluster has no leader.
+	ErrNoLeader = errors.New("no leader available")
+	// ErrInvalidArgument is returned when the server rejects a key or a value.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrPermissionDenied is returned when the bucket may not be read or written.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrUnauthenticated is returned when a node doesn't accept the credentials of the client.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrNotSupported is returned when the server doesn't have the method.
+	ErrNotSupported = errors.New("not supported by the server")
+	// ErrUnavailable is returned when no node can be reached.
+	ErrUnavailable = errors.New("no node available")
+	// ErrClosed is returned when the client is used after Close.
+	ErrClosed = errors.New("client is closed")
+)
+
+// noArgs is the argument of the methods without arguments. It holds a value because a server
+// that doesn't have the method can't skip an argument with only nil, and stops answering.
+var noArgs = [1]interface{}{0}
+
+// Option configures a client.
+type Option func(*Client)
+
+// Client calls the KeyValueStore service of a cluster, it is safe for concurrent use.
+type Client struct {
+	mu      sync.Mutex
+	nodes   []string // the addresses of the nodes, the seeds first
+	leader  string
+	next    int // the node for the next local read
+	peers   *transport.Pool
+	closed  bool
+	timeout time.Duration
+	retries int
+
+	credentials transport.Credentials
+	tls         *tls.Config
+}
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register([]byte{})
+	gob.Register(string(""))
+	gob.Register(int(0))
+	gob.Register(float64(0))
+	gob.Register(bool(false))
+}
+
+// WithTimeout sets the timeout of one attempt of a call, when the context has no earlier deadline.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a call is done again, after a node couldn't be reached
+// or wasn't the leader.
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = max(retries, 0)
+	}
+}
+
+// WithPoolSize set the number of idle net/rpc connections that were kept per node.
+//
+// Deprecated: the calls to a node share one connection of the transport package, the size isn't used.
+func WithPoolSize(int) Option {
+	return func(*Client) {}
+}
+
+// WithToken authenticates the connections with the secret of a credential, for a cluster that requires it.
+// The secret is sent as it is, WithHMAC doesn't send it.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.credentials = service.TokenCredentials(token)
+	}
+}
+
+// WithHMAC authenticates the connections with the name of a credential, and a signature made with its secret.
+func WithHMAC(name, secret string) Option {
+	return func(c *Client) {
+		c.credentials = service.HMACCredentials(name, secret)
+	}
+}
+
+// WithTLS makes the connections with TLS. Without a ServerName the host of the address of a node is verified,
+// for a node that requires client certificates the config has one.
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tls = config
+	}
+}
+
+// New returns a client for the cluster that one or more of the addresses belong to.
+// The leader is looked up on the first call.
+func New(addrs []string, opts ...Option) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("client: no address")
+	}
+
+	c := &Client{
+		nodes:   slices.Clone(addrs),
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	var dialOpts []transport.DialOption
+	if c.credentials != nil {
+		dialOpts = append(dialOpts, transport.WithCredentials(c.credentials))
+	}
+	if c.tls != nil {
+		dialOpts = append(dialOpts, transport.WithTLS(func(string) *tls.Config { return c.tls }))
+	}
+
+	c.peers = transport.NewPool(dialOpts...)
+
+	return c, nil
+}
+
+// Set sets the value of a key on the leader, which replicates it. An empty bucket is the default bucket of the server.
+// The value is stored as JSON, so it should be a number, a bool, a string, or a map or slice of those.
+// A TypedValue is stored with its content type, which Get returns in GetResult.ContentType.
+func (c *Client) Set(ctx context.Context, bucket string, key int, value any) error {
+	var reply string
+	return c.callLeader(ctx, "KeyValueStore.Set", [3]interface{}{bucket, key, value}, &reply)
+}
+
+// Get gets the value of a key, from the leader, or from any node with ReadFromLocal.
+func (c *Client) Get(ctx context.Context, bucket string, key int, preference ReadPreference) (*GetResult, error) {
+	var result GetResult
+	args := [3]interface{}{bucket, key, int(preference)}
+
+	var err error
+	if preference == ReadFromLocal {
+		err = c.callAny(ctx, "KeyValueStore.GetWithPreference", args, &result)
+	} else {
+		err = c.callLeader(ctx, "KeyValueStore.GetWithPreference", args, &result)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// GetAll returns all the values of a bucket.
+func (c *Client) GetAll(ctx context.Context, bucket string) (map[int][]byte, error) {
+	var values map[int][]byte
+	err := c.callLeader(ctx, "KeyValueStore.GetAll", [1]interface{}{bucket}, &values)
+	return values, err
+}
+
+// GetAllSorted returns all the values of a bucket, sorted by key.
+func (c *Client) GetAllSorted(ctx context.Context, bucket string) ([]Record, error) {
+	var records []Record
+	err := c.callLeader(ctx, "KeyValueStore.GetAllSorted", [1]interface{}{bucket}, &records)
+	return records, err
+}
+
+// Delete deletes a key, it returns false when the key didn't exist.
+func (c *Client) Delete(ctx context.Context, bucket string, key int) (bool, error) {
+	var deleted bool
+	err := c.callLeader(ctx, "KeyValueStore.Delete", [2]interface{}{bucket, key}, &deleted)
+	return deleted, err
+}
+
+// Exists tells if a key exists.
+func (c *Client) Exists(ctx context.Context, bucket string, key int) (bool, error) {
+	var exists bool
+	err := c.callLeader(ctx, "KeyValueStore.Exists", [2]interface{}{bucket, key}, &exists)
+	return exists, err
+}
+
+// Keys returns a page of the keys of a bucket in sorted order: at most limit keys
+// (the default of the server when it is 0), from the first key at or after start.
+// The next page starts at the last key plus one.
+func (c *Client) Keys(ctx context.Context, bucket string, start, limit int) ([]int, error) {
+	var keys []int
+	err := c.callLeader(ctx, "KeyValueStore.Keys", [3]interface{}{bucket, start, limit}, &keys)
+	return keys, err
+}
+
+// Count returns the number of keys of a bucket.
+func (c *Client) Count(ctx context.Context, bucket string) (int, error) {
+	var count int
+	err := c.callLeader(ctx, "KeyValueStore.Count", [1]interface{}{bucket}, &count)
+	return count, err
+}
+
+// Buckets returns the names of the buckets on all the nodes that may be read, sorted.
+func (c *Client) Buckets(ctx context.Context) ([]string, error) {
+	var buckets []string
+	err := c.callLeader(ctx, "KeyValueStore.Buckets", noArgs, &buckets)
+	return buckets, err
+}
+
+// Info returns the number of records and buckets on the leader.
+func (c *Client) Info(ctx context.Context) (string, error) {
+	var info string
+	err := c.callLeader(ctx, "KeyValueStore.Info", noArgs, &info)
+	return info, err
+}
+
+// Cluster returns the cluster as the leader sees it.
+func (c *Client) Cluster(ctx context.Context) (*ClusterInfo, error) {
+	var info ClusterInfo
+	if err := c.callLeader(ctx, "KeyValueStore.Cluster", noArgs, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// Leader returns the address of the leader, it is looked up when it isn't known yet.
+func (c *Client) Leader(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	leader := c.leader
+	c.mu.Unlock()
+
+	if leader != "" {
+		return leader, nil
+	}
+
+	return c.discover(ctx)
+}
+
+// Close closes all the connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+
+	return c.peers.Close()
+}
+
+// callLeader calls a method on the leader. When the leader can't be reached or
+// isn't the leader anymore, the leader is looked up again and the call is retried.
+func (c *Client) callLeader(ctx context.Context, method string, args, reply any) error {
+	var err error
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			if werr := wait(ctx, attempt); werr != nil {
+				return errors.Join(err, werr)
+			}
+		}
+
+		var leader string
+		leader, err = c.Leader(ctx)
+		if err != nil {
+			if errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNoLeader) {
+				continue
+			}
+			return err
+		}
+
+		err = c.call(ctx, leader, method, args, reply)
+		if !retryable(err) {
+			return err
+		}
+
+		c.forgetLeader(leader)
+	}
+
+	return err
+}
+
+// callAny calls a method on the nodes in turn, until one answers.
+func (c *Client) callAny(ctx context.Context, method string, args, reply any) error {
+	c.mu.Lock()
+	nodes := slices.Clone(c.nodes)
+	start := c.next
+	c.next++
+	c.mu.Unlock()
+
+	var err error
+	for i := range nodes {
+		err = c.call(ctx, nodes[(start+i)%len(nodes)], method, args, reply)
+		if !errors.Is(err, ErrUnavailable) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// discover asks the nodes who the leader is, and remembers the other nodes they know.
+// A node that can't tell the cluster (an older server) is used as the leader.
+func (c *Client) discover(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	nodes := slices.Clone(c.nodes)
+	c.mu.Unlock()
+
+	errs := make([]error, 0, len(nodes))
+
+	for _, addr := range nodes {
+		var info ClusterInfo
+		err := c.call(ctx, addr, "KeyValueStore.Cluster", noArgs, &info)
+		if errors.Is(err, ErrNotSupported) {
+			c.setLeader(addr)
+			return addr, nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		c.learn(info)
+
+		if info.LeaderID == -1 {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, ErrNoLeader))
+			continue
+		}
+
+		leader := addr
+		if info.LeaderID != info.NodeID {
+			var ok bool
+			if leader, ok = info.Peers[info.LeaderID]; !ok {
+				errs = append(errs, fmt.Errorf("%s: leader Node-%d is unknown: %w", addr, info.LeaderID, ErrNoLeader))
+				continue
+			}
+		}
+
+		c.setLeader(leader)
+		return leader, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.Join(append([]error{ErrUnavailable}, errs...)...)
+}
+
+// learn adds the nodes a node knows to the nodes of the client.
+func (c *Client) learn(info ClusterInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, addr := range info.Peers {
+		if !slices.Contains(c.nodes, addr) {
+			c.nodes = append(c.nodes, addr)
+		}
+	}
+}
+
+func (c *Client) setLeader(addr string) {
+	c.mu.Lock()
+	c.leader = addr
+	c.mu.Unlock()
+}
+
+// forgetLeader forgets the leader, when it is still the given one.
+func (c *Client) forgetLeader(addr string) {
+	c.mu.Lock()
+	if c.leader == addr {
+		c.leader = ""
+	}
+	c.mu.Unlock()
+}
+
+// call calls a method on one node, over the connection the client keeps to it.
+func (c *Client) call(ctx context.Context, addr, method string, args, reply any) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	err := c.peers.Call(ctx, addr, method, args, reply)
+
+	var serverErr transport.ServerError
+	var rpcErr rpc.ServerError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &serverErr) || errors.As(err, &rpcErr):
+		return mapError(err)
+	case errors.Is(err, transport.ErrAuthentication):
+		return fmt.Errorf("%s: %w: %w", addr, ErrUnauthenticated, err)
+	case err == ctx.Err(): //nolint:errorlint // a dial that ends with the context is wrapped, and is unavailable
+		// the call was sent, it isn't done again because it may have been applied
+		return fmt.Errorf("%s: %w", method, err)
+	default:
+		return fmt.Errorf("%s: %w: %w", addr, ErrUnavailable, err)
+	}
+}
+
+// mapError turns an error of the server into an error of this package, with the message of the server.
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+
+	var kind error
+	switch {
+	case strings.HasPrefix(msg, "rpc: can't find") || strings.HasPrefix(msg, "transport: can't find"):
+		kind = ErrNotSupported
+	case strings.Contains(msg, "permission denied"):
+		kind = ErrPermissionDenied
+	case strings.Contains(msg, "not the leader"):
+		kind = ErrNotLeader
+	case strings.Contains(msg, "no leader available"):
+		kind = ErrNoLeader
+	case strings.Contains(msg, "not found") || strings.Contains(msg, "failed to get value"):
+		kind = ErrNotFound
+	case strings.Contains(msg, "parse") || strings.Contains(msg, "is nil") || strings.Contains(msg, "should be positive"):
+		kind = ErrInvalidArgument
+	default:
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", kind, msg)
+}
+
+// retryable tells if a call can be done again, on the (new) leader.
+func retryable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNotLeader) || errors.Is(err, ErrNoLeader)
+}
+
+// wait waits before the next attempt, longer after every attempt.
+func wait(ctx context.Context, attempt int) error {
+	backoff := min(firstBackoff<<(attempt-1), maxBackoff)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
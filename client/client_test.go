@@ -0,0 +1,485 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode is a node that keeps its values in memory.
+type fakeNode struct {
+	mu     sync.Mutex
+	info   ClusterInfo
+	values map[int][]byte
+}
+
+func (n *fakeNode) isLeader() error {
+	if n.info.LeaderID == -1 {
+		return errors.New("no leader available")
+	}
+	if n.info.LeaderID != n.info.NodeID {
+		return fmt.Errorf("not the leader, current leader is Node-%d", n.info.LeaderID)
+	}
+	return nil
+}
+
+func (n *fakeNode) setLeader(id int) {
+	n.mu.Lock()
+	n.info.LeaderID = id
+	n.mu.Unlock()
+}
+
+// checkBucket only gives access to the default bucket.
+func checkBucket(bucket interface{}) error {
+	if bucket != "" {
+		return fmt.Errorf("permission denied: no access to bucket (%s)", bucket)
+	}
+	return nil
+}
+
+func (n *fakeNode) Set(args [3]interface{}, reply *string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.isLeader(); err != nil {
+		return err
+	}
+	if err := checkBucket(args[0]); err != nil {
+		return err
+	}
+
+	key, ok := args[1].(int)
+	if !ok || key <= 0 {
+		return errors.New("key should be positive")
+	}
+
+	n.values[key] = []byte(fmt.Sprint(args[2]))
+	*reply = "Set key successfully"
+	return nil
+}
+
+func (n *fakeNode) GetWithPreference(args [3]interface{}, reply *GetResult) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ReadPreference(args[2].(int)) == ReadFromLeader {
+		if err := n.isLeader(); err != nil {
+			return err
+		}
+	}
+
+	value, ok := n.values[args[1].(int)]
+	if !ok {
+		return errors.New("get->key not found")
+	}
+
+	*reply = GetResult{Value: value, Found: true, Source: fmt.Sprintf("Node-%d", n.info.NodeID)}
+	return nil
+}
+
+func (n *fakeNode) Delete(args [2]interface{}, reply *bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.isLeader(); err != nil {
+		return err
+	}
+
+	_, *reply = n.values[args[1].(int)]
+	delete(n.values, args[1].(int))
+	return nil
+}
+
+func (n *fakeNode) Exists(args [2]interface{}, reply *bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, *reply = n.values[args[1].(int)]
+	return nil
+}
+
+func (n *fakeNode) Keys(args [3]interface{}, reply *[]int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	keys := []int{}
+	for key := range n.values {
+		if key >= args[1].(int) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	*reply = keys[:min(len(keys), args[2].(int))]
+	return nil
+}
+
+func (n *fakeNode) Cluster(_ [1]interface{}, reply *ClusterInfo) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	*reply = n.info
+	return nil
+}
+
+// oldNode is a node of a server without the cluster methods.
+type oldNode struct{}
+
+func (oldNode) Info(_ [1]interface{}, reply *string) error {
+	*reply = "1 record(s) in 1 bucket(s)"
+	return nil
+}
+
+// countingListener counts the connections it accepted.
+type countingListener struct {
+	net.Listener
+	accepted *atomic.Int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+
+	return conn, err
+}
+
+// startNode serves a node like rpcserver does, and returns its address and the number of connections it accepted.
+func startNode(t *testing.T, node any) (string, *atomic.Int32) {
+	t.Helper()
+
+	server := transport.NewServer()
+	require.NoError(t, server.RegisterName("KeyValueStore", node))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	accepted := &atomic.Int32{}
+	go server.Serve(countingListener{Listener: listener, accepted: accepted})
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String(), accepted
+}
+
+// startRPCNode serves a node with net/rpc only, like an older server.
+func startRPCNode(t *testing.T, node any) string {
+	t.Helper()
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("KeyValueStore", node))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Accept(listener)
+
+	return listener.Addr().String()
+}
+
+func startCluster(t *testing.T) (*fakeNode, string, *fakeNode, string) {
+	t.Helper()
+
+	leader := &fakeNode{info: ClusterInfo{NodeID: 2, LeaderID: 2}, values: map[int][]byte{}}
+	leaderAddr, _ := startNode(t, leader)
+
+	follower := &fakeNode{info: ClusterInfo{NodeID: 1, LeaderID: 2}, values: map[int][]byte{}}
+	followerAddr, _ := startNode(t, follower)
+
+	leader.info.Peers = map[int]string{1: followerAddr}
+	follower.info.Peers = map[int]string{2: leaderAddr}
+
+	return leader, leaderAddr, follower, followerAddr
+}
+
+func Test_New_noAddress(t *testing.T) {
+	_, err := New(nil)
+	require.Error(t, err)
+}
+
+func Test_Client_followsLeader(t *testing.T) {
+	leader, leaderAddr, follower, followerAddr := startCluster(t)
+
+	c, err := New([]string{followerAddr}, WithTimeout(time.Second))
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	addr, err := c.Leader(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, leaderAddr, addr)
+
+	require.NoError(t, c.Set(ctx, "", 1, "one"))
+	assert.Equal(t, []byte("one"), leader.values[1])
+
+	// the leader changes: the client is told so, and goes to the new leader
+	leader.setLeader(1)
+	follower.setLeader(1)
+
+	require.NoError(t, c.Set(ctx, "", 2, 42))
+	assert.Equal(t, []byte("42"), follower.values[2])
+
+	addr, err = c.Leader(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, followerAddr, addr)
+
+	info, err := c.Cluster(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.LeaderID)
+}
+
+func Test_Client_Get(t *testing.T) {
+	leader, _, follower, followerAddr := startCluster(t)
+	leader.values[1] = []byte("leader")
+	follower.values[1] = []byte("follower")
+
+	c, err := New([]string{followerAddr})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	result, err := c.Get(ctx, "", 1, ReadFromLeader)
+	require.NoError(t, err)
+	assert.Equal(t, "Node-2", result.Source)
+	assert.Equal(t, []byte("leader"), result.Value)
+
+	// the local reads go to all the known nodes in turn
+	sources := map[string]bool{}
+	for range 4 {
+		result, err = c.Get(ctx, "", 1, ReadFromLocal)
+		require.NoError(t, err)
+		sources[result.Source] = true
+	}
+	assert.Equal(t, map[string]bool{"Node-1": true, "Node-2": true}, sources)
+
+	_, err = c.Get(ctx, "", 2, ReadFromLeader)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_Client_Delete(t *testing.T) {
+	leader, leaderAddr, _, _ := startCluster(t)
+	leader.values[1] = []byte("one")
+
+	c, err := New([]string{leaderAddr})
+	require.NoError(t, err)
+	defer c.Close()
+
+	deleted, err := c.Delete(context.Background(), "", 1)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	deleted, err = c.Delete(context.Background(), "", 1)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func Test_Client_ExistsKeys(t *testing.T) {
+	leader, leaderAddr, _, _ := startCluster(t)
+	leader.values = map[int][]byte{1: []byte("1"), 2: []byte("2"), 4: []byte("4")}
+
+	c, err := New([]string{leaderAddr})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	exists, err := c.Exists(ctx, "", 1)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = c.Exists(ctx, "", 3)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	keys, err := c.Keys(ctx, "", 0, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, keys)
+
+	keys, err = c.Keys(ctx, "", 3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4}, keys)
+}
+
+func Test_Client_errors(t *testing.T) {
+	leader, leaderAddr, follower, _ := startCluster(t)
+
+	c, err := New([]string{leaderAddr}, WithRetries(1))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	err = c.Set(ctx, "", -1, "minus")
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	assert.Contains(t, err.Error(), "key should be positive")
+
+	err = c.Set(ctx, "secret", 1, "one")
+	require.ErrorIs(t, err, ErrPermissionDenied)
+
+	_, err = c.Count(ctx, "")
+	require.ErrorIs(t, err, ErrNotSupported)
+
+	// an election is going on
+	leader.setLeader(-1)
+	follower.setLeader(-1)
+
+	err = c.Set(ctx, "", 1, "one")
+	require.ErrorIs(t, err, ErrNoLeader)
+
+	require.NoError(t, c.Close())
+	_, err = c.Get(ctx, "", 1, ReadFromLocal)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func Test_Client_unavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	c, err := New([]string{addr}, WithRetries(2), WithTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer c.Close()
+
+	err = c.Set(context.Background(), "", 1, "one")
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	// the context ends the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = c.Set(ctx, "", 1, "one")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_Client_oneConnection(t *testing.T) {
+	leader := &fakeNode{info: ClusterInfo{NodeID: 1, LeaderID: 1}, values: map[int][]byte{}}
+	addr, accepted := startNode(t, leader)
+
+	c, err := New([]string{addr})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, c.Set(ctx, "", i, i))
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.Set(ctx, "", i, i))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), accepted.Load(), "the calls at the same time share the connection")
+}
+
+func Test_Client_oldServer(t *testing.T) {
+	addr := startRPCNode(t, oldNode{})
+
+	c, err := New([]string{addr})
+	require.NoError(t, err)
+	defer c.Close()
+
+	leader, err := c.Leader(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, addr, leader)
+
+	info, err := c.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1 record(s) in 1 bucket(s)", info)
+}
+
+func Test_Client_authentication(t *testing.T) {
+	credentials, err := service.ParseCredentials("alice:s3cret:*=rw")
+	require.NoError(t, err)
+
+	auth, err := service.NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	node := &fakeNode{info: ClusterInfo{NodeID: 1, LeaderID: 1}, values: map[int][]byte{}}
+	nodeServer := transport.NewServer()
+	require.NoError(t, nodeServer.RegisterName("KeyValueStore", node))
+
+	server := transport.NewServer(transport.WithAuthenticator(func(_ net.Conn, challenge, credentials []byte) (*transport.Server, error) {
+		if _, err := auth.Authenticate(challenge, credentials); err != nil {
+			return nil, err
+		}
+
+		return nodeServer, nil
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	ctx := context.Background()
+	addr := listener.Addr().String()
+
+	for _, opt := range []Option{WithToken("s3cret"), WithHMAC("alice", "s3cret")} {
+		c, err := New([]string{addr}, opt)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Set(ctx, "", 1, "one"))
+		c.Close()
+	}
+
+	c, err := New([]string{addr}, WithHMAC("alice", "wrong"), WithRetries(0))
+	require.NoError(t, err)
+	defer c.Close()
+
+	err = c.Set(ctx, "", 1, "one")
+	require.ErrorIs(t, err, ErrUnauthenticated)
+	require.ErrorContains(t, err, "invalid credentials")
+}
+
+func Test_mapError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{"rpc: can't find method KeyValueStore.Keys", ErrNotSupported},
+		{"not the leader, current leader is Node-2", ErrNotLeader},
+		{"set->permission denied: no write access to bucket (logs)", ErrPermissionDenied},
+		{"no leader available", ErrNoLeader},
+		{"get->key not found", ErrNotFound},
+		{"failed to get value: nothing", ErrNotFound},
+		{"failed to parse key", ErrInvalidArgument},
+		{"key is nil", ErrInvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			err := mapError(rpc.ServerError(tt.msg))
+			require.ErrorIs(t, err, tt.want)
+			assert.Contains(t, err.Error(), tt.msg)
+		})
+	}
+
+	err := mapError(transport.ServerError("transport: can't find method KeyValueStore.Count"))
+	require.ErrorIs(t, err, ErrNotSupported)
+
+	require.NoError(t, mapError(nil))
+	assert.Equal(t, "other", mapError(rpc.ServerError("other")).Error())
+}
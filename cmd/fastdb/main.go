@@ -0,0 +1,435 @@
+/*
+Command fastdb inspects and repairs fastdb data files, without opening a database.
+Run it without arguments to see the commands.
+*/
+package main
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// command is a subcommand, with the number of arguments it needs.
+type command struct {
+	run     func(args []string, out io.Writer) error
+	minArgs int
+	maxArgs int
+}
+
+// errFound is returned when verify finds a problem, or diff finds differences,
+// which is reported with the exit code only.
+var errFound = errors.New("found")
+
+var commands = map[string]command{
+	"stat":    {run: stat, minArgs: 1, maxArgs: 1},
+	"dump":    {run: dump, minArgs: 1, maxArgs: 2},
+	"get":     {run: get, minArgs: 3, maxArgs: 3},
+	"verify":  {run: verify, minArgs: 1, maxArgs: 1},
+	"repair":  {run: repair, minArgs: 1, maxArgs: 1},
+	"compact": {run: compact, minArgs: 1, maxArgs: 1},
+	"convert": {run: convert, minArgs: 2, maxArgs: 2},
+	"diff":    {run: diff, minArgs: 2, maxArgs: 2},
+}
+
+const usage = `usage: fastdb <command> <arguments>
+
+  stat <file>                  shows the records, buckets and keys in a file
+  dump <file> [bucket]         writes the buckets (or one bucket) as JSON
+  get <file> <bucket> <key>    writes the value of a key
+  verify <file>                checks the format, the checksums and the batches
+  repair <file>                cuts off the corrupt end of a file (after a backup to <file>.bak)
+  compact <file>               rewrites a file with only the current values
+  convert <file> <new file>    rewrites a file in the current format, with checksums
+  diff <file> <other file>     shows the keys that differ between two files
+`
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+/*
+run runs the command in the arguments, and returns the exit code.
+*/
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+
+		return 2
+	}
+
+	cmd, found := commands[args[0]]
+	if !found || len(args)-1 < cmd.minArgs || len(args)-1 > cmd.maxArgs {
+		fmt.Fprint(stderr, usage)
+
+		return 2
+	}
+
+	err := cmd.run(args[1:], stdout)
+	if errors.Is(err, errFound) {
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "fastdb %s: %v\n", args[0], err)
+
+		return 1
+	}
+
+	return 0
+}
+
+/*
+stat shows the size, the records by instruction, and the keys by bucket.
+*/
+func stat(args []string, out io.Writer) error {
+	report, err := persist.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "size: %d bytes\n", report.Size)
+
+	for _, name := range slices.Sorted(maps.Keys(report.Records)) {
+		fmt.Fprintf(out, "%s records: %d\n", name, report.Records[name])
+	}
+
+	fmt.Fprintf(out, "records without checksum: %d\n", report.Unchecked)
+
+	if report.Problem != nil {
+		fmt.Fprintf(out, "problem: %v (run verify)\n", report.Problem)
+
+		return nil
+	}
+
+	keys, meta, err := persist.Load(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "buckets: %d\n", len(keys))
+
+	for _, bucket := range slices.Sorted(maps.Keys(keys)) {
+		fmt.Fprintf(out, "  %s: %d keys\n", bucket, len(keys[bucket]))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(meta)) {
+		fmt.Fprintf(out, "meta: %s\n", name)
+	}
+
+	return nil
+}
+
+/*
+dump writes the buckets as JSON, with the keys as names.
+A value that is JSON is written as it is, other values as a string.
+*/
+func dump(args []string, out io.Writer) error {
+	keys, _, err := persist.Load(args[0])
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		bmap, found := keys[args[1]]
+		if !found {
+			return fmt.Errorf("bucket (%s) not found", args[1])
+		}
+
+		keys = map[string]map[int][]byte{args[1]: bmap}
+	}
+
+	buckets := make(map[string]map[string]json.RawMessage, len(keys))
+
+	for bucket, bmap := range keys {
+		buckets[bucket] = make(map[string]json.RawMessage, len(bmap))
+
+		for key, value := range bmap {
+			if !json.Valid(value) {
+				value, _ = json.Marshal(string(value)) //nolint:errchkjson // a string can always be marshalled
+			}
+
+			buckets[bucket][strconv.Itoa(key)] = value
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(buckets)
+}
+
+/*
+get writes the value of a key.
+*/
+func get(args []string, out io.Writer) error {
+	key, err := strconv.Atoi(args[2])
+	if err != nil {
+		return fmt.Errorf("wrong key (%s)", args[2])
+	}
+
+	keys, _, err := persist.Load(args[0])
+	if err != nil {
+		return err
+	}
+
+	value, found := keys[args[1]][key]
+	if !found {
+		return fmt.Errorf("key (%s_%d) not found", args[1], key)
+	}
+
+	fmt.Fprintf(out, "%s\n", value)
+
+	return nil
+}
+
+/*
+verify checks the file, and returns errFound when something is wrong.
+*/
+func verify(args []string, out io.Writer) error {
+	report, err := persist.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	if report.Unchecked > 0 {
+		fmt.Fprintf(out, "%d records without checksum (run convert)\n", report.Unchecked)
+	}
+
+	if report.Problem != nil {
+		fmt.Fprintf(out, "%v, %d of %d bytes can be read (run repair)\n", report.Problem, report.Valid, report.Size)
+
+		return errFound
+	}
+
+	fmt.Fprintln(out, "ok")
+
+	return nil
+}
+
+/*
+repair makes a backup of the file, and cuts off its corrupt end.
+*/
+func repair(args []string, out io.Writer) error {
+	report, err := persist.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	if report.Problem == nil {
+		fmt.Fprintln(out, "nothing to repair")
+
+		return nil
+	}
+
+	err = copyFile(args[0], args[0]+".bak")
+	if err != nil {
+		return err
+	}
+
+	report, err = persist.Repair(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%v, removed %d bytes (backup in %s.bak)\n", report.Problem, report.Size-report.Valid, args[0])
+
+	return nil
+}
+
+/*
+compact rewrites the file with only the current values.
+*/
+func compact(args []string, out io.Writer) error {
+	before, err := persist.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	if before.Problem != nil {
+		return fmt.Errorf("%w (run repair)", before.Problem)
+	}
+
+	aof, keys, err := persist.OpenPersister(args[0], 0)
+	if err != nil {
+		return err
+	}
+
+	err = aof.Defrag(keys)
+	if err != nil {
+		return errors.Join(err, aof.Close())
+	}
+
+	err = aof.Close()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%d -> %d bytes\n", before.Size, info.Size())
+
+	return nil
+}
+
+/*
+convert rewrites all the records of a file in the current format, with checksums.
+*/
+func convert(args []string, out io.Writer) error {
+	report, err := persist.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	if report.Problem != nil {
+		return fmt.Errorf("%w (run repair)", report.Problem)
+	}
+
+	in, err := os.Open(filepath.Clean(args[0]))
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	target, err := os.OpenFile(filepath.Clean(args[1]), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	scanner := persist.NewScanner(in)
+
+	for scanner.Scan() {
+		_, err = target.WriteString(lines(scanner.Record()))
+		if err != nil {
+			break
+		}
+
+		count++
+	}
+
+	err = errors.Join(err, scanner.Err(), target.Close())
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%d records converted\n", count)
+
+	return nil
+}
+
+/*
+lines returns the lines of a record in the current format.
+*/
+func lines(rec persist.Record) string {
+	switch rec.Name {
+	case "set":
+		return persist.SetInstruction(rec.Bucket, rec.Key, rec.Value, rec.Stamp)
+	case "del":
+		return persist.DelInstruction(rec.Bucket, rec.Key, rec.Stamp)
+	case "expire":
+		return persist.ExpireInstruction(rec.Bucket, rec.Key, rec.Expires, rec.Stamp)
+	case "attrs":
+		return persist.AttrsInstruction(rec.Bucket, rec.Key, rec.Attrs, rec.Stamp)
+	case "meta":
+		return persist.MetaInstruction(rec.Meta, rec.Value, rec.Stamp)
+	case "batch":
+		// the lines of a batch without its instructions and commit
+		return strings.TrimSuffix(persist.BatchInstruction(rec.Stamp), "commit\n")
+	default:
+		return rec.Name + "\n"
+	}
+}
+
+/*
+diff shows the keys that are only in the first file (-), only in the other file (+),
+or have another value (~), and returns errFound when there are any.
+*/
+func diff(args []string, out io.Writer) error {
+	keys, _, err := persist.Load(args[0])
+	if err != nil {
+		return err
+	}
+
+	other, _, err := persist.Load(args[1])
+	if err != nil {
+		return err
+	}
+
+	buckets := slices.Sorted(maps.Keys(keys))
+	for bucket := range other {
+		if _, found := keys[bucket]; !found {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	slices.Sort(buckets)
+
+	differences := 0
+
+	for _, bucket := range buckets {
+		ids := slices.Collect(maps.Keys(keys[bucket]))
+		for key := range other[bucket] {
+			if _, found := keys[bucket][key]; !found {
+				ids = append(ids, key)
+			}
+		}
+
+		slices.Sort(ids)
+
+		for _, key := range ids {
+			value, inFirst := keys[bucket][key]
+			otherValue, inOther := other[bucket][key]
+
+			switch {
+			case !inOther:
+				fmt.Fprintf(out, "- %s_%d: %s\n", bucket, key, value)
+			case !inFirst:
+				fmt.Fprintf(out, "+ %s_%d: %s\n", bucket, key, otherValue)
+			case string(value) != string(otherValue):
+				fmt.Fprintf(out, "~ %s_%d: %s -> %s\n", bucket, key, value, otherValue)
+			default:
+				continue
+			}
+
+			differences++
+		}
+	}
+
+	if differences > 0 {
+		return errFound
+	}
+
+	return nil
+}
+
+/*
+copyFile copies a file.
+*/
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(filepath.Clean(from))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Clean(to), data, 0o600)
+}
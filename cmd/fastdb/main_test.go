@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	return path
+}
+
+func runCommand(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+
+	code := run(args, &stdout, &stderr)
+
+	return code, stdout.String(), stderr.String()
+}
+
+func Test_run_usage(t *testing.T) {
+	code, _, stderr := runCommand()
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage")
+
+	code, _, _ = runCommand("get", "file")
+	assert.Equal(t, 2, code)
+
+	code, _, stderr = runCommand("stat", filepath.Join(t.TempDir(), "missing.db"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "fastdb stat:")
+}
+
+func Test_stat_dump_get(t *testing.T) {
+	stamp := time.Now()
+	path := writeFile(t, "data.db", "set\nuser_1\n{\"Name\":\"one\"}\n"+
+		persist.SetInstruction("texts", 1, []byte("a text"), stamp)+
+		persist.MetaInstruction("schema:user", []byte("{}"), stamp))
+
+	code, stdout, _ := runCommand("stat", path)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "set records: 2\n")
+	assert.Contains(t, stdout, "records without checksum: 1\n")
+	assert.Contains(t, stdout, "  texts: 1 keys\n")
+	assert.Contains(t, stdout, "meta: schema:user\n")
+
+	code, stdout, _ = runCommand("dump", path, "user")
+	assert.Equal(t, 0, code)
+	assert.JSONEq(t, `{"user":{"1":{"Name":"one"}}}`, stdout)
+
+	code, stdout, _ = runCommand("dump", path)
+	assert.Equal(t, 0, code)
+	assert.JSONEq(t, `{"user":{"1":{"Name":"one"}},"texts":{"1":"a text"}}`, stdout)
+
+	code, stdout, _ = runCommand("get", path, "texts", "1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "a text\n", stdout)
+
+	code, _, stderr := runCommand("get", path, "texts", "2")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not found")
+}
+
+func Test_verify_repair(t *testing.T) {
+	good := persist.SetInstruction("texts", 1, []byte("one"), time.Now())
+	path := writeFile(t, "data.db", good+"set\ntexts_2\n")
+
+	code, stdout, _ := runCommand("verify", path)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "incomplete set instruction on line: 4")
+
+	code, stdout, _ = runCommand("repair", path)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "removed 12 bytes")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, good, string(data))
+
+	backup, err := os.ReadFile(path + ".bak")
+	require.NoError(t, err)
+	assert.Equal(t, good+"set\ntexts_2\n", string(backup))
+
+	code, stdout, _ = runCommand("verify", path)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "ok\n", stdout)
+
+	code, stdout, _ = runCommand("repair", path)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "nothing to repair\n", stdout)
+}
+
+func Test_compact_convert(t *testing.T) {
+	path := writeFile(t, "old.db", "set\ntexts_1\none\nset\ntexts_1\ntwo\nbatch\nset\ntexts_2\nthree\ncommit\n")
+	converted := filepath.Join(t.TempDir(), "new.db")
+
+	code, stdout, _ := runCommand("convert", path, converted)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "5 records converted\n", stdout)
+
+	report, err := persist.Verify(converted)
+	require.NoError(t, err)
+	require.NoError(t, report.Problem)
+	assert.Equal(t, 0, report.Unchecked)
+
+	// the converted file holds the same data
+	code, _, _ = runCommand("diff", path, converted)
+	assert.Equal(t, 0, code)
+
+	code, _, stderr := runCommand("convert", path, converted)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "exists")
+
+	code, stdout, _ = runCommand("compact", converted)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "->")
+
+	report, err = persist.Verify(converted)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Records["set"])
+}
+
+func Test_diff(t *testing.T) {
+	first := writeFile(t, "first.db", "set\ntexts_1\none\nset\ntexts_2\ntwo\nset\nother_1\nx\n")
+	second := writeFile(t, "second.db", "set\ntexts_1\nuno\nset\ntexts_3\nthree\nset\nother_1\nx\n")
+
+	code, stdout, _ := runCommand("diff", first, second)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, []string{
+		"~ texts_1: one -> uno",
+		"- texts_2: two",
+		"+ texts_3: three",
+	}, strings.Split(strings.TrimSpace(stdout), "\n"))
+}
@@ -0,0 +1,118 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Codec encodes and decodes the values of a collection.
+type Codec interface {
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, value any) error
+}
+
+// JSONCodec stores values as JSON, this is the default codec.
+type JSONCodec struct{}
+
+// GobCodec stores values in the gob format.
+type GobCodec struct{}
+
+/*
+BinaryCodec stores values in their own binary format.
+The values should implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler,
+which makes it the place to plug in compact formats like msgpack.
+*/
+type BinaryCodec struct{}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+Marshal encodes a value as JSON.
+*/
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("json marshal error: %w", err)
+	}
+
+	return data, nil
+}
+
+/*
+Unmarshal decodes a value from JSON.
+*/
+func (JSONCodec) Unmarshal(data []byte, value any) error {
+	err := json.Unmarshal(data, value)
+	if err != nil {
+		return fmt.Errorf("json unmarshal error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Marshal encodes a value with gob.
+*/
+func (GobCodec) Marshal(value any) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("gob marshal error: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+/*
+Unmarshal decodes a value with gob.
+*/
+func (GobCodec) Unmarshal(data []byte, value any) error {
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+	if err != nil {
+		return fmt.Errorf("gob unmarshal error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Marshal encodes a value that implements encoding.BinaryMarshaler.
+*/
+func (BinaryCodec) Marshal(value any) ([]byte, error) {
+	marshaler, ok := value.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("binary marshal error: %T doesn't implement encoding.BinaryMarshaler", value)
+	}
+
+	data, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("binary marshal error: %w", err)
+	}
+
+	return data, nil
+}
+
+/*
+Unmarshal decodes a value that implements encoding.BinaryUnmarshaler.
+*/
+func (BinaryCodec) Unmarshal(data []byte, value any) error {
+	unmarshaler, ok := value.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("binary unmarshal error: %T doesn't implement encoding.BinaryUnmarshaler", value)
+	}
+
+	err := unmarshaler.UnmarshalBinary(data)
+	if err != nil {
+		return fmt.Errorf("binary unmarshal error: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+/*
+Collection stores values of one type in a bucket,
+so the caller doesn't have to encode and decode them.
+*/
+type Collection[T any] struct {
+	db     *DB
+	codec  Codec
+	id     func(*T) *int
+	bucket string
+}
+
+// CollectionOption configures optional behaviour of a collection.
+type CollectionOption[T any] func(*Collection[T])
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+NewCollection returns a collection that stores its values in a bucket of the database.
+Without a codec option, the values are stored as JSON.
+*/
+func NewCollection[T any](fdb *DB, bucket string, opts ...CollectionOption[T]) *Collection[T] {
+	coll := &Collection[T]{db: fdb, bucket: bucket, codec: JSONCodec{}}
+
+	for _, opt := range opts {
+		opt(coll)
+	}
+
+	return coll
+}
+
+/*
+WithCodec sets the codec that encodes and decodes the values.
+*/
+func WithCodec[T any](codec Codec) CollectionOption[T] {
+	return func(coll *Collection[T]) {
+		coll.codec = codec
+	}
+}
+
+/*
+WithID sets the extractor that returns a pointer to the ID field of a value.
+Put uses that ID as the key, and fills it in when a new key is allocated.
+*/
+func WithID[T any](id func(*T) *int) CollectionOption[T] {
+	return func(coll *Collection[T]) {
+		coll.id = id
+	}
+}
+
+/*
+Put stores a value and returns its key.
+When the value has an ID (see WithID) that isn't 0, that ID is used as the key,
+otherwise a new key is allocated atomically and stored in the ID.
+*/
+func (coll *Collection[T]) Put(value *T) (int, error) {
+	if value == nil {
+		return 0, errors.New("put->value is nil")
+	}
+
+	var id *int
+	if coll.id != nil {
+		id = coll.id(value)
+	}
+
+	if id != nil && *id != 0 {
+		return *id, coll.Set(*id, *value)
+	}
+
+	sh := coll.db.shardFor(coll.bucket)
+	defer sh.lockUnlock()()
+
+	key := sh.newIndex(coll.bucket)
+	if id != nil {
+		*id = key
+	}
+
+	data, err := coll.codec.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("put->%w", err)
+	}
+
+	err = coll.db.set(context.Background(), sh, coll.bucket, key, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return key, nil
+}
+
+/*
+Set stores a value with the given key.
+*/
+func (coll *Collection[T]) Set(key int, value T) error {
+	data, err := coll.codec.Marshal(&value)
+	if err != nil {
+		return fmt.Errorf("set->%w", err)
+	}
+
+	return coll.db.Set(coll.bucket, key, data)
+}
+
+/*
+Get returns the value of a key, the bool is false when the key doesn't exist.
+*/
+func (coll *Collection[T]) Get(key int) (T, bool, error) {
+	var value T
+
+	data, ok := coll.db.Get(coll.bucket, key)
+	if !ok {
+		return value, false, nil
+	}
+
+	err := coll.codec.Unmarshal(data, &value)
+	if err != nil {
+		return value, true, fmt.Errorf("get->%w", err)
+	}
+
+	return value, true, nil
+}
+
+/*
+Delete deletes the value of a key, the bool is false when the key didn't exist.
+*/
+func (coll *Collection[T]) Delete(key int) (bool, error) {
+	return coll.db.Del(coll.bucket, key)
+}
+
+/*
+All returns all the values of the collection by their key.
+*/
+func (coll *Collection[T]) All() (map[int]T, error) {
+	sh := coll.db.shardFor(coll.bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	live := sh.live(coll.bucket, time.Now())
+	values := make(map[int]T, len(live))
+
+	for key, data := range live {
+		var value T
+
+		err := coll.codec.Unmarshal(data, &value)
+		if err != nil {
+			return nil, fmt.Errorf("all->key %d: %w", key, err)
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+/*
+Sorted returns all the values of the collection sorted by cmp.
+When cmp is nil, the values are sorted by their key.
+*/
+func (coll *Collection[T]) Sorted(cmp func(a, b T) int) ([]T, error) {
+	values, err := coll.All()
+	if err != nil {
+		return nil, err
+	}
+
+	sortedKeys := slices.Sorted(maps.Keys(values))
+
+	sortedValues := make([]T, len(sortedKeys))
+	for count, key := range sortedKeys {
+		sortedValues[count] = values[key]
+	}
+
+	if cmp != nil {
+		slices.SortStableFunc(sortedValues, cmp)
+	}
+
+	return sortedValues, nil
+}
@@ -0,0 +1,221 @@
+package fastdb_test
+
+import (
+	"cmp"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type binaryRecord struct {
+	ID int
+}
+
+func (r binaryRecord) MarshalBinary() ([]byte, error) {
+	return []byte(strconv.Itoa(r.ID)), nil
+}
+
+func (r *binaryRecord) UnmarshalBinary(data []byte) error {
+	id, err := strconv.Atoi(string(data))
+	if err != nil {
+		return errors.New("no number")
+	}
+
+	r.ID = id
+
+	return nil
+}
+
+// lineRecord is binary encoded as its text, which can hold line breaks.
+type lineRecord struct {
+	Text string
+}
+
+func (r lineRecord) MarshalBinary() ([]byte, error) {
+	return []byte(r.Text), nil
+}
+
+func (r *lineRecord) UnmarshalBinary(data []byte) error {
+	r.Text = string(data)
+
+	return nil
+}
+
+func recordID(record *someRecord) *int {
+	return &record.ID
+}
+
+func Test_Collection_PutGetDelete(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	users := fastdb.NewCollection(store, "user", fastdb.WithID(recordID))
+
+	record := &someRecord{UUID: "UUIDtext", Text: "a text"}
+
+	key, err := users.Put(record)
+	require.NoError(t, err)
+	assert.Equal(t, 1, key)
+	assert.Equal(t, 1, record.ID)
+
+	record = &someRecord{ID: 10, UUID: "other", Text: "another text"}
+
+	key, err = users.Put(record)
+	require.NoError(t, err)
+	assert.Equal(t, 10, key)
+
+	memRecord, ok, err := users.Get(1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "UUIDtext", memRecord.UUID)
+	assert.Equal(t, 1, memRecord.ID)
+
+	_, ok, err = users.Get(2)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = users.Delete(10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	all, err := users.All()
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	_, err = users.Put(nil)
+	require.Error(t, err)
+}
+
+func Test_Collection_PutConcurrent(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	users := fastdb.NewCollection(store, "user", fastdb.WithID(recordID))
+
+	var wg sync.WaitGroup
+
+	for range 100 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := users.Put(&someRecord{Text: "a text"})
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	all, err := users.All()
+	require.NoError(t, err)
+	assert.Len(t, all, 100)
+
+	for key, record := range all {
+		assert.Equal(t, key, record.ID)
+	}
+}
+
+func Test_Collection_Sorted(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	users := fastdb.NewCollection[someRecord](store, "user", fastdb.WithCodec[someRecord](fastdb.GobCodec{}))
+
+	for _, key := range []int{3, 1, 2} {
+		err = users.Set(key, someRecord{ID: key, UUID: strconv.Itoa(10 - key)})
+		require.NoError(t, err)
+	}
+
+	sorted, err := users.Sorted(nil)
+	require.NoError(t, err)
+	require.Len(t, sorted, 3)
+	assert.Equal(t, 1, sorted[0].ID)
+	assert.Equal(t, 3, sorted[2].ID)
+
+	sorted, err = users.Sorted(func(a, b someRecord) int {
+		return cmp.Compare(a.UUID, b.UUID)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, sorted[0].ID)
+	assert.Equal(t, 1, sorted[2].ID)
+}
+
+func Test_Collection_BinaryCodec(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	numbers := fastdb.NewCollection[binaryRecord](store, "numbers", fastdb.WithCodec[binaryRecord](fastdb.BinaryCodec{}))
+
+	err = numbers.Set(1, binaryRecord{ID: 42})
+	require.NoError(t, err)
+
+	data, ok := store.Get("numbers", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "42", string(data))
+
+	record, ok, err := numbers.Get(1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 42, record.ID)
+
+	err = store.Set("numbers", 2, []byte("wrong"))
+	require.NoError(t, err)
+
+	_, _, err = numbers.Get(2)
+	require.Error(t, err)
+
+	texts := fastdb.NewCollection[string](store, "texts", fastdb.WithCodec[string](fastdb.BinaryCodec{}))
+
+	err = texts.Set(1, "text")
+	require.Error(t, err)
+}
+
+func Test_Collection_codecs_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "codecs.db")
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	// gob and binary values are bytes, that can be line breaks in the file
+	user := someRecord{ID: 10, UUID: "a\nb", Text: "x\r\n\x00"}
+	line := lineRecord{Text: "one\ntwo\x00"}
+
+	users := fastdb.NewCollection[someRecord](store, "users", fastdb.WithCodec[someRecord](fastdb.GobCodec{}))
+	require.NoError(t, users.Set(10, user))
+
+	lines := fastdb.NewCollection[lineRecord](store, "lines", fastdb.WithCodec[lineRecord](fastdb.BinaryCodec{}))
+	require.NoError(t, lines.Set(1, line))
+
+	require.NoError(t, store.Close())
+
+	store, err = fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	users = fastdb.NewCollection[someRecord](store, "users", fastdb.WithCodec[someRecord](fastdb.GobCodec{}))
+	storedUser, ok, err := users.Get(10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, user, storedUser)
+
+	lines = fastdb.NewCollection[lineRecord](store, "lines", fastdb.WithCodec[lineRecord](fastdb.BinaryCodec{}))
+	storedLine, ok, err := lines.Get(1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, line, storedLine)
+}
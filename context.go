@@ -0,0 +1,202 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+const (
+	// maxLockWait is the longest pause between two attempts to get a lock.
+	maxLockWait = time.Millisecond
+
+	// checkEvery is the number of records after which a long operation checks its context.
+	checkEvery = 4096
+)
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+SetCtx stores one map value in a bucket, like Set.
+It returns the context error when the context ends while waiting for the lock or the write.
+When it ends while waiting for the sync (sync time 0), the value is stored anyway.
+*/
+func (fdb *DB) SetCtx(ctx context.Context, bucket string, key int, value []byte) error {
+	sh := fdb.shardFor(bucket)
+
+	unlock, err := sh.lockCtx(ctx)
+	if err != nil {
+		return fmt.Errorf("set->%w", err)
+	}
+
+	defer unlock()
+
+	return fdb.set(ctx, sh, bucket, key, value)
+}
+
+/*
+GetAllSortedCtx returns all map values from a bucket in Key sorted order, like GetAllSorted.
+It returns the context error when the context ends before it's done.
+*/
+func (fdb *DB) GetAllSortedCtx(ctx context.Context, bucket string) ([]*SortRecord, error) {
+	sh := fdb.shardFor(bucket)
+
+	unlock, err := sh.rlockCtx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getAllSorted->%w", err)
+	}
+
+	defer unlock()
+
+	if _, found := sh.keys[bucket]; !found {
+		return nil, fmt.Errorf("bucket (%s) not found", bucket)
+	}
+
+	bmap := sh.live(bucket, time.Now())
+
+	memRecords := fdb.hooks.Load().interceptGetAll(bucket, bmap)
+
+	sortedKeys := make([]int, 0, len(memRecords))
+	for key := range memRecords {
+		if len(sortedKeys)%checkEvery == 0 && ctx.Err() != nil {
+			return nil, fmt.Errorf("getAllSorted->%w", ctx.Err())
+		}
+
+		sortedKeys = append(sortedKeys, key)
+	}
+
+	slices.Sort(sortedKeys)
+
+	sortedRecords := make([]*SortRecord, len(sortedKeys))
+
+	for count, key := range sortedKeys {
+		if count%checkEvery == 0 && ctx.Err() != nil {
+			return nil, fmt.Errorf("getAllSorted->%w", ctx.Err())
+		}
+
+		sortedRecords[count] = &SortRecord{SortField: key, Data: memRecords[key]}
+	}
+
+	return sortedRecords, nil
+}
+
+/*
+DefragCtx optimises the file to reflect the latest state, like Defrag.
+When the context ends before it's done, the original file is restored.
+A database in memory has no file, only its history is pruned.
+*/
+func (fdb *DB) DefragCtx(ctx context.Context) error {
+	unlock, err := fdb.lockAllCtx(ctx)
+	if err != nil {
+		return fmt.Errorf("defrag error: %w", err)
+	}
+
+	defer unlock()
+
+	if fdb.retention.Enabled() {
+		for _, sh := range fdb.shards {
+			persist.PruneHistory(sh.history, fdb.retention, time.Now())
+		}
+	}
+
+	if fdb.aof == nil {
+		return nil
+	}
+
+	err = fdb.aof.DefragCtx(ctx, fdb.allKeys(), fdb.allHistory())
+	if err != nil {
+		return fmt.Errorf("defrag error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+lockAllCtx locks all the shards for writing, or returns the context error when the context ends first.
+It returns the function that unlocks them.
+*/
+func (fdb *DB) lockAllCtx(ctx context.Context) (func(), error) {
+	unlocks := make([]func(), 0, len(fdb.shards))
+
+	unlockAll := func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+
+	for _, sh := range fdb.shards {
+		unlock, err := sh.lockCtx(ctx)
+		if err != nil {
+			unlockAll()
+
+			return nil, err
+		}
+
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
+
+/*
+lockCtx locks the shard for writing, or returns the context error when the context ends first.
+It returns the function that unlocks it.
+*/
+func (sh *shard) lockCtx(ctx context.Context) (func(), error) {
+	err := waitFor(ctx, sh.mu.TryLock)
+	if err != nil {
+		return nil, err
+	}
+
+	return sh.mu.Unlock, nil
+}
+
+/*
+rlockCtx locks the shard for reading, or returns the context error when the context ends first.
+It returns the function that unlocks it.
+*/
+func (sh *shard) rlockCtx(ctx context.Context) (func(), error) {
+	err := waitFor(ctx, sh.mu.TryRLock)
+	if err != nil {
+		return nil, err
+	}
+
+	return sh.mu.RUnlock, nil
+}
+
+/*
+waitFor tries to get a lock until it succeeds, or the context ends.
+*/
+func waitFor(ctx context.Context, tryLock func() bool) error {
+	wait := time.Microsecond
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return fmt.Errorf("lock error: %w", err)
+		}
+
+		if tryLock() {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return fmt.Errorf("lock error: %w", ctx.Err())
+		case <-timer.C:
+		}
+
+		wait = min(wait*2, maxLockWait)
+	}
+}
@@ -0,0 +1,156 @@
+package fastdb_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetCtx(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	err = store.SetCtx(context.Background(), "texts", 1, []byte("a text"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = store.SetCtx(ctx, "texts", 2, []byte("a text"))
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, ok := store.Get("texts", 2)
+	assert.False(t, ok)
+}
+
+func Test_SetCtx_lockDeadline(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	// a hook that blocks keeps the write lock of its bucket
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	store.OnBeforeSet("slow", func(_ string, key int, value []byte) ([]byte, error) {
+		if key == 1 {
+			close(started)
+			<-release
+		}
+
+		return value, nil
+	})
+
+	go func() {
+		_ = store.Set("slow", 1, []byte("slow"))
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = store.SetCtx(ctx, "slow", 2, []byte("a text"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = store.GetAllSortedCtx(ctx, "slow")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+
+	err = store.SetCtx(context.Background(), "slow", 2, []byte("a text"))
+	require.NoError(t, err)
+}
+
+func Test_GetAllSortedCtx(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	for key := range 10000 {
+		err = store.Set("texts", key, []byte(strconv.Itoa(key)))
+		require.NoError(t, err)
+	}
+
+	records, err := store.GetAllSortedCtx(context.Background(), "texts")
+	require.NoError(t, err)
+	assert.Len(t, records, 10000)
+
+	_, err = store.GetAllSortedCtx(context.Background(), "notexisting")
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = store.GetAllSortedCtx(ctx, "texts")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_DefragCtx(t *testing.T) {
+	path := "data/fastdb_defrag_ctx.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+
+		_ = os.Remove(filePath + ".bak")
+	}()
+
+	store, err := fastdb.Open(filePath, syncIime)
+	require.NoError(t, err)
+
+	for range 10 {
+		err = store.Set("texts", 1, []byte("a text"))
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = store.DefragCtx(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	checkFileLines(t, filePath, 30)
+
+	err = store.DefragCtx(context.Background())
+	require.NoError(t, err)
+
+	checkFileLines(t, filePath, 3)
+
+	err = store.Set("texts", 2, []byte("another text"))
+	require.NoError(t, err)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	checkFileLines(t, filePath, 6)
+}
+
+func Test_DefragCtx_memory(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	err = store.Set("texts", 1, []byte("a text"))
+	require.NoError(t, err)
+
+	err = store.DefragCtx(context.Background())
+	require.NoError(t, err)
+
+	err = store.Defrag()
+	require.NoError(t, err)
+
+	value, ok := store.Get("texts", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "a text", string(value))
+}
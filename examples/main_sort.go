@@ -103,6 +103,8 @@ func fillData(store *fastdb.DB, total int) {
 		Email: "test@example.com",
 	}
 
+	batch := store.NewBatch()
+
 	for i := 1; i <= total; i++ {
 		user.ID = i
 		user.UUID = "UUIDtext_" + generateRandomString(8) + strconv.Itoa(user.ID)
@@ -112,10 +114,12 @@ func fillData(store *fastdb.DB, total int) {
 			log.Fatal(err)
 		}
 
-		err = store.Set("user", user.ID, userData)
-		if err != nil {
-			log.Fatal(err)
-		}
+		batch.Set("user", user.ID, userData)
+	}
+
+	err := batch.Commit()
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -0,0 +1,418 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Format is the format of an export or import.
+type Format int
+
+// ImportOption configures how Import adds the records.
+type ImportOption func(*importOptions)
+
+// importOptions holds the options of Import.
+type importOptions struct {
+	progress   func(imported int)
+	batchSize  int
+	onConflict Conflict
+}
+
+// importer adds the imported records to the database in batches.
+type importer struct {
+	db       *DB
+	batch    *WriteBatch
+	options  importOptions
+	imported int
+}
+
+// record is one line of an NDJSON export.
+type record struct {
+	Bucket   string          `json:"bucket"`
+	Encoding string          `json:"encoding,omitempty"`
+	Value    json.RawMessage `json:"value"`
+	Key      int             `json:"key"`
+}
+
+const (
+	// NDJSON has one JSON object per line: {"bucket":"user","key":1,"value":{...}}.
+	// A value that isn't compact JSON is stored base64 encoded, with "encoding":"base64",
+	// so every value is imported exactly as it was exported.
+	NDJSON Format = iota
+	// CSV has a header with a key and a value column, followed by one record per line.
+	CSV
+)
+
+// defaultBatchSize is the number of records Import writes with one append.
+const defaultBatchSize = 1000
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+OnConflict sets what happens when an imported key already exists (Upsert by default).
+*/
+func OnConflict(onConflict Conflict) ImportOption {
+	return func(opts *importOptions) {
+		opts.onConflict = onConflict
+	}
+}
+
+/*
+Progress sets a function that is called after every batch, with the number of records imported so far.
+*/
+func Progress(progress func(imported int)) ImportOption {
+	return func(opts *importOptions) {
+		opts.progress = progress
+	}
+}
+
+/*
+BatchSize sets the number of records that are written with one append (1000 by default).
+*/
+func BatchSize(size int) ImportOption {
+	return func(opts *importOptions) {
+		opts.batchSize = max(size, 1)
+	}
+}
+
+/*
+Export writes the records of a bucket to w, sorted by key.
+With an empty bucket, all the buckets are exported (only for NDJSON).
+*/
+func (fdb *DB) Export(w io.Writer, bucket string, format Format) error {
+	buckets := []string{bucket}
+
+	if bucket == "" {
+		if format != NDJSON {
+			return errors.New("export->a bucket is needed for CSV")
+		}
+
+		buckets = fdb.Buckets()
+	}
+
+	switch format {
+	case NDJSON:
+		return fdb.exportNDJSON(w, buckets)
+	case CSV:
+		return fdb.exportCSV(w, bucket)
+	default:
+		return fmt.Errorf("export->unknown format (%d)", format)
+	}
+}
+
+/*
+Import reads records from r and sets them in the bucket, in batches.
+For NDJSON an empty bucket means the bucket of every record is used.
+It returns the number of imported records, also when an error stopped the import.
+*/
+func (fdb *DB) Import(r io.Reader, bucket string, format Format, opts ...ImportOption) (int, error) {
+	options := importOptions{batchSize: defaultBatchSize}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	imp := &importer{db: fdb, batch: fdb.NewBatch(), options: options}
+
+	var err error
+
+	switch format {
+	case NDJSON:
+		err = imp.readNDJSON(r, bucket)
+	case CSV:
+		err = imp.readCSV(r, bucket)
+	default:
+		err = fmt.Errorf("unknown format (%d)", format)
+	}
+
+	if err == nil {
+		err = imp.flush()
+	}
+
+	if err != nil {
+		return imp.imported, fmt.Errorf("import->%w", err)
+	}
+
+	return imp.imported, nil
+}
+
+/*
+exportRecords returns a copy of the records of a bucket, so they can be written without the lock.
+*/
+func (fdb *DB) exportRecords(bucket string) (map[int][]byte, error) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if _, found := sh.keys[bucket]; !found {
+		return nil, fmt.Errorf("export->bucket (%s) not found", bucket)
+	}
+
+	bmap := sh.live(bucket, time.Now())
+
+	return maps.Clone(fdb.hooks.Load().interceptGetAll(bucket, bmap)), nil
+}
+
+/*
+exportNDJSON writes the records of the buckets as JSON lines.
+*/
+func (fdb *DB) exportNDJSON(w io.Writer, buckets []string) error {
+	bw := bufio.NewWriter(w)
+
+	for _, bucket := range buckets {
+		records, err := fdb.exportRecords(bucket)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range slices.Sorted(maps.Keys(records)) {
+			rec := record{Bucket: bucket, Key: key, Value: records[key]}
+			if !isCompactJSON(rec.Value) {
+				rec.Encoding = "base64"
+				rec.Value = strconv.AppendQuote(nil, base64.StdEncoding.EncodeToString(records[key]))
+			}
+
+			line, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("export->marshal (%s_%d) error: %w", bucket, key, err)
+			}
+
+			_, err = bw.Write(append(line, '\n'))
+			if err != nil {
+				return fmt.Errorf("export->write error: %w", err)
+			}
+		}
+	}
+
+	return flushWriter(bw)
+}
+
+/*
+exportCSV writes the records of a bucket as CSV, with a header.
+*/
+func (fdb *DB) exportCSV(w io.Writer, bucket string) error {
+	records, err := fdb.exportRecords(bucket)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+
+	err = cw.Write([]string{"key", "value"})
+	if err != nil {
+		return fmt.Errorf("export->write error: %w", err)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(records)) {
+		err = cw.Write([]string{strconv.Itoa(key), string(records[key])})
+		if err != nil {
+			return fmt.Errorf("export->write error: %w", err)
+		}
+	}
+
+	cw.Flush()
+
+	err = cw.Error()
+	if err != nil {
+		return fmt.Errorf("export->write error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+isCompactJSON checks if a value is JSON without extra whitespace, so it can be written as it is.
+*/
+func isCompactJSON(value []byte) bool {
+	var compact bytes.Buffer
+
+	err := json.Compact(&compact, value)
+
+	return err == nil && bytes.Equal(compact.Bytes(), value)
+}
+
+/*
+flushWriter flushes a buffered writer.
+*/
+func flushWriter(bw *bufio.Writer) error {
+	err := bw.Flush()
+	if err != nil {
+		return fmt.Errorf("export->write error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+add adds a record to the batch, and commits the batch when it is full.
+*/
+func (imp *importer) add(bucket string, key int, value []byte) error {
+	imp.batch.SetNew(bucket, key, value, imp.options.onConflict)
+
+	if imp.batch.Len() < imp.options.batchSize {
+		return nil
+	}
+
+	return imp.flush()
+}
+
+/*
+flush commits the records in the batch.
+*/
+func (imp *importer) flush() error {
+	if imp.batch.Len() == 0 {
+		return nil
+	}
+
+	result, err := imp.batch.commit(context.Background())
+	if err != nil {
+		return err
+	}
+
+	imp.imported += result.set
+	imp.batch = imp.db.NewBatch()
+
+	if imp.options.progress != nil {
+		imp.options.progress(imp.imported)
+	}
+
+	return nil
+}
+
+/*
+readNDJSON reads JSON lines, an empty line is skipped.
+*/
+func (imp *importer) readNDJSON(r io.Reader, bucket string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var rec record
+
+		err := json.Unmarshal(data, &rec)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		value, err := rec.decode()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		target := rec.Bucket
+		if bucket != "" {
+			target = bucket
+		}
+
+		if target == "" {
+			return fmt.Errorf("line %d: bucket is missing", line)
+		}
+
+		err = imp.add(target, rec.Key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+decode returns the value of a record.
+*/
+func (rec *record) decode() ([]byte, error) {
+	switch rec.Encoding {
+	case "":
+		if len(rec.Value) == 0 {
+			return nil, errors.New("value is missing")
+		}
+
+		return []byte(rec.Value), nil
+	case "base64":
+		var text string
+
+		err := json.Unmarshal(rec.Value, &text)
+		if err != nil {
+			return nil, fmt.Errorf("base64 value error: %w", err)
+		}
+
+		return base64.StdEncoding.DecodeString(text)
+	default:
+		return nil, fmt.Errorf("unknown encoding (%s)", rec.Encoding)
+	}
+}
+
+/*
+readCSV reads CSV records, the header should have a key and a value column.
+*/
+func (imp *importer) readCSV(r io.Reader, bucket string) error {
+	if bucket == "" {
+		return errors.New("a bucket is needed for CSV")
+	}
+
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("header error: %w", err)
+	}
+
+	keyCol := slices.Index(header, "key")
+	valueCol := slices.Index(header, "value")
+
+	if keyCol < 0 || valueCol < 0 {
+		return errors.New("header should have a key and a value column")
+	}
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read error: %w", err)
+		}
+
+		line, _ := cr.FieldPos(keyCol)
+
+		key, err := strconv.Atoi(row[keyCol])
+		if err != nil {
+			return fmt.Errorf("line %d: wrong key (%s)", line, row[keyCol])
+		}
+
+		err = imp.add(bucket, key, []byte(row[valueCol]))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package fastdb_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Export_Import_NDJSON(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("user", 2, []byte(`{"Name":"two"}`)))
+	require.NoError(t, store.Set("user", 1, []byte(`{"Name":"one"}`)))
+	require.NoError(t, store.Set("texts", 1, []byte("not json")))
+
+	var out bytes.Buffer
+
+	err = store.Export(&out, "", fastdb.NDJSON)
+	require.NoError(t, err)
+
+	expected := `{"bucket":"texts","encoding":"base64","value":"bm90IGpzb24=","key":1}
+{"bucket":"user","value":{"Name":"one"},"key":1}
+{"bucket":"user","value":{"Name":"two"},"key":2}
+`
+	assert.Equal(t, expected, out.String())
+
+	other, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	var progress []int
+
+	count, err := other.Import(&out, "", fastdb.NDJSON, fastdb.BatchSize(2), fastdb.Progress(func(imported int) {
+		progress = append(progress, imported)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, []int{2, 3}, progress)
+
+	value, ok := other.Get("texts", 1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("not json"), value)
+
+	value, ok = other.Get("user", 2)
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"Name":"two"}`, string(value))
+
+	// one bucket, into another bucket
+	out.Reset()
+
+	err = store.Export(&out, "user", fastdb.NDJSON)
+	require.NoError(t, err)
+
+	count, err = other.Import(&out, "copy", fastdb.NDJSON)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = other.Import(strings.NewReader(`{"key":1,"value":1}`), "", fastdb.NDJSON)
+	require.ErrorContains(t, err, "bucket is missing")
+}
+
+func Test_Export_Import_CSV(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("texts", 1, []byte("one, two")))
+	require.NoError(t, store.Set("texts", 2, []byte("line\nbreak")))
+
+	var out bytes.Buffer
+
+	err = store.Export(&out, "texts", fastdb.CSV)
+	require.NoError(t, err)
+	assert.Equal(t, "key,value\n1,\"one, two\"\n2,\"line\nbreak\"\n", out.String())
+
+	err = store.Export(&out, "", fastdb.CSV)
+	require.Error(t, err)
+
+	other, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	count, err := other.Import(&out, "texts", fastdb.CSV)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	value, ok := other.Get("texts", 2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("line\nbreak"), value)
+
+	_, err = other.Import(strings.NewReader("id,data\n1,one\n"), "texts", fastdb.CSV)
+	require.Error(t, err)
+
+	_, err = other.Import(strings.NewReader("value,key\none,x\n"), "texts", fastdb.CSV)
+	require.ErrorContains(t, err, "wrong key")
+}
+
+func Test_Import_conflict(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("texts", 1, []byte("old")))
+
+	input := "key,value\n1,new\n2,two\n"
+
+	count, err := store.Import(strings.NewReader(input), "texts", fastdb.CSV, fastdb.OnConflict(fastdb.Skip))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	value, _ := store.Get("texts", 1)
+	assert.Equal(t, []byte("old"), value)
+
+	count, err = store.Import(strings.NewReader("key,value\n3,three\n1,new\n"), "texts", fastdb.CSV, fastdb.OnConflict(fastdb.Fail))
+	require.ErrorIs(t, err, fastdb.ErrKeyExists)
+	assert.Equal(t, 0, count)
+
+	// the batch with the conflict isn't written at all
+	_, ok := store.Get("texts", 3)
+	assert.False(t, ok)
+
+	count, err = store.Import(strings.NewReader(input), "texts", fastdb.CSV)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	value, _ = store.Get("texts", 1)
+	assert.Equal(t, []byte("new"), value)
+}
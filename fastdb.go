@@ -3,12 +3,13 @@ package fastdb
 /* ------------------------------- Imports --------------------------- */
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"maps"
 	"slices"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/marcelloh/fastdb/persist"
 )
@@ -17,11 +18,19 @@ import (
 
 // DB represents a collection of key-value pairs that persist on disk or memory.
 type DB struct {
-	aof  *persist.AOF
-	keys map[string]map[int][]byte
-	mu   sync.RWMutex
+	aof       *persist.AOF
+	hooks     atomic.Pointer[hooks]
+	closed    chan struct{}
+	shards    []*shard
+	retention persist.Retention
+	mu        sync.Mutex
+	expiring  sync.Once
+	closing   sync.Once
 }
 
+// Option configures optional behaviour of a DB when it is opened.
+type Option func(*DB)
+
 // SortRecord represents a record from a sorted collection of sliced records
 type SortRecord struct {
 	SortField any
@@ -35,217 +44,343 @@ Open opens a database at the provided path.
 If the file doesn't exist, it will be created automatically.
 If the path is ':memory:' then the database will be opened in memory only.
 */
-func Open(path string, syncIime int) (*DB, error) {
+func Open(path string, syncIime int, opts ...Option) (*DB, error) {
 	var (
-		aof *persist.AOF
-		err error
+		keys map[string]map[int][]byte
+		err  error
 	)
 
-	keys := map[string]map[int][]byte{}
+	fdb := &DB{shards: newShards(defaultShards), closed: make(chan struct{})}
+	fdb.hooks.Store(&hooks{})
+
+	for _, opt := range opts {
+		opt(fdb)
+	}
 
 	if path != ":memory:" {
-		aof, keys, err = persist.OpenPersister(path, syncIime)
+		fdb.aof, keys, err = persist.OpenPersister(path, syncIime, persist.WithRetention(fdb.retention))
+		if err != nil {
+			return fdb, err //nolint:wrapcheck // it is already wrapped
+		}
+
+		fdb.spread(keys, fdb.aof.History())
+		fdb.loadExpires(fdb.aof.Expires())
+		fdb.loadAttrs(fdb.aof.Attrs())
+
+		err = fdb.loadSchemas(fdb.aof.Meta())
+		if err != nil {
+			return fdb, fmt.Errorf("open error: %w", err)
+		}
 	}
 
-	return &DB{aof: aof, keys: keys}, err //nolint:wrapcheck // it is already wrapped
+	return fdb, nil
 }
 
 /*
 Defrag optimises the file to reflect the latest state.
 */
 func (fdb *DB) Defrag() error {
-	defer fdb.lockUnlock()()
-
-	var err error
-
-	err = fdb.aof.Defrag(fdb.keys)
-	if err != nil {
-		err = fmt.Errorf("defrag error: %w", err)
-	}
-
-	return err
+	return fdb.DefragCtx(context.Background())
 }
 
 /*
 Del deletes one map value in a bucket.
 */
 func (fdb *DB) Del(bucket string, key int) (bool, error) {
-	defer fdb.lockUnlock()()
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	return fdb.del(sh, bucket, key)
+}
 
+/*
+del deletes one map value in a bucket, the caller should hold the lock of the shard.
+*/
+func (fdb *DB) del(sh *shard, bucket string, key int) (bool, error) {
 	var err error
 
 	// bucket exists?
-	_, found := fdb.keys[bucket]
+	_, found := sh.keys[bucket]
 	if !found {
 		return found, nil
 	}
 
 	// key exists in bucket?
-	_, found = fdb.keys[bucket][key]
+	_, found = sh.keys[bucket][key]
 	if !found {
 		return found, nil
 	}
 
-	if fdb.aof != nil {
-		lines := "del\n" + bucket + "_" + strconv.Itoa(key) + "\n"
+	hks := fdb.hooks.Load()
+
+	err = hks.beforeDelKey(bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
 
-		err = fdb.aof.Write(lines)
+	if fdb.aof != nil {
+		err = fdb.aof.Append(persist.DelInstruction(bucket, key, now))
 		if err != nil {
 			return false, fmt.Errorf("del->write error: %w", err)
 		}
 	}
 
-	delete(fdb.keys[bucket], key)
+	fdb.applyDel(sh, hks, bucket, key, now)
 
-	if len(fdb.keys[bucket]) == 0 {
-		delete(fdb.keys, bucket)
+	return true, nil
+}
+
+/*
+applyDel removes a key from memory after it is written, the caller should hold the lock of the shard.
+*/
+func (fdb *DB) applyDel(sh *shard, hks *hooks, bucket string, key int, now time.Time) {
+	oldValue := sh.keys[bucket][key]
+
+	delete(sh.keys[bucket], key)
+	fdb.setExpiry(sh, bucket, key, time.Time{})
+	fdb.setAttrs(sh, bucket, key, nil)
+	fdb.addVersion(sh, bucket, key, Version{Time: now, Deleted: true})
+	sh.changed(bucket, key, oldValue, nil)
+
+	if len(sh.keys[bucket]) == 0 {
+		delete(sh.keys, bucket)
 	}
 
-	return true, nil
+	hks.afterDelKey(bucket, key)
 }
 
 /*
-Get returns one map value from a bucket.
+Get returns one map value from a bucket, a key that has expired isn't found.
 */
 func (fdb *DB) Get(bucket string, key int) ([]byte, bool) {
-	fdb.mu.RLock()
-	defer fdb.mu.RUnlock()
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	data, ok := fdb.keys[bucket][key]
+	data, ok := sh.keys[bucket][key]
+	if ok && sh.expired(bucket, key, time.Now()) {
+		data, ok = nil, false
+	}
 
-	return data, ok
+	return fdb.hooks.Load().interceptGet(bucket, key, data, ok)
 }
 
 /*
-GetAll returns all map values from a bucket in random order.
+GetAll returns all map values from a bucket in random order, without the keys that have expired.
 */
 func (fdb *DB) GetAll(bucket string) (map[int][]byte, error) {
-	fdb.mu.RLock()
-	defer fdb.mu.RUnlock()
+	sh := fdb.shardFor(bucket)
 
-	bmap, found := fdb.keys[bucket]
-	if !found {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if _, found := sh.keys[bucket]; !found {
 		return nil, fmt.Errorf("bucket (%s) not found", bucket)
 	}
 
-	return bmap, nil
+	bmap := sh.live(bucket, time.Now())
+
+	return fdb.hooks.Load().interceptGetAll(bucket, bmap), nil
 }
 
 /*
 GetAllSorted returns all map values from a bucket in Key sorted order.
 */
 func (fdb *DB) GetAllSorted(bucket string) ([]*SortRecord, error) {
-	memRecords, err := fdb.GetAll(bucket)
-	if err != nil {
-		return nil, err
+	return fdb.GetAllSortedCtx(context.Background(), bucket)
+}
+
+/*
+GetNewIndex returns the next available index for a bucket.
+*/
+func (fdb *DB) GetNewIndex(bucket string) (newKey int) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.newIndex(bucket)
+}
+
+/*
+Keys returns the keys of a bucket in sorted order, from the first key at or after start,
+and at most limit keys (all of them when limit is 0). Keys that have expired are left out.
+*/
+func (fdb *DB) Keys(bucket string, start, limit int) []int {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+
+	now := time.Now()
+	keys := make([]int, 0, len(sh.keys[bucket]))
+
+	for key := range sh.keys[bucket] {
+		if key >= start && !sh.expired(bucket, key, now) {
+			keys = append(keys, key)
+		}
 	}
 
-	sortedKeys := slices.Sorted(maps.Keys(memRecords))
+	sh.mu.RUnlock()
 
-	sortedRecords := make([]*SortRecord, len(memRecords))
+	slices.Sort(keys)
 
-	for count, key := range sortedKeys {
-		sortedRecords[count] = &SortRecord{SortField: key, Data: memRecords[key]}
-		// count++
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
 	}
 
-	return sortedRecords, nil
+	return keys
 }
 
 /*
-GetNewIndex returns the next available index for a bucket.
+Count returns the number of keys in a bucket, that haven't expired.
 */
-func (fdb *DB) GetNewIndex(bucket string) (newKey int) {
-	memRecords, err := fdb.GetAll(bucket)
-	if err != nil {
-		return 1
-	}
+func (fdb *DB) Count(bucket string) int {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return len(sh.keys[bucket]) - sh.expiredIn(bucket, time.Now())
+}
 
+/*
+newIndex returns the next available index for a bucket, the caller should hold the lock.
+*/
+func (sh *shard) newIndex(bucket string) int {
 	lkey := 0
-	for key := range memRecords {
+	for key := range sh.keys[bucket] {
 		if key > lkey {
 			lkey = key
 		}
 	}
 
-	newKey = lkey + 1
-
-	return newKey
+	return lkey + 1
 }
 
 /*
 Info returns info about the storage.
 */
 func (fdb *DB) Info() string {
+	defer fdb.rlockAll()()
+
 	count := 0
-	for i := range fdb.keys {
-		count += len(fdb.keys[i])
+	buckets := 0
+
+	for _, sh := range fdb.shards {
+		for i := range sh.keys {
+			count += len(sh.keys[i])
+		}
+
+		buckets += len(sh.keys)
 	}
 
-	return fmt.Sprintf("%d record(s) in %d bucket(s)", count, len(fdb.keys))
+	return fmt.Sprintf("%d record(s) in %d bucket(s)", count, buckets)
 }
 
 /*
-Set stores one map value in a bucket.
+Buckets returns the names of all the buckets, sorted.
 */
-func (fdb *DB) Set(bucket string, key int, value []byte) error {
-	defer fdb.lockUnlock()()
+func (fdb *DB) Buckets() []string {
+	var buckets []string
 
-	if key < 0 {
-		return errors.New("set->key should be positive")
+	for _, sh := range fdb.shards {
+		sh.mu.RLock()
+		buckets = slices.AppendSeq(buckets, maps.Keys(sh.keys))
+		sh.mu.RUnlock()
 	}
 
-	if fdb.aof != nil {
-		lines := "set\n" + bucket + "_" + strconv.Itoa(key) + "\n" + string(value) + "\n"
+	slices.Sort(buckets)
 
-		err := fdb.aof.Write(lines)
-		if err != nil {
-			return fmt.Errorf("set->write error: %w", err)
-		}
-	}
+	return buckets
+}
+
+/*
+Set stores one map value in a bucket.
+*/
+func (fdb *DB) Set(bucket string, key int, value []byte) error {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	return fdb.set(context.Background(), sh, bucket, key, value)
+}
+
+/*
+set stores one map value in a bucket, the caller should hold the lock of the shard.
+When the context ends while waiting for the sync, the value is stored anyway,
+because it is already in the file, but the context error is returned.
+*/
+func (fdb *DB) set(ctx context.Context, sh *shard, bucket string, key int, value []byte) error {
+	return fdb.setEntry(ctx, sh, bucket, key, Entry{Value: value})
+}
 
-	_, found := fdb.keys[bucket]
+/*
+applySet stores a value in memory after it is written, the caller should hold the lock of the shard.
+*/
+func (fdb *DB) applySet(sh *shard, hks *hooks, bucket string, key int, value []byte, now time.Time) {
+	_, found := sh.keys[bucket]
 	if !found {
-		fdb.keys[bucket] = map[int][]byte{}
+		sh.keys[bucket] = map[int][]byte{}
 	}
 
-	fdb.keys[bucket][key] = value
+	oldValue := sh.keys[bucket][key]
+	sh.keys[bucket][key] = value
+	fdb.setExpiry(sh, bucket, key, time.Time{})
+	fdb.setAttrs(sh, bucket, key, nil)
+	fdb.addVersion(sh, bucket, key, Version{Time: now, Value: value})
+	sh.changed(bucket, key, oldValue, value)
+	hks.afterSetValue(bucket, key, value)
+}
 
-	return nil
+/*
+changed updates everything that is derived from the values, after a key changed.
+A nil value means the key didn't exist (old) or is deleted (new).
+*/
+func (sh *shard) changed(bucket string, key int, oldValue, newValue []byte) {
+	sh.updateIndexes(bucket, key, oldValue, newValue)
+	sh.updateMaterialized(bucket, oldValue, newValue)
 }
 
 /*
-Close closes the database.
+Close closes the database, and stops deleting the expired keys.
 */
 func (fdb *DB) Close() error {
-	if fdb.aof != nil {
-		defer fdb.lockUnlock()()
+	fdb.closing.Do(func() {
+		close(fdb.closed)
+	})
 
+	defer fdb.lockAll()()
+
+	if fdb.aof != nil {
 		err := fdb.aof.Close()
 		if err != nil {
 			return fmt.Errorf("close error: %w", err)
 		}
 	}
 
-	fdb.keys = map[string]map[int][]byte{}
+	for i := range fdb.shards {
+		fdb.shards[i].reset()
+	}
 
 	return nil
 }
 
 /*
-lockUnlock locks the database and unlocks it later
+lockUnlock locks the shard and unlocks it later
 
-if you call it like this: defer fdb.lockUnlock()()
+if you call it like this: defer sh.lockUnlock()()
 the first function call locks it and because it returns a function,
 that function will actually be called as the defer.
 */
-func (fdb *DB) lockUnlock() func() {
-	fdb.mu.Lock()
+func (sh *shard) lockUnlock() func() {
+	sh.mu.Lock()
 	//nolint:gocritic // leave it here
 	// log.Println("> Locked")
 
 	return func() {
-		fdb.mu.Unlock()
+		sh.mu.Unlock()
 		//nolint:gocritic // leave it here
 		// log.Println("> Unlocked")
 	}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -131,11 +132,58 @@ func Test_SetGetDel_oneRecord(t *testing.T) {
 	assert.Equal(t, "0 record(s) in 0 bucket(s)", info)
 }
 
-func Fuzz_SetGetDel_oneRecord(f *testing.F) {
-	path := "data/fastdb_fuzzset.db"
+func Test_KeysCount(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+	require.NotNil(t, store)
 
-	filePath := filepath.Clean(path)
-	_ = os.Remove(filePath)
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Empty(t, store.Keys("texts", 0, 0))
+	assert.Equal(t, 0, store.Count("texts"))
+
+	for _, key := range []int{5, 1, 3, 2, 4} {
+		err = store.Set("texts", key, []byte("a text"))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, store.Keys("texts", 0, 0))
+	assert.Equal(t, []int{1, 2}, store.Keys("texts", 0, 2))
+	assert.Equal(t, []int{3, 4}, store.Keys("texts", 3, 2))
+	assert.Empty(t, store.Keys("texts", 6, 2))
+	assert.Equal(t, 5, store.Count("texts"))
+}
+
+func Test_Buckets(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+	require.NotNil(t, store)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Empty(t, store.Buckets())
+
+	for _, bucket := range []string{"user", "address", "text"} {
+		err = store.Set(bucket, 1, []byte("a text"))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"address", "text", "user"}, store.Buckets())
+
+	_, err = store.Del("text", 1)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"address", "user"}, store.Buckets())
+}
+
+func Fuzz_SetGetDel_oneRecord(f *testing.F) {
+	filePath := filepath.Join(f.TempDir(), "fastdb_fuzzset.db")
 
 	store, err := fastdb.Open(filePath, 1000)
 	require.NoError(f, err)
@@ -892,3 +940,86 @@ func Benchmark_Set_Memory(b *testing.B) {
 	err = store.Close()
 	require.NoError(b, err)
 }
+
+func Benchmark_Set_Memory_Parallel(b *testing.B) {
+	path := memory
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(b, err)
+	assert.NotNil(b, store)
+
+	var worker atomic.Int32
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// every worker writes to its own bucket, so they end up in different shards
+		bucket := fmt.Sprintf("user%d", worker.Add(1))
+		record := &someRecord{
+			ID:   1,
+			UUID: "UUIDtext",
+			Text: "a text",
+		}
+
+		for pb.Next() {
+			record.ID = rand.Intn(1000000)
+
+			recordData, err := json.Marshal(record)
+			if err != nil {
+				b.Error(err)
+
+				return
+			}
+
+			err = store.Set(bucket, record.ID, recordData)
+			if err != nil {
+				b.Error(err)
+
+				return
+			}
+		}
+	})
+
+	err = store.Close()
+	require.NoError(b, err)
+}
+
+func Benchmark_Set_Memory_Parallel_sameBucket(b *testing.B) {
+	path := memory
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(b, err)
+	assert.NotNil(b, store)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// all the workers write to one bucket, so they wait for the lock of its shard
+		record := &someRecord{
+			ID:   1,
+			UUID: "UUIDtext",
+			Text: "a text",
+		}
+
+		for pb.Next() {
+			record.ID = rand.Intn(1000000)
+
+			recordData, err := json.Marshal(record)
+			if err != nil {
+				b.Error(err)
+
+				return
+			}
+
+			err = store.Set("user", record.ID, recordData)
+			if err != nil {
+				b.Error(err)
+
+				return
+			}
+		}
+	})
+
+	err = store.Close()
+	require.NoError(b, err)
+}
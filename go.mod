@@ -5,6 +5,7 @@ go 1.23.2
 require (
 	github.com/stretchr/testify v1.9.0
 	github.com/tidwall/gjson v1.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -12,5 +13,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,82 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"slices"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Version is one historical state of a key.
+type Version = persist.Version
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+WithHistory keeps the history of every key.
+versions is the maximum number of versions per key (0 means no maximum),
+window is how long a version is kept (0 means forever).
+Without this option, no history is kept.
+*/
+func WithHistory(versions int, window time.Duration) Option {
+	return func(fdb *DB) {
+		fdb.retention = persist.Retention{Versions: versions, Window: window}
+	}
+}
+
+/*
+History returns the retained versions of a key in chronological order.
+It returns nil when there is no history for the key.
+*/
+func (fdb *DB) History(bucket string, key int) []Version {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return slices.Clone(sh.history[bucket][key])
+}
+
+/*
+GetAt returns the value a key had at the given time.
+It returns false when the key didn't exist at that time,
+or when that time falls outside the retained history.
+*/
+func (fdb *DB) GetAt(bucket string, key int, at time.Time) ([]byte, bool) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	versions := sh.history[bucket][key]
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Time.After(at) {
+			continue
+		}
+
+		if versions[i].Deleted {
+			return nil, false
+		}
+
+		return versions[i].Value, true
+	}
+
+	return nil, false
+}
+
+/*
+addVersion adds a version to the history of a key, when history is retained.
+The caller should hold the lock of the shard.
+*/
+func (fdb *DB) addVersion(sh *shard, bucket string, key int, version Version) {
+	if !fdb.retention.Enabled() {
+		return
+	}
+
+	persist.AddVersion(sh.history, fdb.retention, bucket, key, version)
+}
@@ -0,0 +1,127 @@
+package fastdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_History_Memory(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime, fastdb.WithHistory(2, 0))
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	for _, value := range []string{"one", "two", "three"} {
+		err = store.Set("texts", 1, []byte(value))
+		require.NoError(t, err)
+	}
+
+	versions := store.History("texts", 1)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "two", string(versions[0].Value))
+	assert.Equal(t, "three", string(versions[1].Value))
+
+	value, ok := store.GetAt("texts", 1, versions[0].Time)
+	assert.True(t, ok)
+	assert.Equal(t, "two", string(value))
+
+	_, ok = store.GetAt("texts", 1, versions[0].Time.Add(-time.Nanosecond))
+	assert.False(t, ok)
+
+	ok, err = store.Del("texts", 1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	versions = store.History("texts", 1)
+	require.Len(t, versions, 2)
+	assert.True(t, versions[1].Deleted)
+
+	_, ok = store.GetAt("texts", 1, time.Now())
+	assert.False(t, ok)
+
+	value, ok = store.GetAt("texts", 1, versions[0].Time)
+	assert.True(t, ok)
+	assert.Equal(t, "three", string(value))
+}
+
+func Test_History_NotRetained(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	err = store.Set("texts", 1, []byte("one"))
+	require.NoError(t, err)
+
+	assert.Nil(t, store.History("texts", 1))
+
+	_, ok := store.GetAt("texts", 1, time.Now())
+	assert.False(t, ok)
+}
+
+func Test_History_FileAndDefrag(t *testing.T) {
+	path := "data/fastdb_history.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+
+		_ = os.Remove(filePath + ".bak")
+	}()
+
+	store, err := fastdb.Open(filePath, syncIime, fastdb.WithHistory(3, time.Hour))
+	require.NoError(t, err)
+
+	for _, value := range []string{"one", "two", "three", "four"} {
+		err = store.Set("texts", 1, []byte(value))
+		require.NoError(t, err)
+	}
+
+	err = store.Set("texts", 2, []byte("other"))
+	require.NoError(t, err)
+
+	_, err = store.Del("texts", 2)
+	require.NoError(t, err)
+
+	checkFileLines(t, filePath, 4*3+3+2)
+
+	err = store.Defrag()
+	require.NoError(t, err)
+
+	checkFileLines(t, filePath, 3*3+3+2)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	store, err = fastdb.Open(filePath, syncIime, fastdb.WithHistory(3, time.Hour))
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	versions := store.History("texts", 1)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "two", string(versions[0].Value))
+	assert.Equal(t, "four", string(versions[2].Value))
+
+	value, ok := store.GetAt("texts", 1, versions[1].Time)
+	assert.True(t, ok)
+	assert.Equal(t, "three", string(value))
+
+	versions = store.History("texts", 2)
+	require.Len(t, versions, 2)
+	assert.True(t, versions[1].Deleted)
+
+	_, ok = store.Get("texts", 2)
+	assert.False(t, ok)
+}
@@ -0,0 +1,220 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"fmt"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// AllBuckets registers a hook or an interceptor for every bucket.
+const AllBuckets = "*"
+
+/*
+BeforeSetHook is called before a value is stored.
+It returns the value to store (which can be transformed), or an error to reject the Set.
+*/
+type BeforeSetHook func(bucket string, key int, value []byte) ([]byte, error)
+
+// BeforeDelHook is called before a key is deleted, it returns an error to reject the Del.
+type BeforeDelHook func(bucket string, key int) error
+
+// AfterSetHook is called after a value is stored.
+type AfterSetHook func(bucket string, key int, value []byte)
+
+// AfterDelHook is called after a key is deleted.
+type AfterDelHook func(bucket string, key int)
+
+// GetInterceptor is called by Get, it returns the value (and if it's found) to the caller.
+type GetInterceptor func(bucket string, key int, value []byte, found bool) ([]byte, bool)
+
+/*
+GetAllInterceptor is called by GetAll, it returns the values to the caller.
+The given map belongs to the database, so it should be copied before making changes.
+*/
+type GetAllInterceptor func(bucket string, values map[int][]byte) map[int][]byte
+
+// hooks holds all the registered hooks and interceptors, in the order of registration.
+type hooks struct {
+	beforeSet []bucketHook[BeforeSetHook]
+	beforeDel []bucketHook[BeforeDelHook]
+	afterSet  []bucketHook[AfterSetHook]
+	afterDel  []bucketHook[AfterDelHook]
+	get       []bucketHook[GetInterceptor]
+	getAll    []bucketHook[GetAllInterceptor]
+}
+
+// bucketHook is a hook with the bucket it is registered for.
+type bucketHook[T any] struct {
+	hook   T
+	bucket string
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+OnBeforeSet registers a hook that is called before a value is stored in a bucket (or AllBuckets).
+The hooks are called in the order of registration, inside the write lock of the bucket,
+so they should not call the database themselves.
+The first hook that returns an error stops the Set, nothing is written then.
+*/
+func (fdb *DB) OnBeforeSet(bucket string, hook BeforeSetHook) {
+	fdb.addHook(func(hks *hooks) {
+		hks.beforeSet = append(hks.beforeSet, bucketHook[BeforeSetHook]{bucket: bucket, hook: hook})
+	})
+}
+
+/*
+OnBeforeDel registers a hook that is called before a key is deleted from a bucket (or AllBuckets).
+The first hook that returns an error stops the Del, nothing is deleted then.
+*/
+func (fdb *DB) OnBeforeDel(bucket string, hook BeforeDelHook) {
+	fdb.addHook(func(hks *hooks) {
+		hks.beforeDel = append(hks.beforeDel, bucketHook[BeforeDelHook]{bucket: bucket, hook: hook})
+	})
+}
+
+/*
+OnAfterSet registers a hook that is called after a value is stored in a bucket (or AllBuckets).
+The change is already committed, so the hook can only observe it.
+*/
+func (fdb *DB) OnAfterSet(bucket string, hook AfterSetHook) {
+	fdb.addHook(func(hks *hooks) {
+		hks.afterSet = append(hks.afterSet, bucketHook[AfterSetHook]{bucket: bucket, hook: hook})
+	})
+}
+
+/*
+OnAfterDel registers a hook that is called after a key is deleted from a bucket (or AllBuckets).
+*/
+func (fdb *DB) OnAfterDel(bucket string, hook AfterDelHook) {
+	fdb.addHook(func(hks *hooks) {
+		hks.afterDel = append(hks.afterDel, bucketHook[AfterDelHook]{bucket: bucket, hook: hook})
+	})
+}
+
+/*
+OnGet registers an interceptor for Get on a bucket (or AllBuckets).
+The interceptors are called in the order of registration, inside the read lock.
+*/
+func (fdb *DB) OnGet(bucket string, interceptor GetInterceptor) {
+	fdb.addHook(func(hks *hooks) {
+		hks.get = append(hks.get, bucketHook[GetInterceptor]{bucket: bucket, hook: interceptor})
+	})
+}
+
+/*
+OnGetAll registers an interceptor for GetAll (and GetAllSorted) on a bucket (or AllBuckets).
+*/
+func (fdb *DB) OnGetAll(bucket string, interceptor GetAllInterceptor) {
+	fdb.addHook(func(hks *hooks) {
+		hks.getAll = append(hks.getAll, bucketHook[GetAllInterceptor]{bucket: bucket, hook: interceptor})
+	})
+}
+
+/*
+addHook adds a hook to a copy of the registered hooks, and makes that copy the current one.
+That way the hooks can be read without a lock.
+*/
+func (fdb *DB) addHook(add func(hks *hooks)) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	hks := *fdb.hooks.Load()
+	add(&hks)
+	fdb.hooks.Store(&hks)
+}
+
+/*
+beforeSetValue calls the before set hooks of a bucket and returns the value to store.
+*/
+func (h *hooks) beforeSetValue(bucket string, key int, value []byte) ([]byte, error) {
+	var err error
+
+	for _, bh := range h.beforeSet {
+		if !bh.matches(bucket) {
+			continue
+		}
+
+		value, err = bh.hook(bucket, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("set->before hook error: %w", err)
+		}
+	}
+
+	return value, nil
+}
+
+/*
+beforeDelKey calls the before del hooks of a bucket.
+*/
+func (h *hooks) beforeDelKey(bucket string, key int) error {
+	for _, bh := range h.beforeDel {
+		if !bh.matches(bucket) {
+			continue
+		}
+
+		err := bh.hook(bucket, key)
+		if err != nil {
+			return fmt.Errorf("del->before hook error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+afterSetValue calls the after set hooks of a bucket.
+*/
+func (h *hooks) afterSetValue(bucket string, key int, value []byte) {
+	for _, bh := range h.afterSet {
+		if bh.matches(bucket) {
+			bh.hook(bucket, key, value)
+		}
+	}
+}
+
+/*
+afterDelKey calls the after del hooks of a bucket.
+*/
+func (h *hooks) afterDelKey(bucket string, key int) {
+	for _, bh := range h.afterDel {
+		if bh.matches(bucket) {
+			bh.hook(bucket, key)
+		}
+	}
+}
+
+/*
+interceptGet calls the get interceptors of a bucket.
+*/
+func (h *hooks) interceptGet(bucket string, key int, value []byte, found bool) ([]byte, bool) {
+	for _, bh := range h.get {
+		if bh.matches(bucket) {
+			value, found = bh.hook(bucket, key, value, found)
+		}
+	}
+
+	return value, found
+}
+
+/*
+interceptGetAll calls the get all interceptors of a bucket.
+*/
+func (h *hooks) interceptGetAll(bucket string, values map[int][]byte) map[int][]byte {
+	for _, bh := range h.getAll {
+		if bh.matches(bucket) {
+			values = bh.hook(bucket, values)
+		}
+	}
+
+	return values
+}
+
+/*
+matches returns true if the hook is registered for the bucket.
+*/
+func (bh bucketHook[T]) matches(bucket string) bool {
+	return bh.bucket == AllBuckets || bh.bucket == bucket
+}
@@ -0,0 +1,143 @@
+package fastdb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Hooks_Set(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	var calls []string
+
+	store.OnBeforeSet(fastdb.AllBuckets, func(bucket string, key int, value []byte) ([]byte, error) {
+		calls = append(calls, fmt.Sprintf("global %s %d", bucket, key))
+
+		if key == 13 {
+			return nil, errors.New("unlucky")
+		}
+
+		return value, nil
+	})
+
+	store.OnBeforeSet("texts", func(_ string, _ int, value []byte) ([]byte, error) {
+		calls = append(calls, "texts")
+
+		return bytes.ToUpper(value), nil
+	})
+
+	store.OnAfterSet(fastdb.AllBuckets, func(bucket string, key int, value []byte) {
+		calls = append(calls, fmt.Sprintf("after %s %d %s", bucket, key, value))
+	})
+
+	err = store.Set("texts", 1, []byte("a text"))
+	require.NoError(t, err)
+
+	err = store.Set("other", 2, []byte("other text"))
+	require.NoError(t, err)
+
+	err = store.Set("texts", 13, []byte("a text"))
+	require.Error(t, err)
+
+	value, ok := store.Get("texts", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "A TEXT", string(value))
+
+	_, ok = store.Get("texts", 13)
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{
+		"global texts 1", "texts", "after texts 1 A TEXT",
+		"global other 2", "after other 2 other text",
+		"global texts 13",
+	}, calls)
+}
+
+func Test_Hooks_Del(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	var deleted []int
+
+	store.OnBeforeDel("texts", func(_ string, key int) error {
+		if key == 1 {
+			return errors.New("protected")
+		}
+
+		return nil
+	})
+
+	store.OnAfterDel(fastdb.AllBuckets, func(_ string, key int) {
+		deleted = append(deleted, key)
+	})
+
+	for key := range 3 {
+		err = store.Set("texts", key, []byte("a text"))
+		require.NoError(t, err)
+	}
+
+	ok, err := store.Del("texts", 1)
+	require.Error(t, err)
+	assert.False(t, ok)
+
+	ok, err = store.Del("texts", 2)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.Del("texts", 5)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok = store.Get("texts", 1)
+	assert.True(t, ok)
+	assert.Equal(t, []int{2}, deleted)
+}
+
+func Test_Hooks_Get(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	for key := range 4 {
+		err = store.Set("texts", key, []byte("a text"))
+		require.NoError(t, err)
+	}
+
+	// hide the odd keys
+	store.OnGet("texts", func(_ string, key int, value []byte, found bool) ([]byte, bool) {
+		if key%2 == 1 {
+			return nil, false
+		}
+
+		return value, found
+	})
+
+	store.OnGetAll(fastdb.AllBuckets, func(_ string, values map[int][]byte) map[int][]byte {
+		even := map[int][]byte{}
+
+		for key, value := range values {
+			if key%2 == 0 {
+				even[key] = value
+			}
+		}
+
+		return even
+	})
+
+	_, ok := store.Get("texts", 1)
+	assert.False(t, ok)
+
+	_, ok = store.Get("texts", 2)
+	assert.True(t, ok)
+
+	records, err := store.GetAllSorted("texts")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, 2, records[1].SortField)
+}
@@ -0,0 +1,484 @@
+// Package httpapi serves the key-value service over HTTP with JSON bodies, for clients that can't speak
+// net/rpc with gob. It sits on the same service.KeyValueStoreService as the RPC server.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+)
+
+// MaxBodySize is the largest request body, a value or a batch.
+const MaxBodySize = 8 << 20
+
+// Handler serves the HTTP API of a node:
+//
+//	GET    /health                          the node and its leader
+//	GET    /buckets/{bucket}/keys/{key}     a value, with its ETag (?local=true reads this node)
+//	PUT    /buckets/{bucket}/keys/{key}     set a value, If-Match and If-None-Match make it a compare-and-set
+//	DELETE /buckets/{bucket}/keys/{key}     delete a key, If-Match makes it a compare-and-delete
+//	GET    /buckets/{bucket}?from=&to=&limit=  a page of records, sorted by key
+//	POST   /batch                           sets and deletes, all at once or not at all
+//
+// A write to a node that isn't the leader is redirected to the leader with 307 Temporary Redirect.
+// With WithLogin a request (but /health) needs the header "Authorization: Bearer <secret>".
+type Handler struct {
+	service *service.KeyValueStoreService
+	login   service.Login // nil when the requests don't log in
+	peers   map[int]string
+	mux     *http.ServeMux
+}
+
+// serviceKey is the context key of the service of a request that logged in.
+type serviceKey struct{}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithPeers sets the base URLs of the HTTP API of the nodes, like "http://localhost:9080",
+// the writes are redirected to them. Without the URL of the leader a write answers 503 Service Unavailable.
+func WithPeers(peers map[int]string) Option {
+	return func(h *Handler) {
+		h.peers = peers
+	}
+}
+
+// WithLogin makes the requests log in with the secret of a credential as a bearer token,
+// they get the permissions that both the service and their credential give.
+func WithLogin(login service.Login) Option {
+	return func(h *Handler) {
+		h.login = login
+	}
+}
+
+// Record is a key with its value, in a page of records.
+type Record struct {
+	Key   int             `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Page is the answer of GET /buckets/{bucket}, Next is the from of the next page when there may be one.
+type Page struct {
+	Records []Record `json:"records"`
+	Next    *int     `json:"next,omitempty"`
+}
+
+// BatchOp is one operation of POST /batch, Op is "set" or "delete".
+type BatchOp struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    int             `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// BatchRequest is the body of POST /batch.
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// BatchResult is the answer of POST /batch.
+type BatchResult struct {
+	Count int `json:"count"`
+}
+
+// Health is the answer of GET /health.
+type Health struct {
+	Status   string `json:"status"`
+	NodeID   int    `json:"node"`
+	LeaderID int    `json:"leader"`
+}
+
+// NewHandler returns the handler of the HTTP API of the service.
+func NewHandler(kvService *service.KeyValueStoreService, opts ...Option) *Handler {
+	h := &Handler{service: kvService, peers: map[int]string{}, mux: http.NewServeMux()}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("GET /health", h.health)
+	h.mux.HandleFunc("GET /buckets/{bucket}/keys/{key}", h.get)
+	h.mux.HandleFunc("PUT /buckets/{bucket}/keys/{key}", h.put)
+	h.mux.HandleFunc("DELETE /buckets/{bucket}/keys/{key}", h.delete)
+	h.mux.HandleFunc("GET /buckets/{bucket}", h.list)
+	h.mux.HandleFunc("POST /batch", h.batch)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.login != nil && r.URL.Path != "/health" {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fastdb"`)
+			writeError(w, http.StatusUnauthorized, "a bearer token is required")
+			return
+		}
+
+		principal, err := h.login("", strings.TrimSpace(secret))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fastdb", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), serviceKey{}, h.service.Restrict(principal.Permissions)))
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// serviceOf returns the service of a request, with the permissions of who it logged in as.
+func (h *Handler) serviceOf(r *http.Request) *service.KeyValueStoreService {
+	if restricted, ok := r.Context().Value(serviceKey{}).(*service.KeyValueStoreService); ok {
+		return restricted
+	}
+
+	return h.service
+}
+
+func (h *Handler) health(w http.ResponseWriter, _ *http.Request) {
+	cluster := h.cluster()
+
+	health := Health{Status: "ok", NodeID: cluster.NodeID, LeaderID: cluster.LeaderID}
+	if cluster.LeaderID == -1 {
+		health.Status = "no leader"
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+
+	preference := replicationmanager.ReadFromLeader
+	if r.URL.Query().Get("local") == "true" {
+		preference = replicationmanager.ReadFromLocal
+	}
+
+	var result replicationmanager.GetResult
+	args := [3]interface{}{r.PathValue("bucket"), key, int(preference)}
+	if err := h.serviceOf(r).GetWithPreference(args, &result); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	etag := ETag(result.Value)
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && matches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType(result.ContentType))
+	_, _ = w.Write(result.Value)
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToLeader(w, r) {
+		return
+	}
+
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("read body error: %v", err))
+		return
+	}
+
+	value, stored, err := bodyValue(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var set bool
+	args := [5]interface{}{
+		r.PathValue("bucket"), key, value,
+		condition(r.Header.Get("If-Match")), condition(r.Header.Get("If-None-Match")),
+	}
+	if err := h.serviceOf(r).SetIf(args, &set); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !set {
+		writeError(w, http.StatusPreconditionFailed, "the value doesn't match the condition")
+		return
+	}
+
+	w.Header().Set("ETag", ETag(stored))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bodyValue returns the value of a body and the data the service stores: application/octet-stream
+// is stored as raw bytes, text/plain as a string, and any other body as compact JSON.
+func bodyValue(contentType string, body []byte) (interface{}, []byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/octet-stream":
+		return replicationmanager.TypedValue{Type: replicationmanager.ContentRaw, Data: body}, body, nil
+	case "text/plain":
+		typed := replicationmanager.TypedValue{Type: replicationmanager.ContentString, Data: body}
+		return typed, body, typed.Validate()
+	}
+
+	if !json.Valid(body) {
+		return nil, nil, errors.New("the body is not valid JSON")
+	}
+
+	// the service stores the value as compact JSON
+	value := json.RawMessage(body)
+	stored, err := json.Marshal(value)
+
+	return value, stored, err
+}
+
+// mediaType returns the Content-Type of a value with a content type, the numbers and booleans are JSON.
+func mediaType(contentType replicationmanager.ContentType) string {
+	switch contentType {
+	case replicationmanager.ContentRaw:
+		return "application/octet-stream"
+	case replicationmanager.ContentString:
+		return "text/plain; charset=utf-8"
+	default:
+		return "application/json"
+	}
+}
+
+// jsonValue returns a value that is JSON as it is, and any other value as a JSON string.
+func jsonValue(value []byte) json.RawMessage {
+	if json.Valid(value) {
+		return value
+	}
+
+	text, _ := json.Marshal(string(value))
+	return text
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToLeader(w, r) {
+		return
+	}
+
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+
+	var deleted bool
+	ifMatch := condition(r.Header.Get("If-Match"))
+	if err := h.serviceOf(r).DeleteIf([3]interface{}{r.PathValue("bucket"), key, ifMatch}, &deleted); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	switch {
+	case deleted:
+		w.WriteHeader(http.StatusNoContent)
+	case ifMatch != nil:
+		writeError(w, http.StatusPreconditionFailed, "the value doesn't match the condition")
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("key not found: %d", key))
+	}
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	args := [4]interface{}{r.PathValue("bucket")}
+
+	for i, name := range []string{"from", "to", "limit"} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		number, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s=%q, %s is not an integer", name, query.Get(name), name))
+			return
+		}
+		args[i+1] = number
+	}
+
+	var records []replicationmanager.Record
+	if err := h.serviceOf(r).Range(args, &records); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	page := Page{Records: make([]Record, 0, len(records))}
+	for _, record := range records {
+		page.Records = append(page.Records, Record{Key: record.Key, Value: jsonValue(record.Value)})
+	}
+
+	if len(records) > 0 && len(records) == pageSize(args[3]) {
+		next := records[len(records)-1].Key + 1
+		page.Next = &next
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToLeader(w, r) {
+		return
+	}
+
+	var request BatchRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode body error: %v", err))
+		return
+	}
+
+	ops := make([]replicationmanager.BatchOp, 0, len(request.Ops))
+	for _, op := range request.Ops {
+		batchOp := replicationmanager.BatchOp{Op: replicationmanager.OpType(op.Op), Bucket: op.Bucket, Key: op.Key}
+
+		if len(op.Value) > 0 {
+			value, err := json.Marshal(op.Value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			batchOp.Value = value
+		}
+
+		ops = append(ops, batchOp)
+	}
+
+	var count int
+	if err := h.serviceOf(r).Batch(ops, &count); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, BatchResult{Count: count})
+}
+
+func (h *Handler) cluster() replicationmanager.ClusterInfo {
+	var cluster replicationmanager.ClusterInfo
+	_ = h.service.Cluster([1]interface{}{}, &cluster)
+
+	return cluster
+}
+
+// redirectToLeader answers a write with a redirect when this node isn't the leader, it returns false when it is.
+func (h *Handler) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	cluster := h.cluster()
+	if cluster.NodeID == cluster.LeaderID {
+		return false
+	}
+
+	base := h.peers[cluster.LeaderID]
+	if cluster.LeaderID == -1 || base == "" {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("not the leader, current leader is Node-%d", cluster.LeaderID))
+		return true
+	}
+
+	http.Redirect(w, r, strings.TrimSuffix(base, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// ETag returns the entity tag of a value.
+func ETag(value []byte) string {
+	return strconv.Quote(replicationmanager.Fingerprint(value))
+}
+
+// condition turns an If-Match or If-None-Match header into a condition of the service, nil when there is none.
+func condition(header string) interface{} {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+
+	if header == "*" {
+		return header
+	}
+
+	// a weak tag never matches, the values are compared byte for byte
+	return strings.Trim(header, `"`)
+}
+
+// matches tells if an If-None-Match header holds the entity tag.
+func matches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathKey parses the key of the path, it answers 400 Bad Request when it isn't a positive integer.
+func pathKey(w http.ResponseWriter, r *http.Request) (int, bool) {
+	key, err := strconv.Atoi(r.PathValue("key"))
+	if err != nil || key < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("key=%q, key should be a positive integer", r.PathValue("key")))
+		return 0, false
+	}
+
+	return key, true
+}
+
+// pageSize returns the number of records a page holds at most, for the limit the service got.
+func pageSize(limit interface{}) int {
+	size, _ := limit.(int)
+	if size <= 0 {
+		return service.DefaultKeysLimit
+	}
+
+	return min(size, service.MaxKeysLimit)
+}
+
+// writeServiceError answers an error of the service, with a status for its cause.
+func writeServiceError(w http.ResponseWriter, err error) {
+	message := err.Error()
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, service.ErrPermissionDenied):
+		status = http.StatusForbidden
+	case strings.Contains(message, "key not found"):
+		status = http.StatusNotFound
+	case strings.Contains(message, "parse "), strings.HasPrefix(message, "batch->"):
+		status = http.StatusBadRequest
+	case strings.Contains(message, "not the leader"), strings.Contains(message, "no leader"):
+		status = http.StatusServiceUnavailable
+	}
+
+	writeError(w, status, message)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,315 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/replication/election"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNode is one node of a test cluster, with its database in memory.
+type testNode struct {
+	db      *fastdb.DB
+	handler *Handler
+}
+
+// setupCluster starts a leader (Node-1) and a backup (Node-2), the backup redirects the writes to leaderURL.
+func setupCluster(t *testing.T, leaderURL string) (*testNode, *testNode) {
+	t.Helper()
+
+	leaderListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backupListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	peers := map[int]string{1: leaderURL}
+	leader := startNode(t, leaderListener, 1, map[int]string{2: backupListener.Addr().String()}, peers)
+	backup := startNode(t, backupListener, 2, map[int]string{1: leaderListener.Addr().String()}, peers)
+
+	return leader, backup
+}
+
+func startNode(t *testing.T, listener net.Listener, nodeID int, peers, httpPeers map[int]string) *testNode {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+
+	bully := election.NewBullyAlgorithm(nodeID, 1, peers)
+	replication := replicationmanager.NewReplicationManager(nodeID, db, bully)
+
+	server := transport.NewServer()
+	require.NoError(t, server.RegisterName("ReplicationManager", replication))
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+
+	permissions, err := service.ParsePermissions("*=rw,secret=none")
+	require.NoError(t, err)
+
+	kvService := service.NewKeyValueStoreService(replication, service.WithPermissions(permissions))
+
+	return &testNode{db: db, handler: NewHandler(kvService, WithPeers(httpPeers))}
+}
+
+// do sends a request to the handler, the headers are pairs of names and values.
+func do(handler http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestHandler_health(t *testing.T) {
+	leader, _ := setupCluster(t, "")
+
+	response := do(leader.handler, http.MethodGet, "/health", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"status":"ok","node":1,"leader":1}`, response.Body.String())
+}
+
+func TestHandler_key(t *testing.T) {
+	leader, backup := setupCluster(t, "")
+
+	response := do(leader.handler, http.MethodGet, "/buckets/texts/keys/1", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = do(leader.handler, http.MethodPut, "/buckets/texts/keys/1", `{ "name": "one" }`)
+	require.Equal(t, http.StatusNoContent, response.Code, response.Body.String())
+	etag := response.Header().Get("ETag")
+	assert.Equal(t, ETag([]byte(`{"name":"one"}`)), etag)
+
+	for _, node := range []*testNode{leader, backup} {
+		response = do(node.handler, http.MethodGet, "/buckets/texts/keys/1?local=true", "")
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, `{"name":"one"}`, response.Body.String())
+		assert.Equal(t, etag, response.Header().Get("ETag"))
+		assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	}
+
+	response = do(leader.handler, http.MethodGet, "/buckets/texts/keys/1", "", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, response.Code)
+
+	// compare-and-set
+	response = do(leader.handler, http.MethodPut, "/buckets/texts/keys/1", `"two"`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code, "the key exists")
+
+	response = do(leader.handler, http.MethodPut, "/buckets/texts/keys/1", `"two"`, "If-Match", `"abc"`)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code, "the value doesn't match")
+
+	response = do(leader.handler, http.MethodPut, "/buckets/texts/keys/1", `"two"`, "If-Match", etag)
+	require.Equal(t, http.StatusNoContent, response.Code)
+	newETag := response.Header().Get("ETag")
+
+	// compare-and-delete
+	response = do(leader.handler, http.MethodDelete, "/buckets/texts/keys/1", "", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code, "the value changed")
+
+	response = do(leader.handler, http.MethodDelete, "/buckets/texts/keys/1", "", "If-Match", newETag)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	response = do(leader.handler, http.MethodDelete, "/buckets/texts/keys/1", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	_, ok := backup.db.Get("texts", 1)
+	assert.False(t, ok, "the delete is replicated")
+}
+
+func TestHandler_login(t *testing.T) {
+	leader, _ := setupCluster(t, "")
+
+	credentials, err := service.ParseCredentials("app:s3cret:texts=rw,secret=rw,*=r")
+	require.NoError(t, err)
+
+	auth, err := service.NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	handler := NewHandler(leader.handler.service, WithLogin(auth.Login))
+
+	response := do(handler, http.MethodGet, "/health", "")
+	assert.Equal(t, http.StatusOK, response.Code, "the health needs no login")
+
+	response = do(handler, http.MethodPut, "/buckets/texts/keys/1", `"one"`)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Contains(t, response.Header().Get("WWW-Authenticate"), "Bearer")
+
+	response = do(handler, http.MethodPut, "/buckets/texts/keys/1", `"one"`, "Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	bearer := []string{"Authorization", "Bearer s3cret"}
+
+	response = do(handler, http.MethodPut, "/buckets/texts/keys/1", `"one"`, bearer...)
+	assert.Equal(t, http.StatusNoContent, response.Code, response.Body.String())
+
+	response = do(handler, http.MethodGet, "/buckets/texts/keys/1", "", bearer...)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// the credential can only read the other buckets, and the service can't use secret
+	response = do(handler, http.MethodPut, "/buckets/logs/keys/1", `"one"`, bearer...)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	response = do(handler, http.MethodGet, "/buckets/secret/keys/1", "", bearer...)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+}
+
+func TestHandler_contentTypes(t *testing.T) {
+	leader, _ := setupCluster(t, "")
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{name: "Raw", body: "\x00\x01", contentType: "application/octet-stream", want: "application/octet-stream"},
+		{name: "Text", body: "say hi", contentType: "text/plain; charset=utf-8", want: "text/plain; charset=utf-8"},
+		{name: "JSON", body: `{"a":1}`, contentType: "application/json", want: "application/json"},
+	}
+
+	for key, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/buckets/typed/keys/" + strconv.Itoa(key)
+
+			response := do(leader.handler, http.MethodPut, target, tt.body, "Content-Type", tt.contentType)
+			require.Equal(t, http.StatusNoContent, response.Code, response.Body.String())
+			assert.Equal(t, ETag([]byte(tt.body)), response.Header().Get("ETag"))
+
+			response = do(leader.handler, http.MethodGet, target, "")
+			require.Equal(t, http.StatusOK, response.Code)
+			assert.Equal(t, tt.body, response.Body.String())
+			assert.Equal(t, tt.want, response.Header().Get("Content-Type"))
+		})
+	}
+
+	// a value that isn't JSON is a string in a list
+	response := do(leader.handler, http.MethodGet, "/buckets/typed?from=1&to=1", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"records":[{"key":1,"value":"say hi"}]}`, response.Body.String())
+
+	response = do(leader.handler, http.MethodPut, "/buckets/typed/keys/1", "\xff", "Content-Type", "text/plain")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "the text is not UTF-8")
+}
+
+func TestHandler_invalid(t *testing.T) {
+	leader, _ := setupCluster(t, "")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{name: "Key not a number", method: http.MethodGet, target: "/buckets/texts/keys/one", want: http.StatusBadRequest},
+		{name: "Negative key", method: http.MethodPut, target: "/buckets/texts/keys/-1", body: "1", want: http.StatusBadRequest},
+		{name: "Invalid JSON", method: http.MethodPut, target: "/buckets/texts/keys/1", body: "{", want: http.StatusBadRequest},
+		{name: "Invalid bucket", method: http.MethodPut, target: "/buckets/*/keys/1", body: "1", want: http.StatusBadRequest},
+		{name: "Denied bucket", method: http.MethodGet, target: "/buckets/secret/keys/1", want: http.StatusForbidden},
+		{name: "Invalid limit", method: http.MethodGet, target: "/buckets/texts?limit=all", want: http.StatusBadRequest},
+		{name: "Negative limit", method: http.MethodGet, target: "/buckets/texts?limit=-1", want: http.StatusBadRequest},
+		{name: "Unknown method", method: http.MethodPost, target: "/buckets/texts/keys/1", want: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := do(leader.handler, tt.method, tt.target, tt.body)
+			assert.Equal(t, tt.want, response.Code, response.Body.String())
+		})
+	}
+}
+
+func TestHandler_list(t *testing.T) {
+	leader, _ := setupCluster(t, "")
+
+	for _, key := range []string{"1", "2", "3", "4", "5"} {
+		response := do(leader.handler, http.MethodPut, "/buckets/numbers/keys/"+key, key)
+		require.Equal(t, http.StatusNoContent, response.Code)
+	}
+
+	response := do(leader.handler, http.MethodGet, "/buckets/numbers?from=2&limit=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"records":[{"key":2,"value":2},{"key":3,"value":3}],"next":4}`, response.Body.String())
+
+	response = do(leader.handler, http.MethodGet, "/buckets/numbers?from=4&to=4", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"records":[{"key":4,"value":4}]}`, response.Body.String())
+
+	response = do(leader.handler, http.MethodGet, "/buckets/empty", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"records":[]}`, response.Body.String())
+}
+
+func TestHandler_batch(t *testing.T) {
+	leader, backup := setupCluster(t, "")
+
+	response := do(leader.handler, http.MethodPut, "/buckets/texts/keys/1", `"one"`)
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	body := `{"ops":[{"op":"delete","bucket":"texts","key":1},{"op":"set","bucket":"texts","key":2,"value":{"a": 1}}]}`
+	response = do(leader.handler, http.MethodPost, "/batch", body)
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+
+	var result BatchResult
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Count)
+
+	for _, node := range []*testNode{leader, backup} {
+		_, ok := node.db.Get("texts", 1)
+		assert.False(t, ok)
+		value, _ := node.db.Get("texts", 2)
+		assert.Equal(t, `{"a":1}`, string(value))
+	}
+
+	for _, body := range []string{
+		`{"ops":[]}`,
+		`{"ops":[{"op":"set","bucket":"texts","key":3}]}`,
+		`{"ops":[{"op":"incr","bucket":"texts","key":3}]}`,
+		`{"operations":[]}`,
+	} {
+		response = do(leader.handler, http.MethodPost, "/batch", body)
+		assert.Equal(t, http.StatusBadRequest, response.Code, body)
+	}
+
+	response = do(leader.handler, http.MethodPost, "/batch", `{"ops":[{"op":"delete","bucket":"secret","key":1}]}`)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+}
+
+func TestHandler_redirect(t *testing.T) {
+	_, backup := setupCluster(t, "http://leader:9080/")
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		response := do(backup.handler, method, "/buckets/texts/keys/1?x=1", "1")
+		assert.Equal(t, http.StatusTemporaryRedirect, response.Code)
+		assert.Equal(t, "http://leader:9080/buckets/texts/keys/1?x=1", response.Header().Get("Location"))
+	}
+
+	response := do(backup.handler, http.MethodPost, "/batch", `{"ops":[]}`)
+	assert.Equal(t, http.StatusTemporaryRedirect, response.Code)
+
+	// a read is answered by the backup, it asks the leader
+	response = do(backup.handler, http.MethodGet, "/buckets/texts?limit=1", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	_, backup = setupCluster(t, "")
+	response = do(backup.handler, http.MethodPut, "/buckets/texts/keys/1", "1")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "the leader has no HTTP address")
+}
@@ -0,0 +1,153 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// index is a secondary index on a JSON path of the values in a bucket.
+type index struct {
+	entries map[string]map[int]struct{}
+	path    string
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+CreateIndex creates a secondary index on a JSON path of the values in a bucket.
+The index lives in memory only, it is built from the current values
+and kept up to date on every Set and Del.
+*/
+func (fdb *DB) CreateIndex(bucket, path string) error {
+	if path == "" {
+		return errors.New("createIndex->path is empty")
+	}
+
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	idx := &index{path: path, entries: map[string]map[int]struct{}{}}
+	for key, value := range sh.keys[bucket] {
+		idx.add(key, value)
+	}
+
+	if _, found := sh.indexes[bucket]; !found {
+		sh.indexes[bucket] = map[string]*index{}
+	}
+
+	sh.indexes[bucket][path] = idx
+
+	return nil
+}
+
+/*
+DropIndex removes the secondary index on a JSON path of a bucket.
+*/
+func (fdb *DB) DropIndex(bucket, path string) {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	delete(sh.indexes[bucket], path)
+
+	if len(sh.indexes[bucket]) == 0 {
+		delete(sh.indexes, bucket)
+	}
+}
+
+/*
+Indexes returns the JSON paths that are indexed for a bucket.
+*/
+func (fdb *DB) Indexes(bucket string) []string {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	paths := make([]string, 0, len(sh.indexes[bucket]))
+	for path := range sh.indexes[bucket] {
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+/*
+updateIndexes replaces the old value of a key by the new one in the indexes of a bucket.
+A nil value means the key didn't exist (old) or is deleted (new).
+The caller should hold the lock.
+*/
+func (sh *shard) updateIndexes(bucket string, key int, oldValue, newValue []byte) {
+	for _, idx := range sh.indexes[bucket] {
+		if oldValue != nil {
+			idx.remove(key, oldValue)
+		}
+
+		if newValue != nil {
+			idx.add(key, newValue)
+		}
+	}
+}
+
+/*
+add adds a key to the index.
+*/
+func (idx *index) add(key int, value []byte) {
+	res := gjson.GetBytes(value, idx.path)
+	if !res.Exists() {
+		return
+	}
+
+	entry := indexKey(res)
+	if _, found := idx.entries[entry]; !found {
+		idx.entries[entry] = map[int]struct{}{}
+	}
+
+	idx.entries[entry][key] = struct{}{}
+}
+
+/*
+remove removes a key from the index.
+*/
+func (idx *index) remove(key int, value []byte) {
+	res := gjson.GetBytes(value, idx.path)
+	if !res.Exists() {
+		return
+	}
+
+	entry := indexKey(res)
+
+	delete(idx.entries[entry], key)
+
+	if len(idx.entries[entry]) == 0 {
+		delete(idx.entries, entry)
+	}
+}
+
+/*
+indexKey returns the key under which a JSON value is stored in an index.
+The type is part of the key, so the number 1 and the string "1" differ.
+*/
+func indexKey(res gjson.Result) string {
+	switch res.Type {
+	case gjson.Number:
+		return "n" + strconv.FormatFloat(res.Num, 'g', -1, 64)
+	case gjson.String:
+		return "s" + res.Str
+	case gjson.True:
+		return "t"
+	case gjson.False:
+		return "f"
+	case gjson.Null:
+		return "0"
+	case gjson.JSON:
+		return "j" + res.Raw
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,103 @@
+package memcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+)
+
+// Backend is where the server keeps the items: a database, or the replication layer of a cluster.
+type Backend interface {
+	Get(ctx context.Context, bucket string, key int) (fastdb.Entry, bool, error)
+	SetWith(ctx context.Context, bucket string, key int, value []byte, opts replicationmanager.SetOptions) (bool, error)
+	Delete(ctx context.Context, bucket string, key int) (bool, error)
+	Update(ctx context.Context, bucket string, key int, update fastdb.UpdateFunc) ([]byte, error)
+	ExpireAt(ctx context.Context, bucket string, key int, expires time.Time) (bool, error)
+}
+
+// local is the backend of a database that isn't part of a cluster.
+type local struct {
+	db *fastdb.DB
+	mu sync.Mutex // the writes are done one by one, so the conditions of add, replace and cas hold
+}
+
+// replicated is the backend of a node of a cluster, it uses the replication layer like the RPC service:
+// the writes are only accepted on the leader and replicated to the backups, the reads are done on the leader.
+type replicated struct {
+	*replicationmanager.ReplicationManager
+}
+
+// Local returns the backend of a database that isn't part of a cluster.
+func Local(db *fastdb.DB) Backend {
+	return &local{db: db}
+}
+
+// Replicated returns the backend of a node of a cluster.
+func Replicated(rm *replicationmanager.ReplicationManager) Backend {
+	return replicated{rm}
+}
+
+func (b *local) Get(_ context.Context, bucket string, key int) (fastdb.Entry, bool, error) {
+	entry, found := b.db.GetEntry(bucket, key)
+	return entry, found, nil
+}
+
+func (b *local) SetWith(_ context.Context, bucket string, key int, value []byte, opts replicationmanager.SetOptions) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if current, exists := b.db.Get(bucket, key); !opts.Allows(current, exists) {
+		return false, nil
+	}
+
+	if err := b.db.SetEntry(bucket, key, opts.Entry(value)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (b *local) Delete(_ context.Context, bucket string, key int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.Del(bucket, key)
+}
+
+func (b *local) Update(_ context.Context, bucket string, key int, update fastdb.UpdateFunc) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var newValue []byte
+
+	err := b.db.Update(bucket, key, func(value []byte, found bool) ([]byte, error) {
+		var err error
+		newValue, err = update(value, found)
+
+		return newValue, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newValue, nil
+}
+
+func (b *local) ExpireAt(_ context.Context, bucket string, key int, expires time.Time) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.ExpireAt(bucket, key, expires)
+}
+
+func (b replicated) Get(ctx context.Context, bucket string, key int) (fastdb.Entry, bool, error) {
+	result, err := b.ReplicationManager.Get(ctx, bucket, key, replicationmanager.ReadFromLeader)
+	if err != nil {
+		return fastdb.Entry{}, false, err
+	}
+
+	return fastdb.Entry{Value: result.Value, Expires: result.Expires, Attrs: result.Attrs}, result.Found, nil
+}
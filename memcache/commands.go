@@ -0,0 +1,622 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/marcelloh/fastdb"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+)
+
+const (
+	// relativeLimit is the largest exptime that is a number of seconds, a larger one is a unix time.
+	relativeLimit = 30 * 24 * 60 * 60
+
+	// flagsAttr is the attribute that holds the flags of an item.
+	flagsAttr = "flags"
+)
+
+var (
+	errLineTooLong = errors.New("line too long")
+	errNotFound    = errors.New("not found")
+	errNotNumeric  = errors.New("cannot increment or decrement non-numeric value")
+)
+
+// session is the state of one connection.
+type session struct {
+	server  *Server
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	noreply bool
+	quit    bool
+
+	permissions   service.Permissions
+	authenticated bool // the client has logged in, or doesn't have to
+}
+
+var commands map[string]func(sess *session, args []string)
+
+func init() {
+	commands = map[string]func(sess *session, args []string){
+		"get":       get,
+		"gets":      gets,
+		"set":       set,
+		"add":       add,
+		"replace":   replace,
+		"cas":       cas,
+		"delete":    del,
+		"incr":      incr,
+		"decr":      decr,
+		"touch":     touch,
+		"stats":     stats,
+		"version":   version,
+		"verbosity": verbosity,
+		"quit":      quit,
+	}
+}
+
+// readLine reads a command line without its line break.
+func (sess *session) readLine() (string, error) {
+	line, err := sess.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// handle runs the command of a line, an unknown command is answered with ERROR.
+func (sess *session) handle(line string) {
+	args := strings.Fields(line)
+	sess.noreply = false
+
+	if len(args) == 0 {
+		sess.reply("ERROR")
+		return
+	}
+
+	run, ok := commands[args[0]]
+	switch {
+	case !ok:
+		sess.reply("ERROR")
+	case !sess.authenticated && args[0] == "set":
+		sess.logIn(args)
+	case !sess.authenticated && args[0] != "quit":
+		sess.clientError("unauthenticated")
+	default:
+		run(sess, args)
+	}
+}
+
+// logIn logs in with the set of the ASCII authentication, its data is "<name> <secret>".
+func (sess *session) logIn(args []string) {
+	args = sess.cutNoreply(args)
+	if len(args) != 5 {
+		sess.reply("ERROR")
+		return
+	}
+
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		sess.clientError("bad command line format")
+		return
+	}
+
+	data, ok := sess.readData(size)
+	if !ok {
+		return
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		sess.clientError("authentication failure")
+		return
+	}
+
+	principal, err := sess.server.login(fields[0], fields[1])
+	if err != nil {
+		sess.clientError("authentication failure")
+		return
+	}
+
+	sess.permissions = sess.server.permissions.Intersect(principal.Permissions)
+	sess.authenticated = true
+	sess.result("STORED")
+}
+
+// reply writes an answer.
+func (sess *session) reply(line string) {
+	sess.writer.WriteString(line + "\r\n")
+}
+
+// result writes the answer of a command that succeeded, unless the client asked for noreply.
+func (sess *session) result(line string) {
+	if !sess.noreply {
+		sess.reply(line)
+	}
+}
+
+func (sess *session) clientError(message string) {
+	sess.reply("CLIENT_ERROR " + message)
+}
+
+// replyError answers with the error of the backend, not being the leader is a server error.
+func (sess *session) replyError(err error) {
+	if errors.Is(err, service.ErrPermissionDenied) {
+		sess.clientError(err.Error())
+		return
+	}
+
+	sess.reply("SERVER_ERROR " + err.Error())
+}
+
+// cutNoreply removes the noreply of the arguments, and remembers it.
+func (sess *session) cutNoreply(args []string) []string {
+	if len(args) > 1 && args[len(args)-1] == "noreply" {
+		sess.noreply = true
+		return args[:len(args)-1]
+	}
+
+	return args
+}
+
+// key parses a key and checks the permission of its bucket, it answers with an error when it fails.
+func (sess *session) key(text string, perm service.Permission) (string, int, bool) {
+	bucket, key, err := parseKey(text)
+	if err != nil {
+		sess.clientError(err.Error())
+		return "", 0, false
+	}
+
+	if err := sess.permissions.Check(bucket, perm); err != nil {
+		sess.replyError(err)
+		return "", 0, false
+	}
+
+	return bucket, key, true
+}
+
+// parseKey parses a key "bucket:id", a key without a bucket is in replicationmanager.KeyBucket.
+func parseKey(text string) (string, int, error) {
+	if len(text) > MaxKeyLength || strings.ContainsFunc(text, unicode.IsControl) {
+		return "", 0, errors.New("bad key format")
+	}
+
+	bucket, id := replicationmanager.KeyBucket, text
+	if i := strings.LastIndexByte(text, ':'); i >= 0 {
+		bucket, id = text[:i], text[i+1:]
+	}
+
+	if bucket == "" {
+		bucket = replicationmanager.KeyBucket
+	}
+
+	key, err := strconv.Atoi(id)
+	if err != nil || key < 0 || bucket == service.AllBuckets {
+		return "", 0, errors.New("key should be bucket:id, with a positive id")
+	}
+
+	return bucket, key, nil
+}
+
+// readData reads the data block of a storage command, and answers with an error when it isn't valid.
+func (sess *session) readData(size int) ([]byte, bool) {
+	if size > MaxValueSize {
+		if _, err := sess.reader.Discard(size + 2); err != nil {
+			sess.quit = true
+		}
+
+		sess.reply("SERVER_ERROR object too large for cache")
+		return nil, false
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(sess.reader, data); err != nil {
+		sess.quit = true
+		return nil, false
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		// the rest of the line belongs to the data block
+		if data[size+1] != '\n' {
+			if _, err := sess.readLine(); err != nil {
+				sess.quit = true
+			}
+		}
+
+		sess.clientError("bad data chunk")
+		return nil, false
+	}
+
+	return data[:size], true
+}
+
+// expiry returns the moment an item expires: an exptime of 0 never expires, up to 30 days it is
+// a number of seconds and after that a unix time. A negative exptime has already expired.
+func expiry(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime <= relativeLimit:
+		return now.Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// itemAttrs returns the attributes of an item: its value is raw, and its flags unless they are 0.
+func itemAttrs(flags uint64) fastdb.Attrs {
+	attrs := fastdb.Attrs{replicationmanager.ContentTypeAttr: string(replicationmanager.ContentRaw)}
+	if flags != 0 {
+		attrs[flagsAttr] = strconv.FormatUint(flags, 10)
+	}
+
+	return attrs
+}
+
+// flagsOf returns the flags of an item.
+func flagsOf(attrs fastdb.Attrs) uint64 {
+	flags, _ := strconv.ParseUint(attrs[flagsAttr], 10, 32)
+	return flags
+}
+
+// casUnique returns the cas value of an item, the replicationmanager.Fingerprint of its value.
+// An item that gets the same value again has the same cas value.
+func casUnique(value []byte) uint64 {
+	unique, _ := strconv.ParseUint(replicationmanager.Fingerprint(value), 16, 64)
+	return unique
+}
+
+func get(sess *session, args []string) {
+	sess.retrieve(args, false)
+}
+
+func gets(sess *session, args []string) {
+	sess.retrieve(args, true)
+}
+
+// retrieve answers with the items of the keys that are found, with their cas value for gets.
+// The items are only written when all keys are read, so an error isn't mixed with items.
+func (sess *session) retrieve(args []string, withCAS bool) {
+	if len(args) < 2 {
+		sess.reply("ERROR")
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	var items bytes.Buffer
+
+	for _, text := range args[1:] {
+		bucket, key, ok := sess.key(text, service.Read)
+		if !ok {
+			return
+		}
+
+		sess.server.stats.count("cmd_get")
+
+		entry, found, err := sess.server.backend.Get(ctx, bucket, key)
+		if err != nil {
+			sess.replyError(err)
+			return
+		}
+
+		if !found {
+			sess.server.stats.count("get_misses")
+			continue
+		}
+
+		sess.server.stats.count("get_hits")
+
+		fmt.Fprintf(&items, "VALUE %s %d %d", text, flagsOf(entry.Attrs), len(entry.Value))
+		if withCAS {
+			fmt.Fprintf(&items, " %d", casUnique(entry.Value))
+		}
+
+		items.WriteString("\r\n")
+		items.Write(entry.Value)
+		items.WriteString("\r\n")
+	}
+
+	sess.writer.Write(items.Bytes())
+	sess.reply("END")
+}
+
+func set(sess *session, args []string) {
+	sess.store(args, replicationmanager.SetOptions{})
+}
+
+func add(sess *session, args []string) {
+	sess.store(args, replicationmanager.SetOptions{IfMissing: true})
+}
+
+func replace(sess *session, args []string) {
+	sess.store(args, replicationmanager.SetOptions{IfExists: true})
+}
+
+func cas(sess *session, args []string) {
+	sess.store(args, replicationmanager.SetOptions{})
+}
+
+// store runs a storage command: <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply],
+// followed by the data block. The flags and the exptime are kept with the value.
+func (sess *session) store(args []string, opts replicationmanager.SetOptions) {
+	withCAS := args[0] == "cas"
+	args = sess.cutNoreply(args)
+
+	want := 5
+	if withCAS {
+		want = 6
+	}
+
+	if len(args) != want {
+		sess.reply("ERROR")
+		return
+	}
+
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		sess.clientError("bad command line format")
+		return
+	}
+
+	value, ok := sess.readData(size)
+	if !ok {
+		return
+	}
+
+	flags, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	if flagsErr != nil || exptimeErr != nil {
+		sess.clientError("bad command line format")
+		return
+	}
+
+	if withCAS {
+		unique, err := strconv.ParseUint(args[5], 10, 64)
+		if err != nil {
+			sess.clientError("bad command line format")
+			return
+		}
+
+		opts.IfMatch = strconv.FormatUint(unique, 16)
+	}
+
+	bucket, key, ok := sess.key(args[1], service.Write)
+	if !ok {
+		return
+	}
+
+	opts.Expires = expiry(exptime, time.Now())
+	opts.Attrs = itemAttrs(flags)
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	sess.server.stats.count("cmd_set")
+
+	done, err := sess.server.backend.SetWith(ctx, bucket, key, value, opts)
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case done:
+		if withCAS {
+			sess.server.stats.count("cas_hits")
+		}
+
+		sess.result("STORED")
+	case withCAS:
+		sess.casFailed(bucket, key)
+	default:
+		sess.result("NOT_STORED")
+	}
+}
+
+// casFailed answers a cas that didn't store, NOT_FOUND when the key doesn't exist
+// and EXISTS when it has another value.
+func (sess *session) casFailed(bucket string, key int) {
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	_, found, err := sess.server.backend.Get(ctx, bucket, key)
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case found:
+		sess.server.stats.count("cas_badval")
+		sess.result("EXISTS")
+	default:
+		sess.server.stats.count("cas_misses")
+		sess.result("NOT_FOUND")
+	}
+}
+
+func del(sess *session, args []string) {
+	args = sess.cutNoreply(args)
+	if len(args) != 2 {
+		sess.reply("ERROR")
+		return
+	}
+
+	bucket, key, ok := sess.key(args[1], service.Write)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	deleted, err := sess.server.backend.Delete(ctx, bucket, key)
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case deleted:
+		sess.server.stats.count("delete_hits")
+		sess.result("DELETED")
+	default:
+		sess.server.stats.count("delete_misses")
+		sess.result("NOT_FOUND")
+	}
+}
+
+func incr(sess *session, args []string) {
+	sess.change(args, "incr")
+}
+
+func decr(sess *session, args []string) {
+	sess.change(args, "decr")
+}
+
+// change runs incr or decr on the decimal value of an item, incr wraps around at 64 bits
+// and decr stops at 0. The item keeps its flags and exptime.
+func (sess *session) change(args []string, name string) {
+	args = sess.cutNoreply(args)
+	if len(args) != 3 {
+		sess.reply("ERROR")
+		return
+	}
+
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		sess.clientError("invalid numeric delta argument")
+		return
+	}
+
+	bucket, key, ok := sess.key(args[1], service.Write)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	value, err := sess.server.backend.Update(ctx, bucket, key, func(value []byte, found bool) ([]byte, error) {
+		if !found {
+			return nil, errNotFound
+		}
+
+		number, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return nil, errNotNumeric
+		}
+
+		switch {
+		case name == "incr":
+			number += delta
+		case delta > number:
+			number = 0
+		default:
+			number -= delta
+		}
+
+		return []byte(strconv.FormatUint(number, 10)), nil
+	})
+
+	switch {
+	case errors.Is(err, errNotFound):
+		sess.server.stats.count(name + "_misses")
+		sess.result("NOT_FOUND")
+	case errors.Is(err, errNotNumeric):
+		sess.clientError(err.Error())
+	case err != nil:
+		sess.replyError(err)
+	default:
+		sess.server.stats.count(name + "_hits")
+		sess.result(string(value))
+	}
+}
+
+// touch changes the exptime of an item.
+func touch(sess *session, args []string) {
+	args = sess.cutNoreply(args)
+	if len(args) != 3 {
+		sess.reply("ERROR")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		sess.clientError("invalid exptime argument")
+		return
+	}
+
+	bucket, key, ok := sess.key(args[1], service.Write)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	sess.server.stats.count("cmd_touch")
+
+	touched, err := sess.server.backend.ExpireAt(ctx, bucket, key, expiry(exptime, time.Now()))
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case touched:
+		sess.server.stats.count("touch_hits")
+		sess.result("TOUCHED")
+	default:
+		sess.server.stats.count("touch_misses")
+		sess.result("NOT_FOUND")
+	}
+}
+
+// stats answers with the general statistics, the groups of statistics aren't supported.
+func stats(sess *session, args []string) {
+	if len(args) > 1 {
+		sess.reply("ERROR")
+		return
+	}
+
+	st := sess.server.stats
+	now := time.Now()
+
+	sess.reply("STAT pid " + strconv.Itoa(os.Getpid()))
+	sess.reply("STAT uptime " + strconv.FormatInt(int64(now.Sub(st.started)/time.Second), 10))
+	sess.reply("STAT time " + strconv.FormatInt(now.Unix(), 10))
+	sess.reply("STAT version " + MemcachedVersion)
+	sess.reply("STAT curr_connections " + strconv.FormatInt(st.current.Load(), 10))
+	sess.reply("STAT total_connections " + strconv.FormatInt(st.total.Load(), 10))
+
+	for _, name := range counterNames {
+		sess.reply("STAT " + name + " " + strconv.FormatUint(st.counters[name].Load(), 10))
+	}
+
+	sess.reply("END")
+}
+
+func version(sess *session, _ []string) {
+	sess.reply("VERSION " + MemcachedVersion)
+}
+
+// verbosity is accepted for the clients that send it, it doesn't change anything.
+func verbosity(sess *session, args []string) {
+	args = sess.cutNoreply(args)
+	if len(args) != 2 {
+		sess.reply("ERROR")
+		return
+	}
+
+	sess.result("OK")
+}
+
+func quit(sess *session, _ []string) {
+	sess.quit = true
+}
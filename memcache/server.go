@@ -0,0 +1,294 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcelloh/fastdb/service"
+)
+
+const (
+	// MemcachedVersion is the version of memcached the server answers like.
+	MemcachedVersion = "1.6.0"
+
+	// MaxKeyLength is the longest key, like memcached.
+	MaxKeyLength = 250
+
+	// MaxValueSize is the largest value of an item, like the default of memcached.
+	MaxValueSize = 1 << 20
+
+	// maxLineLength is the longest command line, a longer line closes the connection.
+	maxLineLength = 2048
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("memcache: server closed")
+
+// Server answers memcached clients (the text protocol), it maps the keys "bucket:id" onto buckets.
+type Server struct {
+	backend     Backend
+	permissions service.Permissions
+	login       service.Login // nil when the clients don't log in
+	timeout     time.Duration
+	stats       *statistics
+	listener    net.Listener
+	conns       map[net.Conn]struct{}
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	closed      bool
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPermissions sets the permissions of the buckets, all buckets may be read and written without it.
+func WithPermissions(permissions service.Permissions) Option {
+	return func(s *Server) {
+		s.permissions = permissions
+	}
+}
+
+// WithLogin makes the clients log in before the other commands, like the ASCII authentication of memcached:
+// the first command is a set of any key, with "<name> <secret>" as its data.
+// The clients get the permissions that both the server and their credential give.
+func WithLogin(login service.Login) Option {
+	return func(s *Server) {
+		s.login = login
+	}
+}
+
+// WithRequestTimeout sets the deadline of one command, service.RequestTimeout without it.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// NewServer returns a server that keeps the items in the backend.
+func NewServer(backend Backend, opts ...Option) *Server {
+	s := &Server{
+		backend:     backend,
+		permissions: service.NewPermissions(service.ReadWrite),
+		timeout:     service.RequestTimeout,
+		stats:       newStats(),
+		conns:       map[net.Conn]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe listens on a TCP address, and serves the connections until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve serves the connections of the listener until Close, it always returns an error.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops listening, closes the connections and waits until their commands are done.
+func (s *Server) Close() error {
+	err := s.stop()
+	s.closeConns()
+
+	s.wg.Wait()
+	return err
+}
+
+// Shutdown stops listening, lets the connections answer the commands they are running and closes them.
+// The connections that are still running a command when the context ends are closed right away,
+// their commands aren't waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stop()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		// the command that runs is answered, the next read fails
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		return fmt.Errorf("memcache: commands are still running: %w", ctx.Err())
+	}
+}
+
+// stop stops listening, the connections that are accepted after it are closed.
+func (s *Server) stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// track keeps a connection, so Close can close it. It returns false when the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.stats.connected()
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	conn.Close()
+	s.stats.disconnected()
+	s.wg.Done()
+}
+
+// serveConn reads the commands of a connection and answers them, until the client quits.
+// The answers are written when no more commands are waiting, so pipelined commands are answered at once.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+
+	sess := &session{
+		server:        s,
+		reader:        bufio.NewReaderSize(conn, maxLineLength),
+		writer:        bufio.NewWriter(conn),
+		permissions:   s.permissions,
+		authenticated: s.login == nil,
+	}
+
+	for !sess.quit {
+		line, err := sess.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				sess.clientError("line too long")
+				sess.writer.Flush()
+			}
+			return
+		}
+
+		sess.handle(line)
+
+		if sess.reader.Buffered() == 0 || sess.quit {
+			if err := sess.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// context returns the context of one command.
+func (s *Server) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// statistics are the counters of the stats command.
+type statistics struct {
+	started  time.Time
+	current  atomic.Int64
+	total    atomic.Int64
+	counters map[string]*atomic.Uint64
+}
+
+// counterNames are the counters of the commands, in the order stats shows them.
+var counterNames = []string{
+	"cmd_get", "cmd_set", "cmd_touch", "get_hits", "get_misses",
+	"delete_misses", "delete_hits", "incr_misses", "incr_hits", "decr_misses", "decr_hits",
+	"cas_misses", "cas_hits", "cas_badval", "touch_hits", "touch_misses",
+}
+
+func newStats() *statistics {
+	st := &statistics{started: time.Now(), counters: map[string]*atomic.Uint64{}}
+	for _, name := range counterNames {
+		st.counters[name] = &atomic.Uint64{}
+	}
+
+	return st
+}
+
+func (st *statistics) connected() {
+	st.current.Add(1)
+	st.total.Add(1)
+}
+
+func (st *statistics) disconnected() {
+	st.current.Add(-1)
+}
+
+// count adds one to a counter.
+func (st *statistics) count(name string) {
+	st.counters[name].Add(1)
+}
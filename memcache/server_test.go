@@ -0,0 +1,449 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/replication/election"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// client sends lines to a server, and reads its answers.
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// startServer serves the backend on a free port, and returns a client that is connected to it.
+func startServer(t *testing.T, backend Backend, opts ...Option) *client {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(backend, opts...)
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+		require.NoError(t, server.Close())
+	})
+
+	return &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func startLocal(t *testing.T, opts ...Option) (*client, *fastdb.DB) {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return startServer(t, Local(db), opts...), db
+}
+
+// do sends the lines, and returns the answer lines until one of the final answers.
+func (c *client) do(t *testing.T, lines ...string) []string {
+	t.Helper()
+
+	_, err := c.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	require.NoError(t, err)
+
+	return c.read(t)
+}
+
+// read returns the answer lines until one that ends an answer.
+func (c *client) read(t *testing.T) []string {
+	t.Helper()
+
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	var answer []string
+
+	for {
+		line, err := c.reader.ReadString('\n')
+		require.NoError(t, err, answer)
+
+		line = strings.TrimSuffix(line, "\r\n")
+		answer = append(answer, line)
+
+		if !strings.HasPrefix(line, "VALUE ") && !strings.HasPrefix(line, "STAT ") &&
+			(len(answer) < 2 || !strings.HasPrefix(answer[len(answer)-2], "VALUE ")) {
+			return answer
+		}
+	}
+}
+
+func TestServer_storage(t *testing.T) {
+	c, db := startLocal(t)
+
+	assert.Equal(t, []string{"END"}, c.do(t, "get user:1"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set user:1 12 0 3", "one"))
+	assert.Equal(t, []string{"VALUE user:1 12 3", "one", "END"}, c.do(t, "get user:1"))
+
+	entry, found := db.GetEntry("user", 1)
+	assert.True(t, found)
+	assert.Equal(t, fastdb.Entry{Value: []byte("one"), Attrs: fastdb.Attrs{"flags": "12", "type": "raw"}}, entry)
+
+	// a key without a bucket is in the default bucket
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set 2 0 0 3", "two"))
+	value, _ := db.Get(replicationmanager.KeyBucket, 2)
+	assert.Equal(t, "two", string(value))
+
+	assert.Equal(t, []string{"VALUE user:1 12 3", "one", "VALUE 2 0 3", "two", "END"}, c.do(t, "get user:1 user:9 2"))
+
+	assert.Equal(t, []string{"NOT_STORED"}, c.do(t, "add user:1 0 0 3", "uno"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "add user:3 0 0 5", "three"))
+	assert.Equal(t, []string{"NOT_STORED"}, c.do(t, "replace user:4 0 0 4", "four"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "replace user:1 0 0 3", "uno"))
+	assert.Equal(t, []string{"VALUE user:1 0 3", "uno", "END"}, c.do(t, "get user:1"), "the flags are replaced")
+
+	assert.Equal(t, []string{"DELETED"}, c.do(t, "delete user:1"))
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "delete user:1"))
+	assert.Equal(t, []string{"END"}, c.do(t, "get user:1"))
+
+	// an empty value
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set user:5 0 0 0", ""))
+	assert.Equal(t, []string{"VALUE user:5 0 0", "", "END"}, c.do(t, "get user:5"))
+}
+
+func TestServer_binaryValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memcache.db")
+
+	db, err := fastdb.Open(path, 100)
+	require.NoError(t, err)
+
+	c := startServer(t, Local(db))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set user:1 0 0 7", "a\r\nb\x00\nc"))
+	require.NoError(t, db.Close())
+
+	// the value is read back from the data file as it was set
+	db, err = fastdb.Open(path, 100)
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, found := db.Get("user", 1)
+	assert.True(t, found)
+	assert.Equal(t, "a\r\nb\x00\nc", string(value))
+}
+
+func TestServer_cas(t *testing.T) {
+	c, _ := startLocal(t)
+
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "cas 1 0 0 3 123", "one"))
+
+	c.do(t, "set 1 0 0 3", "one")
+
+	answer := c.do(t, "gets 1")
+	require.Len(t, answer, 3)
+	fields := strings.Fields(answer[0])
+	require.Len(t, fields, 5)
+	unique := fields[4]
+	assert.Equal(t, strconv.FormatUint(casUnique([]byte("one")), 10), unique)
+
+	assert.Equal(t, []string{"EXISTS"}, c.do(t, "cas 1 0 0 3 123", "uno"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "cas 1 0 0 3 "+unique, "uno"))
+	assert.Equal(t, []string{"EXISTS"}, c.do(t, "cas 1 0 0 3 "+unique, "one"), "the value changed")
+}
+
+func TestServer_incrDecr(t *testing.T) {
+	c, db := startLocal(t)
+
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "incr 1 1"))
+
+	c.do(t, "set 1 5 100 2", "10")
+	assert.Equal(t, []string{"15"}, c.do(t, "incr 1 5"))
+	assert.Equal(t, []string{"5"}, c.do(t, "decr 1 10"))
+	assert.Equal(t, []string{"0"}, c.do(t, "decr 1 10"), "decr stops at 0")
+	assert.Equal(t, []string{"0"}, c.do(t, "incr 1 0"))
+
+	c.do(t, "set 1 5 100 20", "18446744073709551615")
+	assert.Equal(t, []string{"1"}, c.do(t, "incr 1 2"), "incr wraps around")
+
+	entry, _ := db.GetEntry(replicationmanager.KeyBucket, 1)
+	assert.Equal(t, fastdb.Attrs{"flags": "5", "type": "raw"}, entry.Attrs, "the flags are kept")
+	assert.False(t, entry.Expires.IsZero(), "the exptime is kept")
+
+	c.do(t, "set 2 0 0 3", "two")
+	assert.Equal(t, []string{"CLIENT_ERROR cannot increment or decrement non-numeric value"}, c.do(t, "incr 2 1"))
+	assert.Equal(t, []string{"CLIENT_ERROR invalid numeric delta argument"}, c.do(t, "incr 1 -1"))
+}
+
+func TestServer_exptime(t *testing.T) {
+	c, db := startLocal(t)
+
+	c.do(t, "set 1 0 100 3", "one")
+	ttl, _ := db.TTL(replicationmanager.KeyBucket, 1)
+	assert.InDelta(t, 100*time.Second, ttl, float64(time.Second))
+
+	later := time.Now().Add(time.Hour).Unix()
+	c.do(t, "set 2 0 "+strconv.FormatInt(later, 10)+" 3", "two")
+	expires, _ := db.ExpiresAt(replicationmanager.KeyBucket, 2)
+	assert.Equal(t, later, expires.Unix(), "a large exptime is a unix time")
+
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set 3 0 -1 5", "three"))
+	assert.Equal(t, []string{"END"}, c.do(t, "get 3"), "a negative exptime has expired")
+
+	assert.Equal(t, []string{"TOUCHED"}, c.do(t, "touch 1 0"))
+	ttl, _ = db.TTL(replicationmanager.KeyBucket, 1)
+	assert.Equal(t, fastdb.NoExpiry, ttl)
+
+	assert.Equal(t, []string{"TOUCHED"}, c.do(t, "touch 1 50"))
+	ttl, _ = db.TTL(replicationmanager.KeyBucket, 1)
+	assert.InDelta(t, 50*time.Second, ttl, float64(time.Second))
+
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "touch 4 50"))
+	assert.Equal(t, []string{"TOUCHED"}, c.do(t, "touch 1 -1"))
+	assert.Equal(t, []string{"END"}, c.do(t, "get 1"))
+}
+
+func TestServer_invalid(t *testing.T) {
+	c, _ := startLocal(t)
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{name: "Unknown command", lines: []string{"flush_all"}, want: "ERROR"},
+		{name: "Empty line", lines: []string{""}, want: "ERROR"},
+		{name: "Missing key", lines: []string{"get"}, want: "ERROR"},
+		{name: "Key not a number", lines: []string{"get user:one"}, want: "CLIENT_ERROR key should be bucket:id, with a positive id"},
+		{name: "Negative key", lines: []string{"delete user:-1"}, want: "CLIENT_ERROR key should be bucket:id, with a positive id"},
+		{name: "All buckets", lines: []string{"get *:1"}, want: "CLIENT_ERROR key should be bucket:id, with a positive id"},
+		{name: "Long key", lines: []string{"get " + strings.Repeat("a", MaxKeyLength) + ":1"}, want: "CLIENT_ERROR bad key format"},
+		{name: "Wrong arguments", lines: []string{"set 1 0 0"}, want: "ERROR"},
+		{name: "Bad size", lines: []string{"set 1 0 0 x"}, want: "CLIENT_ERROR bad command line format"},
+		{name: "Bad flags", lines: []string{"set 1 x 0 1", "1"}, want: "CLIENT_ERROR bad command line format"},
+		{name: "Bad data", lines: []string{"set 1 0 0 1", "12"}, want: "CLIENT_ERROR bad data chunk"},
+		{name: "Bad exptime", lines: []string{"touch 1 x"}, want: "CLIENT_ERROR invalid exptime argument"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := c.do(t, tt.lines...)
+			assert.Equal(t, []string{tt.want}, answer)
+		})
+	}
+
+	// a value that is too large is skipped
+	size := MaxValueSize + 1
+	assert.Equal(t, []string{"SERVER_ERROR object too large for cache"},
+		c.do(t, "set 1 0 0 "+strconv.Itoa(size), strings.Repeat("a", size)))
+	assert.Equal(t, []string{"VERSION " + MemcachedVersion}, c.do(t, "version"))
+}
+
+func TestServer_noreplyAndPipelined(t *testing.T) {
+	c, _ := startLocal(t)
+
+	answer := c.do(t, "set 1 0 0 3 noreply", "one", "incr 2 1 noreply", "verbosity 1 noreply", "add 2 0 0 3", "two", "get 1")
+	assert.Equal(t, []string{"STORED"}, answer, "only the add answers")
+	assert.Equal(t, []string{"VALUE 1 0 3", "one", "END"}, c.read(t))
+
+	answer = c.do(t, "stats")
+	assert.Contains(t, answer, "STAT version "+MemcachedVersion)
+	assert.Contains(t, answer, "STAT cmd_set 2")
+	assert.Contains(t, answer, "STAT get_hits 1")
+	assert.Contains(t, answer, "STAT incr_misses 1")
+	assert.Contains(t, answer, "STAT curr_connections 1")
+	assert.Equal(t, "END", answer[len(answer)-1])
+
+	_, err := c.conn.Write([]byte("quit\r\n"))
+	require.NoError(t, err)
+
+	_, err = c.reader.ReadString('\n')
+	assert.Error(t, err, "the connection is closed")
+}
+
+func TestServer_Permissions(t *testing.T) {
+	permissions, err := service.ParsePermissions("logs=r,secret=none")
+	require.NoError(t, err)
+
+	c, _ := startLocal(t, WithPermissions(permissions))
+
+	assert.Equal(t, []string{"END"}, c.do(t, "get logs:1"))
+	assert.Equal(t, []string{"CLIENT_ERROR permission denied: no write access to bucket (logs)"}, c.do(t, "set logs:1 0 0 1", "1"))
+	assert.Equal(t, []string{"CLIENT_ERROR permission denied: no read access to bucket (secret)"}, c.do(t, "get secret:1"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set other:1 0 0 1", "1"))
+}
+
+func TestServer_Auth(t *testing.T) {
+	credentials, err := service.ParseCredentials("app:s3cret:logs=r,other=rw")
+	require.NoError(t, err)
+
+	auth, err := service.NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	c, db := startLocal(t, WithLogin(auth.Login))
+
+	assert.Equal(t, []string{"CLIENT_ERROR unauthenticated"}, c.do(t, "get logs:1"))
+	assert.Equal(t, []string{"CLIENT_ERROR authentication failure"}, c.do(t, "set auth 0 0 9", "app wrong"))
+	assert.Equal(t, []string{"CLIENT_ERROR authentication failure"}, c.do(t, "set auth 0 0 6", "s3cret"))
+
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set auth 0 0 10", "app s3cret"))
+	assert.Zero(t, db.Count(replicationmanager.KeyBucket), "the login isn't stored")
+
+	// the permissions of the credential
+	assert.Equal(t, []string{"END"}, c.do(t, "get logs:1"))
+	assert.Equal(t, []string{"CLIENT_ERROR permission denied: no write access to bucket (logs)"}, c.do(t, "set logs:1 0 0 1", "1"))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set other:1 0 0 1", "1"))
+	assert.Equal(t, []string{"CLIENT_ERROR permission denied: no write access to bucket (kvstore)"}, c.do(t, "set 1 0 0 1", "1"))
+}
+
+func TestServer_replicated(t *testing.T) {
+	leaderListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backupListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	_, leader := startNode(t, leaderListener, 1, map[int]string{2: backupListener.Addr().String()})
+	backupDB, backup := startNode(t, backupListener, 2, map[int]string{1: leaderListener.Addr().String()})
+
+	leaderClient := startServer(t, Replicated(leader))
+	backupClient := startServer(t, Replicated(backup))
+
+	assert.Equal(t, []string{"STORED"}, leaderClient.do(t, "set user:1 7 100 3", "one"))
+
+	entry, found := backupDB.GetEntry("user", 1)
+	require.True(t, found, "the set is replicated")
+	assert.Equal(t, fastdb.Attrs{"flags": "7", "type": "raw"}, entry.Attrs, "the flags are replicated")
+	assert.False(t, entry.Expires.IsZero(), "the exptime is replicated")
+
+	// the backup reads from the leader, and doesn't write
+	assert.Equal(t, []string{"VALUE user:1 7 3", "one", "END"}, backupClient.do(t, "get user:1"))
+
+	answer := backupClient.do(t, "set user:2 0 0 3", "two")
+	assert.Equal(t, []string{"SERVER_ERROR not the leader, current leader is Node-1"}, answer)
+
+	assert.Equal(t, []string{"TOUCHED"}, leaderClient.do(t, "touch user:1 0"))
+	ttl, _ := backupDB.TTL("user", 1)
+	assert.Equal(t, fastdb.NoExpiry, ttl, "the touch is replicated")
+
+	leaderClient.do(t, "set user:3 0 0 1", "1")
+	assert.Equal(t, []string{"3"}, leaderClient.do(t, "incr user:3 2"))
+	value, _ := backupDB.Get("user", 3)
+	assert.Equal(t, "3", string(value))
+
+	assert.Equal(t, []string{"DELETED"}, leaderClient.do(t, "delete user:1"))
+	_, found = backupDB.Get("user", 1)
+	assert.False(t, found, "the delete is replicated")
+}
+
+func startNode(t *testing.T, listener net.Listener, nodeID int, peers map[int]string) (*fastdb.DB, *replicationmanager.ReplicationManager) {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+
+	bully := election.NewBullyAlgorithm(nodeID, 1, peers)
+	replication := replicationmanager.NewReplicationManager(nodeID, db, bully)
+
+	server := transport.NewServer()
+	require.NoError(t, server.RegisterName("ReplicationManager", replication))
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+
+	return db, replication
+}
+
+// blockingBackend answers get when release is closed, it tells on started that a get runs.
+type blockingBackend struct {
+	Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Get(ctx context.Context, bucket string, key int) (fastdb.Entry, bool, error) {
+	b.started <- struct{}{}
+	<-b.release
+
+	return b.Backend.Get(ctx, bucket, key)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// start serves a backend that blocks get, with a client that runs one and an idle client
+	start := func() (*Server, *blockingBackend, chan error, *client) {
+		backend := &blockingBackend{Backend: Local(db), started: make(chan struct{}), release: make(chan struct{})}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := NewServer(backend)
+		go server.Serve(listener)
+
+		dial := func() *client {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			t.Cleanup(func() { conn.Close() })
+
+			return &client{conn: conn, reader: bufio.NewReader(conn)}
+		}
+
+		busy, idle := dial(), dial()
+		assert.Equal(t, []string{"VERSION " + MemcachedVersion}, idle.do(t, "version"))
+
+		answered := make(chan error, 1)
+		go func() {
+			_, err := busy.conn.Write([]byte("get 1\r\n"))
+			if err == nil {
+				_, err = busy.reader.ReadString('\n')
+			}
+			answered <- err
+		}()
+		<-backend.started
+
+		return server, backend, answered, idle
+	}
+
+	server, backend, answered, idle := start()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	_, err = idle.reader.ReadString('\n')
+	require.Error(t, err, "an idle connection is closed")
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the command ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	require.NoError(t, <-answered, "a running command is answered")
+	require.NoError(t, <-shutdown)
+
+	// a command that runs when the context ends isn't waited for
+	server, backend, answered, _ = start()
+	defer close(backend.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	require.Error(t, <-answered, "the connection is closed")
+}
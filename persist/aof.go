@@ -3,9 +3,14 @@ package persist
 /* ------------------------------- Imports --------------------------- */
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -20,23 +25,48 @@ const fileMode = 0o600
 
 // AOF is Append Only File.
 type AOF struct {
-	file     *os.File
-	syncTime int
-	mu       sync.RWMutex
+	file      *os.File
+	history   map[string]map[int][]Version
+	expires   map[string]map[int]time.Time
+	attrs     map[string]map[int]map[string]string
+	meta      map[string][]byte
+	retention Retention
+	syncTime  int
+	mu        sync.RWMutex
+	queueMu   sync.Mutex
+	pending   []*appendRequest
+	writing   bool
 }
 
+// appendRequest holds lines waiting to be written by Append, and where to report the result.
+type appendRequest struct {
+	lines string
+	done  chan error
+}
+
+// Option configures optional behaviour of the persister.
+type Option func(*AOF)
+
 var (
 	lock     = &sync.Mutex{}
 	osCreate = os.O_CREATE
 )
 
+// ErrNotSynced is returned by WriteCtx and AppendCtx when the lines are written (or will be),
+// but the context ended before the sync.
+var ErrNotSynced = errors.New("written, but not synced")
+
 /* -------------------------- Methods/Functions ---------------------- */
 
 /*
 OpenPersister opens the append only file and reads in all the data.
 */
-func OpenPersister(path string, syncIime int) (*AOF, map[string]map[int][]byte, error) {
-	aof := &AOF{syncTime: syncIime}
+func OpenPersister(path string, syncIime int, opts ...Option) (*AOF, map[string]map[int][]byte, error) {
+	aof := newAOF(syncIime)
+
+	for _, opt := range opts {
+		opt(aof)
+	}
 
 	filePath := filepath.Clean(path)
 	if filePath != path {
@@ -58,6 +88,19 @@ func OpenPersister(path string, syncIime int) (*AOF, map[string]map[int][]byte,
 	return aof, keys, nil
 }
 
+/*
+newAOF returns a persister without a file.
+*/
+func newAOF(syncTime int) *AOF {
+	return &AOF{
+		syncTime: syncTime,
+		history:  map[string]map[int][]Version{},
+		expires:  map[string]map[int]time.Time{},
+		attrs:    map[string]map[int]map[string]string{},
+		meta:     map[string][]byte{},
+	}
+}
+
 /*
 getData opens a file and reads the data into the memory.
 */
@@ -102,138 +145,287 @@ func (aof *AOF) readDataFromFile(path string) (map[string]map[int][]byte, error)
 
 /*
 fileReader reads the file and fills the keys.
+A batch that isn't committed at the end of the file (after a crash) is dropped,
+and cut off the file, so new writes don't end up inside it.
 */
 func (aof *AOF) fileReader() (map[string]map[int][]byte, error) {
+	keys, tail, err := aof.replay(aof.file)
+	if err != nil {
+		return nil, err
+	}
+
+	if tail >= 0 {
+		return keys, aof.truncate(tail)
+	}
+
+	return keys, nil
+}
+
+/*
+replay reads the records and applies them to the keys, the history and the metadata.
+The changes of a batch are only applied when its commit is read.
+It returns the position of a batch that isn't committed at the end of the file, or -1.
+*/
+func (aof *AOF) replay(r io.Reader) (map[string]map[int][]byte, int64, error) {
 	var (
-		count int
-		err   error
+		batch   []Record
+		inBatch bool
+		start   int64
 	)
 
 	keys := make(map[string]map[int][]byte, 1)
-	scanner := bufio.NewScanner(aof.file)
-	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024) // Increase buffer size
+	scanner := NewScanner(r)
 
 	for scanner.Scan() {
-		count++
-		instruction := scanner.Text()
+		rec := scanner.Record()
 
-		count, err = aof.processInstruction(instruction, scanner, count, keys)
-		if err != nil {
-			return nil, err
+		if !allowed(rec.Name, inBatch) {
+			return nil, -1, fmt.Errorf("file (%s) has wrong instruction in batch '%s' on line: %d", aof.file.Name(), rec.Name, rec.Line)
+		}
+
+		switch {
+		case rec.Name == "batch":
+			batch, inBatch, start = nil, true, rec.Offset
+		case rec.Name == "commit":
+			for _, change := range batch {
+				aof.apply(change, keys)
+			}
+
+			inBatch = false
+		case inBatch:
+			batch = append(batch, rec)
+		default:
+			aof.apply(rec, keys)
 		}
 	}
 
-	return keys, nil
+	var corrupt *CorruptError
+
+	err := scanner.Err()
+	if errors.As(err, &corrupt) && corrupt.Incomplete && inBatch {
+		return keys, start, nil
+	}
+
+	if err != nil {
+		return nil, -1, fmt.Errorf("file (%s) has %w", aof.file.Name(), err)
+	}
+
+	if inBatch {
+		return keys, start, nil
+	}
+
+	return keys, -1, nil
 }
 
 /*
-processInstruction processes an instruction from the AOF file and fills the keys.
+apply applies a set, del, expire, attrs or meta record.
+A set or del removes the expiry and the attributes of the key,
+an expire or attrs is ignored when the key doesn't exist.
+An empty meta value removes the metadata.
 */
-func (aof *AOF) processInstruction(
-	instruction string,
-	scanner *bufio.Scanner,
-	count int,
-	keys map[string]map[int][]byte,
-) (int, error) {
-	switch instruction {
+func (aof *AOF) apply(rec Record, keys map[string]map[int][]byte) {
+	switch rec.Name {
 	case "set":
-		return aof.handleSetInstruction(scanner, count, keys)
+		if _, found := keys[rec.Bucket]; !found {
+			keys[rec.Bucket] = map[int][]byte{}
+		}
+
+		keys[rec.Bucket][rec.Key] = rec.Value
+		aof.addVersion(rec.Bucket, rec.Key, Version{Time: rec.Stamp, Value: rec.Value})
+		aof.setExpire(rec.Bucket, rec.Key, time.Time{})
+		aof.setAttrs(rec.Bucket, rec.Key, nil)
 	case "del":
-		return aof.handleDelInstruction(scanner, count, keys)
-	default:
-		return count, fmt.Errorf("file (%s) has wrong instruction format '%s' on line: %d", aof.file.Name(), instruction, count)
+		delete(keys[rec.Bucket], rec.Key)
+		aof.addVersion(rec.Bucket, rec.Key, Version{Time: rec.Stamp, Deleted: true})
+		aof.setExpire(rec.Bucket, rec.Key, time.Time{})
+		aof.setAttrs(rec.Bucket, rec.Key, nil)
+	case "expire":
+		if _, found := keys[rec.Bucket][rec.Key]; found {
+			aof.setExpire(rec.Bucket, rec.Key, rec.Expires)
+		}
+	case "attrs":
+		if _, found := keys[rec.Bucket][rec.Key]; found {
+			aof.setAttrs(rec.Bucket, rec.Key, rec.Attrs)
+		}
+	case "meta":
+		if len(rec.Value) == 0 {
+			delete(aof.meta, rec.Meta)
+		} else {
+			aof.meta[rec.Meta] = rec.Value
+		}
 	}
 }
 
 /*
-handleSetInstruction handles the set instruction.
+truncate cuts the file off at the given offset, so the next write starts there.
 */
-func (aof *AOF) handleSetInstruction(scanner *bufio.Scanner, inpCount int, keys map[string]map[int][]byte) (int, error) {
-	count := inpCount
+func (aof *AOF) truncate(offset int64) error {
+	err := aof.file.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("truncate (%s) error: %w", aof.file.Name(), err)
+	}
 
-	if !scanner.Scan() {
-		return count, fmt.Errorf("file (%s) has incomplete set instruction on line: %d", aof.file.Name(), count)
+	_, err = aof.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("truncate (%s) error: %w", aof.file.Name(), err)
 	}
 
-	key := scanner.Text()
+	return nil
+}
 
-	if !scanner.Scan() {
-		return count, fmt.Errorf("file (%s) has incomplete set instruction on line: %d", aof.file.Name(), count)
+/*
+addVersion adds a version to the history of a key, when history is retained.
+*/
+func (aof *AOF) addVersion(bucket string, key int, version Version) {
+	if !aof.retention.Enabled() {
+		return
 	}
 
-	line := scanner.Text()
+	AddVersion(aof.history, aof.retention, bucket, key, version)
+}
 
-	err := aof.setBucketAndKey(key, line, keys)
-	if err != nil {
-		return count, err
+/*
+History returns the history that was read from the file.
+It is empty when the persister was opened without a retention.
+*/
+func (aof *AOF) History() map[string]map[int][]Version {
+	return aof.history
+}
+
+/*
+Expires returns the moments the keys expire, that were read from the file or set after that.
+*/
+func (aof *AOF) Expires() map[string]map[int]time.Time {
+	aof.mu.RLock()
+	defer aof.mu.RUnlock()
+
+	expires := make(map[string]map[int]time.Time, len(aof.expires))
+	for bucket, keys := range aof.expires {
+		expires[bucket] = maps.Clone(keys)
 	}
 
-	count += 2
+	return expires
+}
 
-	return count, nil
+/*
+SetExpire keeps the moment a key expires, so Defrag writes it again.
+It should be called after an expire record was written, or after a set or del of a key that expired,
+the zero time removes the expiry.
+*/
+func (aof *AOF) SetExpire(bucket string, key int, expires time.Time) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.setExpire(bucket, key, expires)
 }
 
 /*
-handleDelInstruction handles the del instruction.
+setExpire keeps or removes the moment a key expires, the caller holds the lock.
 */
-func (aof *AOF) handleDelInstruction(scanner *bufio.Scanner, inpCount int, keys map[string]map[int][]byte) (int, error) {
-	count := inpCount
+func (aof *AOF) setExpire(bucket string, key int, expires time.Time) {
+	if expires.IsZero() {
+		delete(aof.expires[bucket], key)
+
+		if len(aof.expires[bucket]) == 0 {
+			delete(aof.expires, bucket)
+		}
 
-	if !scanner.Scan() {
-		return count, fmt.Errorf("file (%s) has incomplete del instruction on line: %d", aof.file.Name(), count)
+		return
 	}
 
-	key := scanner.Text()
+	if _, found := aof.expires[bucket]; !found {
+		aof.expires[bucket] = map[int]time.Time{}
+	}
+
+	aof.expires[bucket][key] = expires
+}
+
+/*
+Attrs returns the attributes of the keys, that were read from the file or set after that.
+*/
+func (aof *AOF) Attrs() map[string]map[int]map[string]string {
+	aof.mu.RLock()
+	defer aof.mu.RUnlock()
+
+	attrs := make(map[string]map[int]map[string]string, len(aof.attrs))
+	for bucket, keys := range aof.attrs {
+		attrs[bucket] = make(map[int]map[string]string, len(keys))
 
-	bucket, keyID, ok := aof.parseBucketAndKey(key)
-	if !ok {
-		return count, fmt.Errorf("file (%s) has wrong key format: '%s' on line: %d", aof.file.Name(), key, count)
+		for key, keyAttrs := range keys {
+			attrs[bucket][key] = maps.Clone(keyAttrs)
+		}
 	}
 
-	delete(keys[bucket], keyID)
+	return attrs
+}
 
-	count++
+/*
+SetAttrs keeps the attributes of a key, so Defrag writes them again.
+It should be called after an attrs record was written, or after a set or del of a key with attributes,
+empty attributes are removed.
+*/
+func (aof *AOF) SetAttrs(bucket string, key int, attrs map[string]string) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
 
-	return count, nil
+	aof.setAttrs(bucket, key, attrs)
 }
 
 /*
-setBucketAndKey sets a key-value pair in a bucket.
+setAttrs keeps or removes the attributes of a key, the caller holds the lock.
 */
-func (aof *AOF) setBucketAndKey(key, value string, keys map[string]map[int][]byte) error {
-	bucket, keyID, ok := aof.parseBucketAndKey(key)
-	if !ok {
-		return fmt.Errorf("file (%s) has wrong key format: %s", aof.file.Name(), key)
+func (aof *AOF) setAttrs(bucket string, key int, attrs map[string]string) {
+	if len(attrs) == 0 {
+		delete(aof.attrs[bucket], key)
+
+		if len(aof.attrs[bucket]) == 0 {
+			delete(aof.attrs, bucket)
+		}
+
+		return
 	}
 
-	if _, found := keys[bucket]; !found {
-		keys[bucket] = map[int][]byte{}
+	if _, found := aof.attrs[bucket]; !found {
+		aof.attrs[bucket] = map[int]map[string]string{}
 	}
 
-	keys[bucket][keyID] = []byte(value)
+	aof.attrs[bucket][key] = maps.Clone(attrs)
+}
 
-	return nil
+/*
+Meta returns the metadata that was read from the file, or written after that.
+*/
+func (aof *AOF) Meta() map[string][]byte {
+	aof.mu.RLock()
+	defer aof.mu.RUnlock()
+
+	return maps.Clone(aof.meta)
 }
 
 /*
-parseBucketAndKey parses a key in the format "bucket_keyid" and returns
-the bucket name, key id and true if the key is valid.
-Otherwise it returns empty string, 0 and false.
+WriteMeta writes a metadata record, an empty value removes the metadata.
+The value should be on one line.
 */
-func (*AOF) parseBucketAndKey(key string) (string, int, bool) {
-	uPos := strings.LastIndex(key, "_")
-	if uPos < 0 {
-		return "", 0, false
+func (aof *AOF) WriteMeta(name string, value []byte) error {
+	if strings.ContainsAny(name, "\n") || bytes.ContainsAny(value, "\n") {
+		return fmt.Errorf("writeMeta error: (%s) should be on one line", name)
 	}
 
-	bucket := key[:uPos]
-
-	keyID, err := strconv.Atoi(key[uPos+1:])
+	err := aof.Write(MetaInstruction(name, value, time.Now()))
 	if err != nil {
-		return "", 0, false
+		return err
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if len(value) == 0 {
+		delete(aof.meta, name)
+	} else {
+		aof.meta[name] = value
 	}
 
-	return bucket, keyID, true
+	return nil
 }
 
 /*
@@ -252,6 +444,140 @@ func (aof *AOF) Write(lines string) error {
 	return err
 }
 
+/*
+WriteCtx writes to the file like Write, but stops when the context ends.
+Nothing is written when the context has already ended.
+When it ends while waiting for the sync, the error wraps ErrNotSynced and
+the context error, the lines are written then and will be synced later.
+With a sync time the lines are synced later anyway, so the context is only
+checked before the write.
+*/
+func (aof *AOF) WriteCtx(ctx context.Context, lines string) error {
+	err := ctx.Err()
+	if err != nil {
+		return fmt.Errorf("write error: %#v %w", aof.file.Name(), err)
+	}
+
+	if aof.syncTime != 0 || ctx.Done() == nil {
+		return aof.Write(lines)
+	}
+
+	_, err = aof.file.WriteString(lines)
+	if err != nil {
+		return fmt.Errorf("write error: %#v %w", aof.file.Name(), err)
+	}
+
+	synced := make(chan error, 1)
+
+	go func() {
+		synced <- aof.file.Sync()
+	}()
+
+	select {
+	case err = <-synced:
+		if err != nil {
+			err = fmt.Errorf("write error: %#v %w", aof.file.Name(), err)
+		}
+
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("write error: %#v %w: %w", aof.file.Name(), ErrNotSynced, ctx.Err())
+	}
+}
+
+/*
+Append writes lines to the file like Write, but appends from concurrent callers are grouped,
+so a single write and sync serves all of them.
+*/
+func (aof *AOF) Append(lines string) error {
+	return aof.AppendCtx(context.Background(), lines)
+}
+
+/*
+AppendCtx appends lines like Append, but stops waiting when the context ends.
+When the context ends after the lines are queued, they will still be written,
+and the error wraps ErrNotSynced.
+*/
+func (aof *AOF) AppendCtx(ctx context.Context, lines string) error {
+	err := ctx.Err()
+	if err != nil {
+		return fmt.Errorf("append error: %#v %w", aof.file.Name(), err)
+	}
+
+	req := &appendRequest{lines: lines, done: make(chan error, 1)}
+
+	aof.queueMu.Lock()
+	aof.pending = append(aof.pending, req)
+	leader := !aof.writing
+	aof.writing = true
+	aof.queueMu.Unlock()
+
+	// the first caller in an idle queue writes the batch, the others wait for it
+	if leader && aof.writeBatch() {
+		go aof.drain()
+	}
+
+	select {
+	case err = <-req.done:
+		return err
+	default:
+	}
+
+	select {
+	case err = <-req.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("append error: %#v %w: %w", aof.file.Name(), ErrNotSynced, ctx.Err())
+	}
+}
+
+/*
+writeBatch writes all the pending lines at once, and reports the result to every caller.
+It returns true when new lines were queued in the meantime.
+*/
+func (aof *AOF) writeBatch() bool {
+	aof.queueMu.Lock()
+	batch := aof.pending
+	aof.pending = nil
+
+	if len(batch) == 0 {
+		aof.writing = false
+		aof.queueMu.Unlock()
+
+		return false
+	}
+
+	aof.queueMu.Unlock()
+
+	var lines strings.Builder
+	for _, req := range batch {
+		lines.WriteString(req.lines)
+	}
+
+	err := aof.Write(lines.String())
+	for _, req := range batch {
+		req.done <- err
+	}
+
+	aof.queueMu.Lock()
+	defer aof.queueMu.Unlock()
+
+	more := len(aof.pending) > 0
+	if !more {
+		aof.writing = false
+	}
+
+	return more
+}
+
+/*
+drain keeps writing batches until nothing is pending anymore.
+*/
+func (aof *AOF) drain() {
+	for aof.writeBatch() {
+	}
+}
+
 /*
 Flush starts a goroutine to sync the database.
 The routine will stop if the file is closed
@@ -280,7 +606,33 @@ func (aof *AOF) flush() {
 Defrag will only store the last key information, so all the history is lost
 This can mean a smaller filesize, which is quicker to read.
 */
-func (aof *AOF) Defrag(keys map[string]map[int][]byte) (err error) {
+func (aof *AOF) Defrag(keys map[string]map[int][]byte) error {
+	return aof.DefragHistory(keys, nil)
+}
+
+/*
+DefragHistory works like Defrag, but keeps the given history of the keys.
+Keys that have history are written as their versions in chronological order,
+all the other keys only get their last value.
+*/
+func (aof *AOF) DefragHistory(keys map[string]map[int][]byte, history map[string]map[int][]Version) error {
+	return aof.DefragCtx(context.Background(), keys, history)
+}
+
+/*
+DefragCtx works like DefragHistory, but stops when the context ends.
+The original file is restored from the backup then.
+*/
+func (aof *AOF) DefragCtx(
+	ctx context.Context,
+	keys map[string]map[int][]byte,
+	history map[string]map[int][]Version,
+) (err error) {
+	err = ctx.Err()
+	if err != nil {
+		return fmt.Errorf("defrag error: %w", err)
+	}
+
 	lock.Lock()
 	defer lock.Unlock()
 
@@ -295,14 +647,47 @@ func (aof *AOF) Defrag(keys map[string]map[int][]byte) (err error) {
 		return fmt.Errorf("defrag->makeBackup error: %w", err)
 	}
 
-	err = aof.writeFile(keys)
+	err = aof.writeFile(ctx, keys, history)
 	if err != nil {
+		restoreErr := aof.restoreBackup()
+		if restoreErr != nil {
+			return fmt.Errorf("defrag->writeFile error: %w; restore error: %w", err, restoreErr)
+		}
+
 		return fmt.Errorf("defrag->writeFile error: %w", err)
 	}
 
 	return nil
 }
 
+/*
+restoreBackup puts the backup back in place of a file that wasn't written completely,
+and opens it again to continue writing at the end.
+*/
+func (aof *AOF) restoreBackup() error {
+	path := aof.file.Name()
+
+	_ = aof.file.Close()
+
+	err := os.Rename(path+".bak", path)
+	if err != nil {
+		return fmt.Errorf("restoreBackup->rename error: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, fileMode) //nolint:gosec // path is clean
+	if err != nil {
+		return fmt.Errorf("restoreBackup->open (%s) error: %w", path, err)
+	}
+
+	aof.mu.Lock()
+	aof.file = file
+	aof.mu.Unlock()
+
+	go aof.flush()
+
+	return nil
+}
+
 /*
 Close stops the flush routine, flushes the last data to disk and closes the file.
 */
@@ -360,7 +745,14 @@ func (aof *AOF) makeBackup() (err error) {
 	return nil
 }
 
-func (aof *AOF) writeFile(keys map[string]map[int][]byte) error {
+/*
+writeFile replaces the file with the given keys and history.
+*/
+func (aof *AOF) writeFile(
+	ctx context.Context,
+	keys map[string]map[int][]byte,
+	history map[string]map[int][]Version,
+) error {
 	var err error
 
 	path := aof.file.Name()
@@ -379,12 +771,50 @@ func (aof *AOF) writeFile(keys map[string]map[int][]byte) error {
 	// write keys to file
 	go aof.flush()
 
+	now := time.Now()
+
 	for bucket := range keys {
-		startLine := "set\n" + bucket + "_"
 		for key := range keys[bucket] {
-			lines := startLine + strconv.Itoa(key) + "\n" + string(keys[bucket][key]) + "\n"
+			if _, found := history[bucket][key]; found {
+				continue
+			}
 
-			err = aof.Write(lines)
+			err = aof.WriteCtx(ctx, SetInstruction(bucket, key, keys[bucket][key], now))
+			if err != nil {
+				return fmt.Errorf("write error:%w", err)
+			}
+		}
+	}
+
+	err = aof.writeHistory(ctx, history)
+	if err != nil {
+		return err
+	}
+
+	err = aof.writeExpires(ctx, keys, now)
+	if err != nil {
+		return err
+	}
+
+	err = aof.writeAttrs(ctx, keys, now)
+	if err != nil {
+		return err
+	}
+
+	return aof.writeMeta(ctx, now)
+}
+
+/*
+writeExpires writes the moments the keys expire, of the keys that are written.
+*/
+func (aof *AOF) writeExpires(ctx context.Context, keys map[string]map[int][]byte, now time.Time) error {
+	for bucket, expires := range aof.Expires() {
+		for key, moment := range expires {
+			if _, found := keys[bucket][key]; !found {
+				continue
+			}
+
+			err := aof.WriteCtx(ctx, ExpireInstruction(bucket, key, moment, now))
 			if err != nil {
 				return fmt.Errorf("write error:%w", err)
 			}
@@ -393,3 +823,168 @@ func (aof *AOF) writeFile(keys map[string]map[int][]byte) error {
 
 	return nil
 }
+
+/*
+writeAttrs writes the attributes of the keys that are written.
+*/
+func (aof *AOF) writeAttrs(ctx context.Context, keys map[string]map[int][]byte, now time.Time) error {
+	for bucket, attrs := range aof.Attrs() {
+		for key, keyAttrs := range attrs {
+			if _, found := keys[bucket][key]; !found {
+				continue
+			}
+
+			err := aof.WriteCtx(ctx, AttrsInstruction(bucket, key, keyAttrs, now))
+			if err != nil {
+				return fmt.Errorf("write error:%w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+writeMeta writes all the metadata.
+*/
+func (aof *AOF) writeMeta(ctx context.Context, now time.Time) error {
+	for name, value := range aof.Meta() {
+		err := aof.WriteCtx(ctx, MetaInstruction(name, value, now))
+		if err != nil {
+			return fmt.Errorf("write error:%w", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+writeHistory writes all the versions of the keys in the history.
+*/
+func (aof *AOF) writeHistory(ctx context.Context, history map[string]map[int][]Version) error {
+	for bucket := range history {
+		for key, versions := range history[bucket] {
+			for _, version := range versions {
+				lines := SetInstruction(bucket, key, version.Value, version.Time)
+				if version.Deleted {
+					lines = DelInstruction(bucket, key, version.Time)
+				}
+
+				err := aof.WriteCtx(ctx, lines)
+				if err != nil {
+					return fmt.Errorf("write error:%w", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+SetInstruction returns the lines that store a value for a key in a bucket.
+A value with a line break is written in base64, with the encoding after the checksum,
+so any bytes are read back as they were.
+*/
+func SetInstruction(bucket string, key int, value []byte, stamp time.Time) string {
+	if bytes.ContainsAny(value, "\r\n") {
+		return encodedInstruction("set", stamp, base64Encoding, bucket+"_"+strconv.Itoa(key), base64.StdEncoding.EncodeToString(value))
+	}
+
+	return checkedInstruction("set", stamp, bucket+"_"+strconv.Itoa(key), string(value))
+}
+
+/*
+DelInstruction returns the lines that delete a key from a bucket.
+*/
+func DelInstruction(bucket string, key int, stamp time.Time) string {
+	return checkedInstruction("del", stamp, bucket+"_"+strconv.Itoa(key))
+}
+
+/*
+ExpireInstruction returns the lines that make a key expire at a moment, the zero time removes the expiry.
+*/
+func ExpireInstruction(bucket string, key int, expires time.Time, stamp time.Time) string {
+	nanos := "0"
+	if !expires.IsZero() {
+		nanos = strconv.FormatInt(expires.UnixNano(), 10)
+	}
+
+	return checkedInstruction("expire", stamp, bucket+"_"+strconv.Itoa(key), nanos)
+}
+
+/*
+AttrsInstruction returns the lines that store the attributes of a key, empty attributes remove them.
+*/
+func AttrsInstruction(bucket string, key int, attrs map[string]string, stamp time.Time) string {
+	values := make(url.Values, len(attrs))
+	for name, value := range attrs {
+		values.Set(name, value)
+	}
+
+	return checkedInstruction("attrs", stamp, bucket+"_"+strconv.Itoa(key), values.Encode())
+}
+
+/*
+BatchInstruction returns the lines of a batch, that holds set, del, expire and attrs instructions.
+When the file is read, the instructions of a batch are applied all at once, or not at all.
+*/
+func BatchInstruction(stamp time.Time, instructions ...string) string {
+	var lines strings.Builder
+
+	lines.WriteString(instruction("batch", stamp))
+
+	for _, inst := range instructions {
+		lines.WriteString(inst)
+	}
+
+	lines.WriteString("commit\n")
+
+	return lines.String()
+}
+
+/*
+MetaInstruction returns the lines that store metadata, an empty value removes it.
+*/
+func MetaInstruction(name string, value []byte, stamp time.Time) string {
+	return checkedInstruction("meta", stamp, name, string(value))
+}
+
+/*
+instruction returns the instruction line with its timestamp.
+A zero timestamp (from a file without timestamps) is left out.
+*/
+func instruction(name string, stamp time.Time) string {
+	if stamp.IsZero() {
+		return name + "\n"
+	}
+
+	return name + " " + strconv.FormatInt(stamp.UnixNano(), 10) + "\n"
+}
+
+/*
+checkedInstruction returns the instruction line with its timestamp and the checksum of the lines
+that follow it, and those lines.
+A zero timestamp (from a file without timestamps) is written as 0.
+*/
+func checkedInstruction(name string, stamp time.Time, lines ...string) string {
+	return encodedInstruction(name, stamp, "", lines...)
+}
+
+/*
+encodedInstruction works like checkedInstruction, and adds the encoding of the value to the instruction line.
+The checksum is the one of the lines as they are written.
+*/
+func encodedInstruction(name string, stamp time.Time, encoding string, lines ...string) string {
+	nanos := "0"
+	if !stamp.IsZero() {
+		nanos = strconv.FormatInt(stamp.UnixNano(), 10)
+	}
+
+	head := name + " " + nanos + " " + fmt.Sprintf("%08x", checksum(lines...))
+	if encoding != "" {
+		head += " " + encoding
+	}
+
+	return head + "\n" + strings.Join(lines, "\n") + "\n"
+}
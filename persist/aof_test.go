@@ -2,11 +2,13 @@ package persist_test
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/marcelloh/fastdb/persist"
 	"github.com/stretchr/testify/assert"
@@ -517,3 +519,398 @@ func checkFileLines(t *testing.T, filePath string, checkCount int) {
 	require.NoError(t, err)
 	assert.Equal(t, checkCount, count)
 }
+
+func Test_OpenPersister_withHistory(t *testing.T) {
+	path := "../data/fast_persister_history.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+	}()
+
+	aof, _, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	first := time.Now().Add(-2 * time.Hour)
+	second := time.Now().Add(-time.Minute)
+
+	err = aof.Write("set\ntext_1\nold format\n")
+	require.NoError(t, err)
+
+	err = aof.Write(persist.SetInstruction("text", 1, []byte("first"), first))
+	require.NoError(t, err)
+
+	err = aof.Write(persist.SetInstruction("text", 1, []byte("second"), second))
+	require.NoError(t, err)
+
+	err = aof.Write(persist.DelInstruction("text", 2, second))
+	require.NoError(t, err)
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, keys, err := persist.OpenPersister(path, 0, persist.WithRetention(persist.Retention{Window: time.Hour}))
+	require.NoError(t, err)
+
+	defer func() {
+		err = aof.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Equal(t, "second", string(keys["text"][1]))
+
+	history := aof.History()
+	require.Len(t, history["text"][1], 1)
+	assert.Equal(t, second.UnixNano(), history["text"][1][0].Time.UnixNano())
+	require.Len(t, history["text"][2], 1)
+	assert.True(t, history["text"][2][0].Deleted)
+}
+
+func Test_Retention_Prune(t *testing.T) {
+	now := time.Now()
+	versions := []persist.Version{
+		{Time: now.Add(-3 * time.Hour), Value: []byte("1")},
+		{Time: now.Add(-2 * time.Hour), Value: []byte("2")},
+		{Time: now.Add(-time.Minute), Value: []byte("3")},
+	}
+
+	assert.Len(t, persist.Retention{Versions: 2}.Prune(versions, now), 2)
+	assert.Len(t, persist.Retention{Window: time.Hour}.Prune(versions, now), 1)
+	assert.Len(t, persist.Retention{Window: time.Minute / 2}.Prune(versions, now), 1)
+
+	deleted := []persist.Version{{Time: now.Add(-2 * time.Hour), Deleted: true}}
+	assert.Empty(t, persist.Retention{Window: time.Hour}.Prune(deleted, now))
+	assert.Len(t, persist.Retention{Versions: 1}.Prune(deleted, now), 1)
+}
+
+func Test_OpenPersister_withMeta(t *testing.T) {
+	path := "../data/fast_persister_meta.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+	}()
+
+	aof, _, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	err = aof.WriteMeta("one", []byte("first"))
+	require.NoError(t, err)
+
+	err = aof.WriteMeta("two", []byte("second"))
+	require.NoError(t, err)
+
+	err = aof.WriteMeta("two", nil)
+	require.NoError(t, err)
+
+	err = aof.WriteMeta("three", []byte("multiple\nlines"))
+	require.Error(t, err)
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, _, err = persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = aof.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Equal(t, map[string][]byte{"one": []byte("first")}, aof.Meta())
+}
+
+func Test_OpenPersister_withExpires(t *testing.T) {
+	path := "../data/fast_persister_expires.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+
+		_ = os.Remove(filePath + ".bak")
+	}()
+
+	aof, _, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	now := time.Now()
+	later := now.Add(time.Hour).Round(0)
+
+	lines := []string{
+		persist.SetInstruction("text", 1, []byte("one"), now),
+		persist.ExpireInstruction("text", 1, later, now),
+		persist.SetInstruction("text", 2, []byte("two"), now),
+		persist.ExpireInstruction("text", 2, later, now),
+		persist.SetInstruction("text", 2, []byte("two again"), now), // removes the expiry
+		persist.SetInstruction("text", 3, []byte("three"), now),
+		persist.ExpireInstruction("text", 3, later, now),
+		persist.ExpireInstruction("text", 3, time.Time{}, now), // removes the expiry
+		persist.ExpireInstruction("text", 4, later, now),       // the key doesn't exist
+		persist.BatchInstruction(now,
+			persist.SetInstruction("text", 5, []byte("five"), now),
+			persist.ExpireInstruction("text", 5, later, now),
+		),
+	}
+
+	for _, line := range lines {
+		err = aof.Write(line)
+		require.NoError(t, err)
+	}
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, keys, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	want := map[string]map[int]time.Time{"text": {1: later, 5: later}}
+	assert.Equal(t, want, aof.Expires())
+
+	// a defrag keeps the expiry of the keys it writes
+	delete(keys["text"], 5)
+	aof.SetExpire("text", 1, later.Add(time.Hour))
+
+	err = aof.Defrag(keys)
+	require.NoError(t, err)
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, _, err = persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = aof.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Equal(t, map[string]map[int]time.Time{"text": {1: later.Add(time.Hour)}}, aof.Expires())
+}
+
+func Test_OpenPersister_withAttrs(t *testing.T) {
+	path := "../data/fast_persister_attrs.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+
+		_ = os.Remove(filePath + ".bak")
+	}()
+
+	aof, _, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	now := time.Now()
+	attrs := map[string]string{"flags": "12", "type": "text/plain; charset=utf-8"}
+
+	lines := []string{
+		persist.SetInstruction("text", 1, []byte("one"), now),
+		persist.AttrsInstruction("text", 1, attrs, now),
+		persist.SetInstruction("text", 2, []byte("two"), now),
+		persist.AttrsInstruction("text", 2, attrs, now),
+		persist.SetInstruction("text", 2, []byte("two again"), now), // removes the attributes
+		persist.SetInstruction("text", 3, []byte("three"), now),
+		persist.AttrsInstruction("text", 3, attrs, now),
+		persist.AttrsInstruction("text", 3, nil, now),   // removes the attributes
+		persist.AttrsInstruction("text", 4, attrs, now), // the key doesn't exist
+		persist.BatchInstruction(now,
+			persist.SetInstruction("text", 5, []byte("five"), now),
+			persist.AttrsInstruction("text", 5, map[string]string{"flags": "5"}, now),
+		),
+	}
+
+	for _, line := range lines {
+		err = aof.Write(line)
+		require.NoError(t, err)
+	}
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, keys, err := persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	want := map[string]map[int]map[string]string{"text": {1: attrs, 5: {"flags": "5"}}}
+	assert.Equal(t, want, aof.Attrs())
+
+	// a defrag keeps the attributes of the keys it writes
+	delete(keys["text"], 5)
+	aof.SetAttrs("text", 1, map[string]string{"flags": "1"})
+
+	err = aof.Defrag(keys)
+	require.NoError(t, err)
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	aof, _, err = persist.OpenPersister(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = aof.Close()
+		require.NoError(t, err)
+	}()
+
+	assert.Equal(t, map[string]map[int]map[string]string{"text": {1: {"flags": "1"}}}, aof.Attrs())
+}
+
+// countdownContext ends after its Err is called a number of times.
+type countdownContext struct {
+	context.Context
+	calls int
+}
+
+func (ctx *countdownContext) Err() error {
+	ctx.calls--
+	if ctx.calls < 0 {
+		return context.Canceled
+	}
+
+	return nil
+}
+
+func Test_DefragCtx_restoresBackup(t *testing.T) {
+	path := "../data/fastdb_defrag_restore.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+	}()
+
+	aof, keys, err := persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+
+	keys["text"] = map[int][]byte{}
+
+	for i := range 10 {
+		err = aof.Write(persist.SetInstruction("text", i, []byte("a value"), time.Now()))
+		require.NoError(t, err)
+
+		keys["text"][i] = []byte("a value")
+	}
+
+	// the context ends after 3 of the 10 keys are written in the new file
+	ctx := &countdownContext{Context: context.Background(), calls: 4}
+
+	err = aof.DefragCtx(ctx, keys, nil)
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = aof.Write(persist.SetInstruction("text", 10, []byte("a value"), time.Now()))
+	require.NoError(t, err)
+
+	err = aof.Close()
+	require.NoError(t, err)
+
+	checkFileLines(t, filePath, 33)
+	assert.NoFileExists(t, filePath+".bak")
+}
+
+func Test_WriteCtx(t *testing.T) {
+	path := "../data/fast_persister_write_ctx.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+	}()
+
+	aof, _, err := persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+
+	defer func() {
+		err = aof.Close()
+		require.NoError(t, err)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err = aof.WriteCtx(ctx, "set\ntext_1\na value\n")
+	require.NoError(t, err)
+
+	cancel()
+
+	err = aof.WriteCtx(ctx, "set\ntext_2\na value\n")
+	require.ErrorIs(t, err, context.Canceled)
+
+	checkFileLines(t, filePath, 3)
+}
+
+func Test_Append_concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "append.db")
+
+	aof, keys, err := persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	var wg sync.WaitGroup
+
+	for worker := range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range 50 {
+				err := aof.Append(persist.SetInstruction(fmt.Sprintf("bucket%d", worker), key, []byte("value"), time.Time{}))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	require.NoError(t, aof.Close())
+
+	aof, keys, err = persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, aof.Close())
+	}()
+
+	require.Len(t, keys, 10)
+
+	for _, bucket := range keys {
+		assert.Len(t, bucket, 50)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = aof.AppendCtx(ctx, persist.SetInstruction("bucket", 1, []byte("value"), time.Time{}))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_OpenPersister_withBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.db")
+
+	aof, _, err := persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+
+	stamp := time.Now()
+	err = aof.Write(persist.BatchInstruction(stamp,
+		persist.SetInstruction("texts", 1, []byte("one"), stamp),
+		persist.SetInstruction("texts", 2, []byte("two"), stamp),
+		persist.DelInstruction("texts", 1, stamp),
+	))
+	require.NoError(t, err)
+	require.NoError(t, aof.Close())
+
+	aof, keys, err := persist.OpenPersister(path, 0)
+	require.NoError(t, err)
+	require.NoError(t, aof.Close())
+
+	assert.Equal(t, map[int][]byte{2: []byte("two")}, keys["texts"])
+
+	// a meta record isn't allowed inside a batch
+	err = os.WriteFile(path, []byte("batch\nmeta\nname\nvalue\ncommit\n"), 0o600)
+	require.NoError(t, err)
+
+	_, _, err = persist.OpenPersister(path, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package persist
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"time"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Version is one historical state of a key.
+type Version struct {
+	Time    time.Time
+	Value   []byte
+	Deleted bool
+}
+
+/*
+Retention describes which versions of a key are kept.
+Versions keeps at most that many versions per key,
+Window keeps the versions that are younger than that duration.
+When both are set, a version has to satisfy both.
+The newest version of a key is always kept, unless it is a deletion
+that fell out of the window.
+*/
+type Retention struct {
+	Versions int
+	Window   time.Duration
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+WithRetention makes the persister keep the history of the keys while reading the file.
+*/
+func WithRetention(retention Retention) Option {
+	return func(aof *AOF) {
+		aof.retention = retention
+	}
+}
+
+/*
+Enabled returns true if the retention keeps any history.
+*/
+func (r Retention) Enabled() bool {
+	return r.Versions > 0 || r.Window > 0
+}
+
+/*
+Prune removes the versions that fall outside the retention.
+The versions should be in chronological order.
+*/
+func (r Retention) Prune(versions []Version, now time.Time) []Version {
+	start := 0
+
+	if r.Versions > 0 && len(versions) > r.Versions {
+		start = len(versions) - r.Versions
+	}
+
+	if r.Window > 0 {
+		limit := now.Add(-r.Window)
+		for start < len(versions)-1 && versions[start].Time.Before(limit) {
+			start++
+		}
+
+		last := versions[len(versions)-1]
+		if last.Deleted && last.Time.Before(limit) {
+			return nil
+		}
+	}
+
+	if start == 0 {
+		return versions
+	}
+
+	return append(versions[:0:0], versions[start:]...)
+}
+
+/*
+AddVersion adds a version to the history of a key and prunes it with the retention.
+*/
+func AddVersion(history map[string]map[int][]Version, retention Retention, bucket string, key int, version Version) {
+	if _, found := history[bucket]; !found {
+		history[bucket] = map[int][]Version{}
+	}
+
+	versions := retention.Prune(append(history[bucket][key], version), time.Now())
+	if len(versions) == 0 {
+		delete(history[bucket], key)
+
+		return
+	}
+
+	history[bucket][key] = versions
+}
+
+/*
+PruneHistory prunes the versions of all the keys in the history with the retention.
+*/
+func PruneHistory(history map[string]map[int][]Version, retention Retention, now time.Time) {
+	for bucket := range history {
+		for key, versions := range history[bucket] {
+			versions = retention.Prune(versions, now)
+			if len(versions) == 0 {
+				delete(history[bucket], key)
+
+				continue
+			}
+
+			history[bucket][key] = versions
+		}
+
+		if len(history[bucket]) == 0 {
+			delete(history, bucket)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package persist
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Record is one instruction of a data file, with the lines that belong to it.
+type Record struct {
+	Stamp   time.Time
+	Expires time.Time         // expire, the zero time removes the expiry
+	Attrs   map[string]string // attrs, empty removes the attributes
+	Name    string            // set, del, expire, attrs, meta, batch or commit
+	Bucket  string            // set, del, expire and attrs
+	Meta    string            // the name of the metadata
+	Value   []byte            // set and meta
+	Key     int               // set, del, expire and attrs
+	Line    int               // the line the record starts on
+	Offset  int64             // the position the record starts at
+	End     int64             // the position after the record
+	Checked bool              // the record has a checksum, that matched
+}
+
+// CorruptError tells where, and why, a data file can't be read anymore.
+type CorruptError struct {
+	Reason     string
+	Line       int
+	Offset     int64
+	Incomplete bool // the file ends inside the record
+}
+
+// Scanner reads the records of a data file one by one.
+type Scanner struct {
+	err     error
+	scanner *bufio.Scanner
+	record  Record
+	line    int
+	offset  int64
+	start   int64
+}
+
+// header is the first line of a record.
+type header struct {
+	stamp   time.Time
+	name    string
+	crc     uint32
+	checked bool
+	encoded bool // the value of a set is in base64
+}
+
+// base64Encoding is the encoding of a set value with a line break, after the checksum.
+const base64Encoding = "b64"
+
+// bodyLines is the number of lines that follow the header of a record.
+var bodyLines = map[string]int{"set": 2, "del": 1, "expire": 2, "attrs": 2, "meta": 2, "batch": 0, "commit": 0}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+Error returns the reason and the line.
+*/
+func (ce *CorruptError) Error() string {
+	return fmt.Sprintf("%s on line: %d", ce.Reason, ce.Line)
+}
+
+/*
+NewScanner returns a scanner that reads the records from r.
+*/
+func NewScanner(r io.Reader) *Scanner {
+	sc := &Scanner{}
+	sc.scanner = bufio.NewScanner(r)
+	sc.scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024) // Increase buffer size
+	sc.scanner.Split(sc.scanLines)
+
+	return sc
+}
+
+/*
+Scan reads the next record, it returns false at the end of the file or on an error.
+*/
+func (sc *Scanner) Scan() bool {
+	if sc.err != nil || !sc.scanner.Scan() {
+		return false
+	}
+
+	sc.line++
+	text := sc.scanner.Text()
+	rec := Record{Line: sc.line, Offset: sc.start}
+
+	head, ok := parseInstruction(text)
+
+	count, known := bodyLines[head.name]
+	if !ok || !known {
+		return sc.fail(fmt.Sprintf("wrong instruction format '%s'", text), rec)
+	}
+
+	rec.Name = head.name
+	rec.Stamp = head.stamp
+
+	body := make([]string, 0, count)
+
+	for range count {
+		if !sc.scanner.Scan() {
+			sc.err = &CorruptError{
+				Reason:     fmt.Sprintf("incomplete %s instruction", head.name),
+				Line:       rec.Line,
+				Offset:     rec.Offset,
+				Incomplete: sc.scanner.Err() == nil,
+			}
+
+			return false
+		}
+
+		sc.line++
+		body = append(body, sc.scanner.Text())
+	}
+
+	if head.checked {
+		if checksum(body...) != head.crc {
+			return sc.fail(fmt.Sprintf("checksum mismatch in %s instruction", head.name), rec)
+		}
+
+		rec.Checked = true
+	}
+
+	switch head.name {
+	case "set", "del", "expire", "attrs":
+		bucket, key, found := parseBucketAndKey(body[0])
+		if !found {
+			return sc.fail(fmt.Sprintf("wrong key format: '%s'", body[0]), rec)
+		}
+
+		rec.Bucket, rec.Key = bucket, key
+
+		switch head.name {
+		case "set":
+			rec.Value = []byte(body[1])
+
+			if head.encoded {
+				value, err := base64.StdEncoding.DecodeString(body[1])
+				if err != nil {
+					return sc.fail(fmt.Sprintf("wrong value encoding: '%s'", body[1]), rec)
+				}
+
+				rec.Value = value
+			}
+		case "expire":
+			expires, err := parseExpires(body[1])
+			if err != nil {
+				return sc.fail(fmt.Sprintf("wrong expiry format: '%s'", body[1]), rec)
+			}
+
+			rec.Expires = expires
+		case "attrs":
+			attrs, err := parseAttrs(body[1])
+			if err != nil {
+				return sc.fail(fmt.Sprintf("wrong attributes format: '%s'", body[1]), rec)
+			}
+
+			rec.Attrs = attrs
+		}
+	case "meta":
+		rec.Meta, rec.Value = body[0], []byte(body[1])
+	}
+
+	rec.End = sc.offset
+	sc.record = rec
+
+	return true
+}
+
+/*
+Record returns the record that was read by the last Scan.
+*/
+func (sc *Scanner) Record() Record {
+	return sc.record
+}
+
+/*
+Err returns the error that stopped the scan, a *CorruptError when the data is wrong.
+*/
+func (sc *Scanner) Err() error {
+	if sc.err != nil {
+		return sc.err
+	}
+
+	return sc.scanner.Err()
+}
+
+/*
+fail stops the scan with a CorruptError for the record.
+*/
+func (sc *Scanner) fail(reason string, rec Record) bool {
+	sc.err = &CorruptError{Reason: reason, Line: rec.Line, Offset: rec.Offset}
+
+	return false
+}
+
+/*
+scanLines splits like bufio.ScanLines, and keeps track of where the last line started.
+*/
+func (sc *Scanner) scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if token != nil {
+		sc.start = sc.offset
+	}
+
+	sc.offset += int64(advance)
+
+	return advance, token, err
+}
+
+/*
+parseInstruction splits an instruction line into its name, timestamp, checksum and the encoding of the value.
+Lines written before timestamps were introduced only hold the name,
+those (and a timestamp of 0) get the zero time.
+Lines written before checksums were introduced aren't checked.
+Only a set can have an encoding, it is b64.
+*/
+func parseInstruction(instruction string) (header, bool) {
+	var head header
+
+	fields := strings.Split(instruction, " ")
+	if len(fields) > 4 {
+		return head, false
+	}
+
+	if len(fields) == 4 {
+		if fields[0] != "set" || fields[3] != base64Encoding {
+			return head, false
+		}
+
+		head.encoded = true
+	}
+
+	head.name = fields[0]
+
+	if len(fields) > 1 && fields[1] != "0" {
+		nanos, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return head, false
+		}
+
+		head.stamp = time.Unix(0, nanos)
+	}
+
+	if len(fields) > 2 {
+		crc, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return head, false
+		}
+
+		head.crc = uint32(crc)
+		head.checked = true
+	}
+
+	return head, true
+}
+
+/*
+parseAttrs parses the attributes of a key, they are written like a URL query.
+*/
+func parseAttrs(text string) (map[string]string, error) {
+	values, err := url.ParseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string, len(values))
+	for name, value := range values {
+		attrs[name] = value[0]
+	}
+
+	return attrs, nil
+}
+
+/*
+parseExpires parses the moment a key expires in nanoseconds, 0 is the zero time.
+*/
+func parseExpires(text string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || nanos == 0 {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos), nil
+}
+
+/*
+checksum returns the checksum of the lines of a record, after its header.
+*/
+func checksum(lines ...string) uint32 {
+	crc := crc32.NewIEEE()
+
+	for _, line := range lines {
+		_, _ = crc.Write([]byte(line))
+		_, _ = crc.Write([]byte("\n"))
+	}
+
+	return crc.Sum32()
+}
+
+/*
+parseBucketAndKey parses a key in the format "bucket_keyid" and returns
+the bucket name, key id and true if the key is valid.
+Otherwise it returns empty string, 0 and false.
+*/
+func parseBucketAndKey(key string) (string, int, bool) {
+	uPos := strings.LastIndex(key, "_")
+	if uPos < 0 {
+		return "", 0, false
+	}
+
+	bucket := key[:uPos]
+
+	keyID, err := strconv.Atoi(key[uPos+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return bucket, keyID, true
+}
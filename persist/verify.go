@@ -0,0 +1,148 @@
+package persist
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Report is what Verify found in a data file.
+type Report struct {
+	Problem   error          // a *CorruptError, or nil when the whole file can be read
+	Records   map[string]int // the number of records by instruction
+	Size      int64          // the size of the file
+	Valid     int64          // the size of the part of the file that can be read
+	Unchecked int            // the number of records without a checksum
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+Load reads the keys and the metadata from a data file, without changing it.
+A batch that isn't committed at the end of the file is left out.
+*/
+func Load(path string) (map[string]map[int][]byte, map[string][]byte, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, nil, fmt.Errorf("load (%s) error: %w", path, err)
+	}
+
+	defer file.Close()
+
+	aof := newAOF(0)
+
+	keys, _, err := aof.replay(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load error: %w", err)
+	}
+
+	return keys, aof.meta, nil
+}
+
+/*
+Verify reads all the records of a data file, and checks their format, checksums and batches.
+The error is only about reading the file, what is wrong with its contents is in the report.
+*/
+func Verify(path string) (*Report, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("verify (%s) error: %w", path, err)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("verify (%s) error: %w", path, err)
+	}
+
+	report := &Report{Records: map[string]int{}, Size: info.Size()}
+
+	var batch *Record
+
+	scanner := NewScanner(file)
+
+	for scanner.Scan() {
+		rec := scanner.Record()
+
+		if !allowed(rec.Name, batch != nil) {
+			report.Problem = &CorruptError{Reason: fmt.Sprintf("wrong instruction in batch '%s'", rec.Name), Line: rec.Line, Offset: rec.Offset}
+
+			break
+		}
+
+		report.Records[rec.Name]++
+
+		if !rec.Checked && rec.Name != "batch" && rec.Name != "commit" {
+			report.Unchecked++
+		}
+
+		switch rec.Name {
+		case "batch":
+			batch = &rec
+		case "commit":
+			batch = nil
+			report.Valid = rec.End
+		default:
+			if batch == nil {
+				report.Valid = rec.End
+			}
+		}
+	}
+
+	if report.Problem == nil {
+		report.Problem = scanner.Err()
+	}
+
+	var corrupt *CorruptError
+	if report.Problem != nil && !errors.As(report.Problem, &corrupt) {
+		return nil, fmt.Errorf("verify (%s) error: %w", path, report.Problem)
+	}
+
+	if report.Problem == nil && batch != nil {
+		report.Problem = &CorruptError{Reason: "batch without commit", Line: batch.Line, Offset: batch.Offset, Incomplete: true}
+	}
+
+	return report, nil
+}
+
+/*
+allowed checks if an instruction can be used inside a batch, or outside of it.
+*/
+func allowed(name string, inBatch bool) bool {
+	switch name {
+	case "set", "del", "expire", "attrs":
+		return true
+	case "commit":
+		return inBatch
+	default:
+		return !inBatch
+	}
+}
+
+/*
+Repair cuts off the part of a data file that can't be read, starting at the first corrupt record
+(or the batch that holds it). It returns the report of the file before the repair.
+*/
+func Repair(path string) (*Report, error) {
+	report, err := Verify(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Problem == nil {
+		return report, nil
+	}
+
+	err = os.Truncate(filepath.Clean(path), report.Valid)
+	if err != nil {
+		return nil, fmt.Errorf("repair (%s) error: %w", path, err)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,141 @@
+package persist_test
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Scanner(t *testing.T) {
+	stamp := time.Unix(0, 1234)
+	input := "set\nold_1\nvalue\n" +
+		persist.SetInstruction("texts", 1, []byte("one"), stamp) +
+		persist.DelInstruction("texts", 1, time.Time{}) +
+		persist.MetaInstruction("name", []byte("value"), stamp)
+
+	scanner := persist.NewScanner(strings.NewReader(input))
+
+	var records []persist.Record
+	for scanner.Scan() {
+		records = append(records, scanner.Record())
+	}
+
+	require.NoError(t, scanner.Err())
+	require.Len(t, records, 4)
+
+	assert.Equal(t, "old", records[0].Bucket)
+	assert.False(t, records[0].Checked)
+	assert.Equal(t, int64(0), records[0].Offset)
+
+	assert.Equal(t, "set", records[1].Name)
+	assert.Equal(t, []byte("one"), records[1].Value)
+	assert.Equal(t, stamp, records[1].Stamp)
+	assert.True(t, records[1].Checked)
+	assert.Equal(t, 4, records[1].Line)
+	assert.Equal(t, records[0].End, records[1].Offset)
+
+	assert.Equal(t, "del", records[2].Name)
+	assert.True(t, records[2].Stamp.IsZero())
+
+	assert.Equal(t, "name", records[3].Meta)
+	assert.Equal(t, int64(len(input)), records[3].End)
+
+	// a changed value doesn't match the checksum anymore
+	scanner = persist.NewScanner(strings.NewReader(strings.Replace(input, "one", "two", 1)))
+	for scanner.Scan() {
+	}
+
+	var corrupt *persist.CorruptError
+
+	require.ErrorAs(t, scanner.Err(), &corrupt)
+	assert.Equal(t, 4, corrupt.Line)
+	assert.Contains(t, corrupt.Reason, "checksum mismatch")
+}
+
+func Test_Scanner_encodedValue(t *testing.T) {
+	value := []byte("two\nlines\x00\r")
+	input := persist.SetInstruction("blobs", 1, value, time.Unix(0, 1234)) +
+		persist.SetInstruction("blobs", 2, []byte("\x00 one line"), time.Unix(0, 1234))
+
+	// only the value with line breaks is encoded, on one line
+	lines := strings.Split(input, "\n")
+	require.Len(t, lines, 7)
+	assert.True(t, strings.HasSuffix(lines[0], " b64"))
+	assert.False(t, strings.HasSuffix(lines[3], " b64"))
+
+	scanner := persist.NewScanner(strings.NewReader(input))
+	require.True(t, scanner.Scan())
+	assert.Equal(t, value, scanner.Record().Value)
+	assert.True(t, scanner.Record().Checked)
+
+	require.True(t, scanner.Scan())
+	assert.Equal(t, []byte("\x00 one line"), scanner.Record().Value)
+	require.NoError(t, scanner.Err())
+
+	// the encoding is only known for a set, and the value has to be base64
+	for _, wrong := range []string{"del 1234 00000000 b64\nblobs_1\n", "set 1234 00000000 hex\nblobs_1\nvalue\n"} {
+		scanner = persist.NewScanner(strings.NewReader(wrong))
+		assert.False(t, scanner.Scan())
+		assert.Contains(t, scanner.Err().Error(), "wrong instruction format")
+	}
+
+	notBase64 := fmt.Sprintf("set 0 %08x b64\nblobs_1\n!!!\n", crc32.ChecksumIEEE([]byte("blobs_1\n!!!\n")))
+	scanner = persist.NewScanner(strings.NewReader(notBase64))
+	assert.False(t, scanner.Scan())
+	assert.Contains(t, scanner.Err().Error(), "wrong value encoding")
+}
+
+func Test_Verify_Repair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verify.db")
+	stamp := time.Now()
+	good := persist.SetInstruction("texts", 1, []byte("one"), stamp) +
+		persist.BatchInstruction(stamp, persist.SetInstruction("texts", 2, []byte("two"), stamp))
+
+	err := os.WriteFile(path, []byte(good+"set\ntexts_3\nthree\n"), 0o600)
+	require.NoError(t, err)
+
+	report, err := persist.Verify(path)
+	require.NoError(t, err)
+	require.NoError(t, report.Problem)
+	assert.Equal(t, map[string]int{"set": 3, "batch": 1, "commit": 1}, report.Records)
+	assert.Equal(t, 1, report.Unchecked)
+	assert.Equal(t, report.Size, report.Valid)
+
+	// a batch that isn't finished
+	broken := good + "batch 1\n" + persist.SetInstruction("texts", 4, []byte("four"), stamp) + "del 1 0"
+
+	err = os.WriteFile(path, []byte(broken), 0o600)
+	require.NoError(t, err)
+
+	report, err = persist.Verify(path)
+	require.NoError(t, err)
+	require.Error(t, report.Problem)
+	assert.Equal(t, int64(len(good)), report.Valid)
+
+	keys, _, err := persist.Load(path)
+	require.NoError(t, err)
+	assert.Len(t, keys["texts"], 2)
+
+	report, err = persist.Repair(path)
+	require.NoError(t, err)
+	require.Error(t, report.Problem)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, good, string(data))
+
+	report, err = persist.Verify(path)
+	require.NoError(t, err)
+	require.NoError(t, report.Problem)
+
+	_, err = persist.Verify(filepath.Join(t.TempDir(), "missing.db"))
+	require.Error(t, err)
+}
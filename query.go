@@ -0,0 +1,376 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// Op is a comparison operator of a query condition.
+type Op int
+
+// The comparison operators of a query condition.
+const (
+	Eq Op = iota
+	Ne
+	Gt
+	Gte
+	Lt
+	Lte
+)
+
+/*
+Query selects values from a bucket by the JSON paths in them.
+It is built with DB.Query and executed with Run.
+*/
+type Query struct {
+	db      *DB
+	bucket  string
+	conds   []condition
+	orderBy string
+	fields  []string
+	limit   int
+	desc    bool
+}
+
+// QueryResult is one value that matched a query.
+type QueryResult struct {
+	Data []byte
+	Key  int
+}
+
+// condition is one Where clause of a query.
+type condition struct {
+	value any
+	path  string
+	op    Op
+}
+
+// plan describes how a query will be executed.
+type plan struct {
+	index   string
+	filters []condition
+}
+
+var opNames = map[Op]string{Eq: "=", Ne: "!=", Gt: ">", Gte: ">=", Lt: "<", Lte: "<="}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+Query starts a query on the JSON values of a bucket.
+*/
+func (fdb *DB) Query(bucket string) *Query {
+	return &Query{db: fdb, bucket: bucket}
+}
+
+/*
+Where adds a condition on a JSON path, all the conditions have to match.
+The value can be a string, a number, a bool or nil.
+*/
+func (q *Query) Where(path string, op Op, value any) *Query {
+	q.conds = append(q.conds, condition{path: path, op: op, value: value})
+
+	return q
+}
+
+/*
+OrderBy sorts the results ascending by a JSON path.
+Without it, the results are sorted by key.
+*/
+func (q *Query) OrderBy(path string) *Query {
+	q.orderBy = path
+	q.desc = false
+
+	return q
+}
+
+/*
+OrderByDesc sorts the results descending by a JSON path.
+*/
+func (q *Query) OrderByDesc(path string) *Query {
+	q.orderBy = path
+	q.desc = true
+
+	return q
+}
+
+/*
+Limit sets the maximum number of results, 0 means no limit.
+*/
+func (q *Query) Limit(limit int) *Query {
+	q.limit = limit
+
+	return q
+}
+
+/*
+Select sets the JSON paths that are returned.
+The results will be JSON objects with the paths as their keys.
+Without it, the whole values are returned.
+*/
+func (q *Query) Select(paths ...string) *Query {
+	q.fields = paths
+
+	return q
+}
+
+/*
+Explain returns a description of how the query will be executed.
+*/
+func (q *Query) Explain() string {
+	sh := q.db.shardFor(q.bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	p := q.plan(sh)
+
+	var parts []string
+
+	if p.index != "" {
+		parts = append(parts, "index lookup on "+p.index)
+	} else {
+		parts = append(parts, "scan bucket "+q.bucket)
+	}
+
+	for _, cond := range p.filters {
+		parts = append(parts, fmt.Sprintf("filter %s %s %v", cond.path, opNames[cond.op], cond.value))
+	}
+
+	switch {
+	case q.orderBy == "":
+		parts = append(parts, "order by key")
+	case q.desc:
+		parts = append(parts, "order by "+q.orderBy+" desc")
+	default:
+		parts = append(parts, "order by "+q.orderBy)
+	}
+
+	if q.limit > 0 {
+		parts = append(parts, fmt.Sprintf("limit %d", q.limit))
+	}
+
+	if len(q.fields) > 0 {
+		parts = append(parts, "select "+strings.Join(q.fields, ", "))
+	}
+
+	return strings.Join(parts, " -> ")
+}
+
+/*
+Run executes the query and returns the matching values.
+*/
+func (q *Query) Run() ([]*QueryResult, error) {
+	for _, cond := range q.conds {
+		if _, ok := opNames[cond.op]; !ok {
+			return nil, fmt.Errorf("query->unknown operator %d on %s", cond.op, cond.path)
+		}
+	}
+
+	sh := q.db.shardFor(q.bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	p := q.plan(sh)
+	bucket := sh.live(q.bucket, time.Now())
+
+	var candidates []int
+
+	if p.index != "" {
+		entry := indexKey(resultOf(q.indexValue(p.index)))
+		candidates = slices.Collect(maps.Keys(sh.indexes[q.bucket][p.index].entries[entry]))
+	} else {
+		candidates = slices.Collect(maps.Keys(bucket))
+	}
+
+	results := make([]*QueryResult, 0, len(candidates))
+
+	for _, key := range candidates {
+		if value, found := bucket[key]; found && matches(value, p.filters) {
+			results = append(results, &QueryResult{Key: key, Data: value})
+		}
+	}
+
+	q.sort(results)
+
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[:q.limit]
+	}
+
+	if len(q.fields) > 0 {
+		for _, result := range results {
+			result.Data = project(result.Data, q.fields)
+		}
+	}
+
+	return results, nil
+}
+
+/*
+plan picks the index to use (the first Eq condition on an indexed path)
+and the conditions that are left to filter on.
+The caller should hold the lock of the shard.
+*/
+func (q *Query) plan(sh *shard) plan {
+	var p plan
+
+	for _, cond := range q.conds {
+		_, indexed := sh.indexes[q.bucket][cond.path]
+		if p.index == "" && cond.op == Eq && indexed {
+			p.index = cond.path
+
+			continue
+		}
+
+		p.filters = append(p.filters, cond)
+	}
+
+	return p
+}
+
+/*
+indexValue returns the value of the first Eq condition on a path.
+*/
+func (q *Query) indexValue(path string) any {
+	for _, cond := range q.conds {
+		if cond.path == path && cond.op == Eq {
+			return cond.value
+		}
+	}
+
+	return nil
+}
+
+/*
+sort sorts the results by the order path, and by key after that.
+*/
+func (q *Query) sort(results []*QueryResult) {
+	slices.SortFunc(results, func(a, b *QueryResult) int {
+		if q.orderBy != "" {
+			order := compareResults(gjson.GetBytes(a.Data, q.orderBy), gjson.GetBytes(b.Data, q.orderBy))
+			if q.desc {
+				order = -order
+			}
+
+			if order != 0 {
+				return order
+			}
+		}
+
+		return cmp.Compare(a.Key, b.Key)
+	})
+}
+
+/*
+matches returns true if a value matches all the conditions.
+*/
+func matches(data []byte, conds []condition) bool {
+	for _, cond := range conds {
+		res := gjson.GetBytes(data, cond.path)
+		if !res.Exists() {
+			return false
+		}
+
+		order := compareResults(res, resultOf(cond.value))
+
+		var ok bool
+
+		switch cond.op {
+		case Eq:
+			ok = order == 0
+		case Ne:
+			ok = order != 0
+		case Gt:
+			ok = order > 0
+		case Gte:
+			ok = order >= 0
+		case Lt:
+			ok = order < 0
+		case Lte:
+			ok = order <= 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+resultOf converts a Go value into the JSON result it would be compared with.
+*/
+func resultOf(value any) gjson.Result {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return gjson.Result{}
+	}
+
+	return gjson.ParseBytes(data)
+}
+
+/*
+compareResults compares two JSON values.
+Values of a different type are ordered by their type (null, false, number, string, true, JSON).
+*/
+func compareResults(a, b gjson.Result) int {
+	if a.Type != b.Type {
+		return cmp.Compare(a.Type, b.Type)
+	}
+
+	switch a.Type {
+	case gjson.Number:
+		return cmp.Compare(a.Num, b.Num)
+	case gjson.String:
+		return cmp.Compare(a.Str, b.Str)
+	case gjson.JSON:
+		return cmp.Compare(a.Raw, b.Raw)
+	default:
+		return 0
+	}
+}
+
+/*
+project returns a JSON object with only the given paths of a value.
+*/
+func project(data []byte, paths []string) []byte {
+	var out strings.Builder
+
+	out.WriteByte('{')
+
+	count := 0
+
+	for _, path := range paths {
+		res := gjson.GetBytes(data, path)
+		if !res.Exists() {
+			continue
+		}
+
+		if count > 0 {
+			out.WriteByte(',')
+		}
+
+		name, _ := json.Marshal(path) //nolint:errchkjson // a string always marshals
+		out.Write(name)
+		out.WriteByte(':')
+		out.WriteString(res.Raw)
+
+		count++
+	}
+
+	out.WriteByte('}')
+
+	return []byte(out.String())
+}
@@ -0,0 +1,117 @@
+package fastdb_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type queryUser struct {
+	UUID  string
+	Email string
+	ID    int
+	Age   int
+}
+
+func fillQueryUsers(t *testing.T, store *fastdb.DB, total int) {
+	t.Helper()
+
+	for i := 1; i <= total; i++ {
+		user := &queryUser{
+			ID:    i,
+			UUID:  fmt.Sprintf("UUID_%03d", total-i),
+			Email: fmt.Sprintf("user%d@example.com", i%3),
+			Age:   20 + i,
+		}
+
+		userData, err := json.Marshal(user)
+		require.NoError(t, err)
+
+		err = store.Set("user", user.ID, userData)
+		require.NoError(t, err)
+	}
+}
+
+func Test_Query_Scan(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	fillQueryUsers(t, store, 30)
+
+	query := store.Query("user").
+		Where("Email", fastdb.Eq, "user1@example.com").
+		Where("Age", fastdb.Gt, 30).
+		OrderBy("UUID").
+		Limit(3).
+		Select("ID", "Email")
+
+	assert.Equal(t,
+		"scan bucket user -> filter Email = user1@example.com -> filter Age > 30 -> order by UUID -> limit 3 -> select ID, Email",
+		query.Explain())
+
+	results, err := query.Run()
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, 28, results[0].Key)
+	assert.JSONEq(t, `{"ID":28,"Email":"user1@example.com"}`, string(results[0].Data))
+	assert.Equal(t, 25, results[1].Key)
+	assert.Equal(t, 22, results[2].Key)
+
+	results, err = store.Query("user").Where("Age", fastdb.Lte, 22).OrderByDesc("Age").Run()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, 2, results[0].Key)
+
+	results, err = store.Query("user").Where("Missing", fastdb.Ne, 1).Run()
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = store.Query("user").Where("Age", fastdb.Op(99), 1).Run()
+	require.Error(t, err)
+}
+
+func Test_Query_Index(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	fillQueryUsers(t, store, 30)
+
+	err = store.CreateIndex("user", "Email")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Email"}, store.Indexes("user"))
+
+	query := store.Query("user").Where("Age", fastdb.Gte, 40).Where("Email", fastdb.Eq, "user2@example.com")
+	assert.Equal(t, "index lookup on Email -> filter Age >= 40 -> order by key", query.Explain())
+
+	results, err := query.Run()
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.Equal(t, 20, results[0].Key)
+
+	// the index follows the changes
+	_, err = store.Del("user", 20)
+	require.NoError(t, err)
+
+	err = store.Set("user", 100, []byte(`{"ID":100,"Email":"user2@example.com","Age":50}`))
+	require.NoError(t, err)
+
+	err = store.Set("user", 23, []byte(`{"ID":23,"Email":"other@example.com","Age":50}`))
+	require.NoError(t, err)
+
+	results, err = query.Run()
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, 26, results[0].Key)
+	assert.Equal(t, 100, results[2].Key)
+
+	store.DropIndex("user", "Email")
+	assert.Empty(t, store.Indexes("user"))
+	assert.Equal(t, "scan bucket user -> filter Age >= 40 -> filter Email = user2@example.com -> order by key", query.Explain())
+
+	err = store.CreateIndex("user", "")
+	require.Error(t, err)
+}
@@ -1,54 +1,75 @@
 package election
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"net/rpc"
+	"sync"
 	"time"
+
+	"github.com/marcelloh/fastdb/transport"
 )
 
+// DefaultCallTimeout is how long a node waits for the answer to a message, unless WithCallTimeout says otherwise.
+const DefaultCallTimeout = 2 * time.Second
+
 type RPCResponse struct {
 	Success bool
 }
 
 type BullyAlgorithm struct {
-	NodeID        int
-	CoordinatorID int
-	Peers         map[int]string
+	NodeID          int
+	Peers           map[int]string
+	clients         *transport.Pool
+	timeout         time.Duration
+	heartbeat       Heartbeat
+	coordinatorID   int
+	electionInvoked bool       // an election message started an election of this node, that didn't end yet
+	steppedDown     bool       // the node stops, it doesn't take part in the elections anymore
+	mu              sync.Mutex // guards the heartbeat, the coordinator and the state of the elections
 }
 
-var (
-	noElectionInvoked    = true
-	superiorNodeAvailabe = false
-)
+// Option configures a BullyAlgorithm.
+type Option func(*BullyAlgorithm)
+
+// WithDialOptions configures the connections to the peers, like transport.WithCredentials and transport.WithTLS.
+func WithDialOptions(opts ...transport.DialOption) Option {
+	return func(b *BullyAlgorithm) {
+		b.clients = transport.NewPool(opts...)
+	}
+}
 
-func NewBullyAlgorithm(nodeID int, coordinatorID int, peers map[int]string) *BullyAlgorithm {
-	return &BullyAlgorithm{
+// WithCallTimeout sets how long a node waits for the answer to a message.
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(b *BullyAlgorithm) {
+		b.timeout = timeout
+	}
+}
+
+func NewBullyAlgorithm(nodeID int, coordinatorID int, peers map[int]string, opts ...Option) *BullyAlgorithm {
+	b := &BullyAlgorithm{
 		NodeID:        nodeID,
-		CoordinatorID: coordinatorID,
 		Peers:         peers,
+		clients:       transport.NewPool(),
+		timeout:       DefaultCallTimeout,
+		heartbeat:     DefaultHeartbeat,
+		coordinatorID: coordinatorID,
+	}
+
+	for _, opt := range opts {
+		opt(b)
 	}
+
+	return b
 }
 
 func (b *BullyAlgorithm) CommunicateToCoordinator() {
-	coorID := b.CoordinatorID
+	coorID := b.Coordinator()
 	coorAddr := b.Peers[coorID]
 
 	log.Printf("[Communication] Node-%d: communicate with coordinator Node-%d", b.NodeID, coorID)
 
-	client, err := rpc.Dial("tcp", coorAddr)
-	if err != nil {
-		log.Printf(
-			"[Communication] Node-%d: failed to connect to coordinator Node-%d: %v",
-			b.NodeID, coorID, err,
-		)
-
-		log.Print("[Election] Start election")
-		b.StartElection()
-		return
-	}
-
 	var msg = Message{
 		SenderID: b.NodeID,
 		Type:     MessageTypePing,
@@ -56,7 +77,7 @@ func (b *BullyAlgorithm) CommunicateToCoordinator() {
 	}
 
 	var reply RPCResponse
-	err = client.Call("BullyAlgorithm.HandleMessage", msg, &reply)
+	err := b.send(coorAddr, msg, &reply)
 	if err != nil || !reply.Success {
 		log.Printf(
 			"[Communication] Node-%d: failed to send PING message to coordinator Node-%d: %v",
@@ -70,62 +91,61 @@ func (b *BullyAlgorithm) CommunicateToCoordinator() {
 	log.Printf("[Communication] Node-%d: received PONG message from coordinator Node-%d", b.NodeID, coorID)
 }
 
+// StartElection asks the nodes with a higher id to take over, and makes this node the coordinator
+// when none of them answers. A node that answers starts an election of its own.
 func (b *BullyAlgorithm) StartElection() {
+	if b.isSteppedDown() {
+		return
+	}
+
+	superiorNodeAvailable := false
+
 	for peerID, peerAddr := range b.Peers {
-		if b.isItself(peerID) {
+		if b.isItself(peerID) || !b.isLessPriority(peerID) {
 			continue
 		}
 
-		if b.isLessPriority(peerID) {
-			log.Printf("[Election] Node-%d: send ELECTION message to Node-%d", b.NodeID, peerID)
-
-			client, err := rpc.Dial("tcp", peerAddr)
-			if err != nil {
-				log.Printf("[Election] Node-%d: is not available, error: %v", peerID, err)
-				continue
-			}
-
-			var msg = Message{
-				SenderID: b.NodeID,
-				Type:     MessageTypeElectionInProgress,
-				OccurAt:  time.Now(),
-			}
-
-			var reply RPCResponse
-			err = client.Call("BullyAlgorithm.HandleMessage", msg, &reply)
-			if err != nil {
-				log.Printf(
-					"[Election] Node-%d: failed to send ELECTION message to Node-%d: %v",
-					b.NodeID, peerID, err,
-				)
-
-				continue
-			}
-
-			if reply.Success {
-				log.Printf("[Election] Node-%d: received ELECTION message from Node-%d", b.NodeID, peerID)
-				superiorNodeAvailabe = true
-			}
+		log.Printf("[Election] Node-%d: send ELECTION message to Node-%d", b.NodeID, peerID)
+
+		var msg = Message{
+			SenderID: b.NodeID,
+			Type:     MessageTypeElectionInProgress,
+			OccurAt:  time.Now(),
+		}
+
+		var reply RPCResponse
+		err := b.send(peerAddr, msg, &reply)
+		if err != nil {
+			log.Printf(
+				"[Election] Node-%d: failed to send ELECTION message to Node-%d: %v",
+				b.NodeID, peerID, err,
+			)
+
+			continue
 		}
 
-		if !superiorNodeAvailabe {
-			b.makeYourselfCoordinator()
+		if reply.Success {
+			log.Printf("[Election] Node-%d: received ELECTION message from Node-%d", b.NodeID, peerID)
+			superiorNodeAvailable = true
 		}
+	}
 
-		superiorNodeAvailabe = false
-		noElectionInvoked = true
+	if !superiorNodeAvailable {
+		b.makeYourselfCoordinator()
 	}
+
+	b.mu.Lock()
+	b.electionInvoked = false
+	b.mu.Unlock()
 }
 
 func (b *BullyAlgorithm) makeYourselfCoordinator() {
+	b.setCoordinator(b.NodeID)
+	log.Printf("[Victory] Node-%d: is the new coordinator", b.NodeID)
+
 	for peerID, peerAddr := range b.Peers {
 		log.Printf("[Victory] Node-%d: send VICTORY message to Node-%d", b.NodeID, peerID)
 
-		client, err := rpc.Dial("tcp", peerAddr)
-		if err != nil {
-			continue
-		}
-
 		var msg = Message{
 			SenderID: b.NodeID,
 			Type:     MessageTypeElectionCompleted,
@@ -133,14 +153,27 @@ func (b *BullyAlgorithm) makeYourselfCoordinator() {
 		}
 
 		var reply RPCResponse
-		client.Call("BullyAlgorithm.HandleMessage", msg, &reply)
+		_ = b.send(peerAddr, msg, &reply)
 	}
 }
 
+// send sends a message to a peer, over the connection that is kept to it.
+func (b *BullyAlgorithm) send(peerAddr string, msg Message, reply *RPCResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	return b.clients.Call(ctx, peerAddr, "BullyAlgorithm.HandleMessage", msg, reply)
+}
+
 func (b *BullyAlgorithm) HandleMessage(msg Message, reply *RPCResponse) error {
 	switch msg.Type {
 	case MessageTypePing:
 		return b.handlePingMessage(msg, reply)
+	case MessageTypeHeartbeat:
+		reply.Success = !b.isSteppedDown()
+		return nil
+	case MessageTypeStepDown:
+		return b.handleStepDownMessage(msg, reply)
 	case MessageTypeElectionInProgress:
 		return b.handleElectionInProgressMessage(msg, reply)
 	case MessageTypeElectionCompleted:
@@ -155,18 +188,22 @@ func (b *BullyAlgorithm) handlePingMessage(msg Message, reply *RPCResponse) erro
 		"[Communication] received PING message from Node-%d", msg.SenderID,
 	)
 
-	reply.Success = true
+	reply.Success = !b.isSteppedDown()
 	return nil
 }
 
 func (b *BullyAlgorithm) handleElectionInProgressMessage(msg Message, reply *RPCResponse) error {
 	fmt.Println("[Election]: Receiving election from", msg.SenderID)
-	if msg.SenderID < b.NodeID {
+	if msg.SenderID < b.NodeID && !b.isSteppedDown() {
 		fmt.Println("[Election]: Sending OK to", msg.SenderID)
 		reply.Success = true
 
-		if noElectionInvoked {
-			noElectionInvoked = false
+		b.mu.Lock()
+		invoke := !b.electionInvoked
+		b.electionInvoked = true
+		b.mu.Unlock()
+
+		if invoke {
 			go b.StartElection()
 		}
 	}
@@ -175,13 +212,78 @@ func (b *BullyAlgorithm) handleElectionInProgressMessage(msg Message, reply *RPC
 }
 
 func (b *BullyAlgorithm) handleElectionCompletedMessage(msg Message, reply *RPCResponse) error {
-	b.CoordinatorID = msg.SenderID
+	b.setCoordinator(msg.SenderID)
 	log.Printf("[Victory] The Node-%d is the new coordinator\n", msg.SenderID)
 
 	reply.Success = true
 	return nil
 }
 
+// IsCoordinator tells whether this node is the coordinator.
+func (b *BullyAlgorithm) IsCoordinator() bool {
+	return b.isItself(b.Coordinator())
+}
+
+// Coordinator returns the id of the node that is the coordinator, as far as this node knows.
+func (b *BullyAlgorithm) Coordinator() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.coordinatorID
+}
+
+func (b *BullyAlgorithm) setCoordinator(nodeID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.coordinatorID = nodeID
+}
+
+// StepDown takes the node out of the elections, because it stops: it doesn't answer heartbeats
+// and elections anymore. A coordinator asks the other nodes to elect a new coordinator right away,
+// instead of waiting for their failure detectors.
+func (b *BullyAlgorithm) StepDown() {
+	b.mu.Lock()
+	b.steppedDown = true
+	b.mu.Unlock()
+
+	if !b.IsCoordinator() {
+		return
+	}
+
+	for peerID, peerAddr := range b.Peers {
+		log.Printf("[Step down] Node-%d: send STEP DOWN message to Node-%d", b.NodeID, peerID)
+
+		var msg = Message{
+			SenderID: b.NodeID,
+			Type:     MessageTypeStepDown,
+			OccurAt:  time.Now(),
+		}
+
+		var reply RPCResponse
+		if err := b.send(peerAddr, msg, &reply); err != nil {
+			log.Printf("[Step down] Node-%d: failed to send STEP DOWN message to Node-%d: %v", b.NodeID, peerID, err)
+		}
+	}
+}
+
+func (b *BullyAlgorithm) handleStepDownMessage(msg Message, reply *RPCResponse) error {
+	if msg.SenderID == b.Coordinator() {
+		log.Printf("[Step down] Coordinator Node-%d steps down, start election", msg.SenderID)
+		go b.StartElection()
+	}
+
+	reply.Success = true
+	return nil
+}
+
+func (b *BullyAlgorithm) isSteppedDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.steppedDown
+}
+
 func (b *BullyAlgorithm) isItself(peerID int) bool {
 	return b.NodeID == peerID
 }
@@ -0,0 +1,114 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/rpc"
+	"time"
+
+	"github.com/marcelloh/fastdb/transport"
+)
+
+// Heartbeat configures the failure detector of Monitor.
+type Heartbeat struct {
+	// Interval is the time between two heartbeats to the coordinator.
+	Interval time.Duration
+	// Jitter is the most that is added to an interval at random, so the nodes don't all call at once.
+	Jitter time.Duration
+	// Misses is the number of heartbeats in a row the coordinator misses before an election starts.
+	Misses int
+}
+
+// DefaultHeartbeat is the failure detector of a node, unless WithHeartbeat says otherwise.
+var DefaultHeartbeat = Heartbeat{Interval: time.Second, Jitter: 500 * time.Millisecond, Misses: 3}
+
+// WithHeartbeat configures the failure detector.
+func WithHeartbeat(heartbeat Heartbeat) Option {
+	return func(b *BullyAlgorithm) {
+		b.heartbeat = heartbeat
+	}
+}
+
+// SetHeartbeat changes the failure detector, from the next heartbeat on.
+func (b *BullyAlgorithm) SetHeartbeat(heartbeat Heartbeat) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.heartbeat = heartbeat
+}
+
+func (b *BullyAlgorithm) currentHeartbeat() Heartbeat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.heartbeat
+}
+
+// Monitor sends heartbeats to the coordinator until the context ends, and starts an election when
+// the coordinator misses too many of them. A heartbeat that isn't answered within the call timeout is missed.
+func (b *BullyAlgorithm) Monitor(ctx context.Context) {
+	missed := 0
+
+	for {
+		heartbeat := b.currentHeartbeat()
+
+		wait := heartbeat.Interval
+		if heartbeat.Jitter > 0 {
+			wait += rand.N(heartbeat.Jitter)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		coorID := b.Coordinator()
+		if b.isItself(coorID) {
+			missed = 0
+			continue
+		}
+
+		if b.sendHeartbeat(coorID) {
+			if missed > 0 {
+				log.Printf("[Heartbeat] Node-%d: coordinator Node-%d answers again", b.NodeID, coorID)
+			}
+			missed = 0
+			continue
+		}
+
+		missed++
+		log.Printf("[Heartbeat] Node-%d: coordinator Node-%d missed %d heartbeat(s)", b.NodeID, coorID, missed)
+
+		if missed >= heartbeat.Misses {
+			log.Printf("[Election] Node-%d: coordinator Node-%d is down, start election", b.NodeID, coorID)
+			b.StartElection()
+			missed = 0
+		}
+	}
+}
+
+// sendHeartbeat tells whether the coordinator is alive. An older node that doesn't know
+// heartbeats answers them with an error, which is an answer too.
+func (b *BullyAlgorithm) sendHeartbeat(coorID int) bool {
+	var msg = Message{
+		SenderID: b.NodeID,
+		Type:     MessageTypeHeartbeat,
+		OccurAt:  time.Now(),
+	}
+
+	var reply RPCResponse
+	err := b.send(b.Peers[coorID], msg, &reply)
+
+	var transportErr transport.ServerError
+	var rpcErr rpc.ServerError
+	if errors.As(err, &transportErr) || errors.As(err, &rpcErr) {
+		return true
+	}
+
+	return err == nil && reply.Success
+}
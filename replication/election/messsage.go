@@ -8,6 +8,10 @@ const (
 	MessageTypePing               MessageType = "ping"
 	MessageTypeElectionInProgress MessageType = "election_in_progress"
 	MessageTypeElectionCompleted  MessageType = "election_completed"
+	// MessageTypeHeartbeat is the ping of the failure detector, it isn't logged like MessageTypePing.
+	MessageTypeHeartbeat MessageType = "heartbeat"
+	// MessageTypeStepDown is sent by a coordinator that stops, so the others elect a new one.
+	MessageTypeStepDown MessageType = "step_down"
 )
 
 type Message struct {
@@ -1,15 +1,37 @@
 package replicationmanager
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/marcelloh/fastdb"
 	"github.com/marcelloh/fastdb/replication/election"
+	"github.com/marcelloh/fastdb/transport"
+)
+
+// OpType is the operation that a replication request applies on a backup.
+type OpType string
+
+const (
+	OpSet    OpType = "set"
+	OpDelete OpType = "delete"
+	OpExpire OpType = "expire"
+	OpBatch  OpType = "batch"
 )
 
 type ReplicationRequest struct {
+	Op       OpType // empty from older leaders, which only replicate sets
+	Bucket   string // empty from older leaders, which only use KeyBucket
 	Key      int
 	Value    []byte
+	Expires  time.Time    // when the key expires after a set or expire, the zero time is never
+	Attrs    fastdb.Attrs // the attributes of the key after a set
+	Ops      []BatchOp    // the operations of a batch
 	OccurrAt time.Time
 	LeaderID int
 }
@@ -19,25 +41,121 @@ type ReplicationResponse struct {
 }
 
 const (
+	// KeyBucket is the bucket of the requests without a bucket.
 	KeyBucket = "kvstore"
+
+	// keyLockCount is the number of locks the writes of the keys are divided over.
+	keyLockCount = 64
 )
 
 type ReplicationManager struct {
 	nodeID   int
 	db       *fastdb.DB
 	Election *election.BullyAlgorithm
-	bucket   string
+	peers    *transport.Pool
+	watchers watchers
+	keyLocks [keyLockCount]sync.Mutex
+}
+
+// Option configures a ReplicationManager.
+type Option func(*ReplicationManager)
+
+// WithDialOptions configures the connections to the peers, like transport.WithCredentials and transport.WithTLS.
+func WithDialOptions(opts ...transport.DialOption) Option {
+	return func(rm *ReplicationManager) {
+		rm.peers = transport.NewPool(opts...)
+	}
 }
 
 func NewReplicationManager(
 	nodeID int,
 	db *fastdb.DB,
 	election *election.BullyAlgorithm,
+	opts ...Option,
 ) *ReplicationManager {
-	return &ReplicationManager{
+	rm := &ReplicationManager{
 		nodeID:   nodeID,
 		db:       db,
 		Election: election,
-		bucket:   KeyBucket,
+		peers:    transport.NewPool(),
+	}
+
+	for _, opt := range opts {
+		opt(rm)
+	}
+
+	return rm
+}
+
+// call calls a method of a peer, over the connection the manager keeps to it.
+func (rm *ReplicationManager) call(ctx context.Context, addr, method string, args, reply any) error {
+	return rm.peers.Call(ctx, addr, method, args, reply)
+}
+
+// ClusterInfo describes the cluster as one node sees it.
+type ClusterInfo struct {
+	NodeID   int
+	LeaderID int
+	Peers    map[int]string
+}
+
+// Cluster returns the id of this node, the id of the leader and the addresses of the other nodes.
+func (rm *ReplicationManager) Cluster() ClusterInfo {
+	return ClusterInfo{
+		NodeID:   rm.Election.NodeID,
+		LeaderID: rm.Election.Coordinator(),
+		Peers:    maps.Clone(rm.Election.Peers),
 	}
 }
+
+// lockKey locks the writes of a key, so they reach the backups in the order they are applied,
+// and a read before a write sees no other write in between. It returns the function that unlocks.
+func (rm *ReplicationManager) lockKey(bucket string, key int) func() {
+	mu := &rm.keyLocks[keyLockIndex(bucket, key)]
+	mu.Lock()
+
+	return mu.Unlock
+}
+
+// lockKeys locks the writes of the keys of a batch like lockKey, in a fixed order.
+func (rm *ReplicationManager) lockKeys(ops []BatchOp) func() {
+	indexes := make([]int, 0, len(ops))
+	for _, op := range ops {
+		indexes = append(indexes, keyLockIndex(bucketOrDefault(op.Bucket), op.Key))
+	}
+
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	for _, index := range indexes {
+		rm.keyLocks[index].Lock()
+	}
+
+	return func() {
+		for _, index := range indexes {
+			rm.keyLocks[index].Unlock()
+		}
+	}
+}
+
+// keyLockIndex returns the position of the lock of a key.
+func keyLockIndex(bucket string, key int) int {
+	hash := fnv.New32a()
+	_, _ = fmt.Fprintf(hash, "%s_%d", bucket, key)
+
+	return int(hash.Sum32() % keyLockCount)
+}
+
+// bucketOrDefault returns the bucket, or KeyBucket when it is empty.
+func bucketOrDefault(bucket string) string {
+	if bucket == "" {
+		return KeyBucket
+	}
+
+	return bucket
+}
+
+// Info returns the number of records and buckets in the local database.
+func (rm *ReplicationManager) Info() string {
+	return rm.db.Info()
+}
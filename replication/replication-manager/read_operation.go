@@ -1,10 +1,14 @@
 package replicationmanager
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"net/rpc"
+	"log"
+	"slices"
+	"sync"
 	"time"
+
+	"github.com/marcelloh/fastdb"
 )
 
 type ReadPreference int
@@ -15,74 +19,346 @@ const (
 )
 
 type GetResult struct {
-	Value     []byte
-	Found     bool
-	Timestamp time.Time
-	Source    string
+	Value       []byte
+	Found       bool
+	Timestamp   time.Time
+	Source      string
+	Expires     time.Time    // when the key expires, the zero time is never
+	Attrs       fastdb.Attrs // the attributes of the key
+	ContentType ContentType  // the type of the value, see TypedValue
+}
+
+// Record is a key with its value.
+type Record struct {
+	Key   int
+	Value []byte
+}
+
+// KeyRequest asks the leader about one key of a bucket.
+type KeyRequest struct {
+	Bucket string
+	Key    int
+}
+
+// TTLResult is the time a key has left before it expires, fastdb.NoExpiry when it doesn't expire.
+type TTLResult struct {
+	TTL   time.Duration
+	Found bool
+}
+
+// KeysRequest asks for a page of keys: at most Limit keys, from the first key at or after Start.
+type KeysRequest struct {
+	Bucket string
+	Start  int
+	Limit  int
+}
+
+// RangeRequest asks for a page of records: at most Limit records, with keys from From up to and including To.
+type RangeRequest struct {
+	Bucket string
+	From   int
+	To     int
+	Limit  int
 }
 
-func (rm *ReplicationManager) Get(key int, preference ReadPreference) (*GetResult, error) {
+// Get returns the value of a key, Found is false when the key doesn't exist.
+func (rm *ReplicationManager) Get(ctx context.Context, bucket string, key int, preference ReadPreference) (*GetResult, error) {
 	if preference == ReadFromLocal {
-		return rm.getLocal(key)
+		return rm.getLocal(bucket, key), nil
 	}
 
-	if rm.Election.NodeID == rm.Election.CoordinatorID {
-		return rm.getLocal(key)
+	if rm.isLeader() {
+		return rm.getLocal(bucket, key), nil
 	}
 
-	return rm.getFromLeader(key)
+	return rm.getFromLeader(ctx, bucket, key)
 }
 
-func (rm *ReplicationManager) getLocal(key int) (*GetResult, error) {
-	value, ok := rm.db.Get(rm.bucket, key)
-	if !ok {
-		return nil, errors.New("failed to get value from local database")
+func (rm *ReplicationManager) getLocal(bucket string, key int) *GetResult {
+	entry, ok := rm.db.GetEntry(bucket, key)
+
+	var contentType ContentType
+	if ok {
+		contentType = ContentTypeOf(entry.Attrs)
 	}
 
 	return &GetResult{
-		Value:     value,
-		Found:     true,
-		Source:    fmt.Sprintf("Node-%d", rm.nodeID),
-		Timestamp: time.Now(),
-	}, nil
+		Value:       entry.Value,
+		Found:       ok,
+		Expires:     entry.Expires,
+		Attrs:       entry.Attrs,
+		ContentType: contentType,
+		Source:      fmt.Sprintf("Node-%d", rm.nodeID),
+		Timestamp:   time.Now(),
+	}
 }
 
-func (rm *ReplicationManager) getFromLeader(key int) (*GetResult, error) {
-	leaderID := rm.Election.CoordinatorID
+func (rm *ReplicationManager) getFromLeader(ctx context.Context, bucket string, key int) (*GetResult, error) {
+	var result GetResult
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleGet", KeyRequest{Bucket: bucket, Key: key}, &result); err != nil {
+		return nil, fmt.Errorf("failed to get value from leader: %w", err)
+	}
+
+	return &result, nil
+}
+
+// callLeader calls a method of the replication manager of the leader.
+func (rm *ReplicationManager) callLeader(ctx context.Context, method string, args, reply any) error {
+	leaderID := rm.Election.Coordinator()
 	if leaderID == -1 {
-		return nil, fmt.Errorf("no leader available")
+		return fmt.Errorf("no leader available")
 	}
 
 	leaderAddr, ok := rm.Election.Peers[leaderID]
 	if !ok {
-		return nil, fmt.Errorf("leader node %d not found in peers list", leaderID)
+		return fmt.Errorf("leader node %d not found in peers list", leaderID)
+	}
+
+	return rm.call(ctx, leaderAddr, method, args, reply)
+}
+
+func (rm *ReplicationManager) isLeader() bool {
+	return rm.Election.NodeID == rm.Election.Coordinator()
+}
+
+func (rm *ReplicationManager) HandleGet(request KeyRequest, result *GetResult) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	*result = *rm.getLocal(bucketOrDefault(request.Bucket), request.Key)
+	return nil
+}
+
+// Exists tells if a key exists on the leader.
+func (rm *ReplicationManager) Exists(ctx context.Context, bucket string, key int) (bool, error) {
+	if rm.isLeader() {
+		_, ok := rm.db.Get(bucket, key)
+		return ok, nil
+	}
+
+	var exists bool
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleExists", KeyRequest{Bucket: bucket, Key: key}, &exists); err != nil {
+		return false, fmt.Errorf("failed to check key on leader: %w", err)
+	}
+
+	return exists, nil
+}
+
+// TTL returns the time a key has left before it expires on the leader, fastdb.NoExpiry when it doesn't expire.
+// It returns false when the key doesn't exist.
+func (rm *ReplicationManager) TTL(ctx context.Context, bucket string, key int) (time.Duration, bool, error) {
+	if rm.isLeader() {
+		ttl, found := rm.db.TTL(bucket, key)
+		return ttl, found, nil
+	}
+
+	var result TTLResult
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleTTL", KeyRequest{Bucket: bucket, Key: key}, &result); err != nil {
+		return 0, false, fmt.Errorf("failed to get ttl from leader: %w", err)
+	}
+
+	return result.TTL, result.Found, nil
+}
+
+// Keys returns a page of the keys of a bucket on the leader, in sorted order.
+func (rm *ReplicationManager) Keys(ctx context.Context, bucket string, start, limit int) ([]int, error) {
+	if rm.isLeader() {
+		return rm.db.Keys(bucket, start, limit), nil
+	}
+
+	var keys []int
+	request := KeysRequest{Bucket: bucket, Start: start, Limit: limit}
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleKeys", request, &keys); err != nil {
+		return nil, fmt.Errorf("failed to get keys from leader: %w", err)
 	}
 
-	client, err := rpc.Dial("tcp", leaderAddr)
+	return keys, nil
+}
+
+// Range returns a page of the records of a bucket on the leader, sorted by key.
+func (rm *ReplicationManager) Range(ctx context.Context, bucket string, from, to, limit int) ([]Record, error) {
+	if rm.isLeader() {
+		return rm.rangeLocal(bucket, from, to, limit), nil
+	}
+
+	var records []Record
+	request := RangeRequest{Bucket: bucket, From: from, To: to, Limit: limit}
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleRange", request, &records); err != nil {
+		return nil, fmt.Errorf("failed to get records from leader: %w", err)
+	}
+
+	return records, nil
+}
+
+func (rm *ReplicationManager) rangeLocal(bucket string, from, to, limit int) []Record {
+	keys := rm.db.Keys(bucket, from, limit)
+
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		if key > to {
+			break
+		}
+
+		// a key can be deleted (or expire) after Keys returned it
+		if value, ok := rm.db.Get(bucket, key); ok {
+			records = append(records, Record{Key: key, Value: value})
+		}
+	}
+
+	return records
+}
+
+// Count returns the number of keys of a bucket on the leader.
+func (rm *ReplicationManager) Count(ctx context.Context, bucket string) (int, error) {
+	if rm.isLeader() {
+		return rm.db.Count(bucket), nil
+	}
+
+	var count int
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleCount", bucket, &count); err != nil {
+		return 0, fmt.Errorf("failed to count keys on leader: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetAll returns all the values of a bucket on the leader.
+func (rm *ReplicationManager) GetAll(ctx context.Context, bucket string) (map[int][]byte, error) {
+	records, err := rm.GetAllSorted(ctx, bucket)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to leader: %w", err)
+		return nil, err
 	}
-	defer client.Close()
 
-	var result GetResult
-	err = client.Call("ReplicationManager.HandleGet", key, &result)
+	values := make(map[int][]byte, len(records))
+	for _, record := range records {
+		values[record.Key] = record.Value
+	}
+
+	return values, nil
+}
+
+// GetAllSorted returns all the values of a bucket on the leader, sorted by key.
+func (rm *ReplicationManager) GetAllSorted(ctx context.Context, bucket string) ([]Record, error) {
+	if rm.isLeader() {
+		return rm.getAllLocal(ctx, bucket)
+	}
+
+	var records []Record
+	if err := rm.callLeader(ctx, "ReplicationManager.HandleGetAll", bucket, &records); err != nil {
+		return nil, fmt.Errorf("failed to get values from leader: %w", err)
+	}
+
+	return records, nil
+}
+
+func (rm *ReplicationManager) getAllLocal(ctx context.Context, bucket string) ([]Record, error) {
+	sorted, err := rm.db.GetAllSortedCtx(ctx, bucket)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get value from leader: %w", err)
+		return nil, err
 	}
 
-	return &result, nil
+	records := make([]Record, 0, len(sorted))
+	for _, record := range sorted {
+		records = append(records, Record{Key: record.SortField.(int), Value: record.Data})
+	}
+
+	return records, nil
 }
 
-func (rm *ReplicationManager) HandleGet(key int, result *GetResult) error {
-	if rm.Election.NodeID != rm.Election.CoordinatorID {
+// Buckets returns the names of the buckets on all the nodes, sorted.
+// A node that can't be reached is left out.
+func (rm *ReplicationManager) Buckets(ctx context.Context) []string {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		buckets = rm.db.Buckets()
+	)
+
+	for peerID, peerAddr := range rm.Election.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var peerBuckets []string
+			if err := rm.call(ctx, peerAddr, "ReplicationManager.HandleBuckets", 0, &peerBuckets); err != nil {
+				log.Printf("Failed to get buckets from Node-%d: %v", peerID, err)
+				return
+			}
+
+			mu.Lock()
+			buckets = append(buckets, peerBuckets...)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	slices.Sort(buckets)
+	return slices.Compact(buckets)
+}
+
+func (rm *ReplicationManager) HandleExists(request KeyRequest, exists *bool) error {
+	if !rm.isLeader() {
 		return fmt.Errorf("not the leader")
 	}
 
-	localResult, err := rm.getLocal(key)
+	_, *exists = rm.db.Get(bucketOrDefault(request.Bucket), request.Key)
+	return nil
+}
+
+func (rm *ReplicationManager) HandleTTL(request KeyRequest, result *TTLResult) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	result.TTL, result.Found = rm.db.TTL(bucketOrDefault(request.Bucket), request.Key)
+	return nil
+}
+
+func (rm *ReplicationManager) HandleKeys(request KeysRequest, keys *[]int) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	*keys = rm.db.Keys(bucketOrDefault(request.Bucket), request.Start, request.Limit)
+	return nil
+}
+
+func (rm *ReplicationManager) HandleRange(request RangeRequest, records *[]Record) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	*records = rm.rangeLocal(bucketOrDefault(request.Bucket), request.From, request.To, request.Limit)
+	return nil
+}
+
+func (rm *ReplicationManager) HandleCount(bucket string, count *int) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	*count = rm.db.Count(bucketOrDefault(bucket))
+	return nil
+}
+
+func (rm *ReplicationManager) HandleGetAll(bucket string, records *[]Record) error {
+	if !rm.isLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	local, err := rm.getAllLocal(context.Background(), bucketOrDefault(bucket))
 	if err != nil {
 		return err
 	}
 
-	*result = *localResult
+	*records = local
+	return nil
+}
+
+// HandleBuckets returns the names of the buckets of this node, it is answered by every node.
+func (rm *ReplicationManager) HandleBuckets(_ int, buckets *[]string) error {
+	*buckets = rm.db.Buckets()
 	return nil
 }
@@ -0,0 +1,172 @@
+package replicationmanager
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/marcelloh/fastdb"
+)
+
+// ContentType is the type of a value. It is kept as an attribute of the key, so a Get returns
+// the value with the type it was set with.
+type ContentType string
+
+const (
+	ContentRaw    ContentType = "raw"    // bytes as they are
+	ContentString ContentType = "string" // UTF-8 text
+	ContentJSON   ContentType = "json"   // compact JSON, the type of a value that was set without one
+	ContentInt    ContentType = "int"    // a decimal 64-bit integer
+	ContentFloat  ContentType = "float"  // a 64-bit floating point number
+	ContentBool   ContentType = "bool"   // true or false
+
+	// ContentTypeAttr is the attribute of a key that holds the content type of its value,
+	// it is left out for JSON.
+	ContentTypeAttr = "type"
+)
+
+// TypedValue is a value with its content type. The data of an int, float or bool is its text,
+// like strconv formats it.
+type TypedValue struct {
+	Type ContentType
+	Data []byte
+}
+
+func init() {
+	// a TypedValue is passed as an interface{} argument of the service
+	gob.Register(TypedValue{})
+}
+
+// Typed returns the TypedValue of a Go value: []byte is raw, string is a string, json.RawMessage is JSON,
+// the integers, floats and bools are themselves, and any other value is marshalled to JSON.
+// JSON is compacted.
+func Typed(value any) (TypedValue, error) {
+	switch v := value.(type) {
+	case TypedValue:
+		return v.compacted()
+	case []byte:
+		return TypedValue{Type: ContentRaw, Data: v}, nil
+	case string:
+		return TypedValue{Type: ContentString, Data: []byte(v)}, nil
+	case json.RawMessage:
+		return TypedValue{Type: ContentJSON, Data: v}.compacted()
+	case int:
+		return TypedValue{Type: ContentInt, Data: strconv.AppendInt(nil, int64(v), 10)}, nil
+	case int64:
+		return TypedValue{Type: ContentInt, Data: strconv.AppendInt(nil, v, 10)}, nil
+	case float64:
+		return TypedValue{Type: ContentFloat, Data: strconv.AppendFloat(nil, v, 'g', -1, 64)}, nil
+	case bool:
+		return TypedValue{Type: ContentBool, Data: strconv.AppendBool(nil, v)}, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return TypedValue{}, fmt.Errorf("value=%+v, marshal value error: %w", value, err)
+	}
+
+	return TypedValue{Type: ContentJSON, Data: data}, nil
+}
+
+// Validate checks that the data is valid for the content type.
+func (v TypedValue) Validate() error {
+	var err error
+
+	switch v.Type {
+	case ContentRaw:
+	case ContentString:
+		if !utf8.Valid(v.Data) {
+			err = fmt.Errorf("string is not valid UTF-8")
+		}
+	case ContentJSON:
+		if !json.Valid(v.Data) {
+			err = fmt.Errorf("json is not valid")
+		}
+	case ContentInt:
+		_, err = strconv.ParseInt(string(v.Data), 10, 64)
+	case ContentFloat:
+		_, err = strconv.ParseFloat(string(v.Data), 64)
+	case ContentBool:
+		_, err = strconv.ParseBool(string(v.Data))
+	default:
+		return fmt.Errorf("unknown content type %q", v.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("value is not a valid %s: %w", v.Type, err)
+	}
+
+	return nil
+}
+
+// compacted validates the value, and returns it with its JSON on one line, like the data file keeps it.
+func (v TypedValue) compacted() (TypedValue, error) {
+	if err := v.Validate(); err != nil {
+		return v, err
+	}
+
+	if v.Type != ContentJSON {
+		return v, nil
+	}
+
+	var data bytes.Buffer
+	if err := json.Compact(&data, v.Data); err != nil {
+		return v, fmt.Errorf("value is not a valid %s: %w", v.Type, err)
+	}
+
+	v.Data = data.Bytes()
+
+	return v, nil
+}
+
+// Decode returns the Go value of the data: []byte, string, int64, float64, bool,
+// or what json.Unmarshal makes of JSON.
+func (v TypedValue) Decode() (any, error) {
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch v.Type {
+	case ContentRaw:
+		return v.Data, nil
+	case ContentString:
+		return string(v.Data), nil
+	case ContentInt:
+		return strconv.ParseInt(string(v.Data), 10, 64)
+	case ContentFloat:
+		return strconv.ParseFloat(string(v.Data), 64)
+	case ContentBool:
+		return strconv.ParseBool(string(v.Data))
+	}
+
+	var value any
+	err := json.Unmarshal(v.Data, &value)
+
+	return value, err
+}
+
+// Attrs returns the attributes that keep the content type, none for JSON.
+func (v TypedValue) Attrs() fastdb.Attrs {
+	if v.Type == ContentJSON || v.Type == "" {
+		return nil
+	}
+
+	return fastdb.Attrs{ContentTypeAttr: string(v.Type)}
+}
+
+// ContentTypeOf returns the content type in the attributes of a key, JSON when there is none.
+func ContentTypeOf(attrs fastdb.Attrs) ContentType {
+	if contentType := attrs[ContentTypeAttr]; contentType != "" {
+		return ContentType(contentType)
+	}
+
+	return ContentJSON
+}
+
+// Typed returns the value of a result with its content type.
+func (r *GetResult) Typed() TypedValue {
+	return TypedValue{Type: r.ContentType, Data: r.Value}
+}
@@ -0,0 +1,108 @@
+package replicationmanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/marcelloh/fastdb"
+)
+
+// watchBuffer is the number of changes a watch holds, before it is ended with ErrWatchOverflow.
+const watchBuffer = 1024
+
+// ErrWatchOverflow ends a watch that doesn't keep up with the changes.
+var ErrWatchOverflow = errors.New("watch fell behind the changes")
+
+// WatchEvent is a change of a key: a set with its new value, or a delete.
+type WatchEvent struct {
+	Op     OpType
+	Bucket string
+	Key    int
+	Value  []byte
+}
+
+// watchers are the watches of a node, the hooks of the database pass the changes to them.
+type watchers struct {
+	set   map[*watcher]struct{}
+	hooks sync.Once
+	mu    sync.Mutex
+}
+
+type watcher struct {
+	events chan WatchEvent
+	bucket string
+}
+
+// Watch calls send for every change of a bucket in the local database, until the context ends or send fails.
+// The leader and its backups apply the same changes, so a watch can run on any node.
+// It returns ErrWatchOverflow when send doesn't keep up with the changes.
+func (rm *ReplicationManager) Watch(ctx context.Context, bucket string, send func(WatchEvent) error) error {
+	rm.watchers.hooks.Do(func() {
+		rm.db.OnAfterSet(fastdb.AllBuckets, func(bucket string, key int, value []byte) {
+			rm.watchers.notify(WatchEvent{Op: OpSet, Bucket: bucket, Key: key, Value: value})
+		})
+		rm.db.OnAfterDel(fastdb.AllBuckets, func(bucket string, key int) {
+			rm.watchers.notify(WatchEvent{Op: OpDelete, Bucket: bucket, Key: key})
+		})
+	})
+
+	w := rm.watchers.add(bucket)
+	defer rm.watchers.remove(w)
+
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				return ErrWatchOverflow
+			}
+
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ws *watchers) add(bucket string) *watcher {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.set == nil {
+		ws.set = map[*watcher]struct{}{}
+	}
+
+	w := &watcher{bucket: bucket, events: make(chan WatchEvent, watchBuffer)}
+	ws.set[w] = struct{}{}
+
+	return w
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	delete(ws.set, w)
+}
+
+// notify passes a change to the watches of its bucket. It is called inside the write lock
+// of the database, so it never waits: a watch that is full is ended instead.
+func (ws *watchers) notify(event WatchEvent) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for w := range ws.set {
+		if w.bucket != event.Bucket {
+			continue
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			close(w.events)
+			delete(ws.set, w)
+		}
+	}
+}
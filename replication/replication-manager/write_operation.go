@@ -1,30 +1,298 @@
 package replicationmanager
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"net/rpc"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/marcelloh/fastdb"
 )
 
-func (rm *ReplicationManager) Set(key int, value []byte) error {
-	if rm.Election.NodeID != rm.Election.CoordinatorID {
-		return fmt.Errorf("not the leader, current leader is Node-%d", rm.Election.CoordinatorID)
+// SetOptions are the conditions, the expiry and the attributes of a SetWith.
+// A fingerprint condition is "*" for any value, or the Fingerprint of a value.
+type SetOptions struct {
+	Expires     time.Time     // the key expires at this moment, it overrides the TTL
+	Attrs       fastdb.Attrs  // the attributes of the key, like the flags of a memcached item
+	TTL         time.Duration // the key expires after the TTL, it doesn't expire when it is 0
+	IfMatch     string        // only set the key when its value matches
+	IfNoneMatch string        // only set the key when it doesn't exist, or its value doesn't match
+	IfMissing   bool          // only set the key when it doesn't exist
+	IfExists    bool          // only set the key when it exists
+}
+
+// BatchOp is one set or delete of a Batch.
+type BatchOp struct {
+	Op     OpType
+	Bucket string
+	Key    int
+	Value  []byte
+}
+
+// ErrNotInteger is returned by Incr when the value of the key isn't an integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+func (rm *ReplicationManager) Set(ctx context.Context, bucket string, key int, value []byte) error {
+	_, err := rm.SetWith(ctx, bucket, key, value, SetOptions{})
+	return err
+}
+
+// SetWith sets a key like Set, with a condition and an expiry.
+// It returns false when the condition isn't met, and nothing is set.
+func (rm *ReplicationManager) SetWith(ctx context.Context, bucket string, key int, value []byte, opts SetOptions) (bool, error) {
+	if !rm.isLeader() {
+		return false, rm.errNotLeader()
+	}
+
+	defer rm.lockKey(bucket, key)()
+
+	if current, exists := rm.db.Get(bucket, key); !opts.Allows(current, exists) {
+		return false, nil
+	}
+
+	if err := rm.setEntry(ctx, bucket, key, opts.Entry(value)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Entry returns the value with the expiry and the attributes of the options.
+func (opts SetOptions) Entry(value []byte) fastdb.Entry {
+	entry := fastdb.Entry{Value: value, Expires: opts.Expires, Attrs: opts.Attrs}
+	if entry.Expires.IsZero() && opts.TTL > 0 {
+		entry.Expires = time.Now().Add(opts.TTL)
+	}
+
+	return entry
+}
+
+// Allows tells if the conditions allow a set, for the current value of the key.
+func (opts SetOptions) Allows(current []byte, exists bool) bool {
+	switch {
+	case opts.IfMissing && exists, opts.IfExists && !exists:
+		return false
+	case opts.IfMatch != "" && !matches(opts.IfMatch, current, exists):
+		return false
+	case opts.IfNoneMatch != "" && matches(opts.IfNoneMatch, current, exists):
+		return false
 	}
 
-	if err := rm.replicateToBackups(key, value); err != nil {
+	return true
+}
+
+// matches tells if a value matches a fingerprint condition, a key that doesn't exist never matches.
+func matches(condition string, value []byte, exists bool) bool {
+	return exists && (condition == "*" || condition == Fingerprint(value))
+}
+
+// Fingerprint returns a short hash of a value, to check that it didn't change.
+func Fingerprint(value []byte) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write(value)
+
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// Incr adds delta to the integer value of a key, a key that doesn't exist starts at 0.
+// The key keeps its expiry and attributes. It returns the new value.
+func (rm *ReplicationManager) Incr(ctx context.Context, bucket string, key int, delta int64) (int64, error) {
+	var number int64
+
+	_, err := rm.Update(ctx, bucket, key, func(value []byte, found bool) ([]byte, error) {
+		if found {
+			var err error
+			if number, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return nil, ErrNotInteger
+			}
+		}
+
+		number += delta
+
+		return []byte(strconv.FormatInt(number, 10)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return number, nil
+}
+
+// Update changes the value of a key with a function, on the backups and then in the local database.
+// When the function returns an error, the key is left alone and the error is returned,
+// a nil value deletes the key. The key keeps its expiry and attributes. It returns the new value.
+func (rm *ReplicationManager) Update(ctx context.Context, bucket string, key int, update fastdb.UpdateFunc) ([]byte, error) {
+	if !rm.isLeader() {
+		return nil, rm.errNotLeader()
+	}
+
+	defer rm.lockKey(bucket, key)()
+
+	entry, found := rm.db.GetEntry(bucket, key)
+
+	value, err := update(entry.Value, found)
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		_, err = rm.delete(ctx, bucket, key)
+		return nil, err
+	}
+
+	entry.Value = value
+	if err := rm.setEntry(ctx, bucket, key, entry); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// setEntry sets a key with its expiry and attributes on the backups and then in the local database,
+// the caller holds the lock of the key.
+func (rm *ReplicationManager) setEntry(ctx context.Context, bucket string, key int, entry fastdb.Entry) error {
+	request := ReplicationRequest{
+		Op: OpSet, Bucket: bucket, Key: key, Value: entry.Value, Expires: entry.Expires, Attrs: entry.Attrs,
+	}
+	if err := rm.replicateToBackups(ctx, request); err != nil {
 		return fmt.Errorf("failed to replicate to backups: %w", err)
 	}
 
-	if err := rm.db.Set(rm.bucket, key, value); err != nil {
+	if err := rm.db.SetEntryCtx(ctx, bucket, key, entry); err != nil {
 		return fmt.Errorf("failed to set key in local db: %w", err)
 	}
 
 	return nil
 }
 
-func (rm *ReplicationManager) replicateToBackups(key int, value []byte) error {
+// Delete deletes a key on the backups and then in the local database,
+// it returns false when the key didn't exist.
+func (rm *ReplicationManager) Delete(ctx context.Context, bucket string, key int) (bool, error) {
+	return rm.DeleteIfMatch(ctx, bucket, key, "")
+}
+
+// DeleteIfMatch deletes a key like Delete, when its value matches the fingerprint condition
+// (any value when it is empty). It returns false when the key didn't exist or didn't match.
+func (rm *ReplicationManager) DeleteIfMatch(ctx context.Context, bucket string, key int, ifMatch string) (bool, error) {
+	if !rm.isLeader() {
+		return false, rm.errNotLeader()
+	}
+
+	defer rm.lockKey(bucket, key)()
+
+	if current, exists := rm.db.Get(bucket, key); ifMatch != "" && !matches(ifMatch, current, exists) {
+		return false, nil
+	}
+
+	return rm.delete(ctx, bucket, key)
+}
+
+// Batch sets and deletes keys on the backups and then in the local database, all at once or not at all.
+// It returns the number of operations.
+func (rm *ReplicationManager) Batch(ctx context.Context, ops []BatchOp) (int, error) {
+	if !rm.isLeader() {
+		return 0, rm.errNotLeader()
+	}
+
+	defer rm.lockKeys(ops)()
+
+	if err := rm.replicateToBackups(ctx, ReplicationRequest{Op: OpBatch, Ops: ops}); err != nil {
+		return 0, fmt.Errorf("failed to replicate to backups: %w", err)
+	}
+
+	if err := rm.applyBatch(ctx, ops); err != nil {
+		return 0, fmt.Errorf("failed to apply batch in local db: %w", err)
+	}
+
+	return len(ops), nil
+}
+
+// applyBatch applies the operations of a batch to the local database, in one write.
+func (rm *ReplicationManager) applyBatch(ctx context.Context, ops []BatchOp) error {
+	batch := rm.db.NewBatch()
+
+	for _, op := range ops {
+		bucket := bucketOrDefault(op.Bucket)
+
+		switch op.Op {
+		case OpSet:
+			batch.Set(bucket, op.Key, op.Value)
+		case OpDelete:
+			batch.Del(bucket, op.Key)
+		default:
+			return fmt.Errorf("unknown batch operation %q", op.Op)
+		}
+	}
+
+	return batch.CommitCtx(ctx)
+}
+
+// delete deletes a key like Delete, the caller holds the lock of the key.
+func (rm *ReplicationManager) delete(ctx context.Context, bucket string, key int) (bool, error) {
+	if _, ok := rm.db.Get(bucket, key); !ok {
+		return false, nil
+	}
+
+	if err := rm.replicateToBackups(ctx, ReplicationRequest{Op: OpDelete, Bucket: bucket, Key: key}); err != nil {
+		return false, fmt.Errorf("failed to replicate to backups: %w", err)
+	}
+
+	deleted, err := rm.db.Del(bucket, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete key in local db: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// Expire makes a key expire after the ttl on the backups and in the local database,
+// a ttl that isn't positive deletes the key. It returns false when the key doesn't exist.
+func (rm *ReplicationManager) Expire(ctx context.Context, bucket string, key int, ttl time.Duration) (bool, error) {
+	return rm.ExpireAt(ctx, bucket, key, time.Now().Add(ttl))
+}
+
+// ExpireAt makes a key expire at the given moment on the backups and in the local database,
+// a moment that has passed deletes the key and the zero time removes the expiry.
+// It returns false when the key doesn't exist.
+// The moment the key expires is replicated, so the clocks of the nodes should agree.
+func (rm *ReplicationManager) ExpireAt(ctx context.Context, bucket string, key int, expires time.Time) (bool, error) {
+	if !rm.isLeader() {
+		return false, rm.errNotLeader()
+	}
+
+	defer rm.lockKey(bucket, key)()
+
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		return rm.delete(ctx, bucket, key)
+	}
+
+	if _, ok := rm.db.Get(bucket, key); !ok {
+		return false, nil
+	}
+
+	request := ReplicationRequest{Op: OpExpire, Bucket: bucket, Key: key, Expires: expires}
+	if err := rm.replicateToBackups(ctx, request); err != nil {
+		return false, fmt.Errorf("failed to replicate to backups: %w", err)
+	}
+
+	expired, err := rm.db.ExpireAt(bucket, key, expires)
+	if err != nil {
+		return false, fmt.Errorf("failed to expire key in local db: %w", err)
+	}
+
+	return expired, nil
+}
+
+// errNotLeader is returned by the writes on a node that isn't the leader.
+func (rm *ReplicationManager) errNotLeader() error {
+	return fmt.Errorf("not the leader, current leader is Node-%d", rm.Election.Coordinator())
+}
+
+func (rm *ReplicationManager) replicateToBackups(ctx context.Context, request ReplicationRequest) error {
 	var peers []string
 	for _, peer := range rm.Election.Peers {
 		peers = append(peers, peer)
@@ -36,7 +304,7 @@ func (rm *ReplicationManager) replicateToBackups(key int, value []byte) error {
 		wg.Add(1)
 		go func(peerAddr string) {
 			defer wg.Done()
-			if err := rm.sendReplication(peerAddr, key, value); err != nil {
+			if err := rm.sendReplication(ctx, peerAddr, request); err != nil {
 				errors <- err
 			}
 		}(peer)
@@ -58,22 +326,12 @@ func (rm *ReplicationManager) replicateToBackups(key int, value []byte) error {
 	return nil
 }
 
-func (rm *ReplicationManager) sendReplication(peerAddr string, key int, value []byte) error {
-	client, err := rpc.Dial("tcp", peerAddr)
-	if err != nil {
-		return fmt.Errorf("failed to dial peer %s: %w", peerAddr, err)
-	}
-	defer client.Close()
-
-	request := ReplicationRequest{
-		Key:      key,
-		Value:    value,
-		OccurrAt: time.Now(),
-		LeaderID: rm.nodeID,
-	}
+func (rm *ReplicationManager) sendReplication(ctx context.Context, peerAddr string, request ReplicationRequest) error {
+	request.OccurrAt = time.Now()
+	request.LeaderID = rm.nodeID
 
 	var response ReplicationResponse
-	if err := client.Call("ReplicationManager.HandleReplication", request, &response); err != nil {
+	if err := rm.call(ctx, peerAddr, "ReplicationManager.HandleReplication", request, &response); err != nil {
 		return fmt.Errorf("failed to replicate to peer %s: %w", peerAddr, err)
 	}
 
@@ -88,14 +346,38 @@ func (rm *ReplicationManager) HandleReplication(
 	request ReplicationRequest,
 	response *ReplicationResponse,
 ) error {
-	if request.LeaderID != rm.Election.CoordinatorID {
+	if request.LeaderID != rm.Election.Coordinator() {
 		response.Success = false
 		return nil
 	}
 
-	if err := rm.db.Set(rm.bucket, request.Key, request.Value); err != nil {
+	bucket := bucketOrDefault(request.Bucket)
+
+	switch request.Op {
+	case OpSet, "":
+		entry := fastdb.Entry{Value: request.Value, Expires: request.Expires, Attrs: request.Attrs}
+		if err := rm.db.SetEntry(bucket, request.Key, entry); err != nil {
+			response.Success = false
+			return fmt.Errorf("failed to set key in local db: %w", err)
+		}
+	case OpDelete:
+		if _, err := rm.db.Del(bucket, request.Key); err != nil {
+			response.Success = false
+			return fmt.Errorf("failed to delete key in local db: %w", err)
+		}
+	case OpBatch:
+		if err := rm.applyBatch(context.Background(), request.Ops); err != nil {
+			response.Success = false
+			return fmt.Errorf("failed to apply batch in local db: %w", err)
+		}
+	case OpExpire:
+		if _, err := rm.db.ExpireAt(bucket, request.Key, request.Expires); err != nil {
+			response.Success = false
+			return fmt.Errorf("failed to expire key in local db: %w", err)
+		}
+	default:
 		response.Success = false
-		return fmt.Errorf("failed to set key in local db: %w", err)
+		return fmt.Errorf("unknown replication operation %q", request.Op)
 	}
 
 	response.Success = true
@@ -0,0 +1,219 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+)
+
+// Backend is where the server keeps the keys: a database, or the replication layer of a cluster.
+type Backend interface {
+	Get(ctx context.Context, bucket string, key int) ([]byte, bool, error)
+	SetWith(ctx context.Context, bucket string, key int, value []byte, opts replicationmanager.SetOptions) (bool, error)
+	Delete(ctx context.Context, bucket string, key int) (bool, error)
+	Exists(ctx context.Context, bucket string, key int) (bool, error)
+	Incr(ctx context.Context, bucket string, key int, delta int64) (int64, error)
+	Keys(ctx context.Context, bucket string, start, limit int) ([]int, error)
+	Count(ctx context.Context, bucket string) (int, error)
+	Expire(ctx context.Context, bucket string, key int, ttl time.Duration) (bool, error)
+	TTL(ctx context.Context, bucket string, key int) (time.Duration, bool, error)
+	Batch(ctx context.Context, ops []replicationmanager.BatchOp) ([]bool, error)
+	Info() string
+}
+
+// local is the backend of a database that isn't part of a cluster.
+type local struct {
+	db *fastdb.DB
+	mu sync.Mutex // the writes are done one by one, so the conditions of SET hold
+}
+
+// replicated is the backend of a node of a cluster, the writes go to the leader.
+type replicated struct {
+	*replicationmanager.ReplicationManager
+}
+
+// Local returns the backend of a database that isn't part of a cluster.
+func Local(db *fastdb.DB) Backend {
+	return &local{db: db}
+}
+
+// Replicated returns the backend of a node of a cluster: the writes are only accepted
+// on the leader, and replicated to the backups, the reads are done on the leader.
+func Replicated(rm *replicationmanager.ReplicationManager) Backend {
+	return replicated{rm}
+}
+
+func (b *local) Get(_ context.Context, bucket string, key int) ([]byte, bool, error) {
+	value, found := b.db.Get(bucket, key)
+	return value, found, nil
+}
+
+func (b *local) SetWith(_ context.Context, bucket string, key int, value []byte, opts replicationmanager.SetOptions) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if current, exists := b.db.Get(bucket, key); !opts.Allows(current, exists) {
+		return false, nil
+	}
+
+	if err := b.db.SetEntry(bucket, key, opts.Entry(value)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (b *local) Delete(_ context.Context, bucket string, key int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.Del(bucket, key)
+}
+
+func (b *local) Exists(_ context.Context, bucket string, key int) (bool, error) {
+	_, found := b.db.Get(bucket, key)
+	return found, nil
+}
+
+func (b *local) Incr(_ context.Context, bucket string, key int, delta int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var number int64
+
+	err := b.db.Update(bucket, key, func(value []byte, found bool) ([]byte, error) {
+		if found {
+			var err error
+			if number, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return nil, replicationmanager.ErrNotInteger
+			}
+		}
+
+		number += delta
+
+		return []byte(strconv.FormatInt(number, 10)), nil
+	})
+
+	return number, err
+}
+
+func (b *local) Keys(_ context.Context, bucket string, start, limit int) ([]int, error) {
+	return b.db.Keys(bucket, start, limit), nil
+}
+
+func (b *local) Count(_ context.Context, bucket string) (int, error) {
+	return b.db.Count(bucket), nil
+}
+
+func (b *local) Expire(_ context.Context, bucket string, key int, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.Expire(bucket, key, ttl)
+}
+
+func (b *local) TTL(_ context.Context, bucket string, key int) (time.Duration, bool, error) {
+	ttl, found := b.db.TTL(bucket, key)
+	return ttl, found, nil
+}
+
+// Batch sets and deletes keys all at once, and tells for each operation if its key existed.
+func (b *local) Batch(ctx context.Context, ops []replicationmanager.BatchOp) ([]bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existed := existing(ops, func(bucket string, key int) bool {
+		_, found := b.db.Get(bucket, key)
+		return found
+	})
+
+	batch := b.db.NewBatch()
+
+	for _, op := range ops {
+		if op.Op == replicationmanager.OpDelete {
+			batch.Del(op.Bucket, op.Key)
+		} else {
+			batch.Set(op.Bucket, op.Key, op.Value)
+		}
+	}
+
+	if err := batch.CommitCtx(ctx); err != nil {
+		return nil, err
+	}
+
+	return existed, nil
+}
+
+func (b *local) Info() string {
+	return b.db.Info()
+}
+
+func (b replicated) Get(ctx context.Context, bucket string, key int) ([]byte, bool, error) {
+	result, err := b.ReplicationManager.Get(ctx, bucket, key, replicationmanager.ReadFromLeader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return result.Value, result.Found, nil
+}
+
+// Batch sets and deletes keys all at once on the leader and the backups. The keys that existed
+// are looked up before the batch, a write of another client in between isn't seen.
+func (b replicated) Batch(ctx context.Context, ops []replicationmanager.BatchOp) ([]bool, error) {
+	var lookupErr error
+
+	existed := existing(ops, func(bucket string, key int) bool {
+		if lookupErr != nil {
+			return false
+		}
+
+		result, err := b.ReplicationManager.Get(ctx, bucket, key, replicationmanager.ReadFromLeader)
+		lookupErr = err
+
+		return err == nil && result.Found
+	})
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	if _, err := b.ReplicationManager.Batch(ctx, ops); err != nil {
+		return nil, err
+	}
+
+	return existed, nil
+}
+
+// existing tells for each operation if its key exists before it, after the operations before it.
+func existing(ops []replicationmanager.BatchOp, found func(bucket string, key int) bool) []bool {
+	type bucketKey struct {
+		bucket string
+		key    int
+	}
+
+	state := make(map[bucketKey]bool, len(ops))
+	existed := make([]bool, len(ops))
+
+	for i, op := range ops {
+		id := bucketKey{op.Bucket, op.Key}
+
+		exists, known := state[id]
+		if !known {
+			exists = found(op.Bucket, op.Key)
+		}
+
+		existed[i] = exists
+		state[id] = op.Op != replicationmanager.OpDelete
+	}
+
+	return existed
+}
+
+// isNotInteger tells if an error is about a value that isn't an integer.
+func isNotInteger(err error) bool {
+	return errors.Is(err, replicationmanager.ErrNotInteger)
+}
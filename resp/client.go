@@ -0,0 +1,62 @@
+package resp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// dialTimeout is how long Dial waits for the connection.
+const dialTimeout = 5 * time.Second
+
+// ReplyError is an error the server answered with, like "ERR syntax error".
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Client is a small RESP client, it sends one command at a time and waits for the answer.
+type Client struct {
+	conn   net.Conn
+	reader *Reader
+	writer *Writer
+	mu     sync.Mutex
+}
+
+// Dial connects to a server.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn, reader: NewReader(conn), writer: NewWriter(conn)}, nil
+}
+
+// Do sends a command and returns the answer, an error answer is returned as a ReplyError.
+func (c *Client) Do(args ...string) (Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writer.WriteCommand(args...)
+	if err := c.writer.Flush(); err != nil {
+		return Value{}, err
+	}
+
+	value, err := c.reader.ReadValue()
+	if err != nil {
+		return Value{}, err
+	}
+
+	if value.Kind == ErrorReply || value.Kind == BulkError {
+		return value, ReplyError(value.Str)
+	}
+
+	return value, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
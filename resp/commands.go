@@ -0,0 +1,768 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+)
+
+const (
+	// defaultScanCount is the number of keys SCAN looks at without COUNT.
+	defaultScanCount = 10
+
+	// keysPage is the number of keys KEYS gets from the backend at once.
+	keysPage = 1000
+)
+
+// session is the state of one connection.
+type session struct {
+	server *Server
+	reader *Reader
+	writer *Writer
+	bucket string
+	id     int64
+	quit   bool
+	tx     *transaction // the commands after MULTI, nil when there is no transaction
+
+	permissions   service.Permissions
+	authenticated bool // the client has logged in, or doesn't have to
+}
+
+// transaction holds the commands of a session between MULTI and EXEC.
+type transaction struct {
+	queued  []queued
+	aborted bool // a command couldn't be queued, EXEC discards the transaction
+}
+
+// queued is a SET or DEL of a transaction, with its operations of the batch.
+type queued struct {
+	set bool
+	ops []replicationmanager.BatchOp
+}
+
+// command is a command the server knows. The arity is the number of arguments with the name,
+// or at least -arity when it is negative. A command with queue is queued in a transaction,
+// a control command runs in a transaction, and the others are refused.
+// A public command runs before the client has logged in.
+type command struct {
+	run     func(sess *session, args []string)
+	queue   func(sess *session, args []string)
+	arity   int
+	control bool
+	public  bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {run: ping, arity: -1},
+		"ECHO":    {run: echo, arity: 2},
+		"HELLO":   {run: hello, arity: -1, public: true},
+		"AUTH":    {run: auth, arity: -2, public: true},
+		"SELECT":  {run: selectDB, arity: 2},
+		"INFO":    {run: info, arity: -1},
+		"COMMAND": {run: commandDocs, arity: -1},
+		"GET":     {run: get, arity: 2},
+		"SET":     {run: set, queue: queueSet, arity: -3},
+		"DEL":     {run: del, queue: queueDel, arity: -2},
+		"EXISTS":  {run: exists, arity: -2},
+		"INCR":    {run: incr, arity: 2},
+		"KEYS":    {run: keys, arity: 2},
+		"SCAN":    {run: scan, arity: -2},
+		"EXPIRE":  {run: expire, arity: 3},
+		"TTL":     {run: ttl, arity: 2},
+		"PTTL":    {run: ttl, arity: 2},
+		"MULTI":   {run: multi, arity: 1, control: true},
+		"EXEC":    {run: exec, arity: 1, control: true},
+		"DISCARD": {run: discard, arity: 1, control: true},
+		"QUIT":    {run: quit, arity: 1, control: true, public: true},
+	}
+}
+
+// handle runs a command, or queues it after MULTI. Only SET (without options) and DEL can be queued,
+// because EXEC writes them as one batch: the other clients never see a part of a transaction.
+func (sess *session) handle(args []string) {
+	cmd, ok := commands[strings.ToUpper(args[0])]
+	switch {
+	case !ok:
+		sess.fail(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	case !sess.authenticated && !cmd.public:
+		sess.fail("NOAUTH Authentication required.")
+	case (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity:
+		sess.fail(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(args[0])))
+	case sess.tx != nil && cmd.queue != nil:
+		cmd.queue(sess, args)
+	case sess.tx != nil && !cmd.control:
+		sess.fail(fmt.Sprintf("ERR '%s' can not be used in a transaction, only SET and DEL", strings.ToLower(args[0])))
+	default:
+		cmd.run(sess, args)
+	}
+}
+
+// fail answers with an error, an error in a transaction makes EXEC discard it.
+func (sess *session) fail(message string) {
+	if sess.tx != nil {
+		sess.tx.aborted = true
+	}
+
+	sess.writer.WriteError(message)
+}
+
+// replyError answers with the error of the backend.
+func (sess *session) replyError(err error) {
+	message := err.Error()
+
+	switch {
+	case isNotInteger(err):
+		sess.fail("ERR value is not an integer or out of range")
+	case errors.Is(err, service.ErrPermissionDenied):
+		sess.fail("NOPERM " + message)
+	case strings.Contains(message, "not the leader"):
+		sess.fail("READONLY " + message)
+	default:
+		sess.fail("ERR " + message)
+	}
+}
+
+// allowed checks the permission of the current bucket, and answers with an error when it is denied.
+func (sess *session) allowed(perm service.Permission) bool {
+	if err := sess.permissions.Check(sess.bucket, perm); err != nil {
+		sess.replyError(err)
+		return false
+	}
+
+	return true
+}
+
+// parseKeys parses the keys of a command, and answers with an error when one isn't valid.
+func (sess *session) parseKeys(args []string) ([]int, bool) {
+	keys := make([]int, 0, len(args))
+
+	for _, arg := range args {
+		key, err := strconv.Atoi(arg)
+		if err != nil || key < 0 {
+			sess.fail("ERR key should be a positive integer")
+			return nil, false
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, true
+}
+
+func ping(sess *session, args []string) {
+	switch len(args) {
+	case 1:
+		sess.writer.WriteSimple("PONG")
+	case 2:
+		sess.writer.WriteBulkString(args[1])
+	default:
+		sess.writer.WriteError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echo(sess *session, args []string) {
+	sess.writer.WriteBulkString(args[1])
+}
+
+// hello switches the protocol version, logs in with AUTH name secret, and tells about the server.
+func hello(sess *session, args []string) {
+	protocol := sess.writer.Protocol
+
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || (version != 2 && version != 3) {
+			sess.writer.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+
+		for i := 2; i < len(args); i += 2 {
+			switch {
+			case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+			case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+				if !sess.logIn(args[i+1], args[i+2]) {
+					return
+				}
+
+				i++
+			default:
+				sess.writer.WriteError("ERR syntax error")
+				return
+			}
+		}
+
+		protocol = version
+	}
+
+	if !sess.authenticated {
+		sess.writer.WriteError("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client")
+		return
+	}
+
+	sess.writer.Protocol = protocol
+
+	sess.writer.WriteMap(7)
+	sess.writer.WriteBulkString("server")
+	sess.writer.WriteBulkString("fastdb")
+	sess.writer.WriteBulkString("version")
+	sess.writer.WriteBulkString(RedisVersion)
+	sess.writer.WriteBulkString("proto")
+	sess.writer.WriteInt(int64(protocol))
+	sess.writer.WriteBulkString("id")
+	sess.writer.WriteInt(sess.id)
+	sess.writer.WriteBulkString("mode")
+	sess.writer.WriteBulkString("standalone")
+	sess.writer.WriteBulkString("role")
+	sess.writer.WriteBulkString("master")
+	sess.writer.WriteBulkString("modules")
+	sess.writer.WriteArray(0)
+}
+
+// auth logs in with AUTH secret, or AUTH name secret.
+func auth(sess *session, args []string) {
+	if len(args) > 3 {
+		sess.fail("ERR syntax error")
+		return
+	}
+
+	name, secret := "", args[len(args)-1]
+	if len(args) == 3 {
+		name = args[1]
+	}
+
+	if sess.logIn(name, secret) {
+		sess.writer.WriteSimple("OK")
+	}
+}
+
+// logIn logs in with the credential, and answers with an error when it isn't accepted.
+func (sess *session) logIn(name, secret string) bool {
+	if sess.server.login == nil {
+		sess.fail("ERR AUTH called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+		return false
+	}
+
+	// the default user of Redis clients is any credential
+	if name == "default" {
+		name = ""
+	}
+
+	principal, err := sess.server.login(name, secret)
+	if err != nil {
+		sess.fail("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+
+	sess.permissions = sess.server.permissions.Intersect(principal.Permissions)
+	sess.authenticated = true
+
+	return true
+}
+
+func selectDB(sess *session, args []string) {
+	index, err := strconv.Atoi(args[1])
+	if err != nil || index < 0 || index >= len(sess.server.buckets) {
+		sess.writer.WriteError("ERR DB index is out of range")
+		return
+	}
+
+	sess.bucket = sess.server.buckets[index]
+	sess.writer.WriteSimple("OK")
+}
+
+// info tells about the server and the number of keys of the databases that have keys.
+func info(sess *session, _ []string) {
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	var text strings.Builder
+
+	fmt.Fprintf(&text, "# Server\r\nredis_version:%s\r\nserver:fastdb\r\nproto:%d\r\n", RedisVersion, sess.writer.Protocol)
+	fmt.Fprintf(&text, "\r\n# Database\r\nfastdb:%s\r\n", sess.server.backend.Info())
+	text.WriteString("\r\n# Keyspace\r\n")
+
+	for index, bucket := range sess.server.buckets {
+		if sess.permissions.Of(bucket)&service.Read == 0 {
+			continue
+		}
+
+		count, err := sess.server.backend.Count(ctx, bucket)
+		if err != nil {
+			sess.replyError(err)
+			return
+		}
+
+		if count > 0 {
+			fmt.Fprintf(&text, "db%d:keys=%d,bucket=%s\r\n", index, count, bucket)
+		}
+	}
+
+	sess.writer.WriteBulkString(text.String())
+}
+
+// commandDocs answers COMMAND (and COMMAND DOCS, that clients use when they connect) without details.
+func commandDocs(sess *session, _ []string) {
+	sess.writer.WriteArray(0)
+}
+
+func get(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.Read) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	value, found, err := sess.server.backend.Get(ctx, sess.bucket, keys[0])
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case !found:
+		sess.writer.WriteNull()
+	default:
+		sess.writer.WriteBulk(value)
+	}
+}
+
+// set sets a key, with the options EX seconds, PX milliseconds, NX (only when it doesn't exist)
+// and XX (only when it exists). It answers with a null when the condition isn't met.
+func set(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:2])
+	if !ok {
+		return
+	}
+
+	opts, err := parseSetOptions(args[3:])
+	if err != nil {
+		sess.writer.WriteError(err.Error())
+		return
+	}
+
+	if !sess.allowed(service.Write) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	done, err := sess.server.backend.SetWith(ctx, sess.bucket, keys[0], []byte(args[2]), opts)
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case !done:
+		sess.writer.WriteNull()
+	default:
+		sess.writer.WriteSimple("OK")
+	}
+}
+
+func parseSetOptions(args []string) (replicationmanager.SetOptions, error) {
+	var opts replicationmanager.SetOptions
+
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			opts.IfMissing = true
+		case "XX":
+			opts.IfExists = true
+		case "EX", "PX":
+			if opts.TTL != 0 || i+1 >= len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+
+			i++
+
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || amount <= 0 {
+				return opts, errors.New("ERR invalid expire time in 'set' command")
+			}
+
+			opts.TTL = time.Duration(amount) * time.Millisecond
+			if option == "EX" {
+				opts.TTL = time.Duration(amount) * time.Second
+			}
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+
+	if opts.IfMissing && opts.IfExists {
+		return opts, errors.New("ERR syntax error")
+	}
+
+	return opts, nil
+}
+
+// del deletes keys, and answers with the number of keys that existed.
+func del(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.Write) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	var count int64
+
+	for _, key := range keys {
+		deleted, err := sess.server.backend.Delete(ctx, sess.bucket, key)
+		if err != nil {
+			sess.replyError(err)
+			return
+		}
+
+		if deleted {
+			count++
+		}
+	}
+
+	sess.writer.WriteInt(count)
+}
+
+// exists answers with the number of keys that exist, a key that is given twice is counted twice.
+func exists(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.Read) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	var count int64
+
+	for _, key := range keys {
+		found, err := sess.server.backend.Exists(ctx, sess.bucket, key)
+		if err != nil {
+			sess.replyError(err)
+			return
+		}
+
+		if found {
+			count++
+		}
+	}
+
+	sess.writer.WriteInt(count)
+}
+
+func incr(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.ReadWrite) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	number, err := sess.server.backend.Incr(ctx, sess.bucket, keys[0], 1)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+
+	sess.writer.WriteInt(number)
+}
+
+// keys answers with all the keys that match a glob pattern, in sorted order.
+func keys(sess *session, args []string) {
+	pattern := args[1]
+	if _, err := path.Match(pattern, ""); err != nil {
+		sess.writer.WriteError("ERR invalid pattern")
+		return
+	}
+
+	if !sess.allowed(service.Read) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	var matched []string
+
+	for start := 0; ; {
+		page, err := sess.server.backend.Keys(ctx, sess.bucket, start, keysPage)
+		if err != nil {
+			sess.replyError(err)
+			return
+		}
+
+		matched = appendMatches(matched, pattern, page)
+		if len(page) < keysPage {
+			break
+		}
+
+		start = page[len(page)-1] + 1
+	}
+
+	sess.writeStrings(matched)
+}
+
+// scan answers with the next cursor and a page of keys, the cursor is the key the next page starts at.
+// The cursor is 0 when there are no more keys.
+func scan(sess *session, args []string) {
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil || cursor < 0 {
+		sess.writer.WriteError("ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", defaultScanCount
+
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			sess.writer.WriteError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				sess.writer.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			sess.writer.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		sess.writer.WriteError("ERR invalid pattern")
+		return
+	}
+
+	if !sess.allowed(service.Read) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	page, err := sess.server.backend.Keys(ctx, sess.bucket, cursor, count)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+
+	next := 0
+	if len(page) == count {
+		next = page[len(page)-1] + 1
+	}
+
+	sess.writer.WriteArray(2)
+	sess.writer.WriteBulkString(strconv.Itoa(next))
+	sess.writeStrings(appendMatches(nil, pattern, page))
+}
+
+func appendMatches(matched []string, pattern string, keys []int) []string {
+	for _, key := range keys {
+		text := strconv.Itoa(key)
+		if ok, _ := path.Match(pattern, text); ok {
+			matched = append(matched, text)
+		}
+	}
+
+	return matched
+}
+
+func (sess *session) writeStrings(texts []string) {
+	sess.writer.WriteArray(len(texts))
+
+	for _, text := range texts {
+		sess.writer.WriteBulkString(text)
+	}
+}
+
+// expire makes a key expire after a number of seconds, and answers with 1, or 0 when the key doesn't exist.
+func expire(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:2])
+	if !ok {
+		return
+	}
+
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		sess.writer.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+
+	if !sess.allowed(service.Write) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	expired, err := sess.server.backend.Expire(ctx, sess.bucket, keys[0], time.Duration(seconds)*time.Second)
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case expired:
+		sess.writer.WriteInt(1)
+	default:
+		sess.writer.WriteInt(0)
+	}
+}
+
+// ttl answers with the seconds (TTL) or milliseconds (PTTL) a key has left,
+// -1 when the key doesn't expire and -2 when it doesn't exist.
+func ttl(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.Read) {
+		return
+	}
+
+	ctx, cancel := sess.server.context()
+	defer cancel()
+
+	left, found, err := sess.server.backend.TTL(ctx, sess.bucket, keys[0])
+	switch {
+	case err != nil:
+		sess.replyError(err)
+	case !found:
+		sess.writer.WriteInt(-2)
+	case left == fastdb.NoExpiry:
+		sess.writer.WriteInt(-1)
+	case strings.EqualFold(args[0], "PTTL"):
+		sess.writer.WriteInt(left.Milliseconds())
+	default:
+		sess.writer.WriteInt(int64((left + time.Second/2) / time.Second))
+	}
+}
+
+// multi starts a transaction, the next commands are queued until EXEC or DISCARD.
+func multi(sess *session, _ []string) {
+	if sess.tx != nil {
+		sess.writer.WriteError("ERR MULTI calls can not be nested")
+		return
+	}
+
+	sess.tx = &transaction{}
+	sess.writer.WriteSimple("OK")
+}
+
+// queueSet queues a SET of a transaction.
+func queueSet(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:2])
+	if !ok {
+		return
+	}
+
+	if len(args) > 3 {
+		sess.fail("ERR SET options can not be used in a transaction")
+		return
+	}
+
+	if !sess.allowed(service.Write) {
+		return
+	}
+
+	op := replicationmanager.BatchOp{Op: replicationmanager.OpSet, Bucket: sess.bucket, Key: keys[0], Value: []byte(args[2])}
+	sess.tx.queued = append(sess.tx.queued, queued{set: true, ops: []replicationmanager.BatchOp{op}})
+	sess.writer.WriteSimple("QUEUED")
+}
+
+// queueDel queues a DEL of a transaction.
+func queueDel(sess *session, args []string) {
+	keys, ok := sess.parseKeys(args[1:])
+	if !ok || !sess.allowed(service.Write) {
+		return
+	}
+
+	ops := make([]replicationmanager.BatchOp, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, replicationmanager.BatchOp{Op: replicationmanager.OpDelete, Bucket: sess.bucket, Key: key})
+	}
+
+	sess.tx.queued = append(sess.tx.queued, queued{ops: ops})
+	sess.writer.WriteSimple("QUEUED")
+}
+
+// exec writes the queued commands as one batch, and answers with the reply of each command:
+// OK for a SET and the number of keys that existed for a DEL.
+func exec(sess *session, _ []string) {
+	tx := sess.tx
+	if tx == nil {
+		sess.writer.WriteError("ERR EXEC without MULTI")
+		return
+	}
+
+	sess.tx = nil
+
+	if tx.aborted {
+		sess.writer.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	var ops []replicationmanager.BatchOp
+	for _, cmd := range tx.queued {
+		ops = append(ops, cmd.ops...)
+	}
+
+	var existed []bool
+
+	if len(ops) > 0 {
+		ctx, cancel := sess.server.context()
+		defer cancel()
+
+		var err error
+		if existed, err = sess.server.backend.Batch(ctx, ops); err != nil {
+			sess.replyError(err)
+			return
+		}
+	}
+
+	sess.writer.WriteArray(len(tx.queued))
+
+	for _, cmd := range tx.queued {
+		if cmd.set {
+			sess.writer.WriteSimple("OK")
+		} else {
+			var count int64
+
+			for _, found := range existed[:len(cmd.ops)] {
+				if found {
+					count++
+				}
+			}
+
+			sess.writer.WriteInt(count)
+		}
+
+		existed = existed[len(cmd.ops):]
+	}
+}
+
+// discard drops the queued commands.
+func discard(sess *session, _ []string) {
+	if sess.tx == nil {
+		sess.writer.WriteError("ERR DISCARD without MULTI")
+		return
+	}
+
+	sess.tx = nil
+	sess.writer.WriteSimple("OK")
+}
+
+func quit(sess *session, _ []string) {
+	sess.quit = true
+	sess.writer.WriteSimple("OK")
+}
@@ -0,0 +1,309 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a RESP value, it is the first byte of the value on the wire.
+type Kind byte
+
+const (
+	SimpleString Kind = '+'
+	ErrorReply   Kind = '-'
+	Integer      Kind = ':'
+	BulkString   Kind = '$'
+	Array        Kind = '*'
+
+	// the kinds below are RESP3 only
+	Null      Kind = '_'
+	Boolean   Kind = '#'
+	Double    Kind = ','
+	BigNumber Kind = '('
+	BulkError Kind = '!'
+	Verbatim  Kind = '='
+	Map       Kind = '%'
+	Set       Kind = '~'
+	Push      Kind = '>'
+	Attribute Kind = '|'
+)
+
+const (
+	// MaxBulkLength is the largest bulk string that is read, MaxArrayLength the largest array.
+	MaxBulkLength  = 512 << 20
+	MaxArrayLength = 1 << 20
+
+	// maxInlineLength is the longest line, of a command without RESP framing (like from telnet) or a header.
+	maxInlineLength = 64 << 10
+)
+
+// ErrProtocol is returned when the data that is read isn't valid RESP.
+var ErrProtocol = errors.New("protocol error")
+
+// Value is a value read from the wire. A null (RESP3, or a null bulk string or array in RESP2)
+// has IsNull set. A map holds its keys and values one after the other in Elems.
+type Value struct {
+	Kind   Kind
+	Str    string // simple string, error, bulk string, double, big number, verbatim string
+	Int    int64  // integer
+	Bool   bool   // boolean
+	Elems  []Value
+	IsNull bool
+}
+
+// Reader reads RESP values and commands.
+type Reader struct {
+	br *bufio.Reader
+}
+
+// Writer writes RESP values, in the format of the protocol version (2 or 3).
+type Writer struct {
+	bw       *bufio.Writer
+	Protocol int
+}
+
+// NewReader returns a reader that reads from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReader(r)}
+}
+
+// Buffered tells if more data has been read than has been used.
+func (r *Reader) Buffered() bool {
+	return r.br.Buffered() > 0
+}
+
+// ReadCommand reads a command: an array of bulk strings, or a line of words (an inline command).
+// An empty line is returned as an empty command.
+func (r *Reader) ReadCommand() ([]string, error) {
+	first, err := r.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if Kind(first[0]) != Array {
+		line, err := r.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+
+		return strings.Fields(line), nil
+	}
+
+	value, err := r.ReadValue()
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, len(value.Elems))
+	for _, elem := range value.Elems {
+		if elem.Kind != BulkString || elem.IsNull {
+			return nil, fmt.Errorf("%w: expected a bulk string in the command", ErrProtocol)
+		}
+
+		args = append(args, elem.Str)
+	}
+
+	return args, nil
+}
+
+// ReadValue reads the next value, attributes (RESP3) are skipped.
+func (r *Reader) ReadValue() (Value, error) {
+	line, err := r.readLine(maxInlineLength)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if line == "" {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	kind, text := Kind(line[0]), line[1:]
+	value := Value{Kind: kind}
+
+	switch kind {
+	case SimpleString, ErrorReply, Double, BigNumber:
+		value.Str = text
+	case Integer:
+		value.Int, err = strconv.ParseInt(text, 10, 64)
+	case Null:
+		value.IsNull = true
+	case Boolean:
+		value.Bool = text == "t"
+	case BulkString, BulkError, Verbatim:
+		value, err = r.readBulk(value, text)
+	case Array, Set, Push, Map, Attribute:
+		value, err = r.readAggregate(value, text)
+		if err == nil && kind == Attribute {
+			return r.ReadValue()
+		}
+	default:
+		err = fmt.Errorf("%w: unknown type %q", ErrProtocol, kind)
+	}
+
+	return value, err
+}
+
+// readBulk reads the data of a bulk string of the given length.
+func (r *Reader) readBulk(value Value, text string) (Value, error) {
+	length, err := parseLength(text, MaxBulkLength)
+	if err != nil || length < 0 {
+		value.IsNull = true
+		return value, err
+	}
+
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(r.br, data); err != nil {
+		return value, err
+	}
+
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return value, fmt.Errorf("%w: bulk string without CRLF", ErrProtocol)
+	}
+
+	value.Str = string(data[:length])
+	if value.Kind == Verbatim && len(value.Str) >= 4 {
+		// the format (like "txt:") is left out
+		value.Str = value.Str[4:]
+	}
+
+	return value, nil
+}
+
+// readAggregate reads the elements of an array, set, push, map or attribute.
+func (r *Reader) readAggregate(value Value, text string) (Value, error) {
+	count, err := parseLength(text, MaxArrayLength)
+	if err != nil || count < 0 {
+		value.IsNull = true
+		return value, err
+	}
+
+	if value.Kind == Map || value.Kind == Attribute {
+		count *= 2
+	}
+
+	value.Elems = make([]Value, 0, count)
+	for range count {
+		elem, err := r.ReadValue()
+		if err != nil {
+			return value, err
+		}
+
+		value.Elems = append(value.Elems, elem)
+	}
+
+	return value, nil
+}
+
+// readLine reads a line that ends with CRLF (or LF), without the line ending.
+func (r *Reader) readLine(limit int) (string, error) {
+	var line []byte
+
+	for {
+		part, isPrefix, err := r.br.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		line = append(line, part...)
+		if len(line) > limit {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// parseLength parses the length of a bulk string or aggregate, -1 is a null.
+func parseLength(text string, limit int) (int, error) {
+	length, err := strconv.Atoi(text)
+	if err != nil || length < -1 || length > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, text)
+	}
+
+	return length, nil
+}
+
+// NewWriter returns a writer that writes RESP2 to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{bw: bufio.NewWriter(w), Protocol: 2}
+}
+
+// Flush writes the buffered data.
+func (w *Writer) Flush() error {
+	return w.bw.Flush()
+}
+
+// WriteSimple writes a simple string, it should not contain CR or LF.
+func (w *Writer) WriteSimple(text string) {
+	w.line(SimpleString, text)
+}
+
+// WriteError writes an error, the message starts with its code (like ERR or WRONGTYPE).
+func (w *Writer) WriteError(message string) {
+	w.line(ErrorReply, strings.NewReplacer("\r", " ", "\n", " ").Replace(message))
+}
+
+// WriteInt writes an integer.
+func (w *Writer) WriteInt(number int64) {
+	w.line(Integer, strconv.FormatInt(number, 10))
+}
+
+// WriteBulk writes a bulk string.
+func (w *Writer) WriteBulk(data []byte) {
+	w.line(BulkString, strconv.Itoa(len(data)))
+	_, _ = w.bw.Write(data)
+	_, _ = w.bw.WriteString("\r\n")
+}
+
+// WriteBulkString writes a string as a bulk string.
+func (w *Writer) WriteBulkString(text string) {
+	w.WriteBulk([]byte(text))
+}
+
+// WriteNull writes a null, a null bulk string in RESP2.
+func (w *Writer) WriteNull() {
+	if w.Protocol >= 3 {
+		w.line(Null, "")
+		return
+	}
+
+	w.line(BulkString, "-1")
+}
+
+// WriteArray writes the header of an array of count elements, the elements are written after it.
+func (w *Writer) WriteArray(count int) {
+	w.line(Array, strconv.Itoa(count))
+}
+
+// WriteMap writes the header of a map of count pairs, the keys and values are written after it.
+// In RESP2 it is an array of the keys and values.
+func (w *Writer) WriteMap(count int) {
+	if w.Protocol >= 3 {
+		w.line(Map, strconv.Itoa(count))
+		return
+	}
+
+	w.WriteArray(count * 2)
+}
+
+// WriteCommand writes a command as an array of bulk strings.
+func (w *Writer) WriteCommand(args ...string) {
+	w.WriteArray(len(args))
+
+	for _, arg := range args {
+		w.WriteBulkString(arg)
+	}
+}
+
+// line writes one line of the given kind.
+func (w *Writer) line(kind Kind, text string) {
+	_ = w.bw.WriteByte(byte(kind))
+	_, _ = w.bw.WriteString(text)
+	_, _ = w.bw.WriteString("\r\n")
+}
@@ -0,0 +1,93 @@
+package resp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_ReadValue(t *testing.T) {
+	input := strings.Join([]string{
+		"+OK",
+		"-ERR wrong",
+		":42",
+		"$5", "hello",
+		"$-1",
+		"*-1",
+		"_",
+		"#t",
+		",3.14",
+		"=8", "txt:text",
+		"|1", "+key", "+value", // an attribute is skipped
+		"%1", "+a", ":1",
+		"*2", "$1", "x", "~1", ":2",
+	}, "\r\n") + "\r\n"
+
+	reader := NewReader(strings.NewReader(input))
+
+	want := []Value{
+		{Kind: SimpleString, Str: "OK"},
+		{Kind: ErrorReply, Str: "ERR wrong"},
+		{Kind: Integer, Int: 42},
+		{Kind: BulkString, Str: "hello"},
+		{Kind: BulkString, IsNull: true},
+		{Kind: Array, IsNull: true},
+		{Kind: Null, IsNull: true},
+		{Kind: Boolean, Bool: true},
+		{Kind: Double, Str: "3.14"},
+		{Kind: Verbatim, Str: "text"},
+		{Kind: Map, Elems: []Value{{Kind: SimpleString, Str: "a"}, {Kind: Integer, Int: 1}}},
+		{Kind: Array, Elems: []Value{{Kind: BulkString, Str: "x"}, {Kind: Set, Elems: []Value{{Kind: Integer, Int: 2}}}}},
+	}
+
+	for _, expected := range want {
+		value, err := reader.ReadValue()
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+}
+
+func TestReader_ReadCommand(t *testing.T) {
+	reader := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\n1\r\nPING  hi\r\n\r\n*1\r\n:1\r\n"))
+
+	args, err := reader.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET", "1"}, args)
+
+	args, err = reader.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PING", "hi"}, args, "an inline command")
+
+	args, err = reader.ReadCommand()
+	require.NoError(t, err)
+	assert.Empty(t, args)
+
+	_, err = reader.ReadCommand()
+	require.ErrorIs(t, err, ErrProtocol, "a command only holds bulk strings")
+}
+
+func TestReader_invalid(t *testing.T) {
+	for _, input := range []string{"$abc\r\n", "$3\r\nabcde\r\n", "?\r\n", "*2000000\r\n", "\r\n", "+" + strings.Repeat("a", maxInlineLength+1) + "\r\n"} {
+		_, err := NewReader(strings.NewReader(input)).ReadValue()
+		require.ErrorIs(t, err, ErrProtocol, input[:min(len(input), 20)])
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := NewWriter(&buffer)
+	writer.WriteNull()
+	writer.WriteMap(1)
+	writer.WriteError("ERR two\nlines")
+	writer.Protocol = 3
+	writer.WriteNull()
+	writer.WriteMap(1)
+	writer.WriteCommand("GET", "1")
+	require.NoError(t, writer.Flush())
+
+	assert.Equal(t, "$-1\r\n*2\r\n-ERR two lines\r\n_\r\n%1\r\n*2\r\n$3\r\nGET\r\n$1\r\n1\r\n", buffer.String())
+}
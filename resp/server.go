@@ -0,0 +1,270 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+)
+
+const (
+	// DefaultDatabases is the number of databases SELECT chooses from, when WithBuckets isn't used.
+	DefaultDatabases = 16
+
+	// RedisVersion is the version of Redis the server answers like, clients check it for the commands they use.
+	RedisVersion = "7.0.0"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server answers Redis clients, it maps the databases of SELECT onto buckets.
+type Server struct {
+	backend     Backend
+	permissions service.Permissions
+	login       service.Login // nil when the clients don't log in
+	timeout     time.Duration
+	buckets     []string
+	listener    net.Listener
+	conns       map[net.Conn]struct{}
+	lastID      atomic.Int64
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	closed      bool
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPermissions sets the permissions of the buckets, all buckets may be read and written without it.
+func WithPermissions(permissions service.Permissions) Option {
+	return func(s *Server) {
+		s.permissions = permissions
+	}
+}
+
+// WithLogin makes the clients log in with AUTH (or HELLO with AUTH) before the other commands,
+// they get the permissions that both the server and their credential give.
+func WithLogin(login service.Login) Option {
+	return func(s *Server) {
+		s.login = login
+	}
+}
+
+// WithBuckets sets the buckets of the databases, SELECT n uses the nth bucket.
+// Without it database 0 is replicationmanager.KeyBucket, and database n is bucket "db<n>".
+func WithBuckets(buckets ...string) Option {
+	return func(s *Server) {
+		if len(buckets) > 0 {
+			s.buckets = buckets
+		}
+	}
+}
+
+// WithRequestTimeout sets the deadline of one command, service.RequestTimeout without it.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// NewServer returns a server that keeps the keys in the backend.
+func NewServer(backend Backend, opts ...Option) *Server {
+	buckets := make([]string, DefaultDatabases)
+	buckets[0] = replicationmanager.KeyBucket
+
+	for i := 1; i < DefaultDatabases; i++ {
+		buckets[i] = "db" + strconv.Itoa(i)
+	}
+
+	s := &Server{
+		backend:     backend,
+		permissions: service.NewPermissions(service.ReadWrite),
+		timeout:     service.RequestTimeout,
+		buckets:     buckets,
+		conns:       map[net.Conn]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe listens on a TCP address, and serves the connections until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve serves the connections of the listener until Close, it always returns an error.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops listening, closes the connections and waits until their commands are done.
+func (s *Server) Close() error {
+	err := s.stop()
+	s.closeConns()
+
+	s.wg.Wait()
+	return err
+}
+
+// Shutdown stops listening, lets the connections answer the commands they are running and closes them.
+// The connections that are still running a command when the context ends are closed right away,
+// their commands aren't waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stop()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		// the command that runs is answered, the next read fails
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		return fmt.Errorf("resp: commands are still running: %w", ctx.Err())
+	}
+}
+
+// stop stops listening, the connections that are accepted after it are closed.
+func (s *Server) stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// track keeps a connection, so Close can close it. It returns false when the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	conn.Close()
+	s.wg.Done()
+}
+
+// serveConn reads the commands of a connection and answers them, until the client quits.
+// The answers are written when no more commands are waiting, so pipelined commands are answered at once.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+
+	sess := &session{
+		server:        s,
+		id:            s.lastID.Add(1),
+		reader:        NewReader(conn),
+		writer:        NewWriter(conn),
+		bucket:        s.buckets[0],
+		permissions:   s.permissions,
+		authenticated: s.login == nil,
+	}
+
+	for !sess.quit {
+		args, err := sess.reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				sess.writer.WriteError("ERR Protocol error: " + err.Error())
+				sess.writer.Flush()
+			}
+			return
+		}
+
+		if len(args) > 0 {
+			sess.handle(args)
+		}
+
+		if !sess.reader.Buffered() || sess.quit {
+			if err := sess.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// context returns the context of one command.
+func (s *Server) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
@@ -0,0 +1,560 @@
+package resp
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/replication/election"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves the backend on a free port, and returns a client that is connected to it.
+func startServer(t *testing.T, backend Backend, opts ...Option) *Client {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(backend, opts...)
+	go server.Serve(listener)
+
+	client, err := Dial(listener.Addr().String())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		client.Close()
+		require.NoError(t, server.Close())
+	})
+
+	return client
+}
+
+func startLocal(t *testing.T, opts ...Option) (*Client, *fastdb.DB) {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return startServer(t, Local(db), opts...), db
+}
+
+// do sends a command, and fails the test when it can't be sent or the answer is an error.
+func do(t *testing.T, client *Client, args ...string) Value {
+	t.Helper()
+
+	value, err := client.Do(args...)
+	require.NoError(t, err, args)
+
+	return value
+}
+
+func TestServer_GetSetDel(t *testing.T) {
+	client, db := startLocal(t)
+
+	assert.Equal(t, "PONG", do(t, client, "PING").Str)
+	assert.Equal(t, "hi", do(t, client, "ECHO", "hi").Str)
+
+	assert.True(t, do(t, client, "GET", "1").IsNull)
+	assert.Equal(t, "OK", do(t, client, "SET", "1", "one").Str)
+	assert.Equal(t, "one", do(t, client, "get", "1").Str)
+
+	value, found := db.Get(replicationmanager.KeyBucket, 1)
+	assert.True(t, found)
+	assert.Equal(t, "one", string(value))
+
+	assert.True(t, do(t, client, "SET", "1", "uno", "NX").IsNull, "the key exists")
+	assert.True(t, do(t, client, "SET", "2", "two", "XX").IsNull, "the key doesn't exist")
+	assert.Equal(t, "OK", do(t, client, "SET", "1", "uno", "XX").Str)
+	assert.Equal(t, "OK", do(t, client, "SET", "2", "two", "NX").Str)
+
+	assert.Equal(t, int64(2), do(t, client, "EXISTS", "1", "2", "3").Int)
+	assert.Equal(t, int64(2), do(t, client, "DEL", "1", "2", "3").Int)
+	assert.Equal(t, int64(0), do(t, client, "EXISTS", "1").Int)
+
+	_, err := client.Do("SET", "one", "1")
+	assert.EqualError(t, err, "ERR key should be a positive integer")
+
+	_, err = client.Do("SET", "1", "one", "NX", "XX")
+	assert.EqualError(t, err, "ERR syntax error")
+
+	_, err = client.Do("GET")
+	assert.EqualError(t, err, "ERR wrong number of arguments for 'get' command")
+
+	_, err = client.Do("FLUSHALL")
+	assert.EqualError(t, err, "ERR unknown command 'FLUSHALL'")
+
+	// a value is binary safe
+	assert.Equal(t, "OK", do(t, client, "SET", "5", "two\r\nlines\x00").Str)
+	assert.Equal(t, "two\r\nlines\x00", do(t, client, "GET", "5").Str)
+}
+
+func TestServer_binaryValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resp.db")
+
+	db, err := fastdb.Open(path, 100)
+	require.NoError(t, err)
+
+	client := startServer(t, Local(db))
+	value := "serialized\n\x00\r\nblob"
+	assert.Equal(t, "OK", do(t, client, "SET", "1", value).Str)
+	require.NoError(t, db.Close())
+
+	// the value is read back from the data file as it was set
+	db, err = fastdb.Open(path, 100)
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, value, do(t, startServer(t, Local(db)), "GET", "1").Str)
+}
+
+func TestServer_Incr(t *testing.T) {
+	client, _ := startLocal(t)
+
+	assert.Equal(t, int64(1), do(t, client, "INCR", "1").Int)
+	assert.Equal(t, int64(2), do(t, client, "INCR", "1").Int)
+	assert.Equal(t, "2", do(t, client, "GET", "1").Str)
+
+	do(t, client, "SET", "2", "two")
+	_, err := client.Do("INCR", "2")
+	assert.EqualError(t, err, "ERR value is not an integer or out of range")
+}
+
+func TestServer_ExpireTTL(t *testing.T) {
+	client, _ := startLocal(t)
+
+	assert.Equal(t, int64(-2), do(t, client, "TTL", "1").Int)
+
+	do(t, client, "SET", "1", "one")
+	assert.Equal(t, int64(-1), do(t, client, "TTL", "1").Int)
+
+	assert.Equal(t, int64(1), do(t, client, "EXPIRE", "1", "100").Int)
+	assert.Equal(t, int64(100), do(t, client, "TTL", "1").Int)
+	assert.Equal(t, int64(0), do(t, client, "EXPIRE", "2", "100").Int)
+
+	do(t, client, "INCR", "3")
+	do(t, client, "EXPIRE", "3", "100")
+	do(t, client, "INCR", "3")
+	assert.Equal(t, int64(100), do(t, client, "TTL", "3").Int, "INCR keeps the expiry")
+
+	do(t, client, "SET", "1", "one")
+	assert.Equal(t, int64(-1), do(t, client, "TTL", "1").Int, "SET removes the expiry")
+
+	do(t, client, "SET", "1", "one", "PX", "20")
+	assert.Positive(t, do(t, client, "PTTL", "1").Int)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, do(t, client, "GET", "1").IsNull, "the key has expired")
+
+	do(t, client, "SET", "1", "one", "EX", "10")
+	assert.Equal(t, int64(10), do(t, client, "TTL", "1").Int)
+
+	assert.Equal(t, int64(1), do(t, client, "EXPIRE", "1", "0").Int)
+	assert.Equal(t, int64(0), do(t, client, "EXISTS", "1").Int, "a ttl that isn't positive deletes the key")
+
+	_, err := client.Do("SET", "1", "one", "EX", "0")
+	assert.EqualError(t, err, "ERR invalid expire time in 'set' command")
+}
+
+func TestServer_KeysScan(t *testing.T) {
+	client, _ := startLocal(t)
+
+	for _, key := range []string{"1", "2", "10", "11", "20"} {
+		do(t, client, "SET", key, "value")
+	}
+
+	assert.Equal(t, []string{"1", "10", "11"}, texts(do(t, client, "KEYS", "1*")))
+	assert.Equal(t, []string{"1", "2", "10", "11", "20"}, texts(do(t, client, "KEYS", "*")))
+
+	var (
+		cursor = "0"
+		found  []string
+	)
+
+	for {
+		page := do(t, client, "SCAN", cursor, "COUNT", "2")
+		require.Len(t, page.Elems, 2)
+
+		found = append(found, texts(page.Elems[1])...)
+		cursor = page.Elems[0].Str
+		if cursor == "0" {
+			break
+		}
+	}
+
+	assert.Equal(t, []string{"1", "2", "10", "11", "20"}, found)
+
+	page := do(t, client, "SCAN", "0", "MATCH", "2*", "COUNT", "100")
+	assert.Equal(t, "0", page.Elems[0].Str)
+	assert.Equal(t, []string{"2", "20"}, texts(page.Elems[1]))
+
+	_, err := client.Do("KEYS", "[")
+	assert.EqualError(t, err, "ERR invalid pattern")
+}
+
+func TestServer_Select(t *testing.T) {
+	client, db := startLocal(t, WithBuckets("kvstore", "logs"))
+
+	do(t, client, "SET", "1", "zero")
+	assert.Equal(t, "OK", do(t, client, "SELECT", "1").Str)
+	assert.True(t, do(t, client, "GET", "1").IsNull)
+	do(t, client, "SET", "1", "one")
+
+	value, _ := db.Get("logs", 1)
+	assert.Equal(t, "one", string(value))
+
+	_, err := client.Do("SELECT", "2")
+	assert.EqualError(t, err, "ERR DB index is out of range")
+
+	text := do(t, client, "INFO").Str
+	assert.Contains(t, text, "db0:keys=1,bucket=kvstore")
+	assert.Contains(t, text, "db1:keys=1,bucket=logs")
+}
+
+func TestServer_MultiExec(t *testing.T) {
+	client, db := startLocal(t)
+
+	do(t, client, "SET", "1", "one")
+	do(t, client, "SET", "2", "two")
+
+	assert.Equal(t, "OK", do(t, client, "MULTI").Str)
+	assert.Equal(t, "QUEUED", do(t, client, "SET", "3", "three").Str)
+	assert.Equal(t, "QUEUED", do(t, client, "DEL", "1", "4").Str)
+	assert.Equal(t, "QUEUED", do(t, client, "SET", "4", "four").Str)
+	assert.Equal(t, "QUEUED", do(t, client, "DEL", "4").Str)
+
+	_, found := db.Get(replicationmanager.KeyBucket, 3)
+	assert.False(t, found, "nothing is written before EXEC")
+
+	reply := do(t, client, "EXEC")
+	require.Len(t, reply.Elems, 4)
+	assert.Equal(t, "OK", reply.Elems[0].Str)
+	assert.Equal(t, int64(1), reply.Elems[1].Int, "only key 1 existed")
+	assert.Equal(t, "OK", reply.Elems[2].Str)
+	assert.Equal(t, int64(1), reply.Elems[3].Int, "key 4 is set before it is deleted")
+
+	value, _ := db.Get(replicationmanager.KeyBucket, 3)
+	assert.Equal(t, "three", string(value))
+
+	for _, key := range []int{1, 4} {
+		_, found = db.Get(replicationmanager.KeyBucket, key)
+		assert.False(t, found, key)
+	}
+
+	// DISCARD drops the queued commands
+	do(t, client, "MULTI")
+	do(t, client, "SET", "2", "changed")
+	assert.Equal(t, "OK", do(t, client, "DISCARD").Str)
+	assert.Equal(t, "two", do(t, client, "GET", "2").Str)
+
+	// an error while queueing discards the transaction at EXEC
+	do(t, client, "MULTI")
+	do(t, client, "SET", "2", "changed")
+
+	_, err := client.Do("GET", "2")
+	assert.EqualError(t, err, "ERR 'get' can not be used in a transaction, only SET and DEL")
+
+	_, err = client.Do("SET", "2", "changed", "NX")
+	assert.EqualError(t, err, "ERR SET options can not be used in a transaction")
+
+	_, err = client.Do("MULTI")
+	assert.EqualError(t, err, "ERR MULTI calls can not be nested")
+
+	_, err = client.Do("EXEC")
+	assert.EqualError(t, err, "EXECABORT Transaction discarded because of previous errors.")
+	assert.Equal(t, "two", do(t, client, "GET", "2").Str)
+
+	_, err = client.Do("EXEC")
+	assert.EqualError(t, err, "ERR EXEC without MULTI")
+
+	_, err = client.Do("DISCARD")
+	assert.EqualError(t, err, "ERR DISCARD without MULTI")
+
+	do(t, client, "MULTI")
+	assert.Empty(t, do(t, client, "EXEC").Elems)
+}
+
+func TestServer_Hello(t *testing.T) {
+	client, _ := startLocal(t)
+
+	reply := do(t, client, "HELLO")
+	assert.Equal(t, Array, reply.Kind, "RESP2 has no maps")
+
+	reply = do(t, client, "HELLO", "3")
+	assert.Equal(t, Map, reply.Kind)
+	assert.Equal(t, "fastdb", reply.Elems[1].Str)
+	assert.Equal(t, int64(3), reply.Elems[5].Int)
+
+	assert.Equal(t, Null, do(t, client, "GET", "1").Kind, "RESP3 has its own null")
+
+	_, err := client.Do("HELLO", "4")
+	assert.EqualError(t, err, "NOPROTO unsupported protocol version")
+}
+
+func TestServer_Permissions(t *testing.T) {
+	permissions, err := service.ParsePermissions("kvstore=r,db1=rw,*=none")
+	require.NoError(t, err)
+
+	client, _ := startLocal(t, WithPermissions(permissions))
+
+	do(t, client, "GET", "1")
+
+	_, err = client.Do("SET", "1", "one")
+	assert.EqualError(t, err, "NOPERM permission denied: no write access to bucket (kvstore)")
+
+	do(t, client, "SELECT", "1")
+	do(t, client, "SET", "1", "one")
+
+	do(t, client, "SELECT", "2")
+	_, err = client.Do("GET", "1")
+	assert.EqualError(t, err, "NOPERM permission denied: no read access to bucket (db2)")
+}
+
+func TestServer_Auth(t *testing.T) {
+	credentials, err := service.ParseCredentials("app:s3cret:kvstore=rw,*=none;reader:other:*=r")
+	require.NoError(t, err)
+
+	auth, err := service.NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	client, _ := startLocal(t, WithLogin(auth.Login))
+
+	_, err = client.Do("GET", "1")
+	assert.EqualError(t, err, "NOAUTH Authentication required.")
+
+	_, err = client.Do("AUTH", "wrong")
+	assert.EqualError(t, err, "WRONGPASS invalid username-password pair or user is disabled.")
+
+	_, err = client.Do("AUTH", "reader", "s3cret")
+	assert.EqualError(t, err, "WRONGPASS invalid username-password pair or user is disabled.", "the secret of another name")
+
+	assert.Equal(t, "OK", do(t, client, "AUTH", "s3cret").Str)
+	do(t, client, "SET", "1", "one")
+
+	// the permissions of the credential
+	do(t, client, "SELECT", "1")
+	_, err = client.Do("GET", "1")
+	assert.EqualError(t, err, "NOPERM permission denied: no read access to bucket (db1)")
+
+	// AUTH again logs in with a name
+	do(t, client, "AUTH", "reader", "other")
+	do(t, client, "SELECT", "0")
+	assert.Equal(t, "one", do(t, client, "GET", "1").Str)
+
+	_, err = client.Do("SET", "1", "two")
+	assert.EqualError(t, err, "NOPERM permission denied: no write access to bucket (kvstore)")
+
+	// HELLO logs in too
+	other, _ := startLocal(t, WithLogin(auth.Login))
+
+	_, err = other.Do("HELLO", "3")
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "NOAUTH"), err)
+
+	assert.Equal(t, Map, do(t, other, "HELLO", "3", "AUTH", "default", "s3cret").Kind)
+	do(t, other, "SET", "1", "one")
+
+	// without a login AUTH is an error
+	open, _ := startLocal(t)
+	_, err = open.Do("AUTH", "s3cret")
+	require.Error(t, err)
+}
+
+func TestServer_inlineAndPipelined(t *testing.T) {
+	_, db := startLocal(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(Local(db))
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// an inline command and two pipelined commands
+	_, err = conn.Write([]byte("SET 1 one\r\n*2\r\n$3\r\nGET\r\n$1\r\n1\r\n*1\r\n$4\r\nQUIT\r\n"))
+	require.NoError(t, err)
+
+	reader := NewReader(conn)
+	for _, want := range []string{"OK", "one", "OK"} {
+		value, err := reader.ReadValue()
+		require.NoError(t, err)
+		assert.Equal(t, want, value.Str)
+	}
+}
+
+func TestServer_replicated(t *testing.T) {
+	leaderListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backupListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	leaderDB, leader := startNode(t, leaderListener, 1, map[int]string{2: backupListener.Addr().String()})
+	backupDB, backup := startNode(t, backupListener, 2, map[int]string{1: leaderListener.Addr().String()})
+
+	leaderClient := startServer(t, Replicated(leader))
+	backupClient := startServer(t, Replicated(backup))
+
+	do(t, leaderClient, "SET", "1", "one", "EX", "100")
+	do(t, leaderClient, "INCR", "2")
+
+	value, _ := backupDB.Get(replicationmanager.KeyBucket, 1)
+	assert.Equal(t, "one", string(value), "the set is replicated")
+
+	ttl, _ := backupDB.TTL(replicationmanager.KeyBucket, 1)
+	assert.Greater(t, ttl, 99*time.Second, "the expiry is replicated")
+
+	// the backup reads from the leader, and doesn't write
+	assert.Equal(t, "1", do(t, backupClient, "GET", "2").Str)
+	assert.Equal(t, int64(100), do(t, backupClient, "TTL", "1").Int)
+
+	_, err = backupClient.Do("SET", "3", "three")
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "READONLY"), err)
+
+	do(t, leaderClient, "EXPIRE", "2", "50")
+	ttl, _ = backupDB.TTL(replicationmanager.KeyBucket, 2)
+	assert.Greater(t, ttl, 49*time.Second)
+
+	do(t, leaderClient, "DEL", "1")
+	_, found := backupDB.Get(replicationmanager.KeyBucket, 1)
+	assert.False(t, found, "the delete is replicated")
+
+	do(t, leaderClient, "MULTI")
+	do(t, leaderClient, "SET", "5", "five")
+	do(t, leaderClient, "DEL", "2")
+	reply := do(t, leaderClient, "EXEC")
+	require.Len(t, reply.Elems, 2)
+	assert.Equal(t, int64(1), reply.Elems[1].Int)
+
+	value, _ = backupDB.Get(replicationmanager.KeyBucket, 5)
+	assert.Equal(t, "five", string(value), "the transaction is replicated")
+	_, found = backupDB.Get(replicationmanager.KeyBucket, 2)
+	assert.False(t, found)
+
+	_, found = leaderDB.Get(replicationmanager.KeyBucket, 1)
+	assert.False(t, found)
+}
+
+func startNode(t *testing.T, listener net.Listener, nodeID int, peers map[int]string) (*fastdb.DB, *replicationmanager.ReplicationManager) {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+
+	bully := election.NewBullyAlgorithm(nodeID, 1, peers)
+	replication := replicationmanager.NewReplicationManager(nodeID, db, bully)
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("ReplicationManager", replication))
+	go server.Accept(listener)
+
+	t.Cleanup(func() {
+		listener.Close()
+		db.Close()
+	})
+
+	return db, replication
+}
+
+// texts returns the strings of the elements of an array.
+func texts(value Value) []string {
+	texts := []string{}
+	for _, elem := range value.Elems {
+		texts = append(texts, elem.Str)
+	}
+
+	return texts
+}
+
+// blockingBackend answers GET when release is closed, it tells on started that a GET runs.
+type blockingBackend struct {
+	Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Get(ctx context.Context, bucket string, key int) ([]byte, bool, error) {
+	b.started <- struct{}{}
+	<-b.release
+
+	return b.Backend.Get(ctx, bucket, key)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// start serves a backend that blocks GET, with a client that runs one and an idle client
+	start := func() (*Server, *blockingBackend, chan error, *Client) {
+		backend := &blockingBackend{Backend: Local(db), started: make(chan struct{}), release: make(chan struct{})}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := NewServer(backend)
+		go server.Serve(listener)
+
+		busy, err := Dial(listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { busy.Close() })
+
+		idle, err := Dial(listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { idle.Close() })
+
+		do(t, idle, "PING")
+
+		answered := make(chan error, 1)
+		go func() {
+			_, err := busy.Do("GET", "1")
+			answered <- err
+		}()
+		<-backend.started
+
+		return server, backend, answered, idle
+	}
+
+	server, backend, answered, idle := start()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	_, err = idle.Do("PING")
+	require.Error(t, err, "an idle connection is closed")
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the command ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	require.NoError(t, <-answered, "a running command is answered")
+	require.NoError(t, <-shutdown)
+
+	// a command that runs when the context ends isn't waited for
+	server, backend, answered, _ = start()
+	defer close(backend.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	require.Error(t, <-answered, "the connection is closed")
+}
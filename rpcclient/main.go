@@ -1,94 +1,97 @@
 package main
 
 import (
-	"bufio"
-	"encoding/gob"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"log"
-	"net/rpc"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/marcelloh/fastdb/client"
+	"github.com/marcelloh/fastdb/transport"
 )
 
 const (
 	rpcPort = "localhost:8082"
-)
-
-type GetResult struct {
-	Value     []byte
-	Found     bool
-	Timestamp time.Time
-	Source    string
-}
 
-func init() {
-	gob.Register(map[string]interface{}{})
-	gob.Register([]interface{}{})
-	gob.Register([]byte{})
-	gob.Register(string(""))
-	gob.Register(int(0))
-	gob.Register(float64(0))
-	gob.Register(bool(false))
-}
+	historyFile = ".fastdb_history"
+)
 
 func main() {
-	client, err := rpc.Dial("tcp", rpcPort)
-	if err != nil {
-		log.Fatalf("Error dialing connection to server: %v", err)
+	addr := flag.String("addr", rpcPort, "address of one of the nodes, the leader is found from there")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of one request")
+	format := flag.String("format", formatTable, "output format: table or json")
+	bucket := flag.String("bucket", "", "bucket of the commands, the default bucket of the server when empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: rpcclient [flags] [command [arguments]]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Without a command an interactive shell is started, type help for the commands.\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "A cluster that requires authentication gets FASTDB_USER and FASTDB_SECRET, or FASTDB_TOKEN.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "A cluster with TLS gets FASTDB_TLS_CA, and FASTDB_TLS_CERT and FASTDB_TLS_KEY for a client certificate.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *format != formatTable && *format != formatJSON {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		os.Exit(2)
 	}
-	defer client.Close()
 
-	reader := bufio.NewReader(os.Stdin)
+	sh := newShell(os.Stdout, *timeout, *format)
+	sh.bucket = *bucket
 
-	// Input for Set method
-	var key int
-	fmt.Print("Enter key (integer): ")
-	fmt.Scanln(&key)
+	// the credentials come from the environment, so they don't show up in ps
+	switch {
+	case os.Getenv("FASTDB_USER") != "":
+		sh.options = append(sh.options, client.WithHMAC(os.Getenv("FASTDB_USER"), os.Getenv("FASTDB_SECRET")))
+	case os.Getenv("FASTDB_TOKEN") != "":
+		sh.options = append(sh.options, client.WithToken(os.Getenv("FASTDB_TOKEN")))
+	}
 
-	fmt.Print("Enter value (any type): ")
-	value, err := reader.ReadString('\n')
-	if err != nil {
-		log.Fatalf("Error reading value: %v", err)
+	if caFile := os.Getenv("FASTDB_TLS_CA"); caFile != "" {
+		config, err := clientTLS(caFile, os.Getenv("FASTDB_TLS_CERT"), os.Getenv("FASTDB_TLS_KEY"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sh.options = append(sh.options, client.WithTLS(config))
+	}
+	if err := sh.connect(*addr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	value = strings.TrimSpace(value)
+	defer sh.close()
 
-	var valueType interface{}
-	if intValue, err := strconv.Atoi(value); err == nil {
-		valueType = intValue
-	} else if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
-		valueType = floatValue
-	} else if strings.ToLower(value) == "true" || strings.ToLower(value) == "false" {
-		boolValue := strings.ToLower(value) == "true"
-		valueType = boolValue
-	} else {
-		valueType = value
+	// one command from the arguments, for scripts
+	if flag.NArg() > 0 {
+		if err := sh.execute(strings.Join(flag.Args(), " ")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	var setReply string
-	setArgs := [2]interface{}{key, valueType}
-	err = client.Call("KeyValueStore.Set", setArgs, &setReply)
-	if err != nil {
-		log.Fatalf("Error calling Set method: %v", err)
+	if home, err := os.UserHomeDir(); err == nil {
+		sh.historyPath = filepath.Join(home, historyFile)
 	}
-	fmt.Println("Set key:", setArgs[0])
-	fmt.Println("Set value:", setArgs[1])
-	fmt.Println("Set reply:", setReply)
 
-	// Input for Get method
-	fmt.Print("\nEnter key to retrieve: ")
-	fmt.Scan(&key)
+	sh.run(os.Stdin)
+}
 
-	var getReply GetResult
-	getArgs := [1]interface{}{key}
-	err = client.Call("KeyValueStore.Get", getArgs, &getReply)
+// clientTLS returns the TLS config of a client that trusts the authority, with a certificate when it is given.
+func clientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	authorities, err := transport.LoadCertPool(caFile)
 	if err != nil {
-		log.Fatalf("Error calling Get method: %v", err)
+		return nil, err
+	}
+
+	var pair *transport.KeyPair
+	if certFile != "" {
+		if pair, err = transport.LoadKeyPair(certFile, keyFile); err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Printf(
-		"Value retrieved: [Value] = %s, [Found] = %t, [Timestamp] = %s, [Source] = %s\n",
-		getReply.Value, getReply.Found, getReply.Timestamp, getReply.Source,
-	)
+	return transport.ClientTLS(pair, authorities), nil
 }
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marcelloh/fastdb/client"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+
+	defaultWatchInterval = time.Second
+	maxHistory           = 1000
+)
+
+// shell runs the commands against the leader of the cluster.
+type shell struct {
+	client      *client.Client
+	addr        string // the address of the leader
+	bucket      string // the bucket of the commands, empty for the default bucket of the server
+	timeout     time.Duration
+	format      string
+	out         io.Writer
+	history     []string
+	historyPath string
+	commands    map[string]shellCommand
+	options     []client.Option // the options of the client, like its credentials
+}
+
+// shellCommand is one command of the shell.
+type shellCommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+func newShell(out io.Writer, timeout time.Duration, format string) *shell {
+	sh := &shell{out: out, timeout: timeout, format: format}
+	sh.commands = map[string]shellCommand{
+		"set":     {"set <key> <value>        sets a value (a number, true/false, JSON or text)", sh.set},
+		"get":     {"get <key>                gets a value", sh.get},
+		"del":     {"del <key>                deletes a key", sh.del},
+		"exists":  {"exists <key>             tells if a key exists", sh.exists},
+		"keys":    {"keys                     lists the keys", sh.keys},
+		"count":   {"count                    shows the number of keys", sh.count},
+		"buckets": {"buckets                  lists the buckets of all the nodes", sh.buckets},
+		"use":     {"use [bucket]             uses a bucket for the next commands, the default bucket without one", sh.use},
+		"all":     {"all                      lists the keys with their values", sh.all},
+		"watch":   {"watch <key> [interval]   shows every change of a key, until ctrl-c", sh.watch},
+		"info":    {"info                     shows the number of records", sh.info},
+		"leader":  {"leader                   shows the leader", sh.leader},
+		"cluster": {"cluster                  shows the nodes of the cluster", sh.cluster},
+		"format":  {"format <table|json>      sets the output format", sh.setFormat},
+		"history": {"history                  lists the commands, !n runs one again, !! the last one", sh.listHistory},
+		"help":    {"help                     shows the commands", sh.help},
+	}
+
+	return sh
+}
+
+// connect connects to a node, and finds the leader from there.
+func (sh *shell) connect(addr string) error {
+	c, err := client.New([]string{addr}, append([]client.Option{client.WithTimeout(sh.timeout)}, sh.options...)...)
+	if err != nil {
+		return err
+	}
+
+	sh.close()
+	sh.client = c
+	sh.addr = addr
+
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+
+	sh.addr = leader
+	return nil
+}
+
+func (sh *shell) close() {
+	if sh.client != nil {
+		sh.client.Close()
+		sh.client = nil
+	}
+}
+
+// context returns the context of one command.
+func (sh *shell) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sh.timeout)
+}
+
+// followLeader updates the address in the prompt, after the client went to another leader.
+func (sh *shell) followLeader(ctx context.Context) {
+	if leader, err := sh.client.Leader(ctx); err == nil {
+		sh.addr = leader
+	}
+}
+
+// run reads commands until the end of the input, or exit.
+func (sh *shell) run(in io.Reader) {
+	sh.loadHistory()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(sh.out, sh.prompt())
+		if !scanner.Scan() {
+			fmt.Fprintln(sh.out)
+			return
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "exit" || line == "quit" {
+			return
+		}
+
+		line, err := sh.expand(line)
+		if err == nil && line != "" {
+			sh.addHistory(line)
+			err = sh.execute(line)
+		}
+		if err != nil {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+}
+
+// execute runs one command line.
+func (sh *shell) execute(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	cmd, ok := sh.commands[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type help for the commands", fields[0])
+	}
+
+	return cmd.run(fields[1:])
+}
+
+func (sh *shell) set(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: set <key> <value>")
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	if err := sh.client.Set(ctx, sh.bucket, key, parseValue(strings.Join(args[1:], " "))); err != nil {
+		return err
+	}
+	sh.followLeader(ctx)
+
+	return sh.print(map[string]any{"key": key, "reply": "ok"}, []string{"key", "reply"})
+}
+
+func (sh *shell) get(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: get <key>")
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	result, err := sh.client.Get(ctx, sh.bucket, key, client.ReadFromLeader)
+	if err != nil {
+		return err
+	}
+	sh.followLeader(ctx)
+
+	return sh.printResult(key, *result)
+}
+
+func (sh *shell) del(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: del <key>")
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	deleted, err := sh.client.Delete(ctx, sh.bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return sh.print(map[string]any{"key": key, "deleted": deleted}, []string{"key", "deleted"})
+}
+
+// keys lists the keys, page by page.
+func (sh *shell) keys(_ []string) error {
+	var keys []int
+
+	for start := 0; ; {
+		ctx, cancel := sh.context()
+		page, err := sh.client.Keys(ctx, sh.bucket, start, 0)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		keys = append(keys, page...)
+		start = page[len(page)-1] + 1
+	}
+
+	return sh.printRows(listRows("key", keys), []string{"key"})
+}
+
+func (sh *shell) exists(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: exists <key>")
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	exists, err := sh.client.Exists(ctx, sh.bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return sh.print(map[string]any{"key": key, "exists": exists}, []string{"key", "exists"})
+}
+
+func (sh *shell) count(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	count, err := sh.client.Count(ctx, sh.bucket)
+	if err != nil {
+		return err
+	}
+
+	return sh.print(map[string]any{"count": count}, []string{"count"})
+}
+
+// prompt shows the leader, and the bucket when it isn't the default one.
+func (sh *shell) prompt() string {
+	if sh.bucket == "" {
+		return sh.addr + "> "
+	}
+
+	return fmt.Sprintf("%s[%s]> ", sh.addr, sh.bucket)
+}
+
+func (sh *shell) use(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: use [bucket]")
+	}
+
+	sh.bucket = ""
+	if len(args) == 1 {
+		sh.bucket = args[0]
+	}
+
+	return nil
+}
+
+func (sh *shell) all(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	records, err := sh.client.GetAllSorted(ctx, sh.bucket)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, map[string]any{"key": record.Key, "value": string(record.Value)})
+	}
+
+	return sh.printRows(rows, []string{"key", "value"})
+}
+
+func (sh *shell) buckets(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	buckets, err := sh.client.Buckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	return sh.printRows(listRows("bucket", buckets), []string{"bucket"})
+}
+
+// watch polls a key, and shows its value every time it changes.
+func (sh *shell) watch(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: watch <key> [interval]")
+	}
+
+	key, err := parseKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	interval := defaultWatchInterval
+	if len(args) == 2 {
+		if interval, err = time.ParseDuration(args[1]); err != nil || interval <= 0 {
+			return fmt.Errorf("wrong interval %q", args[1])
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return sh.poll(ctx, key, interval)
+}
+
+func (sh *shell) poll(ctx context.Context, key int, interval time.Duration) error {
+	var (
+		last      *client.GetResult
+		lastFound bool
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		callCtx, cancel := sh.context()
+		result, err := sh.client.Get(callCtx, sh.bucket, key, client.ReadFromLeader)
+		cancel()
+		found := err == nil
+
+		if first || found != lastFound || (found && !slices.Equal(last.Value, result.Value)) {
+			if !found {
+				fmt.Fprintf(sh.out, "%s key %d: %v\n", time.Now().Format(time.TimeOnly), key, err)
+			} else if err := sh.printResult(key, *result); err != nil {
+				return err
+			}
+			last, lastFound = result, found
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sh *shell) info(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	reply, err := sh.client.Info(ctx)
+	if err != nil {
+		return err
+	}
+	sh.followLeader(ctx)
+
+	return sh.print(map[string]any{"node": sh.addr, "info": reply}, []string{"node", "info"})
+}
+
+func (sh *shell) leader(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	info, err := sh.client.Cluster(ctx)
+	if err != nil {
+		return err
+	}
+	sh.followLeader(ctx)
+
+	addr := info.Peers[info.LeaderID]
+	if info.LeaderID == info.NodeID {
+		addr = sh.addr
+	}
+
+	return sh.print(map[string]any{"leader": info.LeaderID, "address": addr}, []string{"leader", "address"})
+}
+
+func (sh *shell) cluster(_ []string) error {
+	ctx, cancel := sh.context()
+	defer cancel()
+
+	info, err := sh.client.Cluster(ctx)
+	if err != nil {
+		return err
+	}
+	sh.followLeader(ctx)
+
+	nodes := maps.Clone(info.Peers)
+	if nodes == nil {
+		nodes = map[int]string{}
+	}
+	nodes[info.NodeID] = sh.addr
+
+	rows := make([]map[string]any, 0, len(nodes))
+	for _, id := range slices.Sorted(maps.Keys(nodes)) {
+		role := "follower"
+		if id == info.LeaderID {
+			role = "leader"
+		}
+		rows = append(rows, map[string]any{"node": id, "address": nodes[id], "role": role})
+	}
+
+	return sh.printRows(rows, []string{"node", "address", "role"})
+}
+
+func (sh *shell) setFormat(args []string) error {
+	if len(args) != 1 || (args[0] != formatTable && args[0] != formatJSON) {
+		return errors.New("usage: format <table|json>")
+	}
+
+	sh.format = args[0]
+	return nil
+}
+
+func (sh *shell) listHistory(_ []string) error {
+	for i, line := range sh.history {
+		fmt.Fprintf(sh.out, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (sh *shell) help(_ []string) error {
+	for _, name := range slices.Sorted(maps.Keys(sh.commands)) {
+		fmt.Fprintln(sh.out, "  "+sh.commands[name].usage)
+	}
+	fmt.Fprintln(sh.out, "  exit                     leaves the shell")
+	return nil
+}
+
+// expand replaces !! and !n by a command from the history.
+func (sh *shell) expand(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+
+	if line == "!!" {
+		if len(sh.history) == 0 {
+			return "", errors.New("no commands in the history")
+		}
+		return sh.history[len(sh.history)-1], nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(sh.history) {
+		return "", fmt.Errorf("%s: not in the history", line)
+	}
+
+	fmt.Fprintln(sh.out, sh.history[n-1])
+	return sh.history[n-1], nil
+}
+
+func (sh *shell) loadHistory() {
+	if sh.historyPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(sh.historyPath)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			sh.history = append(sh.history, line)
+		}
+	}
+	if len(sh.history) > maxHistory {
+		sh.history = sh.history[len(sh.history)-maxHistory:]
+	}
+}
+
+// addHistory adds a line to the history, and to the history file.
+func (sh *shell) addHistory(line string) {
+	sh.history = append(sh.history, line)
+	if len(sh.history) > maxHistory {
+		sh.history = sh.history[len(sh.history)-maxHistory:]
+	}
+
+	if sh.historyPath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(sh.historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, line)
+}
+
+func (sh *shell) printResult(key int, result client.GetResult) error {
+	return sh.print(map[string]any{
+		"key":       key,
+		"value":     string(result.Value),
+		"source":    result.Source,
+		"timestamp": result.Timestamp.Format(time.RFC3339),
+	}, []string{"key", "value", "source", "timestamp"})
+}
+
+// listRows turns a list into rows with one column.
+func listRows[T any](name string, values []T) []map[string]any {
+	rows := make([]map[string]any, 0, len(values))
+	for _, value := range values {
+		rows = append(rows, map[string]any{name: value})
+	}
+
+	return rows
+}
+
+func (sh *shell) print(row map[string]any, columns []string) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(row)
+	}
+
+	return sh.printRows([]map[string]any{row}, columns)
+}
+
+// printRows prints the rows as a table with the columns, or as JSON.
+func (sh *shell) printRows(rows []map[string]any, columns []string) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(rows)
+	}
+
+	tw := tabwriter.NewWriter(sh.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, row := range rows {
+		cells := make([]string, 0, len(columns))
+		for _, column := range columns {
+			cells = append(cells, fmt.Sprint(row[column]))
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func (sh *shell) printJSON(value any) error {
+	enc := json.NewEncoder(sh.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+func parseKey(text string) (int, error) {
+	key, err := strconv.Atoi(text)
+	if err != nil || key < 0 {
+		return 0, fmt.Errorf("key %q should be a positive integer", text)
+	}
+	return key, nil
+}
+
+// parseValue turns the text into a number, a boolean, a JSON object or array, or else a string.
+func parseValue(text string) interface{} {
+	if intValue, err := strconv.Atoi(text); err == nil {
+		return intValue
+	}
+	if floatValue, err := strconv.ParseFloat(text, 64); err == nil {
+		return floatValue
+	}
+	if strings.EqualFold(text, "true") || strings.EqualFold(text, "false") {
+		return strings.EqualFold(text, "true")
+	}
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err == nil {
+			return value
+		}
+	}
+	return text
+}
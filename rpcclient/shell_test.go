@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode is a node that keeps its values in memory.
+type fakeNode struct {
+	mu      sync.Mutex
+	info    client.ClusterInfo
+	values  map[int][]byte
+	buckets []string // the buckets of the calls
+}
+
+func (n *fakeNode) Set(args [3]interface{}, reply *string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.info.LeaderID != n.info.NodeID {
+		return fmt.Errorf("not the leader, current leader is Node-%d", n.info.LeaderID)
+	}
+
+	n.buckets = append(n.buckets, args[0].(string))
+	n.values[args[1].(int)] = []byte(fmt.Sprint(args[2]))
+	*reply = "Set key successfully"
+	return nil
+}
+
+func (n *fakeNode) GetWithPreference(args [3]interface{}, reply *client.GetResult) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.buckets = append(n.buckets, args[0].(string))
+	value, ok := n.values[args[1].(int)]
+	if !ok {
+		return errors.New("get->key not found")
+	}
+
+	*reply = client.GetResult{Value: value, Found: true, Source: fmt.Sprintf("Node-%d", n.info.NodeID)}
+	return nil
+}
+
+func (n *fakeNode) Cluster(_ [1]interface{}, reply *client.ClusterInfo) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	*reply = n.info
+	return nil
+}
+
+func startNode(t *testing.T, node *fakeNode) string {
+	t.Helper()
+
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("KeyValueStore", node))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Accept(listener)
+
+	return listener.Addr().String()
+}
+
+func startCluster(t *testing.T) (*fakeNode, string, *fakeNode, string) {
+	t.Helper()
+
+	leader := &fakeNode{info: client.ClusterInfo{NodeID: 2, LeaderID: 2}, values: map[int][]byte{}}
+	leaderAddr := startNode(t, leader)
+
+	follower := &fakeNode{info: client.ClusterInfo{NodeID: 1, LeaderID: 2}, values: map[int][]byte{}}
+	followerAddr := startNode(t, follower)
+
+	leader.info.Peers = map[int]string{1: followerAddr}
+	follower.info.Peers = map[int]string{2: leaderAddr}
+
+	return leader, leaderAddr, follower, followerAddr
+}
+
+func Test_shell_followsLeader(t *testing.T) {
+	leader, leaderAddr, follower, followerAddr := startCluster(t)
+
+	var out bytes.Buffer
+	sh := newShell(&out, time.Second, formatTable)
+	require.NoError(t, sh.connect(followerAddr))
+	defer sh.close()
+
+	assert.Equal(t, leaderAddr, sh.addr)
+
+	require.NoError(t, sh.execute("set 1 hello world"))
+	assert.Equal(t, []byte("hello world"), leader.values[1])
+
+	// the leader changes: the shell is told so, and goes to the new leader
+	leader.mu.Lock()
+	leader.info.LeaderID = 1
+	leader.mu.Unlock()
+	follower.mu.Lock()
+	follower.info.LeaderID = 1
+	follower.mu.Unlock()
+
+	require.NoError(t, sh.execute("set 2 42"))
+	assert.Equal(t, followerAddr, sh.addr)
+	assert.Equal(t, []byte("42"), follower.values[2])
+
+	out.Reset()
+	require.NoError(t, sh.execute("cluster"))
+	assert.Contains(t, out.String(), "1     "+followerAddr+"  leader")
+	assert.Contains(t, out.String(), "2     "+leaderAddr+"  follower")
+}
+
+func Test_shell_commands(t *testing.T) {
+	_, leaderAddr, _, _ := startCluster(t)
+
+	var out bytes.Buffer
+	sh := newShell(&out, time.Second, formatJSON)
+	require.NoError(t, sh.connect(leaderAddr))
+	defer sh.close()
+
+	require.NoError(t, sh.execute(`set 1 {"Name":"one"}`))
+
+	out.Reset()
+	require.NoError(t, sh.execute("get 1"))
+	assert.Contains(t, out.String(), `"value": "map[Name:one]"`)
+	assert.Contains(t, out.String(), `"source": "Node-2"`)
+
+	out.Reset()
+	require.NoError(t, sh.execute("leader"))
+	assert.JSONEq(t, fmt.Sprintf(`{"leader":2,"address":%q}`, leaderAddr), out.String())
+
+	err := sh.execute("del 1")
+	require.ErrorIs(t, err, client.ErrNotSupported)
+
+	require.Error(t, sh.execute("get one"))
+	require.Error(t, sh.execute("nothing"))
+	require.Error(t, sh.execute("format xml"))
+
+	require.NoError(t, sh.execute("format table"))
+	out.Reset()
+	require.NoError(t, sh.execute("get 1"))
+	assert.True(t, strings.HasPrefix(out.String(), "KEY  VALUE"))
+}
+
+func Test_shell_run(t *testing.T) {
+	leader, leaderAddr, _, _ := startCluster(t)
+
+	var out bytes.Buffer
+	sh := newShell(&out, time.Second, formatTable)
+	sh.historyPath = t.TempDir() + "/history"
+	require.NoError(t, sh.connect(leaderAddr))
+	defer sh.close()
+
+	sh.run(strings.NewReader("set 1 one\nget 1\n!!\n!9\nhistory\nuse logs\nget 1\nexit\nget 1\n"))
+
+	assert.Equal(t, []string{"set 1 one", "get 1", "get 1", "history", "use logs", "get 1"}, sh.history)
+	assert.Equal(t, []string{"", "", "", "logs"}, leader.buckets)
+	assert.Contains(t, out.String(), leaderAddr+"[logs]> ")
+	assert.Equal(t, 3, strings.Count(out.String(), "Node-2"))
+	assert.Contains(t, out.String(), "error: !9: not in the history")
+
+	// the history is kept for the next time
+	other := newShell(&out, time.Second, formatTable)
+	other.historyPath = sh.historyPath
+	other.loadHistory()
+	assert.Equal(t, sh.history, other.history)
+}
+
+func Test_shell_poll(t *testing.T) {
+	leader, leaderAddr, _, _ := startCluster(t)
+
+	var out safeBuffer
+	sh := newShell(&out, time.Second, formatTable)
+	require.NoError(t, sh.connect(leaderAddr))
+	defer sh.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- sh.poll(ctx, 1, 5*time.Millisecond)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	leader.mu.Lock()
+	leader.values[1] = []byte("changed")
+	leader.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Contains(t, out.String(), "key not found")
+	assert.Equal(t, 1, strings.Count(out.String(), "changed"))
+}
+
+// safeBuffer is a buffer that can be written while the test reads it.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/marcelloh/fastdb/replication/election"
+	"github.com/marcelloh/fastdb/service"
+)
+
+// Config is the configuration of a node. It comes from a YAML or JSON file (-config or FASTDB_CONFIG),
+// the environment overrides the file, and the flags override the environment.
+// The secrets can only come from the file or the environment, so they don't show up in ps.
+type Config struct {
+	// NodeID is the id of this node in Peers.
+	NodeID int `yaml:"node_id" json:"node_id"`
+	// Listen is the address the node listens on, Advertise the address the other nodes call it on.
+	// Without them both are the address of the node in Peers.
+	Listen    string `yaml:"listen" json:"listen"`
+	Advertise string `yaml:"advertise" json:"advertise"`
+	// Peers are the addresses of all the nodes of the cluster by id, this node may be one of them.
+	Peers map[int]string `yaml:"peers" json:"peers"`
+	// Coordinator is the node that is the leader at the start, the highest id without it.
+	Coordinator int `yaml:"coordinator" json:"coordinator"`
+
+	// DataDir is the directory of the database file, SyncInterval how often it is synced (0 syncs every write).
+	DataDir      string   `yaml:"data_dir" json:"data_dir"`
+	SyncInterval Duration `yaml:"sync_interval" json:"sync_interval"`
+
+	// Permissions are the permissions of the buckets, like "kvstore=rw,logs=r,*=none".
+	Permissions string `yaml:"permissions" json:"permissions"`
+
+	// RESP, HTTP and Memcache are the addresses of the other servers of the node, they are off when empty.
+	RESP     string `yaml:"resp" json:"resp"`
+	HTTP     string `yaml:"http" json:"http"`
+	Memcache string `yaml:"memcache" json:"memcache"`
+
+	TLS       TLSConfig       `yaml:"tls" json:"tls"`
+	Auth      AuthConfig      `yaml:"auth" json:"auth"`
+	Timeouts  TimeoutsConfig  `yaml:"timeouts" json:"timeouts"`
+	Heartbeat HeartbeatConfig `yaml:"heartbeat" json:"heartbeat"`
+
+	// Daemon runs the node without the prompt, with the failure detector instead.
+	Daemon bool `yaml:"daemon" json:"daemon"`
+}
+
+// TLSConfig are the files of the certificate of the node, its key and the authority of the cluster.
+type TLSConfig struct {
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	CA   string `yaml:"ca" json:"ca"`
+}
+
+// AuthConfig turns on the authentication of the connections, when the cluster secret is set.
+type AuthConfig struct {
+	ClusterSecret string `yaml:"cluster_secret" json:"cluster_secret"`
+	// Credentials are the credentials of the clients, like service.ParseCredentials.
+	Credentials string `yaml:"credentials" json:"credentials"`
+}
+
+// TimeoutsConfig are the deadline of a request, how long a node waits for another node during an election,
+// and how long a node that stops waits for the requests that are running.
+type TimeoutsConfig struct {
+	Request  Duration `yaml:"request" json:"request"`
+	Election Duration `yaml:"election" json:"election"`
+	Shutdown Duration `yaml:"shutdown" json:"shutdown"`
+}
+
+// HeartbeatConfig is the failure detector of a daemon, like election.Heartbeat.
+type HeartbeatConfig struct {
+	Interval Duration `yaml:"interval" json:"interval"`
+	Jitter   Duration `yaml:"jitter" json:"jitter"`
+	Misses   int      `yaml:"misses" json:"misses"`
+}
+
+// election returns the heartbeat of the failure detector.
+func (h HeartbeatConfig) election() election.Heartbeat {
+	return election.Heartbeat{Interval: time.Duration(h.Interval), Jitter: time.Duration(h.Jitter), Misses: h.Misses}
+}
+
+// Duration is a time.Duration that is written like "1s" or "500ms" in a config.
+type Duration time.Duration
+
+// UnmarshalText parses a duration like time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalText writes the duration like time.Duration.String.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// defaultPeers is the cluster of three nodes on localhost, when no peers are configured.
+var defaultPeers = map[int]string{
+	1: "localhost:8080",
+	2: "localhost:8081",
+	3: "localhost:8082",
+}
+
+// defaultConfig returns the config before the file, the environment and the flags.
+func defaultConfig() Config {
+	return Config{
+		DataDir:      "data",
+		SyncInterval: Duration(time.Second),
+		Timeouts: TimeoutsConfig{
+			Request:  Duration(service.RequestTimeout),
+			Election: Duration(election.DefaultCallTimeout),
+			Shutdown: Duration(10 * time.Second),
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval: Duration(election.DefaultHeartbeat.Interval),
+			Jitter:   Duration(election.DefaultHeartbeat.Jitter),
+			Misses:   election.DefaultHeartbeat.Misses,
+		},
+	}
+}
+
+// setting is a part of the config that can be set with a flag and with an environment variable.
+// A setting without a flag can only be set with the file and the environment.
+type setting struct {
+	flag    string
+	env     string
+	usage   string
+	set     func(c *Config, value string) error
+	boolean bool // the flag needs no value
+}
+
+// flagValue is the value of a setting on the command line.
+type flagValue struct {
+	value   string
+	boolean bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.boolean }
+
+func stringSetting(flag, env, usage string, field func(c *Config) *string) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intSetting(flag, env, usage string, field func(c *Config) *int) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", value)
+		}
+
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(flag, env, usage string, field func(c *Config) *bool) setting {
+	return setting{flag: flag, env: env, usage: usage, boolean: true, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", value)
+		}
+
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationSetting(flag, env, usage string, field func(c *Config) *Duration) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, value string) error {
+		return field(c).UnmarshalText([]byte(value))
+	}}
+}
+
+var settings = []setting{
+	intSetting("node-id", "FASTDB_NODE_ID", "the id of this node", func(c *Config) *int { return &c.NodeID }),
+	stringSetting("listen", "FASTDB_LISTEN", "the address to listen on", func(c *Config) *string { return &c.Listen }),
+	stringSetting("advertise", "FASTDB_ADVERTISE", "the address the other nodes call this node on",
+		func(c *Config) *string { return &c.Advertise }),
+	{flag: "peers", env: "FASTDB_PEERS", usage: `the nodes of the cluster, like "1=host1:8080,2=host2:8080"`,
+		set: func(c *Config, value string) (err error) {
+			c.Peers, err = parsePeers(value)
+			return err
+		}},
+	intSetting("coordinator", "FASTDB_COORDINATOR", "the id of the leader at the start (the highest id without it)",
+		func(c *Config) *int { return &c.Coordinator }),
+	stringSetting("data-dir", "FASTDB_DATA_DIR", "the directory of the database", func(c *Config) *string { return &c.DataDir }),
+	durationSetting("sync-interval", "FASTDB_SYNC_INTERVAL", "how often the database is synced (0 syncs every write)",
+		func(c *Config) *Duration { return &c.SyncInterval }),
+	stringSetting("permissions", "FASTDB_PERMISSIONS", `the permissions of the buckets, like "kvstore=rw,*=r"`,
+		func(c *Config) *string { return &c.Permissions }),
+	stringSetting("resp", "FASTDB_RESP", "the address of the Redis server", func(c *Config) *string { return &c.RESP }),
+	stringSetting("http", "FASTDB_HTTP", "the address of the HTTP API", func(c *Config) *string { return &c.HTTP }),
+	stringSetting("memcache", "FASTDB_MEMCACHE", "the address of the memcached server", func(c *Config) *string { return &c.Memcache }),
+	stringSetting("tls-cert", "FASTDB_TLS_CERT", "the certificate of the node", func(c *Config) *string { return &c.TLS.Cert }),
+	stringSetting("tls-key", "FASTDB_TLS_KEY", "the key of the certificate", func(c *Config) *string { return &c.TLS.Key }),
+	stringSetting("tls-ca", "FASTDB_TLS_CA", "the certificate authority of the cluster", func(c *Config) *string { return &c.TLS.CA }),
+	stringSetting("", "FASTDB_CLUSTER_SECRET", "", func(c *Config) *string { return &c.Auth.ClusterSecret }),
+	stringSetting("", "FASTDB_CREDENTIALS", "", func(c *Config) *string { return &c.Auth.Credentials }),
+	durationSetting("request-timeout", "FASTDB_REQUEST_TIMEOUT", "the deadline of a request",
+		func(c *Config) *Duration { return &c.Timeouts.Request }),
+	durationSetting("election-timeout", "FASTDB_ELECTION_TIMEOUT", "how long a node waits for another node in an election",
+		func(c *Config) *Duration { return &c.Timeouts.Election }),
+	durationSetting("shutdown-timeout", "FASTDB_SHUTDOWN_TIMEOUT", "how long a node that stops waits for the running requests",
+		func(c *Config) *Duration { return &c.Timeouts.Shutdown }),
+	durationSetting("heartbeat-interval", "FASTDB_HEARTBEAT_INTERVAL", "the time between two heartbeats to the coordinator",
+		func(c *Config) *Duration { return &c.Heartbeat.Interval }),
+	durationSetting("heartbeat-jitter", "FASTDB_HEARTBEAT_JITTER", "the most that is added to the interval at random",
+		func(c *Config) *Duration { return &c.Heartbeat.Jitter }),
+	intSetting("heartbeat-misses", "FASTDB_HEARTBEAT_MISSES", "the missed heartbeats after which an election starts",
+		func(c *Config) *int { return &c.Heartbeat.Misses }),
+	boolSetting("daemon", "FASTDB_DAEMON", "run without the prompt, with the failure detector", func(c *Config) *bool { return &c.Daemon }),
+}
+
+// loadConfig returns the config of the command line (without the name of the program) and the environment,
+// and whether the config only has to be validated. The older form "<node id> <port> [permissions [resp [http
+// [memcache]]]]" of the command line is still understood, it is like the flags.
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (Config, bool, error) {
+	flags := flag.NewFlagSet("rpcserver", flag.ContinueOnError)
+	flags.SetOutput(output)
+
+	file := flags.String("config", getenv("FASTDB_CONFIG"), "the YAML or JSON config file (FASTDB_CONFIG)")
+	validate := flags.Bool("validate-config", false, "check the config and exit")
+
+	values := map[string]*flagValue{}
+	for _, s := range settings {
+		if s.flag != "" {
+			values[s.flag] = &flagValue{boolean: s.boolean}
+			flags.Var(values[s.flag], s.flag, s.usage+" ("+s.env+")")
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	config := defaultConfig()
+	if *file != "" {
+		if err := readConfigFile(*file, &config); err != nil {
+			return Config{}, false, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, false, fmt.Errorf("config->%s: %w", s.env, err)
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if err = s.set(&config, values[s.flag].value); err != nil {
+					err = fmt.Errorf("config->-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	if err := config.setArgs(flags.Args()); err != nil {
+		return Config{}, false, err
+	}
+
+	config.fillIn()
+
+	return config, *validate, nil
+}
+
+// readConfigFile reads a config file over the config, a .json file is JSON and any other file is YAML.
+// A field that the config doesn't have is an error, so a typo doesn't go unnoticed.
+func readConfigFile(file string, config *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config->%w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(config); errors.Is(err, io.EOF) {
+			err = nil // an empty file
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("config->%s: %w", file, err)
+	}
+
+	return nil
+}
+
+// setArgs sets the config from the arguments of the older command line.
+func (c *Config) setArgs(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	if len(args) == 1 || len(args) > 6 {
+		return fmt.Errorf("config->the arguments should be <node id> <port> [permissions [resp [http [memcache]]]], not %q", args)
+	}
+
+	nodeID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("config->node id %q isn't a number", args[0])
+	}
+
+	c.NodeID = nodeID
+	c.Listen = "localhost:" + args[1]
+	c.Advertise = c.Listen
+
+	fields := []*string{&c.Permissions, &c.RESP, &c.HTTP, &c.Memcache}
+	for i, arg := range args[2:] {
+		*fields[i] = arg
+	}
+
+	return nil
+}
+
+// fillIn fills in what follows from the rest of the config.
+func (c *Config) fillIn() {
+	if len(c.Peers) == 0 {
+		c.Peers = make(map[int]string, len(defaultPeers))
+		for id, addr := range defaultPeers {
+			c.Peers[id] = addr
+		}
+	}
+
+	if c.Advertise == "" {
+		c.Advertise = c.Peers[c.NodeID]
+	}
+
+	if c.Advertise == "" {
+		c.Advertise = c.Listen
+	}
+
+	if c.Listen == "" {
+		c.Listen = c.Advertise
+	}
+
+	if c.Coordinator == 0 {
+		for id := range c.Peers {
+			c.Coordinator = max(c.Coordinator, id)
+		}
+		c.Coordinator = max(c.Coordinator, c.NodeID)
+	}
+}
+
+// Validate returns all the problems of the config at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.NodeID <= 0 {
+		errs = append(errs, errors.New("node_id should be a positive number"))
+	}
+
+	if err := checkAddr("listen", c.Listen); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := checkAddr("advertise", c.Advertise); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, id := range c.peerIDs() {
+		if err := checkAddr("peer "+strconv.Itoa(id), c.Peers[id]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if addr, ok := c.Peers[c.NodeID]; ok && addr != c.Advertise {
+		errs = append(errs, fmt.Errorf("advertise %q isn't the address of node %d in the peers (%q)", c.Advertise, c.NodeID, addr))
+	}
+
+	if _, ok := c.Peers[c.Coordinator]; !ok && c.Coordinator != c.NodeID {
+		errs = append(errs, fmt.Errorf("coordinator %d isn't one of the peers", c.Coordinator))
+	}
+
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data_dir is empty"))
+	}
+
+	if c.SyncInterval < 0 {
+		errs = append(errs, errors.New("sync_interval can't be negative"))
+	}
+
+	if _, err := service.ParsePermissions(c.Permissions); err != nil {
+		errs = append(errs, fmt.Errorf("permissions: %w", err))
+	}
+
+	for _, server := range [][2]string{{"resp", c.RESP}, {"http", c.HTTP}, {"memcache", c.Memcache}} {
+		if server[1] == "" {
+			continue
+		}
+
+		if err := checkAddr(server[0], server[1]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls needs both a cert and a key"))
+	}
+
+	if c.TLS.CA != "" && c.TLS.Cert == "" {
+		errs = append(errs, errors.New("tls has a ca without a cert"))
+	}
+
+	if c.TLS.Cert != "" && c.TLS.CA == "" {
+		errs = append(errs, errors.New("tls needs a ca, the nodes verify the certificates of each other with it"))
+	}
+
+	if c.Auth.Credentials != "" && c.Auth.ClusterSecret == "" {
+		errs = append(errs, errors.New("auth has credentials without a cluster_secret"))
+	}
+
+	if _, err := service.ParseCredentials(c.Auth.Credentials); err != nil {
+		errs = append(errs, fmt.Errorf("auth: %w", err))
+	}
+
+	if c.Timeouts.Request <= 0 || c.Timeouts.Election <= 0 || c.Timeouts.Shutdown <= 0 {
+		errs = append(errs, errors.New("the timeouts should be positive"))
+	}
+
+	if c.Heartbeat.Interval <= 0 || c.Heartbeat.Jitter < 0 || c.Heartbeat.Misses < 1 {
+		errs = append(errs, errors.New("heartbeat needs a positive interval and misses, and a jitter that isn't negative"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config->%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// OtherPeers returns the addresses of the other nodes.
+func (c *Config) OtherPeers() map[int]string {
+	peers := make(map[int]string, len(c.Peers))
+	for id, addr := range c.Peers {
+		if id != c.NodeID {
+			peers[id] = addr
+		}
+	}
+
+	return peers
+}
+
+func (c *Config) peerIDs() []int {
+	ids := make([]int, 0, len(c.Peers))
+	for id := range c.Peers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+func checkAddr(name, addr string) error {
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return fmt.Errorf("%s %q should be host:port", name, addr)
+	}
+
+	return nil
+}
+
+// parsePeers parses a list like "1=host1:8080,2=host2:8080".
+func parsePeers(spec string) (map[int]string, error) {
+	peers := map[int]string{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		id, addr, ok := strings.Cut(item, "=")
+		nodeID, err := strconv.Atoi(id)
+		if !ok || err != nil || addr == "" {
+			return nil, fmt.Errorf("peer %q should be id=host:port", item)
+		}
+
+		peers[nodeID] = addr
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a getenv of the variables.
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	return file
+}
+
+func TestLoadConfig_defaults(t *testing.T) {
+	config, validateOnly, err := loadConfig([]string{"-node-id", "2", "-daemon"}, env(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got: %v", err)
+	}
+
+	if validateOnly || !config.Daemon {
+		t.Error("Expected a daemon that runs")
+	}
+
+	if config.Listen != "localhost:8081" || config.Advertise != "localhost:8081" {
+		t.Errorf("Expected the address of node 2, got %q and %q", config.Listen, config.Advertise)
+	}
+
+	if config.Coordinator != 3 {
+		t.Errorf("Expected node 3 to be the coordinator, got %d", config.Coordinator)
+	}
+
+	if peers := config.OtherPeers(); len(peers) != 2 || peers[2] != "" {
+		t.Errorf("Expected the other two nodes, got %v", peers)
+	}
+
+	if config.DataDir != "data" || time.Duration(config.SyncInterval) != time.Second {
+		t.Errorf("Expected the default data dir and sync interval, got %q and %v", config.DataDir, config.SyncInterval)
+	}
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+	file := writeConfig(t, "node.yaml", `
+node_id: 1
+listen: ":7000"
+advertise: "db1.internal:7000"
+peers:
+  1: "db1.internal:7000"
+  2: "db2.internal:7000"
+data_dir: /var/lib/fastdb
+sync_interval: 250ms
+permissions: "kvstore=rw,*=r"
+auth:
+  cluster_secret: from-file
+timeouts:
+  request: 3s
+  election: 1s
+`)
+
+	vars := map[string]string{
+		"FASTDB_CONFIG":           file,
+		"FASTDB_DATA_DIR":         "/data",
+		"FASTDB_REQUEST_TIMEOUT":  "4s",
+		"FASTDB_CLUSTER_SECRET":   "from-env",
+		"FASTDB_ELECTION_TIMEOUT": "not a duration",
+	}
+
+	_, _, err := loadConfig(nil, env(vars), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "FASTDB_ELECTION_TIMEOUT") {
+		t.Fatalf("Expected an error about FASTDB_ELECTION_TIMEOUT, got: %v", err)
+	}
+
+	delete(vars, "FASTDB_ELECTION_TIMEOUT")
+
+	config, validateOnly, err := loadConfig([]string{"-validate-config", "-request-timeout", "5s"}, env(vars), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got: %v", err)
+	}
+
+	if !validateOnly {
+		t.Error("Expected -validate-config to only validate")
+	}
+
+	if config.Listen != ":7000" || config.Advertise != "db1.internal:7000" || config.Coordinator != 2 {
+		t.Errorf("Expected the addresses of the file, got %q, %q and coordinator %d", config.Listen, config.Advertise, config.Coordinator)
+	}
+
+	if config.DataDir != "/data" || config.Auth.ClusterSecret != "from-env" {
+		t.Errorf("Expected the environment to override the file, got %q and %q", config.DataDir, config.Auth.ClusterSecret)
+	}
+
+	if time.Duration(config.Timeouts.Request) != 5*time.Second {
+		t.Errorf("Expected the flag to override the environment, got %v", config.Timeouts.Request)
+	}
+
+	if time.Duration(config.SyncInterval) != 250*time.Millisecond || time.Duration(config.Timeouts.Election) != time.Second {
+		t.Errorf("Expected the durations of the file, got %v and %v", config.SyncInterval, config.Timeouts.Election)
+	}
+}
+
+func TestLoadConfig_json(t *testing.T) {
+	file := writeConfig(t, "node.json", `{
+		"node_id": 3,
+		"peers": {"1": "10.0.0.1:8080", "2": "10.0.0.2:8080", "3": "10.0.0.3:8080"},
+		"sync_interval": "0s",
+		"tls": {"cert": "node3.pem", "key": "node3-key.pem", "ca": "ca.pem"}
+	}`)
+
+	config, _, err := loadConfig([]string{"-config", file}, env(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got: %v", err)
+	}
+
+	if config.Listen != "10.0.0.3:8080" || config.SyncInterval != 0 || config.TLS.CA != "ca.pem" {
+		t.Errorf("Expected the config of the file, got %+v", config)
+	}
+
+	// a typo in a file is an error
+	for name, content := range map[string]string{
+		"typo.json": `{"node_id": 3, "sync_intervall": "1s"}`,
+		"typo.yaml": "node_id: 3\nsync_intervall: 1s\n",
+		"bad.yaml":  "sync_interval: soon\n",
+	} {
+		if _, _, err := loadConfig([]string{"-config", writeConfig(t, name, content)}, env(nil), io.Discard); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestLoadConfig_args(t *testing.T) {
+	config, _, err := loadConfig([]string{"1", "8080", "kvstore=rw", "", ":9080"}, env(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got: %v", err)
+	}
+
+	if config.NodeID != 1 || config.Listen != "localhost:8080" || config.Permissions != "kvstore=rw" ||
+		config.RESP != "" || config.HTTP != ":9080" {
+		t.Errorf("Expected the config of the arguments, got %+v", config)
+	}
+
+	for _, args := range [][]string{{"1"}, {"one", "8080"}, {"1", "8080", "", "", "", "", "extra"}} {
+		if _, _, err := loadConfig(args, env(nil), io.Discard); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config, _, err := loadConfig([]string{
+		"-node-id", "4", "-peers", "1=localhost:8080,2=localhost", "-coordinator", "9",
+		"-permissions", "kvstore=x", "-tls-cert", "node.pem", "-resp", "6379", "-request-timeout", "0s",
+	}, env(map[string]string{"FASTDB_CREDENTIALS": "app:secret:*=r"}), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid config")
+	}
+
+	for _, problem := range []string{
+		"listen", `peer 2 "localhost"`, "coordinator 9", "permissions", "resp", "cert and a key",
+		"without a cluster_secret", "tls needs a ca", "timeouts",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected the problem %q, got: %v", problem, err)
+		}
+	}
+
+	// the clients of the front ends log in with the credentials
+	config, _, err = loadConfig([]string{"-node-id", "1", "-resp", ":6379", "-http", ":9080", "-memcache", ":11211"},
+		env(map[string]string{"FASTDB_CLUSTER_SECRET": "cluster", "FASTDB_CREDENTIALS": "app:s3cret:*=r"}), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected the front ends to be served with a cluster_secret, got: %v", err)
+	}
+
+	if _, err := parsePeers("1=a:1,two=b:2"); err == nil {
+		t.Error("Expected an error for a peer without a number")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/marcelloh/fastdb/replication/election"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+)
+
+// node is a running rpcserver, a signal reloads its config or stops it.
+type node struct {
+	args      []string // the command line, to load the config again
+	config    Config
+	bully     *election.BullyAlgorithm
+	auth      *reloadableAuthenticator // nil without authentication
+	newServer func(service.Principal) *transport.Server
+	servers   []func(ctx context.Context) error // stop accepting, and drain the running requests until ctx ends
+}
+
+// reloadableAuthenticator authenticates with the authenticator that was stored last, and logs in the clients
+// of the front ends with its auth, so the credentials can change while the node runs.
+// The connections that are open keep their server, and who they logged in as.
+type reloadableAuthenticator struct {
+	current atomic.Pointer[transport.Authenticator]
+	auth    atomic.Pointer[service.Auth]
+}
+
+func newReloadableAuthenticator(auth *service.Auth, authenticate transport.Authenticator) *reloadableAuthenticator {
+	r := &reloadableAuthenticator{}
+	r.Store(auth, authenticate)
+
+	return r
+}
+
+// Store replaces the auth and the authenticator, for the connections that authenticate after it.
+func (r *reloadableAuthenticator) Store(auth *service.Auth, authenticate transport.Authenticator) {
+	r.auth.Store(auth)
+	r.current.Store(&authenticate)
+}
+
+// login is the service.Login of the Redis, HTTP and memcached servers.
+func (r *reloadableAuthenticator) login(name, secret string) (service.Principal, error) {
+	return r.auth.Load().Login(name, secret)
+}
+
+func (r *reloadableAuthenticator) authenticate(conn net.Conn, challenge, credentials []byte) (*transport.Server, error) {
+	return (*r.current.Load())(conn, challenge, credentials)
+}
+
+// wait waits for a signal to stop, and returns it. SIGHUP reloads the config in the meantime.
+func (n *node) wait() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			return sig
+		}
+
+		log.Print("Reloading the config")
+		if err := n.reload(); err != nil {
+			log.Printf("Error reloading the config, the old config is kept: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// reload loads the config again, and uses the heartbeat and the credentials of the clients of the new config.
+// The other settings are only used when the node starts, their changes are logged.
+func (n *node) reload() error {
+	config, _, err := loadConfig(n.args, os.Getenv, io.Discard)
+	if err != nil {
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if n.auth != nil {
+		credentials, err := service.ParseCredentials(config.Auth.Credentials)
+		if err != nil {
+			return err
+		}
+
+		// the nodes keep the cluster secret they started with
+		auth, err := service.NewAuth(n.config.Auth.ClusterSecret, credentials...)
+		if err != nil {
+			return err
+		}
+
+		n.auth.Store(auth, authenticator(auth, n.newServer))
+		n.config.Auth.Credentials = config.Auth.Credentials
+	}
+
+	n.bully.SetHeartbeat(config.Heartbeat.election())
+	n.config.Heartbeat = config.Heartbeat
+
+	if changed := restartNeeded(n.config, config); len(changed) > 0 {
+		log.Printf("The changes of %s are used after a restart", strings.Join(changed, ", "))
+	}
+
+	return nil
+}
+
+// stop stops the node in order: the servers stop accepting and drain the running requests until the
+// timeout, the node steps down as the coordinator so another node takes over, and the database is synced and
+// closed. It returns the exit code, which isn't 0 when a step failed.
+func (n *node) stop(timeout time.Duration) int {
+	code := 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(n.servers))
+	for _, shutdown := range n.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		log.Printf("Error draining the requests: %v", err)
+		code = 1
+	}
+
+	if n.bully.IsCoordinator() {
+		log.Printf("Node-%d steps down as the coordinator", n.bully.NodeID)
+	}
+	n.bully.StepDown()
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing the database: %v", err)
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// restartNeeded returns the settings of the config that changed, and that are only used when a node starts.
+func restartNeeded(running, next Config) []string {
+	running.Heartbeat, next.Heartbeat = HeartbeatConfig{}, HeartbeatConfig{}
+	running.Auth.Credentials, next.Auth.Credentials = "", ""
+
+	var changed []string
+
+	before, after := reflect.ValueOf(running), reflect.ValueOf(next)
+	for i := range before.NumField() {
+		if !reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			changed = append(changed, before.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+
+	return changed
+}
+
+// prompt is the interactive mode: it asks whether the node recovers from a crash, and checks the
+// coordinator every time Enter is pressed. It returns when stdin is closed, the node keeps running.
+func prompt(bully *election.BullyAlgorithm) {
+	reply := ""
+	fmt.Printf("Is this node recovering from a crash?(y/n): ") // Recovery from crash.
+	if _, err := fmt.Scanf("%s", &reply); closedInput(err) {
+		return
+	}
+
+	if reply == "y" {
+		fmt.Println("Log: Invoking Elections")
+		bully.StartElection()
+	}
+
+	random := ""
+	for {
+		fmt.Printf("Press enter for %d to communicate with coordinator.\n", bully.NodeID)
+		if _, err := fmt.Scanf("%s", &random); closedInput(err) {
+			return
+		}
+
+		bully.CommunicateToCoordinator()
+		fmt.Println("")
+	}
+}
+
+// closedInput tells whether stdin is closed, like it is for a service. A daemon doesn't use it.
+func closedInput(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Print("stdin is closed, the prompt stops (-daemon runs without it)")
+		return true
+	}
+
+	return false
+}
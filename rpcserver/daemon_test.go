@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/replication/election"
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
+)
+
+func TestNode_reload(t *testing.T) {
+	file := writeConfig(t, "node.yaml", `
+node_id: 1
+auth: {cluster_secret: cluster, credentials: "app:first:*=r"}
+`)
+
+	config, _, err := loadConfig([]string{"-config", file}, env(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Expected the config, got error: %v", err)
+	}
+
+	credentials, _ := service.ParseCredentials(config.Auth.Credentials)
+	auth, err := service.NewAuth(config.Auth.ClusterSecret, credentials...)
+	if err != nil {
+		t.Fatalf("Expected an auth, got error: %v", err)
+	}
+
+	newServer := func(service.Principal) *transport.Server { return transport.NewServer() }
+	n := &node{
+		args:      []string{"-config", file},
+		config:    config,
+		bully:     election.NewBullyAlgorithm(1, 1, nil),
+		auth:      newReloadableAuthenticator(auth, authenticator(auth, newServer)),
+		newServer: newServer,
+	}
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	if _, err := n.auth.authenticate(nil, challenge, service.TokenCredentials("first")(challenge)); err != nil {
+		t.Fatalf("Expected the first secret to be accepted, got error: %v", err)
+	}
+
+	// the secret of a client is rotated, and the data directory needs a restart
+	if err := os.WriteFile(file, []byte(`
+node_id: 1
+data_dir: /elsewhere
+auth: {cluster_secret: cluster, credentials: "app:second:*=r"}
+heartbeat: {interval: 5s, misses: 2}
+`), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	if err := n.reload(); err != nil {
+		t.Fatalf("Expected the config to be reloaded, got error: %v", err)
+	}
+
+	if _, err := n.auth.authenticate(nil, challenge, service.TokenCredentials("first")(challenge)); err == nil {
+		t.Error("Expected the first secret to be refused after the reload")
+	}
+
+	if _, err := n.auth.authenticate(nil, challenge, service.TokenCredentials("second")(challenge)); err != nil {
+		t.Errorf("Expected the second secret to be accepted, got error: %v", err)
+	}
+
+	// the clients of the front ends log in with the new credentials too
+	if _, err := n.auth.login("app", "first"); err == nil {
+		t.Error("Expected the first secret to be refused by the login after the reload")
+	}
+
+	if _, err := n.auth.login("app", "second"); err != nil {
+		t.Errorf("Expected the second secret to log in, got error: %v", err)
+	}
+
+	if time.Duration(n.config.Heartbeat.Interval) != 5*time.Second || n.config.Heartbeat.Misses != 2 {
+		t.Errorf("Expected the new heartbeat, got %+v", n.config.Heartbeat)
+	}
+
+	if n.config.DataDir != "data" {
+		t.Errorf("Expected the data directory it started with, got %q", n.config.DataDir)
+	}
+
+	// a config that isn't valid is not used
+	if err := os.WriteFile(file, []byte("node_id: 1\nheartbeat: {misses: 0}\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	if err := n.reload(); err == nil {
+		t.Error("Expected an error for a config without misses")
+	}
+
+	if n.config.Heartbeat.Misses != 2 {
+		t.Errorf("Expected the heartbeat to be kept, got %+v", n.config.Heartbeat)
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	running := defaultConfig()
+	running.Peers = map[int]string{1: "localhost:8080"}
+
+	next := running
+	next.Peers = map[int]string{1: "localhost:8080", 2: "localhost:8081"}
+	next.Heartbeat.Misses = 5
+	next.Auth.Credentials = "app:secret:*=r"
+	next.TLS.CA = "ca.pem"
+
+	if changed := restartNeeded(running, next); !reflect.DeepEqual(changed, []string{"peers", "tls"}) {
+		t.Errorf("Expected peers and tls to need a restart, got %v", changed)
+	}
+
+	if changed := restartNeeded(running, running); len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+}
+
+func TestNode_stop(t *testing.T) {
+	store, err := fastdb.Open(":memory:", 0)
+	if err != nil {
+		t.Fatalf("Expected a database, got error: %v", err)
+	}
+
+	db = store
+	defer func() { db = nil }()
+
+	drained := false
+	n := &node{bully: election.NewBullyAlgorithm(1, 1, nil)}
+	n.servers = []func(context.Context) error{func(context.Context) error {
+		drained = true
+		return nil
+	}}
+
+	if code := n.stop(time.Second); code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+
+	var reply election.RPCResponse
+	if err := n.bully.HandleMessage(election.Message{SenderID: 2, Type: election.MessageTypeHeartbeat}, &reply); err != nil || reply.Success {
+		t.Errorf("Expected the node to step down and miss heartbeats, got %+v and error %v", reply, err)
+	}
+
+	if !drained {
+		t.Error("Expected the server to be drained")
+	}
+
+	// a request that is still running at the timeout makes the exit code 1
+	db = nil
+	n.servers = []func(context.Context) error{func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	if code := n.stop(10 * time.Millisecond); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+}
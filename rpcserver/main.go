@@ -1,56 +1,298 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/httpapi"
+	"github.com/marcelloh/fastdb/memcache"
 	"github.com/marcelloh/fastdb/replication/election"
 	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/resp"
 	"github.com/marcelloh/fastdb/service"
-)
-
-const (
-	syncTime = 1000
+	"github.com/marcelloh/fastdb/transport"
 )
 
 var db *fastdb.DB
 
 type KVStoreService interface {
-	Set(args [2]interface{}, reply *string) error
-	Get(args [1]interface{}, reply *replicationmanager.GetResult) error
+	Set(args [3]interface{}, reply *string) error
+	Get(args [2]interface{}, reply *replicationmanager.GetResult) error
+	GetWithPreference(args [3]interface{}, reply *replicationmanager.GetResult) error
+	GetAll(args [1]interface{}, reply *map[int][]byte) error
+	GetAllSorted(args [1]interface{}, reply *[]replicationmanager.Record) error
+	SetIf(args [5]interface{}, reply *bool) error
+	Delete(args [2]interface{}, reply *bool) error
+	DeleteIf(args [3]interface{}, reply *bool) error
+	Batch(ops []replicationmanager.BatchOp, reply *int) error
+	Exists(args [2]interface{}, reply *bool) error
+	Keys(args [3]interface{}, reply *[]int) error
+	Range(args [4]interface{}, reply *[]replicationmanager.Record) error
+	Count(args [1]interface{}, reply *int) error
+	Buckets(args [1]interface{}, reply *[]string) error
+	Cluster(args [1]interface{}, reply *replicationmanager.ClusterInfo) error
+	Info(args [1]interface{}, reply *string) error
 }
 
 type KeyValueStoreImpl struct {
 	service KVStoreService
 }
 
-func (k *KeyValueStoreImpl) Set(args [2]interface{}, reply *string) error {
+func (k *KeyValueStoreImpl) Set(args [3]interface{}, reply *string) error {
 	return k.service.Set(args, reply)
 }
 
-func (k *KeyValueStoreImpl) Get(args [1]interface{}, reply *replicationmanager.GetResult) error {
+func (k *KeyValueStoreImpl) Get(args [2]interface{}, reply *replicationmanager.GetResult) error {
 	return k.service.Get(args, reply)
 }
 
-func initDB() error {
+func (k *KeyValueStoreImpl) GetWithPreference(args [3]interface{}, reply *replicationmanager.GetResult) error {
+	return k.service.GetWithPreference(args, reply)
+}
+
+func (k *KeyValueStoreImpl) GetAll(args [1]interface{}, reply *map[int][]byte) error {
+	return k.service.GetAll(args, reply)
+}
+
+func (k *KeyValueStoreImpl) GetAllSorted(args [1]interface{}, reply *[]replicationmanager.Record) error {
+	return k.service.GetAllSorted(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Delete(args [2]interface{}, reply *bool) error {
+	return k.service.Delete(args, reply)
+}
+
+func (k *KeyValueStoreImpl) SetIf(args [5]interface{}, reply *bool) error {
+	return k.service.SetIf(args, reply)
+}
+
+func (k *KeyValueStoreImpl) DeleteIf(args [3]interface{}, reply *bool) error {
+	return k.service.DeleteIf(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Batch(ops []replicationmanager.BatchOp, reply *int) error {
+	return k.service.Batch(ops, reply)
+}
+
+func (k *KeyValueStoreImpl) Exists(args [2]interface{}, reply *bool) error {
+	return k.service.Exists(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Keys(args [3]interface{}, reply *[]int) error {
+	return k.service.Keys(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Range(args [4]interface{}, reply *[]replicationmanager.Record) error {
+	return k.service.Range(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Count(args [1]interface{}, reply *int) error {
+	return k.service.Count(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Buckets(args [1]interface{}, reply *[]string) error {
+	return k.service.Buckets(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Cluster(args [1]interface{}, reply *replicationmanager.ClusterInfo) error {
+	return k.service.Cluster(args, reply)
+}
+
+func (k *KeyValueStoreImpl) Info(args [1]interface{}, reply *string) error {
+	return k.service.Info(args, reply)
+}
+
+// httpPeers returns the URLs of the HTTP API of the nodes, every node serves it at the same
+// distance from its RPC port as this node does, with the scheme of this node.
+func httpPeers(peers map[int]string, rpcPort, httpAddr, scheme string) (map[int]string, error) {
+	_, httpPort, err := net.SplitHostPort(httpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	myRPC, err := strconv.Atoi(rpcPort)
+	if err != nil {
+		return nil, err
+	}
+
+	myHTTP, err := strconv.Atoi(httpPort)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make(map[int]string, len(peers))
+	for id, addr := range peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		peerRPC, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+
+		urls[id] = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(peerRPC+myHTTP-myRPC))
+	}
+
+	return urls, nil
+}
+
+// newNodeServer returns a server with the KeyValueStore service, and the methods of the election
+// and the replication when they are given. The older net/rpc clients get the same methods.
+func newNodeServer(
+	kvStore *service.KeyValueStoreService,
+	bully *election.BullyAlgorithm,
+	replicationManager *replicationmanager.ReplicationManager,
+) *transport.Server {
+	kvStoreImp := &KeyValueStoreImpl{service: kvStore}
+
+	// the nodes call each other with the transport protocol, the older clients still use net/rpc on the same port
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("KeyValueStore", kvStoreImp)
+
+	server := transport.NewServer(transport.WithRPCFallback(rpcServer))
+	server.RegisterName("KeyValueStore", kvStoreImp)
+	transport.HandleStream(server, "KeyValueStore.Scan", kvStore.Scan)
+	transport.HandleStream(server, "KeyValueStore.Watch", kvStore.Watch)
+
+	if bully != nil && replicationManager != nil {
+		rpcServer.RegisterName("BullyAlgorithm", bully)
+		rpcServer.RegisterName("ReplicationManager", replicationManager)
+		server.RegisterName("BullyAlgorithm", bully)
+		server.RegisterName("ReplicationManager", replicationManager)
+	}
+
+	return server
+}
+
+// authenticator returns the server of the principal a connection is authenticated as,
+// a principal gets its server the first time it connects. Over TLS a node has to show its own certificate.
+func authenticator(auth *service.Auth, newServer func(service.Principal) *transport.Server) transport.Authenticator {
+	type serverKey struct {
+		name string
+		peer bool
+	}
+
+	var mu sync.Mutex
+	servers := map[serverKey]*transport.Server{}
+
+	return func(conn net.Conn, challenge, credentials []byte) (*transport.Server, error) {
+		principal, err := auth.Authenticate(challenge, credentials)
+		if err != nil {
+			return nil, err
+		}
+
+		// over TLS a node shows its own certificate too
+		if tlsConn, ok := conn.(*tls.Conn); ok && principal.Peer {
+			if err := service.VerifyNode(tlsConn.ConnectionState(), principal.NodeID); err != nil {
+				return nil, err
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := serverKey{name: principal.Name, peer: principal.Peer}
+		if servers[key] == nil {
+			servers[key] = newServer(principal)
+		}
+
+		return servers[key], nil
+	}
+}
+
+// certSelector returns the server of a connection by its certificate, for a cluster with TLS and without a cluster
+// secret: a node that shows its verified certificate may call the replication and the election, the other
+// connections only get the KeyValueStore service.
+func certSelector(peers map[int]string, nodeServer, clientServer *transport.Server) transport.Selector {
+	return func(conn net.Conn) (*transport.Server, error) {
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return clientServer, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), transport.HandshakeTimeout)
+		defer cancel()
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+
+		state := tlsConn.ConnectionState()
+		for id := range peers {
+			if service.VerifyNode(state, id) == nil {
+				return nodeServer, nil
+			}
+		}
+
+		return clientServer, nil
+	}
+}
+
+// loadTLS returns the TLS config of the listener and the one of the calls to the other nodes, from the
+// certificate and key of the node, and the authority of the cluster that the certificates of the nodes are verified with.
+// The certificate of a node is also the one it shows to the other nodes, it has service.NodeName as a DNS name.
+// Both configs are nil without a certificate.
+func loadTLS(files TLSConfig, peers map[int]string) (*tls.Config, func(addr string) *tls.Config, error) {
+	if files.Cert == "" {
+		return nil, nil, nil
+	}
+
+	pair, err := transport.LoadKeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var authorities *x509.CertPool
+	if files.CA != "" {
+		if authorities, err = transport.LoadCertPool(files.CA); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	names := make(map[string]string, len(peers))
+	for id, addr := range peers {
+		names[addr] = service.NodeName(id)
+	}
+
+	client := transport.ClientTLS(pair, authorities)
+	peerTLS := func(addr string) *tls.Config {
+		config := client.Clone()
+		config.ServerName = names[addr]
+		return config
+	}
+
+	return transport.ServerTLS(pair, authorities), peerTLS, nil
+}
+
+// initDB opens the database in the data directory, it is synced every syncInterval (every write with 0).
+func initDB(dataDir string, syncInterval time.Duration) error {
 	if db != nil {
 		return nil
 	}
 
-	workDir, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get working directory: %v", err)
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
 	}
-	dbPath := filepath.Join(workDir, "data", "fastdb.db")
 
-	db, err = fastdb.Open(dbPath, syncTime)
+	var err error
+	db, err = fastdb.Open(filepath.Join(dataDir, "fastdb.db"), int(syncInterval.Milliseconds()))
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
@@ -66,70 +308,208 @@ func init() {
 	gob.Register(int(0))
 	gob.Register(float64(0))
 	gob.Register(bool(false))
-
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	}
 }
 
 func main() {
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	config, validateOnly, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	myID := config.NodeID
+	peers := config.OtherPeers()
+
+	serverTLS, peerTLS, err := loadTLS(config.TLS, peers)
+	if err != nil {
+		log.Fatalf("Error loading TLS certificates: %v", err)
 	}
 
 	var (
-		nodeID int            = 1
-		coorID int            = 3
-		peers  map[int]string = map[int]string{
-			1: "localhost:8080",
-			2: "localhost:8081",
-			3: "localhost:8082",
-		}
+		auth     *service.Auth
+		dialOpts []transport.DialOption
 	)
+	if peerTLS != nil {
+		dialOpts = append(dialOpts, transport.WithTLS(peerTLS))
+	}
+
+	if secret := config.Auth.ClusterSecret; secret != "" {
+		credentials, err := service.ParseCredentials(config.Auth.Credentials)
+		if err != nil {
+			log.Fatalf("Error parsing credentials: %v", err)
+		}
+
+		auth, err = service.NewAuth(secret, credentials...)
+		if err != nil {
+			log.Fatalf("Error configuring authentication: %v", err)
+		}
 
-	myID, err := strconv.Atoi(os.Args[1])
+		dialOpts = append(dialOpts, transport.WithCredentials(service.PeerCredentials(myID, secret)))
+	}
+
+	permissions, err := service.ParsePermissions(config.Permissions)
 	if err != nil {
-		log.Fatalf("Error converting nodeID to int: %v", err)
+		log.Fatalf("Error parsing permissions: %v", err)
 	}
 
-	delete(peers, myID)
-	bully := election.NewBullyAlgorithm(nodeID, coorID, peers)
-	bully.NodeID = myID
+	var urls map[int]string
+	if config.HTTP != "" {
+		_, rpcPort, _ := net.SplitHostPort(config.Advertise)
+		scheme := "http"
+		if serverTLS != nil {
+			scheme = "https"
+		}
 
-	replicationManager := replicationmanager.NewReplicationManager(myID, db, bully)
-	kvStore := service.NewKeyValueStoreService(replicationManager)
-	kvStoreImp := &KeyValueStoreImpl{service: kvStore}
+		if urls, err = httpPeers(peers, rpcPort, config.HTTP, scheme); err != nil {
+			log.Fatalf("Error parsing HTTP address: %v", err)
+		}
+	}
 
-	myAddr := "localhost:" + os.Args[2]
-	address, err := net.ResolveTCPAddr("tcp", myAddr)
-	if err != nil {
-		log.Fatalf("Error resolving TCP address: %v", err)
+	if validateOnly {
+		fmt.Printf("the config of node %d is valid\n", myID)
+		return
+	}
+
+	if err := initDB(config.DataDir, time.Duration(config.SyncInterval)); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	inbound, err := net.ListenTCP("tcp", address)
+	requestTimeout := time.Duration(config.Timeouts.Request)
+
+	bully := election.NewBullyAlgorithm(myID, config.Coordinator, peers,
+		election.WithDialOptions(dialOpts...), election.WithCallTimeout(time.Duration(config.Timeouts.Election)),
+		election.WithHeartbeat(config.Heartbeat.election()))
+
+	replicationManager := replicationmanager.NewReplicationManager(myID, db, bully, replicationmanager.WithDialOptions(dialOpts...))
+	kvStore := service.NewKeyValueStoreService(replicationManager,
+		service.WithPermissions(permissions), service.WithRequestTimeout(requestTimeout))
+
+	inbound, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
 
-	rpc.RegisterName("BullyAlgorithm", bully)
-	rpc.RegisterName("ReplicationManager", replicationManager)
-	rpc.RegisterName("KeyValueStore", kvStoreImp)
-	fmt.Println("server is running with IP address and port number:", address)
-	go rpc.Accept(inbound)
+	// without authentication every connection may call every method, with it a connection only
+	// gets the methods and the permissions of who it is authenticated as
+	newServer := func(principal service.Principal) *transport.Server {
+		kvStore := service.NewKeyValueStoreService(replicationManager,
+			service.WithPermissions(permissions.Intersect(principal.Permissions)), service.WithRequestTimeout(requestTimeout))
+		if principal.Peer {
+			return newNodeServer(kvStore, bully, replicationManager)
+		}
+		return newNodeServer(kvStore, nil, nil)
+	}
 
-	reply := ""
-	fmt.Printf("Is this node recovering from a crash?(y/n): ") // Recovery from crash.
-	fmt.Scanf("%s", &reply)
-	if reply == "y" {
-		fmt.Println("Log: Invoking Elections")
-		bully.StartElection()
+	n := &node{args: os.Args[1:], config: config, bully: bully, newServer: newServer}
+
+	server := newNodeServer(kvStore, bully, replicationManager)
+	switch {
+	case auth != nil:
+		n.auth = newReloadableAuthenticator(auth, authenticator(auth, newServer))
+		server = transport.NewServer(transport.WithAuthenticator(n.auth.authenticate))
+	case serverTLS != nil:
+		// without a cluster secret the certificate of a node is what lets it call the replication and the election
+		server = transport.NewServer(transport.WithSelector(certSelector(peers, server, newNodeServer(kvStore, nil, nil))))
+	}
+
+	listener := inbound
+	if serverTLS != nil {
+		listener = tls.NewListener(inbound, serverTLS)
 	}
 
-	random := ""
-	for {
-		fmt.Printf("Press enter for %d to communicate with coordinator.\n", bully.NodeID)
-		fmt.Scanf("%s", &random)
-		bully.CommunicateToCoordinator()
-		fmt.Println("")
+	fmt.Println("server is running with IP address and port number:", inbound.Addr())
+	go server.Serve(listener)
+	n.servers = append(n.servers, server.Shutdown)
+
+	// with authentication the clients of the front ends log in with the credentials too
+	var login service.Login
+	if n.auth != nil {
+		login = n.auth.login
 	}
+
+	if config.RESP != "" {
+		respOpts := []resp.Option{resp.WithPermissions(permissions), resp.WithRequestTimeout(requestTimeout)}
+		if login != nil {
+			respOpts = append(respOpts, resp.WithLogin(login))
+		}
+
+		respServer := resp.NewServer(resp.Replicated(replicationManager), respOpts...)
+		go func() {
+			if err := respServer.ListenAndServe(config.RESP); err != nil && !errors.Is(err, resp.ErrServerClosed) {
+				log.Printf("RESP server stopped: %v", err)
+			}
+		}()
+		n.servers = append(n.servers, respServer.Shutdown)
+		fmt.Println("RESP server is running on", config.RESP)
+	}
+
+	if config.HTTP != "" {
+		httpOpts := []httpapi.Option{httpapi.WithPeers(urls)}
+		if login != nil {
+			httpOpts = append(httpOpts, httpapi.WithLogin(login))
+		}
+
+		httpServer := &http.Server{
+			Addr:              config.HTTP,
+			Handler:           httpapi.NewHandler(kvStore, httpOpts...),
+			ReadHeaderTimeout: 10 * time.Second,
+			TLSConfig:         serverTLS, // the certificate of the node, like the RPC port
+		}
+		go func() {
+			serve := httpServer.ListenAndServe
+			if serverTLS != nil {
+				serve = func() error { return httpServer.ListenAndServeTLS("", "") }
+			}
+
+			if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("HTTP server stopped: %v", err)
+			}
+		}()
+		n.servers = append(n.servers, httpServer.Shutdown)
+		fmt.Println("HTTP API is running on", config.HTTP)
+	}
+
+	if config.Memcache != "" {
+		memcacheOpts := []memcache.Option{memcache.WithPermissions(permissions), memcache.WithRequestTimeout(requestTimeout)}
+		if login != nil {
+			memcacheOpts = append(memcacheOpts, memcache.WithLogin(login))
+		}
+
+		memcacheServer := memcache.NewServer(memcache.Replicated(replicationManager), memcacheOpts...)
+		go func() {
+			if err := memcacheServer.ListenAndServe(config.Memcache); err != nil && !errors.Is(err, memcache.ErrServerClosed) {
+				log.Printf("memcached server stopped: %v", err)
+			}
+		}()
+		n.servers = append(n.servers, memcacheServer.Shutdown)
+		fmt.Println("memcached server is running on", config.Memcache)
+	}
+
+	// a daemon starts an election, so a node that rejoins the cluster finds the coordinator (or becomes it)
+	ctx, stopMonitor := context.WithCancel(context.Background())
+	if config.Daemon {
+		go func() {
+			bully.StartElection()
+			bully.Monitor(ctx)
+		}()
+	} else {
+		go prompt(bully)
+	}
+
+	sig := n.wait()
+	log.Printf("Received %v, stopping (a second signal stops at once)", sig)
+	go func() {
+		n.wait()
+		log.Print("Stopping at once")
+		os.Exit(1)
+	}()
+
+	stopMonitor()
+	os.Exit(n.stop(time.Duration(config.Timeouts.Shutdown)))
 }
@@ -1,9 +1,21 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb/service"
+	"github.com/marcelloh/fastdb/transport"
 )
 
 func TestInitDB(t *testing.T) {
@@ -26,7 +38,7 @@ func TestInitDB(t *testing.T) {
 			t.Fatalf("Failed to change working directory: %v", err)
 		}
 
-		err = initDB()
+		err = initDB("data", time.Second)
 		if err != nil {
 			t.Errorf("Expected successful DB initialization, got error: %v", err)
 		}
@@ -47,12 +59,12 @@ func TestInitDB(t *testing.T) {
 			t.Fatalf("Failed to change working directory: %v", err)
 		}
 
-		err = initDB()
+		err = initDB("data", time.Second)
 		if err != nil {
 			t.Fatalf("Failed first initialization: %v", err)
 		}
 
-		err = initDB()
+		err = initDB("data", time.Second)
 		if err != nil {
 			t.Errorf("Expected nil error on second initialization, got: %v", err)
 		}
@@ -62,4 +74,190 @@ func TestInitDB(t *testing.T) {
 			db = nil
 		}
 	})
+
+	t.Run("creates the data directory", func(t *testing.T) {
+		dataDir := filepath.Join(testDir, "new", "data")
+
+		if err := initDB(dataDir, 0); err != nil {
+			t.Fatalf("Expected successful DB initialization, got error: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dataDir, "fastdb.db")); err != nil {
+			t.Errorf("Expected the database file in the data directory, got: %v", err)
+		}
+
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+	})
+}
+
+func TestHTTPPeers(t *testing.T) {
+	peers := map[int]string{2: "localhost:8081", 3: "10.0.0.3:8082"}
+
+	urls, err := httpPeers(peers, "8080", ":9080", "http")
+	if err != nil {
+		t.Fatalf("Expected the URLs, got error: %v", err)
+	}
+
+	if urls[2] != "http://localhost:9081" || urls[3] != "http://10.0.0.3:9082" {
+		t.Errorf("Expected the HTTP ports next to the RPC ports, got: %v", urls)
+	}
+
+	urls, _ = httpPeers(peers, "8080", ":9080", "https")
+	if urls[2] != "https://localhost:9081" {
+		t.Errorf("Expected the scheme of the node, got: %v", urls)
+	}
+
+	if _, err := httpPeers(peers, "8080", "9080", "http"); err == nil {
+		t.Error("Expected an error for an address without a port")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	credentials, err := service.ParseCredentials("alice:s3cret:*=r")
+	if err != nil {
+		t.Fatalf("Expected the credentials, got error: %v", err)
+	}
+
+	auth, err := service.NewAuth("cluster", credentials...)
+	if err != nil {
+		t.Fatalf("Expected an auth, got error: %v", err)
+	}
+
+	var principals []service.Principal
+	authenticate := authenticator(auth, func(principal service.Principal) *transport.Server {
+		principals = append(principals, principal)
+		return transport.NewServer()
+	})
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	first, err := authenticate(nil, challenge, service.HMACCredentials("alice", "s3cret")(challenge))
+	if err != nil {
+		t.Fatalf("Expected alice to be authenticated, got error: %v", err)
+	}
+
+	second, _ := authenticate(nil, challenge, service.TokenCredentials("s3cret")(challenge))
+	if first != second {
+		t.Error("Expected a principal to get the same server every time")
+	}
+
+	peer, err := authenticate(nil, challenge, service.PeerCredentials(2, "cluster")(challenge))
+	if err != nil || peer == first {
+		t.Errorf("Expected a peer to get a server of its own, got error: %v", err)
+	}
+
+	if len(principals) != 2 || principals[0].Peer || !principals[1].Peer {
+		t.Errorf("Expected a server for alice and one for the peer, got: %+v", principals)
+	}
+
+	if _, err := authenticate(nil, challenge, service.TokenCredentials("wrong")(challenge)); err == nil {
+		t.Error("Expected an error for a wrong token")
+	}
+}
+
+func TestCertSelector(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create the authority: %v", err)
+	}
+
+	ca, _ := x509.ParseCertificate(caDER)
+	authorities := x509.NewCertPool()
+	authorities.AddCert(ca)
+
+	issue := func(name string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate a key: %v", err)
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create a certificate: %v", err)
+		}
+
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	nodeServer, clientServer := transport.NewServer(), transport.NewServer()
+	selectServer := certSelector(map[int]string{1: "localhost:8080", 2: "localhost:8081"}, nodeServer, clientServer)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{issue(service.NodeName(1))},
+		ClientCAs:    authorities,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// selected returns the server of a connection with the certificates of the client
+	selected := func(certificates ...tls.Certificate) *transport.Server {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		go func() {
+			client := tls.Client(clientConn, &tls.Config{
+				Certificates: certificates,
+				RootCAs:      authorities,
+				ServerName:   service.NodeName(1),
+				MinVersion:   tls.VersionTLS12,
+			})
+			_ = client.Handshake()
+		}()
+
+		server, err := selectServer(tls.Server(serverConn, serverTLS))
+		if err != nil {
+			t.Fatalf("Expected a server, got error: %v", err)
+		}
+
+		return server
+	}
+
+	if server := selected(issue(service.NodeName(2))); server != nodeServer {
+		t.Error("Expected a node certificate to get the replication and the election")
+	}
+
+	if server := selected(issue("app")); server != clientServer {
+		t.Error("Expected a certificate that isn't the one of a node to only get the KeyValueStore")
+	}
+
+	if server := selected(); server != clientServer {
+		t.Error("Expected a connection without a certificate to only get the KeyValueStore")
+	}
+
+	// a connection that isn't TLS never gets the node server
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	if server, _ := selectServer(serverConn); server != clientServer {
+		t.Error("Expected a plain connection to only get the KeyValueStore")
+	}
 }
@@ -0,0 +1,618 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// schemaMetaPrefix is the prefix of the metadata records that hold the schemas.
+const schemaMetaPrefix = "schema:"
+
+/*
+Schema is a JSON Schema that the values of a bucket have to satisfy.
+The supported keywords are: type, enum, const, properties, required,
+additionalProperties, items, minItems, maxItems, minLength, maxLength, pattern,
+minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not.
+Other keywords are ignored.
+*/
+type Schema struct {
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Not                  *Schema            `json:"not"`
+	Const                *json.RawMessage   `json:"const"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	pattern              *regexp.Regexp
+	Pattern              string            `json:"pattern"`
+	Type                 schemaTypes       `json:"type"`
+	Required             []string          `json:"required"`
+	Enum                 []json.RawMessage `json:"enum"`
+	AllOf                []*Schema         `json:"allOf"`
+	AnyOf                []*Schema         `json:"anyOf"`
+	OneOf                []*Schema         `json:"oneOf"`
+	never                bool
+}
+
+// SchemaOption configures how a schema is attached to a bucket.
+type SchemaOption func(*schemaOptions)
+
+// Violation is one reason why a value doesn't satisfy a schema.
+type Violation struct {
+	Path    string
+	Message string
+}
+
+// ValidationError is returned when a value doesn't satisfy the schema of its bucket.
+type ValidationError struct {
+	Bucket     string
+	Violations []Violation
+	Key        int
+}
+
+// schemaOptions holds the options of SetSchema.
+type schemaOptions struct {
+	validateExisting bool
+}
+
+// schemaTypes is the type keyword, which can be one type or a list of types.
+type schemaTypes []string
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+ValidateExisting makes SetSchema check the values that are already in the bucket.
+The schema is only attached when all of them are valid.
+*/
+func ValidateExisting() SchemaOption {
+	return func(opts *schemaOptions) {
+		opts.validateExisting = true
+	}
+}
+
+/*
+SetSchema attaches a JSON Schema to a bucket, after which Set rejects values that don't satisfy it.
+The schema is stored in the file, so it survives a restart.
+*/
+func (fdb *DB) SetSchema(bucket string, schemaJSON []byte, opts ...SchemaOption) error {
+	var options schemaOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	schema, err := ParseSchema(schemaJSON)
+	if err != nil {
+		return fmt.Errorf("setSchema->%w", err)
+	}
+
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	if options.validateExisting {
+		err = schema.validateBucket(bucket, sh.keys[bucket])
+		if err != nil {
+			return err
+		}
+	}
+
+	if fdb.aof != nil {
+		var compact bytes.Buffer
+
+		err = json.Compact(&compact, schemaJSON)
+		if err != nil {
+			return fmt.Errorf("setSchema->compact error: %w", err)
+		}
+
+		err = fdb.aof.WriteMeta(schemaMetaPrefix+bucket, compact.Bytes())
+		if err != nil {
+			return fmt.Errorf("setSchema->write error: %w", err)
+		}
+	}
+
+	sh.schemas[bucket] = schema
+
+	return nil
+}
+
+/*
+RemoveSchema removes the schema of a bucket.
+*/
+func (fdb *DB) RemoveSchema(bucket string) error {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	if _, found := sh.schemas[bucket]; !found {
+		return nil
+	}
+
+	if fdb.aof != nil {
+		err := fdb.aof.WriteMeta(schemaMetaPrefix+bucket, nil)
+		if err != nil {
+			return fmt.Errorf("removeSchema->write error: %w", err)
+		}
+	}
+
+	delete(sh.schemas, bucket)
+
+	return nil
+}
+
+/*
+Schema returns the schema of a bucket, if it has one.
+*/
+func (fdb *DB) Schema(bucket string) (*Schema, bool) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	schema, found := sh.schemas[bucket]
+
+	return schema, found
+}
+
+/*
+loadSchemas parses the schemas from the metadata of the file.
+*/
+func (fdb *DB) loadSchemas(meta map[string][]byte) error {
+	for name, value := range meta {
+		bucket, found := strings.CutPrefix(name, schemaMetaPrefix)
+		if !found {
+			continue
+		}
+
+		schema, err := ParseSchema(value)
+		if err != nil {
+			return fmt.Errorf("schema of bucket (%s): %w", bucket, err)
+		}
+
+		fdb.shardFor(bucket).schemas[bucket] = schema
+	}
+
+	return nil
+}
+
+/*
+validate checks a value against the schema of its bucket, the caller should hold the lock.
+*/
+func (sh *shard) validate(bucket string, key int, value []byte) error {
+	schema, found := sh.schemas[bucket]
+	if !found {
+		return nil
+	}
+
+	return schema.validateValue(bucket, key, value)
+}
+
+/*
+ParseSchema parses a JSON Schema.
+*/
+func ParseSchema(schemaJSON []byte) (*Schema, error) {
+	schema := &Schema{}
+
+	err := json.Unmarshal(schemaJSON, schema)
+	if err != nil {
+		return nil, fmt.Errorf("parse schema error: %w", err)
+	}
+
+	err = schema.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+/*
+Validate returns the violations of a JSON value, it is valid when there are none.
+*/
+func (s *Schema) Validate(value []byte) []Violation {
+	var doc any
+
+	err := json.Unmarshal(value, &doc)
+	if err != nil {
+		return []Violation{{Path: "", Message: "invalid JSON: " + err.Error()}}
+	}
+
+	return s.check(doc, "")
+}
+
+/*
+UnmarshalJSON handles the boolean schemas (true and false) next to the object ones.
+*/
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var allowed bool
+
+	if json.Unmarshal(data, &allowed) == nil {
+		*s = Schema{never: !allowed}
+
+		return nil
+	}
+
+	type plain Schema
+
+	err := json.Unmarshal(data, (*plain)(s))
+	if err != nil {
+		return fmt.Errorf("schema: %w", err)
+	}
+
+	return nil
+}
+
+/*
+UnmarshalJSON handles a type keyword with one type, or a list of types.
+*/
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+
+	if json.Unmarshal(data, &single) == nil {
+		*t = schemaTypes{single}
+
+		return nil
+	}
+
+	var multiple []string
+
+	err := json.Unmarshal(data, &multiple)
+	if err != nil {
+		return fmt.Errorf("schema type: %w", err)
+	}
+
+	*t = multiple
+
+	return nil
+}
+
+/*
+Error returns all the violations in one message.
+*/
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.String()
+	}
+
+	return fmt.Sprintf("bucket (%s) key %d doesn't match schema: %s", e.Bucket, e.Key, strings.Join(messages, "; "))
+}
+
+/*
+String returns the violation with its path.
+*/
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+
+	return v.Path + ": " + v.Message
+}
+
+/*
+validateValue checks one value, and returns a ValidationError when it isn't valid.
+*/
+func (s *Schema) validateValue(bucket string, key int, value []byte) error {
+	violations := s.Validate(value)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Bucket: bucket, Key: key, Violations: violations}
+}
+
+/*
+validateBucket checks all the values of a bucket, and returns all the ValidationErrors joined.
+*/
+func (s *Schema) validateBucket(bucket string, values map[int][]byte) error {
+	var errs []error
+
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		err := s.validateValue(bucket, key, values[key])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+compile checks the schema and compiles its patterns.
+*/
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("schema pattern (%s) error: %w", s.Pattern, err)
+		}
+
+		s.pattern = pattern
+	}
+
+	for _, typ := range s.Type {
+		if !slices.Contains([]string{"null", "boolean", "object", "array", "number", "integer", "string"}, typ) {
+			return fmt.Errorf("schema has unknown type (%s)", typ)
+		}
+	}
+
+	for _, sub := range s.subSchemas() {
+		err := sub.compile()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+subSchemas returns all the schemas that are nested in this one.
+*/
+func (s *Schema) subSchemas() []*Schema {
+	var subs []*Schema
+
+	for _, sub := range s.Properties {
+		subs = append(subs, sub)
+	}
+
+	for _, sub := range []*Schema{s.AdditionalProperties, s.Items, s.Not} {
+		if sub != nil {
+			subs = append(subs, sub)
+		}
+	}
+
+	subs = append(subs, s.AllOf...)
+	subs = append(subs, s.AnyOf...)
+
+	return append(subs, s.OneOf...)
+}
+
+/*
+check returns the violations of a decoded JSON value on a path.
+*/
+func (s *Schema) check(doc any, path string) []Violation {
+	if s.never {
+		return []Violation{{Path: path, Message: "is not allowed"}}
+	}
+
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(typ string) bool { return isType(doc, typ) }) {
+		return []Violation{{Path: path, Message: fmt.Sprintf("should be of type %s", strings.Join(s.Type, " or "))}}
+	}
+
+	var violations []Violation
+
+	violations = append(violations, s.checkValue(doc, path)...)
+
+	switch value := doc.(type) {
+	case map[string]any:
+		violations = append(violations, s.checkObject(value, path)...)
+	case []any:
+		violations = append(violations, s.checkArray(value, path)...)
+	case string:
+		violations = append(violations, s.checkString(value, path)...)
+	case float64:
+		violations = append(violations, s.checkNumber(value, path)...)
+	}
+
+	return append(violations, s.checkCombined(doc, path)...)
+}
+
+/*
+checkValue checks the enum and const keywords.
+*/
+func (s *Schema) checkValue(doc any, path string) []Violation {
+	var violations []Violation
+
+	if s.Const != nil && !equalJSON(doc, *s.Const) {
+		violations = append(violations, Violation{Path: path, Message: "should be " + string(*s.Const)})
+	}
+
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(option json.RawMessage) bool { return equalJSON(doc, option) }) {
+		violations = append(violations, Violation{Path: path, Message: "should be one of the enum values"})
+	}
+
+	return violations
+}
+
+/*
+checkObject checks the object keywords.
+*/
+func (s *Schema) checkObject(object map[string]any, path string) []Violation {
+	var violations []Violation
+
+	for _, name := range s.Required {
+		if _, found := object[name]; !found {
+			violations = append(violations, Violation{Path: joinPath(path, name), Message: "is required"})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(object)) {
+		sub, found := s.Properties[name]
+		if !found {
+			sub = s.AdditionalProperties
+		}
+
+		if sub != nil {
+			violations = append(violations, sub.check(object[name], joinPath(path, name))...)
+		}
+	}
+
+	return violations
+}
+
+/*
+checkArray checks the array keywords.
+*/
+func (s *Schema) checkArray(array []any, path string) []Violation {
+	var violations []Violation
+
+	if s.MinItems != nil && len(array) < *s.MinItems {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("should have at least %d items", *s.MinItems)})
+	}
+
+	if s.MaxItems != nil && len(array) > *s.MaxItems {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("should have at most %d items", *s.MaxItems)})
+	}
+
+	if s.Items != nil {
+		for i, item := range array {
+			violations = append(violations, s.Items.check(item, joinPath(path, strconv.Itoa(i)))...)
+		}
+	}
+
+	return violations
+}
+
+/*
+checkString checks the string keywords.
+*/
+func (s *Schema) checkString(text, path string) []Violation {
+	var violations []Violation
+
+	length := utf8.RuneCountInString(text)
+
+	if s.MinLength != nil && length < *s.MinLength {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("should be at least %d characters", *s.MinLength)})
+	}
+
+	if s.MaxLength != nil && length > *s.MaxLength {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("should be at most %d characters", *s.MaxLength)})
+	}
+
+	if s.pattern != nil && !s.pattern.MatchString(text) {
+		violations = append(violations, Violation{Path: path, Message: "should match pattern " + s.Pattern})
+	}
+
+	return violations
+}
+
+/*
+checkNumber checks the number keywords.
+*/
+func (s *Schema) checkNumber(number float64, path string) []Violation {
+	var violations []Violation
+
+	limits := []struct {
+		limit   *float64
+		failed  func(limit float64) bool
+		message string
+	}{
+		{s.Minimum, func(limit float64) bool { return number < limit }, "should be >= %v"},
+		{s.Maximum, func(limit float64) bool { return number > limit }, "should be <= %v"},
+		{s.ExclusiveMinimum, func(limit float64) bool { return number <= limit }, "should be > %v"},
+		{s.ExclusiveMaximum, func(limit float64) bool { return number >= limit }, "should be < %v"},
+	}
+
+	for _, check := range limits {
+		if check.limit != nil && check.failed(*check.limit) {
+			violations = append(violations, Violation{Path: path, Message: fmt.Sprintf(check.message, *check.limit)})
+		}
+	}
+
+	return violations
+}
+
+/*
+checkCombined checks the allOf, anyOf, oneOf and not keywords.
+*/
+func (s *Schema) checkCombined(doc any, path string) []Violation {
+	var violations []Violation
+
+	for _, sub := range s.AllOf {
+		violations = append(violations, sub.check(doc, path)...)
+	}
+
+	if s.AnyOf != nil && countValid(s.AnyOf, doc, path) == 0 {
+		violations = append(violations, Violation{Path: path, Message: "should match at least one schema of anyOf"})
+	}
+
+	if s.OneOf != nil && countValid(s.OneOf, doc, path) != 1 {
+		violations = append(violations, Violation{Path: path, Message: "should match exactly one schema of oneOf"})
+	}
+
+	if s.Not != nil && len(s.Not.check(doc, path)) == 0 {
+		violations = append(violations, Violation{Path: path, Message: "should not match the schema of not"})
+	}
+
+	return violations
+}
+
+/*
+countValid returns how many of the schemas are satisfied by the value.
+*/
+func countValid(schemas []*Schema, doc any, path string) int {
+	count := 0
+
+	for _, sub := range schemas {
+		if len(sub.check(doc, path)) == 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+/*
+isType returns true if a decoded JSON value is of a schema type.
+*/
+func isType(doc any, typ string) bool {
+	switch value := doc.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case map[string]any:
+		return typ == "object"
+	case []any:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || (typ == "integer" && value == math.Trunc(value))
+	default:
+		return false
+	}
+}
+
+/*
+equalJSON returns true if a decoded JSON value equals a raw JSON value.
+*/
+func equalJSON(doc any, raw json.RawMessage) bool {
+	var other any
+
+	err := json.Unmarshal(raw, &other)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(doc, other)
+}
+
+/*
+joinPath adds a property name or an array index to a path.
+*/
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
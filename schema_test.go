@@ -0,0 +1,164 @@
+package fastdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["ID", "Email"],
+	"properties": {
+		"ID": {"type": "integer", "minimum": 1},
+		"Email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"Age": {"type": ["integer", "null"], "exclusiveMaximum": 150},
+		"Tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+	},
+	"additionalProperties": false
+}`
+
+func Test_Schema_Set(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	err = store.SetSchema("user", []byte(userSchema))
+	require.NoError(t, err)
+
+	err = store.Set("user", 1, []byte(`{"ID":1,"Email":"a@b.c","Age":null,"Tags":["a"]}`))
+	require.NoError(t, err)
+
+	err = store.Set("user", 2, []byte(`{"ID":0,"Email":"wrong","Age":200,"Tags":["a","c","b"],"Other":1}`))
+	require.Error(t, err)
+
+	var validationErr *fastdb.ValidationError
+
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "user", validationErr.Bucket)
+	assert.Equal(t, 2, validationErr.Key)
+	assert.Equal(t, []fastdb.Violation{
+		{Path: "Age", Message: "should be < 150"},
+		{Path: "Email", Message: "should match pattern ^[^@]+@[^@]+$"},
+		{Path: "ID", Message: "should be >= 1"},
+		{Path: "Other", Message: "is not allowed"},
+		{Path: "Tags", Message: "should have at most 2 items"},
+		{Path: "Tags.1", Message: "should be one of the enum values"},
+	}, validationErr.Violations)
+
+	_, ok := store.Get("user", 2)
+	assert.False(t, ok)
+
+	err = store.Set("user", 3, []byte(`no json`))
+	require.ErrorAs(t, err, &validationErr)
+
+	// other buckets are not checked
+	err = store.Set("texts", 1, []byte(`no json`))
+	require.NoError(t, err)
+
+	err = store.RemoveSchema("user")
+	require.NoError(t, err)
+
+	err = store.Set("user", 3, []byte(`no json`))
+	require.NoError(t, err)
+
+	err = store.SetSchema("user", []byte(`{"type":"thing"}`))
+	require.Error(t, err)
+
+	err = store.SetSchema("user", []byte(`{"pattern":"("}`))
+	require.Error(t, err)
+}
+
+func Test_Schema_Combined(t *testing.T) {
+	schema, err := fastdb.ParseSchema([]byte(`{
+		"anyOf": [{"type": "string", "minLength": 2}, {"type": "number"}],
+		"oneOf": [{"type": "integer"}, {"type": "string", "maxLength": 3}],
+		"not": {"const": "abc"}
+	}`))
+	require.NoError(t, err)
+
+	assert.Empty(t, schema.Validate([]byte(`12`)))
+	assert.Empty(t, schema.Validate([]byte(`"ab"`)))
+	assert.Len(t, schema.Validate([]byte(`"abc"`)), 1)
+	assert.Len(t, schema.Validate([]byte(`"a"`)), 1)
+	assert.Len(t, schema.Validate([]byte(`1.5`)), 1)
+}
+
+func Test_Schema_ValidateExisting(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	err = store.Set("user", 1, []byte(`{"ID":1}`))
+	require.NoError(t, err)
+
+	err = store.Set("user", 2, []byte(`{"ID":2,"Email":"a@b.c"}`))
+	require.NoError(t, err)
+
+	err = store.SetSchema("user", []byte(userSchema), fastdb.ValidateExisting())
+	require.Error(t, err)
+
+	var validationErr *fastdb.ValidationError
+
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, 1, validationErr.Key)
+
+	_, found := store.Schema("user")
+	assert.False(t, found)
+
+	err = store.SetSchema("user", []byte(userSchema))
+	require.NoError(t, err)
+
+	_, found = store.Schema("user")
+	assert.True(t, found)
+}
+
+func Test_Schema_Persisted(t *testing.T) {
+	path := "data/fastdb_schema.db"
+	filePath := filepath.Clean(path)
+
+	defer func() {
+		err := os.Remove(filePath)
+		require.NoError(t, err)
+
+		_ = os.Remove(filePath + ".bak")
+	}()
+
+	store, err := fastdb.Open(filePath, syncIime)
+	require.NoError(t, err)
+
+	err = store.SetSchema("user", []byte(userSchema))
+	require.NoError(t, err)
+
+	err = store.SetSchema("texts", []byte(`{"type":"string"}`))
+	require.NoError(t, err)
+
+	err = store.RemoveSchema("texts")
+	require.NoError(t, err)
+
+	err = store.Defrag()
+	require.NoError(t, err)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	store, err = fastdb.Open(filePath, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	_, found := store.Schema("texts")
+	assert.False(t, found)
+
+	err = store.Set("user", 1, []byte(`{"ID":1}`))
+	require.Error(t, err)
+
+	err = store.Set("texts", 1, []byte(`1`))
+	require.NoError(t, err)
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/marcelloh/fastdb/transport"
+)
+
+// The credentials of a connection are one of
+//
+//	token <secret>                         the secret of a credential itself
+//	hmac <name> <hmac of the challenge>    signed with the secret of the credential, which isn't sent
+//	peer <node id> <hmac of the challenge> signed with the cluster secret, by a node of the cluster
+//
+// The HMAC is a SHA-256 HMAC in hex, of the challenge followed by the name or the node id.
+const (
+	schemeToken = "token"
+	schemeHMAC  = "hmac"
+	schemePeer  = "peer"
+)
+
+// ErrUnauthenticated is returned when credentials aren't accepted.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Credential is a name with a secret, and the permissions of the clients that use it.
+type Credential struct {
+	Name        string
+	Secret      string
+	Permissions Permissions
+}
+
+// Principal is who a connection is authenticated as: a client with the permissions of its credential,
+// or a node of the cluster, which may also call the methods of the replication and the election.
+type Principal struct {
+	Name        string
+	Permissions Permissions
+	Peer        bool
+	NodeID      int // the id of the node, for a peer
+}
+
+// Login returns the principal of a client of a front end (Redis, HTTP or memcached) with the secret
+// of a credential. The name of the credential is optional, an empty name matches any credential.
+type Login func(name, secret string) (Principal, error)
+
+// Auth checks the credentials of the clients and the nodes of the cluster.
+type Auth struct {
+	clusterSecret []byte
+	credentials   []Credential
+}
+
+// NewAuth returns an Auth for the nodes that know the cluster secret, and the clients with the credentials.
+func NewAuth(clusterSecret string, credentials ...Credential) (*Auth, error) {
+	if clusterSecret == "" {
+		return nil, errors.New("auth->the cluster secret is empty")
+	}
+
+	names := map[string]bool{}
+	for _, credential := range credentials {
+		if credential.Name == "" || credential.Secret == "" {
+			return nil, errors.New("auth->a credential needs a name and a secret")
+		}
+
+		if names[credential.Name] {
+			return nil, fmt.Errorf("auth->name=%q, the name is used twice", credential.Name)
+		}
+		names[credential.Name] = true
+	}
+
+	return &Auth{clusterSecret: []byte(clusterSecret), credentials: credentials}, nil
+}
+
+// ParseCredentials parses a list like "alice:secret:kvstore=write,*=read;ops:secret2:*=admin",
+// the credentials are separated by ; and their permissions are like ParsePermissions,
+// but the other buckets can't be used when * isn't given. A secret can't contain a colon or white space.
+func ParseCredentials(spec string) ([]Credential, error) {
+	var credentials []Credential
+
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, rest, _ := strings.Cut(item, ":")
+		secret, perms, ok := strings.Cut(rest, ":")
+		if !ok || name == "" || secret == "" || strings.ContainsFunc(name+secret, unicode.IsSpace) {
+			return nil, fmt.Errorf("credential %q should be name:secret:permissions", name)
+		}
+
+		permissions, err := parsePermissions(perms, NoAccess)
+		if err != nil {
+			return nil, fmt.Errorf("credential %q: %w", name, err)
+		}
+
+		credentials = append(credentials, Credential{Name: name, Secret: secret, Permissions: permissions})
+	}
+
+	return credentials, nil
+}
+
+// Authenticate returns the principal of the credentials a connection answered the challenge with.
+func (a *Auth) Authenticate(challenge, credentials []byte) (Principal, error) {
+	fields := strings.Fields(string(credentials))
+	if len(fields) < 2 {
+		return Principal{}, fmt.Errorf("%w: malformed credentials", ErrUnauthenticated)
+	}
+
+	switch fields[0] {
+	case schemeToken:
+		for _, credential := range a.credentials {
+			if len(fields) == 2 && subtle.ConstantTimeCompare([]byte(credential.Secret), []byte(fields[1])) == 1 {
+				return credential.principal(), nil
+			}
+		}
+	case schemeHMAC:
+		for _, credential := range a.credentials {
+			if len(fields) == 3 && credential.Name == fields[1] && validSignature(credential.Secret, challenge, fields[1], fields[2]) {
+				return credential.principal(), nil
+			}
+		}
+	case schemePeer:
+		if nodeID, err := strconv.Atoi(fields[1]); err == nil && len(fields) == 3 &&
+			validSignature(string(a.clusterSecret), challenge, fields[1], fields[2]) {
+			return Principal{Name: "Node-" + fields[1], Permissions: NewPermissions(All), Peer: true, NodeID: nodeID}, nil
+		}
+	default:
+		return Principal{}, fmt.Errorf("%w: unknown credentials %q", ErrUnauthenticated, fields[0])
+	}
+
+	return Principal{}, fmt.Errorf("%w: invalid credentials", ErrUnauthenticated)
+}
+
+// Login returns the principal of the credential with the secret, and with the name when it isn't empty.
+// It is the Login of the front ends, the cluster secret doesn't log in there.
+func (a *Auth) Login(name, secret string) (Principal, error) {
+	for _, credential := range a.credentials {
+		if (name == "" || credential.Name == name) && subtle.ConstantTimeCompare([]byte(credential.Secret), []byte(secret)) == 1 {
+			return credential.principal(), nil
+		}
+	}
+
+	return Principal{}, fmt.Errorf("%w: invalid credentials", ErrUnauthenticated)
+}
+
+func (c Credential) principal() Principal {
+	return Principal{Name: c.Name, Permissions: c.Permissions}
+}
+
+// TokenCredentials sends the secret of a credential as it is, which is only safe over an encrypted connection.
+func TokenCredentials(token string) transport.Credentials {
+	return func([]byte) []byte {
+		return []byte(schemeToken + " " + token)
+	}
+}
+
+// HMACCredentials signs the challenge with the secret of a credential, the secret itself isn't sent.
+func HMACCredentials(name, secret string) transport.Credentials {
+	return func(challenge []byte) []byte {
+		return []byte(schemeHMAC + " " + name + " " + sign(secret, challenge, name))
+	}
+}
+
+// PeerCredentials signs the challenge with the cluster secret, for the calls of a node to the other nodes.
+func PeerCredentials(nodeID int, clusterSecret string) transport.Credentials {
+	id := strconv.Itoa(nodeID)
+
+	return func(challenge []byte) []byte {
+		return []byte(schemePeer + " " + id + " " + sign(clusterSecret, challenge, id))
+	}
+}
+
+// NodeName is the name a certificate of a node has (as a DNS name), so the other nodes can tell it is that node.
+func NodeName(nodeID int) string {
+	return "node-" + strconv.Itoa(nodeID)
+}
+
+// VerifyNode checks that the verified certificate of a TLS connection is the one of the node.
+func VerifyNode(state tls.ConnectionState, nodeID int) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("%w: Node-%d has no verified certificate", ErrUnauthenticated, nodeID)
+	}
+
+	if err := state.VerifiedChains[0][0].VerifyHostname(NodeName(nodeID)); err != nil {
+		return fmt.Errorf("%w: the certificate isn't the one of Node-%d: %w", ErrUnauthenticated, nodeID, err)
+	}
+
+	return nil
+}
+
+// sign returns the HMAC of the challenge and the name, in hex.
+func sign(secret string, challenge []byte, name string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(challenge)
+	mac.Write([]byte(name))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validSignature(secret string, challenge []byte, name, signature string) bool {
+	return hmac.Equal([]byte(sign(secret, challenge, name)), []byte(signature))
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredentials(t *testing.T) {
+	credentials, err := ParseCredentials("alice:s3cret:kvstore=write,*=read; ops:other:*=admin;")
+	require.NoError(t, err)
+	require.Len(t, credentials, 2)
+
+	assert.Equal(t, "alice", credentials[0].Name)
+	assert.Equal(t, "s3cret", credentials[0].Secret)
+	assert.Equal(t, ReadWrite, credentials[0].Permissions.Of("kvstore"))
+	assert.Equal(t, Read, credentials[0].Permissions.Of("logs"))
+	assert.Equal(t, All, credentials[1].Permissions.Of("logs"))
+
+	// a credential only gets the buckets it names
+	credentials, err = ParseCredentials("alice:s3cret:kvstore=r")
+	require.NoError(t, err)
+	assert.Equal(t, Read, credentials[0].Permissions.Of("kvstore"))
+	assert.Equal(t, NoAccess, credentials[0].Permissions.Of("logs"))
+	assert.Equal(t, NoAccess, credentials[0].Permissions.Of(AllBuckets))
+
+	for _, wrong := range []string{"alice", "alice:s3cret", ":s3cret:*=r", "alice::*=r", "alice:s3cret:*=x", "al ice:s3cret:"} {
+		_, err = ParseCredentials(wrong)
+		require.Error(t, err, wrong)
+	}
+}
+
+func TestAuth_Authenticate(t *testing.T) {
+	credentials, err := ParseCredentials("alice:s3cret:kvstore=write,*=none")
+	require.NoError(t, err)
+
+	auth, err := NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	principal, err := auth.Authenticate(challenge, TokenCredentials("s3cret")(challenge))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", principal.Name)
+	assert.False(t, principal.Peer)
+	require.NoError(t, principal.Permissions.Check("kvstore", Write))
+	require.ErrorIs(t, principal.Permissions.Check("logs", Read), ErrPermissionDenied)
+
+	principal, err = auth.Authenticate(challenge, HMACCredentials("alice", "s3cret")(challenge))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", principal.Name)
+
+	principal, err = auth.Authenticate(challenge, PeerCredentials(2, "cluster")(challenge))
+	require.NoError(t, err)
+	assert.Equal(t, "Node-2", principal.Name)
+	assert.True(t, principal.Peer)
+
+	// a signature is only valid for its challenge
+	other := []byte("fedcba9876543210fedcba9876543210")
+	for _, wrong := range [][]byte{
+		TokenCredentials("wrong")(challenge),
+		HMACCredentials("alice", "wrong")(challenge),
+		HMACCredentials("bob", "s3cret")(challenge),
+		HMACCredentials("alice", "s3cret")(other),
+		PeerCredentials(2, "wrong")(challenge),
+		PeerCredentials(2, "cluster")(other),
+		[]byte("basic alice:s3cret"),
+		[]byte("token"),
+	} {
+		_, err = auth.Authenticate(challenge, wrong)
+		require.ErrorIs(t, err, ErrUnauthenticated, string(wrong))
+	}
+
+	_, err = NewAuth("")
+	require.Error(t, err)
+
+	_, err = NewAuth("cluster", append(credentials, credentials...)...)
+	require.Error(t, err, "a name is used twice")
+}
+
+func TestAuth_Login(t *testing.T) {
+	credentials, err := ParseCredentials("alice:s3cret:kvstore=write;bob:other:*=read")
+	require.NoError(t, err)
+
+	auth, err := NewAuth("cluster", credentials...)
+	require.NoError(t, err)
+
+	principal, err := auth.Login("", "s3cret")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", principal.Name)
+	require.NoError(t, principal.Permissions.Check("kvstore", Write))
+
+	principal, err = auth.Login("bob", "other")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", principal.Name)
+
+	for _, wrong := range [][2]string{{"", "wrong"}, {"bob", "s3cret"}, {"", "cluster"}, {"", ""}} {
+		_, err = auth.Login(wrong[0], wrong[1])
+		require.ErrorIs(t, err, ErrUnauthenticated, wrong)
+	}
+}
+
+func TestVerifyNode(t *testing.T) {
+	assert.Equal(t, "node-2", NodeName(2))
+
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{DNSNames: []string{"localhost", "node-2"}}}}}
+	require.NoError(t, VerifyNode(state, 2))
+	require.ErrorIs(t, VerifyNode(state, 3), ErrUnauthenticated)
+	require.ErrorIs(t, VerifyNode(tls.ConnectionState{}, 2), ErrUnauthenticated, "a node without a certificate")
+}
@@ -1,33 +1,74 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
 
 	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
 )
 
 const (
 	SetSuccess = "Set key successfully"
+
+	// RequestTimeout is the default deadline of one request, including the replication.
+	RequestTimeout = 5 * time.Second
+
+	// DefaultKeysLimit is the size of a page of keys when no limit is given, MaxKeysLimit the largest size.
+	DefaultKeysLimit = 100
+	MaxKeysLimit     = 1000
+
+	// MaxBucketLength is the longest name of a bucket.
+	MaxBucketLength = 128
 )
 
+// KeyValueStoreService is the RPC service of a node. The first argument of every method
+// (but Cluster and Info) is the name of the bucket, nil or "" is the bucket replicationmanager.KeyBucket.
 type KeyValueStoreService struct {
 	replication *replicationmanager.ReplicationManager
+	permissions Permissions
+	timeout     time.Duration
 }
 
 func NewKeyValueStoreService(
 	replication *replicationmanager.ReplicationManager,
+	opts ...Option,
 ) *KeyValueStoreService {
-	return &KeyValueStoreService{replication}
+	s := &KeyValueStoreService{replication: replication, permissions: NewPermissions(All), timeout: RequestTimeout}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// WithRequestTimeout sets the deadline of one request, RequestTimeout without it.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *KeyValueStoreService) {
+		s.timeout = timeout
+	}
 }
 
-func (s *KeyValueStoreService) Set(args [2]interface{}, reply *string) error {
-	if args[0] == nil || args[1] == nil {
+// Set sets a key on the leader and its backups. The value is a replicationmanager.TypedValue,
+// that is stored with its content type so Get returns it as it was, or any other value, that is stored as JSON.
+func (s *KeyValueStoreService) Set(args [3]interface{}, reply *string) error {
+	bucket, err := s.bucket(args[0], Write)
+	if err != nil {
+		return fmt.Errorf("set->%w", err)
+	}
+
+	if args[1] == nil || args[2] == nil {
 		return errors.New("set->key or value is nil")
 	}
 
-	key, err := parseKey(args[0])
+	key, err := parseKey(args[1])
 	if err != nil {
 		return fmt.Errorf("set->parse key error: %w", err)
 	}
@@ -35,15 +76,16 @@ func (s *KeyValueStoreService) Set(args [2]interface{}, reply *string) error {
 		return errors.New("set->key is nil")
 	}
 
-	value, err := parseValue(args[1])
+	value, err := parseValue(args[2])
 	if err != nil {
 		return fmt.Errorf("set->parse value error: %w", err)
 	}
-	if len(value) == 0 {
-		return errors.New("set->value is nil")
-	}
 
-	if err := s.replication.Set(*key, value); err != nil {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	opts := replicationmanager.SetOptions{Attrs: value.Attrs()}
+	if _, err := s.replication.SetWith(ctx, bucket, *key, value.Data, opts); err != nil {
 		return err
 	}
 
@@ -51,12 +93,74 @@ func (s *KeyValueStoreService) Set(args [2]interface{}, reply *string) error {
 	return nil
 }
 
-func (s *KeyValueStoreService) Get(args [1]interface{}, reply *replicationmanager.GetResult) error {
-	if args[0] == nil {
+// SetIf sets a key like Set, when its value matches the conditions: the fourth argument is the
+// If-Match and the fifth the If-None-Match condition. A condition is nil, "*" for any value, or the
+// replicationmanager.Fingerprint of a value. The reply is false when the conditions didn't match.
+func (s *KeyValueStoreService) SetIf(args [5]interface{}, reply *bool) error {
+	bucket, err := s.bucket(args[0], Write)
+	if err != nil {
+		return fmt.Errorf("setIf->%w", err)
+	}
+
+	if args[1] == nil || args[2] == nil {
+		return errors.New("setIf->key or value is nil")
+	}
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		return fmt.Errorf("setIf->parse key error: %w", err)
+	}
+
+	value, err := parseValue(args[2])
+	if err != nil {
+		return fmt.Errorf("setIf->parse value error: %w", err)
+	}
+
+	ifMatch, err := parseCondition(args[3])
+	if err != nil {
+		return fmt.Errorf("setIf->parse if-match error: %w", err)
+	}
+
+	ifNoneMatch, err := parseCondition(args[4])
+	if err != nil {
+		return fmt.Errorf("setIf->parse if-none-match error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	opts := replicationmanager.SetOptions{IfMatch: ifMatch, IfNoneMatch: ifNoneMatch, Attrs: value.Attrs()}
+	set, err := s.replication.SetWith(ctx, bucket, *key, value.Data, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = set
+	return nil
+}
+
+func (s *KeyValueStoreService) Get(args [2]interface{}, reply *replicationmanager.GetResult) error {
+	return s.GetWithPreference([3]interface{}{args[0], args[1], int(replicationmanager.ReadFromLeader)}, reply)
+}
+
+// GetWithPreference gets a value like Get, the third argument is the ReadPreference:
+// from the leader, or from the node that receives the call.
+func (s *KeyValueStoreService) GetWithPreference(args [3]interface{}, reply *replicationmanager.GetResult) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("get->%w", err)
+	}
+
+	if args[1] == nil {
 		return errors.New("get->key is nil")
 	}
 
-	key, err := parseKey(args[0])
+	preference, ok := args[2].(int)
+	if !ok {
+		return fmt.Errorf("get->preference=%+v, preference is not an integer", args[2])
+	}
+
+	key, err := parseKey(args[1])
 	if err != nil {
 		return fmt.Errorf("get->parse key error: %w", err)
 	}
@@ -64,15 +168,404 @@ func (s *KeyValueStoreService) Get(args [1]interface{}, reply *replicationmanage
 		return errors.New("get->key is nil")
 	}
 
-	value, err := s.replication.Get(*key, replicationmanager.ReadFromLeader)
+	ctx, cancel := s.context()
+	defer cancel()
+
+	value, err := s.replication.Get(ctx, bucket, *key, replicationmanager.ReadPreference(preference))
 	if err != nil {
-		return fmt.Errorf("get->key not found: %w", err)
+		return fmt.Errorf("get->%w", err)
+	}
+	if !value.Found {
+		return fmt.Errorf("get->key not found: %d", *key)
 	}
 
 	*reply = *value
 	return nil
 }
 
+// GetAll returns all the values of a bucket, on the leader.
+func (s *KeyValueStoreService) GetAll(args [1]interface{}, reply *map[int][]byte) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("getAll->%w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	values, err := s.replication.GetAll(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("getAll->%w", err)
+	}
+
+	*reply = values
+	return nil
+}
+
+// GetAllSorted returns all the values of a bucket sorted by key, on the leader.
+func (s *KeyValueStoreService) GetAllSorted(args [1]interface{}, reply *[]replicationmanager.Record) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("getAllSorted->%w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	records, err := s.replication.GetAllSorted(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("getAllSorted->%w", err)
+	}
+
+	*reply = records
+	return nil
+}
+
+// Delete deletes a key on the leader and its backups, the reply is false when the key didn't exist.
+func (s *KeyValueStoreService) Delete(args [2]interface{}, reply *bool) error {
+	bucket, err := s.bucket(args[0], Write)
+	if err != nil {
+		return fmt.Errorf("delete->%w", err)
+	}
+
+	if args[1] == nil {
+		return errors.New("delete->key is nil")
+	}
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		return fmt.Errorf("delete->parse key error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	deleted, err := s.replication.Delete(ctx, bucket, *key)
+	if err != nil {
+		return err
+	}
+
+	*reply = deleted
+	return nil
+}
+
+// DeleteIf deletes a key like Delete, when its value matches the If-Match condition of the third
+// argument (see SetIf). The reply is false when the key didn't exist or didn't match.
+func (s *KeyValueStoreService) DeleteIf(args [3]interface{}, reply *bool) error {
+	bucket, err := s.bucket(args[0], Write)
+	if err != nil {
+		return fmt.Errorf("deleteIf->%w", err)
+	}
+
+	if args[1] == nil {
+		return errors.New("deleteIf->key is nil")
+	}
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		return fmt.Errorf("deleteIf->parse key error: %w", err)
+	}
+
+	ifMatch, err := parseCondition(args[2])
+	if err != nil {
+		return fmt.Errorf("deleteIf->parse if-match error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	deleted, err := s.replication.DeleteIfMatch(ctx, bucket, *key, ifMatch)
+	if err != nil {
+		return err
+	}
+
+	*reply = deleted
+	return nil
+}
+
+// Batch sets and deletes keys on the leader and its backups, all at once or not at all.
+// The value of a set is JSON, like the values Set stores, it is stored compacted. The reply is the number of operations.
+func (s *KeyValueStoreService) Batch(ops []replicationmanager.BatchOp, reply *int) error {
+	if len(ops) == 0 {
+		return errors.New("batch->no operations")
+	}
+
+	for i, op := range ops {
+		bucket, err := s.bucket(op.Bucket, Write)
+		if err != nil {
+			return fmt.Errorf("batch->operation %d: %w", i, err)
+		}
+
+		if _, err := parseKey(op.Key); err != nil {
+			return fmt.Errorf("batch->operation %d: parse key error: %w", i, err)
+		}
+
+		switch op.Op {
+		case replicationmanager.OpSet:
+			// a value is one line of the data file
+			var value bytes.Buffer
+			if err := json.Compact(&value, op.Value); err != nil {
+				return fmt.Errorf("batch->operation %d: value is not valid JSON: %w", i, err)
+			}
+
+			ops[i].Value = value.Bytes()
+		case replicationmanager.OpDelete:
+		default:
+			return fmt.Errorf("batch->operation %d: op=%q, op should be %q or %q",
+				i, op.Op, replicationmanager.OpSet, replicationmanager.OpDelete)
+		}
+
+		ops[i].Bucket = bucket
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	count, err := s.replication.Batch(ctx, ops)
+	if err != nil {
+		return err
+	}
+
+	*reply = count
+	return nil
+}
+
+// Exists tells if a key exists, on the leader.
+func (s *KeyValueStoreService) Exists(args [2]interface{}, reply *bool) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("exists->%w", err)
+	}
+
+	if args[1] == nil {
+		return errors.New("exists->key is nil")
+	}
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		return fmt.Errorf("exists->parse key error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	exists, err := s.replication.Exists(ctx, bucket, *key)
+	if err != nil {
+		return err
+	}
+
+	*reply = exists
+	return nil
+}
+
+// Keys returns a page of the keys of a bucket, in sorted order. The other arguments are the key
+// to start at, and the size of the page (DefaultKeysLimit when it is 0, at most MaxKeysLimit).
+// The next page starts at the last key plus one.
+func (s *KeyValueStoreService) Keys(args [3]interface{}, reply *[]int) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("keys->%w", err)
+	}
+
+	start := 0
+	if args[1] != nil {
+		key, err := parseKey(args[1])
+		if err != nil {
+			return fmt.Errorf("keys->parse start error: %w", err)
+		}
+		start = *key
+	}
+
+	limit, err := parseLimit(args[2])
+	if err != nil {
+		return fmt.Errorf("keys->parse limit error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	keys, err := s.replication.Keys(ctx, bucket, start, limit)
+	if err != nil {
+		return err
+	}
+
+	*reply = keys
+	return nil
+}
+
+// Range returns a page of the records of a bucket sorted by key, on the leader. The other arguments
+// are the first and the last key (nil for no bound) and the size of the page, like Keys.
+func (s *KeyValueStoreService) Range(args [4]interface{}, reply *[]replicationmanager.Record) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("range->%w", err)
+	}
+
+	from, to := 0, math.MaxInt
+	if args[1] != nil {
+		key, err := parseKey(args[1])
+		if err != nil {
+			return fmt.Errorf("range->parse from error: %w", err)
+		}
+		from = *key
+	}
+
+	if args[2] != nil {
+		key, err := parseKey(args[2])
+		if err != nil {
+			return fmt.Errorf("range->parse to error: %w", err)
+		}
+		to = *key
+	}
+
+	limit, err := parseLimit(args[3])
+	if err != nil {
+		return fmt.Errorf("range->parse limit error: %w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	records, err := s.replication.Range(ctx, bucket, from, to, limit)
+	if err != nil {
+		return err
+	}
+
+	*reply = records
+	return nil
+}
+
+// Scan streams the records of a bucket sorted by key, on the leader. The other arguments are the first
+// and the last key, like Range. The records are read a page at a time, so a scan isn't a snapshot.
+func (s *KeyValueStoreService) Scan(ctx context.Context, args [3]interface{}, send func(replicationmanager.Record) error) error {
+	from, to := args[1], args[2]
+
+	for {
+		var records []replicationmanager.Record
+		if err := s.Range([4]interface{}{args[0], from, to, MaxKeysLimit}, &records); err != nil {
+			return fmt.Errorf("scan->%w", err)
+		}
+
+		for _, record := range records {
+			if err := send(record); err != nil {
+				return err
+			}
+		}
+
+		if len(records) < MaxKeysLimit {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		from = records[len(records)-1].Key + 1
+	}
+}
+
+// Watch streams the changes of a bucket on the node that receives the call, until the context ends.
+// A watch that doesn't keep up with the changes ends with replicationmanager.ErrWatchOverflow.
+func (s *KeyValueStoreService) Watch(ctx context.Context, args [1]interface{}, send func(replicationmanager.WatchEvent) error) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("watch->%w", err)
+	}
+
+	return s.replication.Watch(ctx, bucket, send)
+}
+
+// Count returns the number of keys of a bucket, on the leader.
+func (s *KeyValueStoreService) Count(args [1]interface{}, reply *int) error {
+	bucket, err := s.bucket(args[0], Read)
+	if err != nil {
+		return fmt.Errorf("count->%w", err)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	count, err := s.replication.Count(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	*reply = count
+	return nil
+}
+
+// Buckets returns the names of the buckets on all the nodes that may be read, sorted.
+func (s *KeyValueStoreService) Buckets(_ [1]interface{}, reply *[]string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	buckets := []string{}
+	for _, bucket := range s.replication.Buckets(ctx) {
+		if s.permissions.Of(bucket)&Read != 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	*reply = buckets
+	return nil
+}
+
+func (s *KeyValueStoreService) Cluster(_ [1]interface{}, reply *replicationmanager.ClusterInfo) error {
+	*reply = s.replication.Cluster()
+	return nil
+}
+
+// Info describes the database of the node, it needs the Admin permission of AllBuckets.
+func (s *KeyValueStoreService) Info(_ [1]interface{}, reply *string) error {
+	if err := s.permissions.Check(AllBuckets, Admin); err != nil {
+		return fmt.Errorf("info->%w", err)
+	}
+
+	*reply = s.replication.Info()
+	return nil
+}
+
+// context returns the context of a request, that ends after the request timeout.
+func (s *KeyValueStoreService) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// bucket parses the name of a bucket, and checks its permission.
+func (s *KeyValueStoreService) bucket(arg interface{}, perm Permission) (string, error) {
+	bucket, err := parseBucket(arg)
+	if err != nil {
+		return "", fmt.Errorf("parse bucket error: %w", err)
+	}
+
+	if err := s.permissions.Check(bucket, perm); err != nil {
+		return "", err
+	}
+
+	return bucket, nil
+}
+
+func parseBucket(bucket interface{}) (string, error) {
+	if bucket == nil {
+		return replicationmanager.KeyBucket, nil
+	}
+
+	name, ok := bucket.(string)
+	if !ok {
+		return "", fmt.Errorf("bucket=%+v, bucket is not a string", bucket)
+	}
+
+	switch {
+	case name == "":
+		return replicationmanager.KeyBucket, nil
+	case len(name) > MaxBucketLength:
+		return "", fmt.Errorf("bucket=%q, bucket should be at most %d characters", name, MaxBucketLength)
+	case name == AllBuckets || strings.ContainsFunc(name, unicode.IsSpace) || strings.ContainsFunc(name, unicode.IsControl):
+		return "", fmt.Errorf("bucket=%q, bucket should not contain white space or be %s", name, AllBuckets)
+	}
+
+	return name, nil
+}
+
 func parseKey(key interface{}) (*int, error) {
 	keyValue, ok := key.(int)
 	if !ok {
@@ -86,11 +579,49 @@ func parseKey(key interface{}) (*int, error) {
 	return &keyValue, nil
 }
 
-func parseValue(value interface{}) ([]byte, error) {
+func parseLimit(limit interface{}) (int, error) {
+	if limit == nil {
+		return DefaultKeysLimit, nil
+	}
+
+	limitValue, ok := limit.(int)
+	if !ok {
+		return 0, fmt.Errorf("limit=%+v, limit is not an integer", limit)
+	}
+
+	switch {
+	case limitValue < 0:
+		return 0, fmt.Errorf("limit=%+v, limit should be positive", limit)
+	case limitValue == 0:
+		return DefaultKeysLimit, nil
+	default:
+		return min(limitValue, MaxKeysLimit), nil
+	}
+}
+
+func parseCondition(condition interface{}) (string, error) {
+	if condition == nil {
+		return "", nil
+	}
+
+	text, ok := condition.(string)
+	if !ok {
+		return "", fmt.Errorf("condition=%+v, condition is not a string", condition)
+	}
+
+	return text, nil
+}
+
+// parseValue returns a replicationmanager.TypedValue as it is, any other value is stored as JSON.
+func parseValue(value interface{}) (replicationmanager.TypedValue, error) {
+	if typed, ok := value.(replicationmanager.TypedValue); ok {
+		return replicationmanager.Typed(typed)
+	}
+
 	byteValue, err := json.Marshal(value)
 	if err != nil {
-		return nil, fmt.Errorf("value=%+v, marshal value error: %w", value, err)
+		return replicationmanager.TypedValue{}, fmt.Errorf("value=%+v, marshal value error: %w", value, err)
 	}
 
-	return byteValue, nil
+	return replicationmanager.TypedValue{Type: replicationmanager.ContentJSON, Data: byteValue}, nil
 }
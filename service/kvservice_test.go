@@ -1,121 +1,639 @@
 package service
 
-// func setupTestDB(t *testing.T) *fastdb.DB {
-// 	workDir, err := os.Getwd()
-// 	if err != nil {
-// 		t.Fatalf("failed to get working directory: %v", err)
-// 	}
-
-// 	parentDir := filepath.Join(workDir, "..")
-// 	dbPath := filepath.Join(parentDir, "data", "unit_test.db")
-
-// 	db, err := fastdb.Open(dbPath, 1000)
-// 	if err != nil {
-// 		t.Fatalf("Failed to open test database: %v", err)
-// 	}
-
-// 	return db
-// }
-
-// func TestKeyValueStoreService_Set(t *testing.T) {
-// 	db := setupTestDB(t)
-// 	defer db.Close()
-
-// 	replicationManager := replicationmanager.NewReplicationManager(db)
-// 	service := NewKeyValueStoreService(replicationManager)
-
-// 	tests := []struct {
-// 		name    string
-// 		args    [2]interface{}
-// 		wantErr bool
-// 	}{
-// 		{
-// 			name:    "Valid key-value pair",
-// 			args:    [2]interface{}{1, "test value"},
-// 			wantErr: false,
-// 		},
-// 		{
-// 			name:    "Nil key",
-// 			args:    [2]interface{}{nil, "test value"},
-// 			wantErr: true,
-// 		},
-// 		{
-// 			name:    "Negative key",
-// 			args:    [2]interface{}{-1, "test value"},
-// 			wantErr: true,
-// 		},
-// 		{
-// 			name:    "Nil value",
-// 			args:    [2]interface{}{1, nil},
-// 			wantErr: true,
-// 		},
-// 	}
-
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			var reply string
-// 			err := service.Set(tt.args, &reply)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("Set() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if err == nil && reply != SetSuccess {
-// 				t.Errorf("Set() reply = %v, want %v", reply, SetSuccess)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestKeyValueStoreService_Get(t *testing.T) {
-// 	db := setupTestDB(t)
-// 	defer db.Close()
-
-// 	service := NewKeyValueStoreService(db)
-
-// 	// Setup test data
-// 	setupArgs := [2]interface{}{1, "test value"}
-// 	var setupReply string
-// 	if err := service.Set(setupArgs, &setupReply); err != nil {
-// 		t.Fatalf("Failed to setup test data: %v", err)
-// 	}
-
-// 	tests := []struct {
-// 		name    string
-// 		args    [1]interface{}
-// 		want    string
-// 		wantErr bool
-// 	}{
-// 		{
-// 			name:    "Existing key",
-// 			args:    [1]interface{}{1},
-// 			want:    "test value",
-// 			wantErr: false,
-// 		},
-// 		{
-// 			name:    "Non-existing key",
-// 			args:    [1]interface{}{2},
-// 			want:    "",
-// 			wantErr: true,
-// 		},
-// 		{
-// 			name:    "Nil key",
-// 			args:    [1]interface{}{nil},
-// 			want:    "",
-// 			wantErr: true,
-// 		},
-// 	}
-
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			var reply interface{}
-// 			err := service.Get(tt.args, &reply)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if err == nil && reply.(string) != tt.want {
-// 				t.Errorf("Get() reply = %v, want %v", reply, tt.want)
-// 			}
-// 		})
-// 	}
-// }
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/marcelloh/fastdb/replication/election"
+	replicationmanager "github.com/marcelloh/fastdb/replication/replication-manager"
+	"github.com/marcelloh/fastdb/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNode is one node of a test cluster, with its database in memory.
+type testNode struct {
+	db      *fastdb.DB
+	service *KeyValueStoreService
+}
+
+// setupCluster starts a leader (Node-1) and a backup (Node-2), which call each other over RPC.
+func setupCluster(t *testing.T) (*testNode, *testNode) {
+	t.Helper()
+
+	leaderListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backupListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	leader := startNode(t, leaderListener, 1, map[int]string{2: backupListener.Addr().String()})
+	backup := startNode(t, backupListener, 2, map[int]string{1: leaderListener.Addr().String()})
+
+	return leader, backup
+}
+
+func startNode(t *testing.T, listener net.Listener, nodeID int, peers map[int]string) *testNode {
+	t.Helper()
+
+	db, err := fastdb.Open(":memory:", 100)
+	require.NoError(t, err)
+
+	bully := election.NewBullyAlgorithm(nodeID, 1, peers)
+	replication := replicationmanager.NewReplicationManager(nodeID, db, bully)
+
+	server := transport.NewServer()
+	require.NoError(t, server.RegisterName("ReplicationManager", replication))
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+
+	return &testNode{db: db, service: NewKeyValueStoreService(replication)}
+}
+
+// openNode starts a node without peers, with its database in a file that the test may reopen.
+func openNode(t *testing.T, path string) *testNode {
+	t.Helper()
+
+	db, err := fastdb.Open(path, 100)
+	require.NoError(t, err)
+
+	bully := election.NewBullyAlgorithm(1, 1, nil)
+	replication := replicationmanager.NewReplicationManager(1, db, bully)
+
+	return &testNode{db: db, service: NewKeyValueStoreService(replication)}
+}
+
+// reopen closes the database of the node, and opens its file again.
+func (node *testNode) reopen(t *testing.T, path string) *fastdb.DB {
+	t.Helper()
+
+	require.NoError(t, node.db.Close())
+
+	db, err := fastdb.Open(path, 100)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestKeyValueStoreService_Set(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	tests := []struct {
+		name    string
+		args    [3]interface{}
+		wantErr bool
+	}{
+		{name: "Valid key-value pair", args: [3]interface{}{nil, 1, "test value"}},
+		{name: "Other bucket", args: [3]interface{}{"texts", 1, "other value"}},
+		{name: "Nil key", args: [3]interface{}{"", nil, "test value"}, wantErr: true},
+		{name: "Negative key", args: [3]interface{}{"", -1, "test value"}, wantErr: true},
+		{name: "Nil value", args: [3]interface{}{"", 1, nil}, wantErr: true},
+		{name: "Wrong bucket", args: [3]interface{}{"two words", 1, "test value"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply string
+			err := leader.service.Set(tt.args, &reply)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, SetSuccess, reply)
+		})
+	}
+
+	value, ok := backup.db.Get(replicationmanager.KeyBucket, 1)
+	assert.True(t, ok)
+	assert.Equal(t, `"test value"`, string(value))
+
+	value, ok = backup.db.Get("texts", 1)
+	assert.True(t, ok)
+	assert.Equal(t, `"other value"`, string(value))
+}
+
+func TestKeyValueStoreService_Delete(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"", 1, "one"}, &reply))
+
+	// only the leader deletes
+	var deleted bool
+	err := backup.service.Delete([2]interface{}{"", 1}, &deleted)
+	require.ErrorContains(t, err, "not the leader")
+
+	require.NoError(t, leader.service.Delete([2]interface{}{"", 1}, &deleted))
+	assert.True(t, deleted)
+
+	_, ok := leader.db.Get(replicationmanager.KeyBucket, 1)
+	assert.False(t, ok)
+	_, ok = backup.db.Get(replicationmanager.KeyBucket, 1)
+	assert.False(t, ok, "the delete is replicated")
+
+	require.NoError(t, leader.service.Delete([2]interface{}{"", 1}, &deleted))
+	assert.False(t, deleted)
+
+	require.Error(t, leader.service.Delete([2]interface{}{"", nil}, &deleted))
+	require.Error(t, leader.service.Delete([2]interface{}{"", "one"}, &deleted))
+}
+
+func TestKeyValueStoreService_SetIfDeleteIf(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var set bool
+	require.NoError(t, leader.service.SetIf([5]interface{}{"", 1, "one", "*", nil}, &set))
+	assert.False(t, set, "the key doesn't exist yet")
+
+	require.NoError(t, leader.service.SetIf([5]interface{}{"", 1, "one", nil, "*"}, &set))
+	assert.True(t, set)
+
+	require.NoError(t, leader.service.SetIf([5]interface{}{"", 1, "uno", nil, "*"}, &set))
+	assert.False(t, set, "the key exists")
+
+	fingerprint := replicationmanager.Fingerprint([]byte(`"one"`))
+	require.NoError(t, leader.service.SetIf([5]interface{}{"", 1, "two", "abc", nil}, &set))
+	assert.False(t, set, "the value doesn't match")
+
+	require.NoError(t, leader.service.SetIf([5]interface{}{"", 1, "two", fingerprint, nil}, &set))
+	assert.True(t, set)
+
+	value, _ := backup.db.Get(replicationmanager.KeyBucket, 1)
+	assert.Equal(t, `"two"`, string(value))
+
+	var deleted bool
+	require.NoError(t, leader.service.DeleteIf([3]interface{}{"", 1, fingerprint}, &deleted))
+	assert.False(t, deleted, "the value changed")
+
+	fingerprint = replicationmanager.Fingerprint([]byte(`"two"`))
+	require.NoError(t, leader.service.DeleteIf([3]interface{}{"", 1, fingerprint}, &deleted))
+	assert.True(t, deleted)
+
+	require.Error(t, leader.service.SetIf([5]interface{}{"", 1, "one", 1, nil}, &set))
+	require.ErrorContains(t, backup.service.SetIf([5]interface{}{"", 1, "one", nil, nil}, &set), "not the leader")
+}
+
+func TestKeyValueStoreService_Batch(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"", 1, "one"}, &reply))
+
+	var count int
+	ops := []replicationmanager.BatchOp{
+		{Op: replicationmanager.OpDelete, Key: 1},
+		{Op: replicationmanager.OpSet, Bucket: "texts", Key: 2, Value: []byte(`"two"`)},
+	}
+	require.NoError(t, leader.service.Batch(ops, &count))
+	assert.Equal(t, 2, count)
+
+	for _, node := range []*testNode{leader, backup} {
+		_, ok := node.db.Get(replicationmanager.KeyBucket, 1)
+		assert.False(t, ok)
+		value, _ := node.db.Get("texts", 2)
+		assert.Equal(t, `"two"`, string(value))
+	}
+
+	invalid := [][]replicationmanager.BatchOp{
+		{},
+		{{Op: replicationmanager.OpSet, Key: 3, Value: []byte("not json")}},
+		{{Op: replicationmanager.OpExpire, Key: 3}},
+		{{Op: replicationmanager.OpDelete, Key: -1}},
+	}
+	for _, ops := range invalid {
+		require.Error(t, leader.service.Batch(ops, &count))
+	}
+
+	require.ErrorContains(t, backup.service.Batch(ops, &count), "not the leader")
+}
+
+func TestKeyValueStoreService_Batch_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.db")
+	node := openNode(t, path)
+
+	var count int
+	ops := []replicationmanager.BatchOp{
+		{Op: replicationmanager.OpSet, Key: 1, Value: []byte("{\n  \"name\": \"one\",\n  \"tags\": [1, 2]\n}")},
+	}
+	require.NoError(t, node.service.Batch(ops, &count))
+
+	db := node.reopen(t, path)
+
+	value, ok := db.Get(replicationmanager.KeyBucket, 1)
+	assert.True(t, ok)
+	assert.Equal(t, `{"name":"one","tags":[1,2]}`, string(value))
+}
+
+func TestKeyValueStoreService_Exists(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"", 1, "one"}, &reply))
+
+	for name, node := range map[string]*testNode{"leader": leader, "backup": backup} {
+		t.Run(name, func(t *testing.T) {
+			var exists bool
+			require.NoError(t, node.service.Exists([2]interface{}{"", 1}, &exists))
+			assert.True(t, exists)
+
+			require.NoError(t, node.service.Exists([2]interface{}{"", 2}, &exists))
+			assert.False(t, exists)
+
+			require.Error(t, node.service.Exists([2]interface{}{"", -1}, &exists))
+		})
+	}
+}
+
+func TestKeyValueStoreService_KeysCount(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	// a value only on the backup isn't seen, the leader answers
+	require.NoError(t, backup.db.Set(replicationmanager.KeyBucket, 99, []byte("99")))
+
+	var reply string
+	for key := 1; key <= 5; key++ {
+		require.NoError(t, leader.service.Set([3]interface{}{"", key, key}, &reply))
+	}
+
+	for name, node := range map[string]*testNode{"leader": leader, "backup": backup} {
+		t.Run(name, func(t *testing.T) {
+			var keys []int
+			require.NoError(t, node.service.Keys([3]interface{}{"", 0, 2}, &keys))
+			assert.Equal(t, []int{1, 2}, keys)
+
+			require.NoError(t, node.service.Keys([3]interface{}{"", 3, 2}, &keys))
+			assert.Equal(t, []int{3, 4}, keys)
+
+			require.NoError(t, node.service.Keys([3]interface{}{"", nil, nil}, &keys))
+			assert.Equal(t, []int{1, 2, 3, 4, 5}, keys)
+
+			require.Error(t, node.service.Keys([3]interface{}{"", 0, -1}, &keys))
+			require.Error(t, node.service.Keys([3]interface{}{"", "0", 1}, &keys))
+
+			var count int
+			require.NoError(t, node.service.Count([1]interface{}{""}, &count))
+			assert.Equal(t, 5, count)
+		})
+	}
+}
+
+func TestKeyValueStoreService_Range(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	for key := 1; key <= 5; key++ {
+		require.NoError(t, leader.service.Set([3]interface{}{"", key, key}, &reply))
+	}
+
+	for name, node := range map[string]*testNode{"leader": leader, "backup": backup} {
+		t.Run(name, func(t *testing.T) {
+			var records []replicationmanager.Record
+			require.NoError(t, node.service.Range([4]interface{}{"", 2, 4, nil}, &records))
+			assert.Equal(t, []replicationmanager.Record{
+				{Key: 2, Value: []byte("2")}, {Key: 3, Value: []byte("3")}, {Key: 4, Value: []byte("4")},
+			}, records)
+
+			require.NoError(t, node.service.Range([4]interface{}{"", 4, nil, 1}, &records))
+			assert.Equal(t, []replicationmanager.Record{{Key: 4, Value: []byte("4")}}, records)
+
+			require.Error(t, node.service.Range([4]interface{}{"", nil, -1, nil}, &records))
+		})
+	}
+}
+
+func TestKeyValueStoreService_Scan(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	for key := 1; key <= 5; key++ {
+		require.NoError(t, leader.service.Set([3]interface{}{"", key, key}, &reply))
+	}
+
+	var keys []int
+	err := backup.service.Scan(context.Background(), [3]interface{}{"", 2, 4}, func(record replicationmanager.Record) error {
+		keys = append(keys, record.Key)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3, 4}, keys)
+
+	stop := errors.New("stop")
+	err = leader.service.Scan(context.Background(), [3]interface{}{"", nil, nil}, func(replicationmanager.Record) error {
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+}
+
+func TestKeyValueStoreService_Watch(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan replicationmanager.WatchEvent, 10)
+	done := make(chan error, 1)
+	started := make(chan struct{})
+
+	go func() {
+		close(started)
+		done <- backup.service.Watch(ctx, [1]interface{}{"texts"}, func(event replicationmanager.WatchEvent) error {
+			events <- event
+			return nil
+		})
+	}()
+	<-started
+
+	// the watch registers itself, before the changes are made
+	require.Eventually(t, func() bool {
+		var reply string
+		require.NoError(t, leader.service.Set([3]interface{}{"texts", 1, "one"}, &reply))
+		return len(events) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	var deleted bool
+	require.NoError(t, leader.service.Set([3]interface{}{"other", 1, "one"}, new(string)))
+	require.NoError(t, leader.service.Delete([2]interface{}{"texts", 1}, &deleted))
+
+	var last replicationmanager.WatchEvent
+	for last.Op != replicationmanager.OpDelete {
+		last = <-events
+		assert.Equal(t, "texts", last.Bucket, "only the changes of the bucket")
+		assert.Equal(t, 1, last.Key)
+	}
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	require.Error(t, backup.service.Watch(ctx, [1]interface{}{"two words"}, nil))
+}
+
+func TestKeyValueStoreService_Get(t *testing.T) {
+	leader, _ := setupCluster(t)
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"", 1, "test value"}, &reply))
+
+	tests := []struct {
+		name    string
+		args    [2]interface{}
+		want    string
+		wantErr bool
+	}{
+		{name: "Existing key", args: [2]interface{}{nil, 1}, want: `"test value"`},
+		{name: "Other bucket", args: [2]interface{}{"texts", 1}, wantErr: true},
+		{name: "Non-existing key", args: [2]interface{}{"", 2}, wantErr: true},
+		{name: "Nil key", args: [2]interface{}{"", nil}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result replicationmanager.GetResult
+			err := leader.service.Get(tt.args, &result)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(result.Value))
+		})
+	}
+}
+
+func TestKeyValueStoreService_typedValues(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	tests := []struct {
+		name  string
+		value any
+		want  any
+		typ   replicationmanager.ContentType
+	}{
+		{name: "Raw", value: []byte{0, 1, 2}, want: []byte{0, 1, 2}, typ: replicationmanager.ContentRaw},
+		{name: "String", value: "abc", want: "abc", typ: replicationmanager.ContentString},
+		{name: "JSON", value: json.RawMessage(`{"a":1}`), want: map[string]any{"a": float64(1)}, typ: replicationmanager.ContentJSON},
+		{name: "Int", value: 42, want: int64(42), typ: replicationmanager.ContentInt},
+		{name: "Float", value: 1.5, want: 1.5, typ: replicationmanager.ContentFloat},
+		{name: "Bool", value: true, want: true, typ: replicationmanager.ContentBool},
+		{name: "Other", value: []int{1, 2}, want: []any{float64(1), float64(2)}, typ: replicationmanager.ContentJSON},
+	}
+
+	for key, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typed, err := replicationmanager.Typed(tt.value)
+			require.NoError(t, err)
+			require.NoError(t, leader.service.Set([3]interface{}{"typed", key, typed}, new(string)))
+
+			for _, node := range []*testNode{leader, backup} {
+				var result replicationmanager.GetResult
+				args := [3]interface{}{"typed", key, int(replicationmanager.ReadFromLocal)}
+				require.NoError(t, node.service.GetWithPreference(args, &result))
+				assert.Equal(t, tt.typ, result.ContentType)
+
+				value, err := result.Typed().Decode()
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, value)
+			}
+		})
+	}
+
+	// a value without a type is JSON, also after a typed value
+	require.NoError(t, leader.service.Set([3]interface{}{"typed", 1, "abc"}, new(string)))
+
+	var result replicationmanager.GetResult
+	require.NoError(t, leader.service.Get([2]interface{}{"typed", 1}, &result))
+	assert.Equal(t, replicationmanager.ContentJSON, result.ContentType)
+	assert.Equal(t, `"abc"`, string(result.Value))
+
+	for _, typed := range []replicationmanager.TypedValue{
+		{Type: replicationmanager.ContentInt, Data: []byte("abc")},
+		{Type: replicationmanager.ContentJSON, Data: []byte("{")},
+		{Type: replicationmanager.ContentString, Data: []byte{0xff}},
+		{Type: "date", Data: []byte("today")},
+	} {
+		err := leader.service.Set([3]interface{}{"typed", 1, typed}, new(string))
+		require.ErrorContains(t, err, "set->parse value error", typed.Type)
+	}
+}
+
+func TestKeyValueStoreService_typedValues_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "typed.db")
+	node := openNode(t, path)
+
+	tests := []struct {
+		name   string
+		value  any
+		stored string
+	}{
+		{name: "Raw", value: []byte("a\tb"), stored: "a\tb"},
+		{name: "Binary", value: []byte("a\nb\x00\r"), stored: "a\nb\x00\r"},
+		{name: "String", value: `say "hi"`, stored: `say "hi"`},
+		{name: "Lines", value: "one\r\ntwo\n", stored: "one\r\ntwo\n"},
+		{name: "JSON", value: json.RawMessage("{\n  \"a\": \"x\\ny\"\n}"), stored: `{"a":"x\ny"}`},
+		{name: "Typed JSON", value: replicationmanager.TypedValue{Type: replicationmanager.ContentJSON, Data: []byte("[1,\n2]")}, stored: "[1,2]"},
+		{name: "Int", value: 42, stored: "42"},
+		{name: "Float", value: 1.5, stored: "1.5"},
+		{name: "Bool", value: true, stored: "true"},
+		{name: "Other", value: map[string]string{"a": "x\ny"}, stored: `{"a":"x\ny"}`},
+	}
+
+	for key, tt := range tests {
+		typed, err := replicationmanager.Typed(tt.value)
+		require.NoError(t, err, tt.name)
+		require.NoError(t, node.service.Set([3]interface{}{"typed", key, typed}, new(string)), tt.name)
+	}
+
+	db := node.reopen(t, path)
+	service := NewKeyValueStoreService(replicationmanager.NewReplicationManager(1, db, election.NewBullyAlgorithm(1, 1, nil)))
+
+	for key, tt := range tests {
+		entry, ok := db.GetEntry("typed", key)
+		assert.True(t, ok, tt.name)
+		assert.Equal(t, tt.stored, string(entry.Value), tt.name)
+
+		typed, _ := replicationmanager.Typed(tt.value)
+		assert.Equal(t, typed.Type, replicationmanager.ContentTypeOf(entry.Attrs), tt.name)
+
+		// the bytes come back through the service as they were set
+		var result replicationmanager.GetResult
+		require.NoError(t, service.Get([2]interface{}{"typed", key}, &result), tt.name)
+		assert.Equal(t, tt.stored, string(result.Value), tt.name)
+		assert.Equal(t, typed.Type, result.ContentType, tt.name)
+	}
+}
+
+func TestKeyValueStoreService_typedValuesOverRPC(t *testing.T) {
+	leader, _ := setupCluster(t)
+
+	server := transport.NewServer()
+	require.NoError(t, server.RegisterName("KeyValueStore", leader.service))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := transport.Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	typed := replicationmanager.TypedValue{Type: replicationmanager.ContentString, Data: []byte(`say "hi"`)}
+	require.NoError(t, client.Call(context.Background(), "KeyValueStore.Set", [3]interface{}{"", 1, typed}, new(string)))
+
+	var result replicationmanager.GetResult
+	require.NoError(t, client.Call(context.Background(), "KeyValueStore.Get", [2]interface{}{"", 1}, &result))
+	assert.Equal(t, typed, result.Typed())
+}
+
+func TestKeyValueStoreService_GetAll(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	for key := 3; key >= 1; key-- {
+		require.NoError(t, leader.service.Set([3]interface{}{"texts", key, key}, &reply))
+	}
+
+	for name, node := range map[string]*testNode{"leader": leader, "backup": backup} {
+		t.Run(name, func(t *testing.T) {
+			var values map[int][]byte
+			require.NoError(t, node.service.GetAll([1]interface{}{"texts"}, &values))
+			assert.Equal(t, map[int][]byte{1: []byte("1"), 2: []byte("2"), 3: []byte("3")}, values)
+
+			var records []replicationmanager.Record
+			require.NoError(t, node.service.GetAllSorted([1]interface{}{"texts"}, &records))
+			assert.Equal(t, []replicationmanager.Record{{Key: 1, Value: []byte("1")}, {Key: 2, Value: []byte("2")}, {Key: 3, Value: []byte("3")}}, records)
+
+			require.ErrorContains(t, node.service.GetAll([1]interface{}{"nothing"}, &values), "not found")
+		})
+	}
+}
+
+func TestKeyValueStoreService_Buckets(t *testing.T) {
+	leader, backup := setupCluster(t)
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"texts", 1, "one"}, &reply))
+	require.NoError(t, backup.db.Set("local", 1, []byte("one")))
+
+	var buckets []string
+	require.NoError(t, leader.service.Buckets([1]interface{}{}, &buckets))
+	assert.Equal(t, []string{"local", "texts"}, buckets)
+
+	// the buckets without read access are left out
+	hidden := NewKeyValueStoreService(leader.service.replication, WithPermissions(NewPermissions(ReadWrite).With("local", Write)))
+	require.NoError(t, hidden.Buckets([1]interface{}{}, &buckets))
+	assert.Equal(t, []string{"texts"}, buckets)
+}
+
+func TestKeyValueStoreService_permissions(t *testing.T) {
+	leader, _ := setupCluster(t)
+
+	permissions, err := ParsePermissions("logs=r,drop=w,*=none")
+	require.NoError(t, err)
+
+	s := NewKeyValueStoreService(leader.service.replication, WithPermissions(permissions))
+
+	var reply string
+	require.NoError(t, leader.service.Set([3]interface{}{"logs", 1, "one"}, &reply))
+
+	err = s.Set([3]interface{}{"logs", 2, "two"}, &reply)
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	assert.Contains(t, err.Error(), "no write access to bucket (logs)")
+
+	var result replicationmanager.GetResult
+	require.NoError(t, s.Get([2]interface{}{"logs", 1}, &result))
+
+	var deleted bool
+	require.NoError(t, s.Delete([2]interface{}{"drop", 1}, &deleted))
+
+	var exists bool
+	err = s.Exists([2]interface{}{"drop", 1}, &exists)
+	require.ErrorIs(t, err, ErrPermissionDenied)
+
+	var count int
+	err = s.Count([1]interface{}{nil}, &count)
+	require.ErrorIs(t, err, ErrPermissionDenied, "the default bucket is one of the others")
+}
+
+func Test_parseBucket(t *testing.T) {
+	bucket, err := parseBucket(nil)
+	require.NoError(t, err)
+	assert.Equal(t, replicationmanager.KeyBucket, bucket)
+
+	bucket, err = parseBucket("")
+	require.NoError(t, err)
+	assert.Equal(t, replicationmanager.KeyBucket, bucket)
+
+	bucket, err = parseBucket("user_data")
+	require.NoError(t, err)
+	assert.Equal(t, "user_data", bucket)
+
+	for _, wrong := range []interface{}{1, "a b", "a\nb", AllBuckets, strings.Repeat("a", MaxBucketLength+1)} {
+		_, err = parseBucket(wrong)
+		require.Error(t, err, wrong)
+	}
+}
+
+func Test_parseLimit(t *testing.T) {
+	limit, err := parseLimit(nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultKeysLimit, limit)
+
+	limit, err = parseLimit(MaxKeysLimit + 1)
+	require.NoError(t, err)
+	assert.Equal(t, MaxKeysLimit, limit)
+
+	_, err = parseLimit(-1)
+	require.Error(t, err)
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Permission is what the clients may do with a bucket.
+type Permission int
+
+const (
+	NoAccess  Permission = 0
+	Read      Permission = 1 << 0
+	Write     Permission = 1 << 1
+	Admin     Permission = 1 << 2 // the methods about the node itself, like Info
+	ReadWrite            = Read | Write
+	All                  = ReadWrite | Admin
+
+	// AllBuckets is the name for the permission of the buckets that have no permission of their own.
+	AllBuckets = "*"
+)
+
+// ErrPermissionDenied is returned when a bucket may not be read or written.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Permissions are the permissions by bucket, and the permission of the other buckets.
+type Permissions struct {
+	buckets map[string]Permission
+	others  Permission
+}
+
+// Option configures a KeyValueStoreService.
+type Option func(*KeyValueStoreService)
+
+// WithPermissions sets the permissions of the buckets, everything is allowed without it.
+func WithPermissions(permissions Permissions) Option {
+	return func(s *KeyValueStoreService) {
+		s.permissions = permissions
+	}
+}
+
+// Restrict returns the service with only the permissions that both it and the permissions give,
+// for the requests of a client that is logged in.
+func (s *KeyValueStoreService) Restrict(permissions Permissions) *KeyValueStoreService {
+	restricted := *s
+	restricted.permissions = s.permissions.Intersect(permissions)
+
+	return &restricted
+}
+
+// NewPermissions returns permissions that give every bucket the same permission.
+func NewPermissions(others Permission) Permissions {
+	return Permissions{buckets: map[string]Permission{}, others: others}
+}
+
+// ParsePermissions parses a list like "kvstore=rw,logs=r,*=none", the permissions are rw, r, w and none,
+// or the roles read (r), write (rw) and admin (rw and Admin). * is for the other buckets (admin when it isn't given).
+func ParsePermissions(spec string) (Permissions, error) {
+	return parsePermissions(spec, All)
+}
+
+// parsePermissions parses a list like ParsePermissions, the other buckets get the given permission when * isn't given.
+func parsePermissions(spec string, others Permission) (Permissions, error) {
+	permissions := NewPermissions(others)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		bucket, name, ok := strings.Cut(item, "=")
+		if !ok || bucket == "" {
+			return Permissions{}, fmt.Errorf("permission %q should be bucket=permission", item)
+		}
+
+		perm, err := parsePermission(name)
+		if err != nil {
+			return Permissions{}, err
+		}
+
+		permissions = permissions.With(bucket, perm)
+	}
+
+	return permissions, nil
+}
+
+func parsePermission(name string) (Permission, error) {
+	switch name {
+	case "rw", "wr", "write":
+		return ReadWrite, nil
+	case "r", "read":
+		return Read, nil
+	case "w":
+		return Write, nil
+	case "admin":
+		return All, nil
+	case "none", "":
+		return NoAccess, nil
+	default:
+		return NoAccess, fmt.Errorf("permission %q should be rw, r, w, none, read, write or admin", name)
+	}
+}
+
+// With returns the permissions with the permission of one bucket, or of the other buckets for AllBuckets.
+func (p Permissions) With(bucket string, perm Permission) Permissions {
+	if bucket == AllBuckets {
+		p.others = perm
+		return p
+	}
+
+	buckets := make(map[string]Permission, len(p.buckets)+1)
+	for name, bucketPerm := range p.buckets {
+		buckets[name] = bucketPerm
+	}
+	buckets[bucket] = perm
+	p.buckets = buckets
+
+	return p
+}
+
+// Intersect returns the permissions that both permissions give.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	both := NewPermissions(p.others & other.others)
+
+	for bucket := range p.buckets {
+		both.buckets[bucket] = p.Of(bucket) & other.Of(bucket)
+	}
+
+	for bucket := range other.buckets {
+		both.buckets[bucket] = p.Of(bucket) & other.Of(bucket)
+	}
+
+	return both
+}
+
+// Of returns the permission of a bucket.
+func (p Permissions) Of(bucket string) Permission {
+	if perm, ok := p.buckets[bucket]; ok {
+		return perm
+	}
+
+	return p.others
+}
+
+// Check returns ErrPermissionDenied when a bucket doesn't have the permission.
+func (p Permissions) Check(bucket string, perm Permission) error {
+	if p.Of(bucket)&perm == perm {
+		return nil
+	}
+
+	access := "read"
+	switch perm {
+	case Write:
+		access = "write"
+	case Admin:
+		access = "admin"
+	}
+
+	return fmt.Errorf("%w: no %s access to bucket (%s)", ErrPermissionDenied, access, bucket)
+}
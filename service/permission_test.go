@@ -0,0 +1,62 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePermissions(t *testing.T) {
+	permissions, err := ParsePermissions("kvstore=rw, logs=r,drop=w,secret=none")
+	require.NoError(t, err)
+
+	assert.Equal(t, ReadWrite, permissions.Of("kvstore"))
+	assert.Equal(t, Read, permissions.Of("logs"))
+	assert.Equal(t, Write, permissions.Of("drop"))
+	assert.Equal(t, NoAccess, permissions.Of("secret"))
+	assert.Equal(t, All, permissions.Of("other"), "everything is allowed on the others by default")
+
+	permissions, err = ParsePermissions("*=r")
+	require.NoError(t, err)
+	assert.Equal(t, Read, permissions.Of("other"))
+
+	permissions, err = ParsePermissions("")
+	require.NoError(t, err)
+	assert.Equal(t, All, permissions.Of("other"))
+
+	permissions, err = ParsePermissions("logs=read,kvstore=write,*=admin")
+	require.NoError(t, err)
+	assert.Equal(t, Read, permissions.Of("logs"))
+	assert.Equal(t, ReadWrite, permissions.Of("kvstore"))
+	assert.Equal(t, All, permissions.Of("other"))
+
+	for _, wrong := range []string{"logs", "=r", "logs=x"} {
+		_, err = ParsePermissions(wrong)
+		require.Error(t, err, wrong)
+	}
+}
+
+func TestPermissions_With(t *testing.T) {
+	base := NewPermissions(Read)
+	with := base.With("logs", ReadWrite).With(AllBuckets, NoAccess)
+
+	assert.Equal(t, Read, base.Of("logs"), "the original permissions don't change")
+	assert.Equal(t, ReadWrite, with.Of("logs"))
+	assert.Equal(t, NoAccess, with.Of("other"))
+
+	require.NoError(t, with.Check("logs", Write))
+	require.ErrorIs(t, with.Check("other", Read), ErrPermissionDenied)
+}
+
+func TestPermissions_Intersect(t *testing.T) {
+	node := NewPermissions(All).With("secret", NoAccess)
+	user := NewPermissions(Read).With("logs", ReadWrite).With("secret", ReadWrite)
+
+	both := node.Intersect(user)
+	assert.Equal(t, Read, both.Of("other"))
+	assert.Equal(t, ReadWrite, both.Of("logs"))
+	assert.Equal(t, NoAccess, both.Of("secret"))
+
+	require.ErrorContains(t, both.Check(AllBuckets, Admin), "no admin access")
+}
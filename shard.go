@@ -0,0 +1,199 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// defaultShards is the number of lock stripes when WithShards isn't used.
+const defaultShards = 16
+
+/*
+shard is one lock stripe of the database.
+A bucket always lives in the same shard, so everything that belongs to a bucket
+(its keys, history, expiries, attributes, indexes, schema and materialized aggregates) is guarded by the shard lock.
+The stripes are per bucket and not per key, so the writes to one bucket wait for each other.
+*/
+type shard struct {
+	keys         map[string]map[int][]byte
+	history      map[string]map[int][]Version
+	expires      map[string]map[int]time.Time
+	attrs        map[string]map[int]Attrs
+	indexes      map[string]map[string]*index
+	materialized map[string]*aggregator
+	schemas      map[string]*Schema
+	mu           sync.RWMutex
+}
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+WithShards sets the number of lock stripes the buckets are divided over.
+Writes to buckets in different stripes don't wait for each other,
+the writes to the same bucket always do.
+*/
+func WithShards(count int) Option {
+	return func(fdb *DB) {
+		fdb.shards = newShards(max(count, 1))
+	}
+}
+
+/*
+newShards returns the given number of empty shards.
+*/
+func newShards(count int) []*shard {
+	shards := make([]*shard, count)
+	for i := range shards {
+		shards[i] = newShard()
+	}
+
+	return shards
+}
+
+/*
+newShard returns an empty shard.
+*/
+func newShard() *shard {
+	sh := &shard{}
+	sh.reset()
+
+	return sh
+}
+
+/*
+reset empties the shard, the caller should hold the lock.
+*/
+func (sh *shard) reset() {
+	sh.keys = map[string]map[int][]byte{}
+	sh.history = map[string]map[int][]Version{}
+	sh.expires = map[string]map[int]time.Time{}
+	sh.attrs = map[string]map[int]Attrs{}
+	sh.indexes = map[string]map[string]*index{}
+	sh.materialized = map[string]*aggregator{}
+	sh.schemas = map[string]*Schema{}
+}
+
+/*
+shardFor returns the shard a bucket lives in.
+*/
+func (fdb *DB) shardFor(bucket string) *shard {
+	return fdb.shards[fdb.shardIndex(bucket)]
+}
+
+/*
+shardIndex returns the position of the shard a bucket lives in.
+*/
+func (fdb *DB) shardIndex(bucket string) int {
+	if len(fdb.shards) == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(bucket))
+
+	return int(hash.Sum32() % uint32(len(fdb.shards))) //nolint:gosec // the number of shards is small
+}
+
+/*
+lockBuckets locks the shards of the buckets for writing, in a fixed order,
+and returns the function that unlocks them.
+*/
+func (fdb *DB) lockBuckets(buckets []string) func() {
+	positions := make([]int, 0, len(buckets))
+	for _, bucket := range buckets {
+		positions = append(positions, fdb.shardIndex(bucket))
+	}
+
+	slices.Sort(positions)
+	positions = slices.Compact(positions)
+
+	for _, pos := range positions {
+		fdb.shards[pos].mu.Lock()
+	}
+
+	return func() {
+		for _, pos := range positions {
+			fdb.shards[pos].mu.Unlock()
+		}
+	}
+}
+
+/*
+lockAll locks all the shards for writing, in a fixed order,
+and returns the function that unlocks them.
+*/
+func (fdb *DB) lockAll() func() {
+	for _, sh := range fdb.shards {
+		sh.mu.Lock()
+	}
+
+	return func() {
+		for _, sh := range fdb.shards {
+			sh.mu.Unlock()
+		}
+	}
+}
+
+/*
+rlockAll locks all the shards for reading, and returns the function that unlocks them.
+*/
+func (fdb *DB) rlockAll() func() {
+	for _, sh := range fdb.shards {
+		sh.mu.RLock()
+	}
+
+	return func() {
+		for _, sh := range fdb.shards {
+			sh.mu.RUnlock()
+		}
+	}
+}
+
+/*
+allKeys returns the keys of all the shards in one map, the caller should hold all the locks.
+*/
+func (fdb *DB) allKeys() map[string]map[int][]byte {
+	keys := map[string]map[int][]byte{}
+
+	for _, sh := range fdb.shards {
+		for bucket, bmap := range sh.keys {
+			keys[bucket] = bmap
+		}
+	}
+
+	return keys
+}
+
+/*
+allHistory returns the history of all the shards in one map, the caller should hold all the locks.
+*/
+func (fdb *DB) allHistory() map[string]map[int][]Version {
+	history := map[string]map[int][]Version{}
+
+	for _, sh := range fdb.shards {
+		for bucket, versions := range sh.history {
+			history[bucket] = versions
+		}
+	}
+
+	return history
+}
+
+/*
+spread divides the keys and the history that are read from the file over the shards.
+*/
+func (fdb *DB) spread(keys map[string]map[int][]byte, history map[string]map[int][]Version) {
+	for bucket, bmap := range keys {
+		fdb.shardFor(bucket).keys[bucket] = bmap
+	}
+
+	for bucket, versions := range history {
+		fdb.shardFor(bucket).history[bucket] = versions
+	}
+}
@@ -0,0 +1,70 @@
+package fastdb_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Shards_concurrentBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shards.db")
+
+	store, err := fastdb.Open(path, 0, fastdb.WithShards(4))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for worker := range 8 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			bucket := fmt.Sprintf("bucket%d", worker)
+			for key := range 100 {
+				assert.NoError(t, store.Set(bucket, key, []byte(fmt.Sprintf("%d-%d", worker, key))))
+			}
+
+			_, err := store.Del(bucket, 0)
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	require.NoError(t, store.Close())
+
+	// every write must have made it to the file
+	store, err = fastdb.Open(path, 0)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	for worker := range 8 {
+		records, err := store.GetAll(fmt.Sprintf("bucket%d", worker))
+		require.NoError(t, err)
+		assert.Len(t, records, 99)
+		assert.Equal(t, []byte(fmt.Sprintf("%d-99", worker)), records[99])
+	}
+}
+
+func Test_Shards_single(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime, fastdb.WithShards(0))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("a", 1, []byte("one")))
+	require.NoError(t, store.Set("b", 1, []byte("two")))
+
+	value, ok := store.Get("b", 1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("two"), value)
+
+	require.NoError(t, store.Close())
+}
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The authentication of a connection comes before anything else: the client sends authMagic, the server
+// answers with a random challenge, the client sends its credentials for that challenge, and the server
+// answers with an error message, which is empty when it accepts them. The lengths are two bytes.
+// A server that requires authentication closes the connections that don't start with it,
+// so the older net/rpc clients have to authenticate their connection with Authenticate too.
+
+const (
+	// ChallengeSize is the number of random bytes of a challenge.
+	ChallengeSize = 32
+
+	// maxCredentialsSize is the largest credentials a server reads.
+	maxCredentialsSize = 4096
+)
+
+// authMagic asks for a challenge. Like magic, its first byte is never the start of a gob stream.
+var authMagic = [4]byte{0x81, 'F', 'D', 'A'}
+
+// ErrAuthentication is returned when the server doesn't accept the credentials of a client.
+var ErrAuthentication = errors.New("transport: authentication failed")
+
+// Credentials returns the credentials of a client, for the challenge of the server.
+type Credentials func(challenge []byte) []byte
+
+// Authenticator checks the credentials a client answered a challenge on the connection with, and returns
+// the server that answers the calls of the connection: one with the methods the client may call.
+// The connection is a *tls.Conn when the listener is, so the certificate of the client can be checked too.
+type Authenticator func(conn net.Conn, challenge, credentials []byte) (*Server, error)
+
+// WithAuthenticator makes the server authenticate every connection, and pass it to the server the
+// authenticator returns. The connections that don't authenticate are closed, without an answer.
+func WithAuthenticator(authenticate Authenticator) Option {
+	return func(s *Server) {
+		s.authenticate = authenticate
+	}
+}
+
+// WithCredentials authenticates the connections with the credentials, for a server that requires it.
+func WithCredentials(credentials Credentials) DialOption {
+	return func(c *dialConfig) {
+		c.credentials = credentials
+	}
+}
+
+// Authenticate answers the challenge of a server that requires authentication, on a new connection.
+// After it the connection is used for the calls, with NewClient or with net/rpc.
+func Authenticate(conn net.Conn, credentials Credentials) error {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(authMagic[:]); err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	}
+
+	challenge := make([]byte, len(authMagic)+ChallengeSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return fmt.Errorf("%w: the server doesn't answer the challenge: %w", ErrAuthentication, err)
+	}
+
+	if !bytes.Equal(challenge[:len(authMagic)], authMagic[:]) {
+		return fmt.Errorf("%w: not a transport peer", ErrAuthentication)
+	}
+
+	if err := writeBlock(conn, credentials(challenge[len(authMagic):])); err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	}
+
+	message, err := readBlock(conn, maxCredentialsSize)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	}
+
+	if len(message) > 0 {
+		return fmt.Errorf("%w: %s", ErrAuthentication, message)
+	}
+
+	return nil
+}
+
+// authenticateConn sends a challenge and checks the credentials of the client,
+// it returns the server that answers the calls of the connection.
+func (s *Server) authenticateConn(conn net.Conn) (*Server, error) {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var hello [len(authMagic)]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return nil, err
+	}
+
+	if hello != authMagic {
+		return nil, fmt.Errorf("%w: the client didn't authenticate", ErrAuthentication)
+	}
+
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(authMagic[:], challenge...)); err != nil {
+		return nil, err
+	}
+
+	credentials, err := readBlock(conn, maxCredentialsSize)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := s.authenticate(conn, challenge, credentials)
+	if err == nil && server == nil {
+		err = errors.New("no server for the client")
+	}
+
+	if err != nil {
+		_ = writeBlock(conn, []byte(err.Error()))
+		return nil, err
+	}
+
+	if err := writeBlock(conn, nil); err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// writeBlock writes the length of the data in two bytes, and the data.
+func writeBlock(w io.Writer, data []byte) error {
+	if len(data) > maxCredentialsSize {
+		data = data[:maxCredentialsSize]
+	}
+
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...))
+	return err
+}
+
+// readBlock reads the data of writeBlock.
+func readBlock(r io.Reader, limit int) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > limit {
+		return nil, errFrameSize
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
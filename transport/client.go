@@ -0,0 +1,345 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// HandshakeTimeout is how long a client waits for the answer to its handshake.
+const HandshakeTimeout = 5 * time.Second
+
+// Client calls the methods of a server, many calls share its connection.
+type Client struct {
+	conn    net.Conn
+	calls   map[uint64]chan frame
+	done    chan struct{}
+	err     error
+	nextID  uint64
+	version byte
+	writeMu sync.Mutex
+	mu      sync.Mutex
+}
+
+// Stream receives the items of a streaming call.
+type Stream struct {
+	ctx      context.Context
+	client   *Client
+	items    chan frame
+	err      error
+	id       uint64
+	window   int
+	consumed int
+}
+
+// DialOption configures the connections of Dial and a Pool.
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	credentials Credentials
+	tls         func(addr string) *tls.Config
+}
+
+func newDialConfig(opts []DialOption) dialConfig {
+	var config dialConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// Dial connects to a server and does the handshake, over TLS WithTLS and after it authenticated WithCredentials.
+func Dial(ctx context.Context, addr string, opts ...DialOption) (*Client, error) {
+	return dialClient(ctx, addr, newDialConfig(opts))
+}
+
+func dialClient(ctx context.Context, addr string, config dialConfig) (*Client, error) {
+	conn, err := dial(ctx, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// dial connects to a server, with TLS and authenticated when the config says so.
+func dial(ctx context.Context, addr string, config dialConfig) (net.Conn, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, err)
+	}
+
+	if config.tls != nil {
+		tlsConn := tls.Client(conn, serverName(config.tls(addr), addr))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with %s error: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+
+	if config.credentials != nil {
+		if err := Authenticate(conn, config.credentials); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// serverName returns the config with the host of the address as the name of the server, when it has none.
+func serverName(config *tls.Config, addr string) *tls.Config {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+
+	config = config.Clone()
+	config.ServerName, _, _ = net.SplitHostPort(addr)
+
+	return config
+}
+
+// NewClient does the handshake on a connection, and returns a client that uses it.
+func NewClient(conn net.Conn) (*Client, error) {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	if err := writeHandshake(conn, Version); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	version, err := readHandshake(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version < MinVersion || version > Version {
+		return nil, fmt.Errorf("%w: version %d isn't supported", ErrHandshake, version)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	c := &Client{conn: conn, version: version, calls: map[uint64]chan frame{}, done: make(chan struct{})}
+	go c.read(reader)
+
+	return c, nil
+}
+
+// Version returns the version of the protocol the client and the server agreed on.
+func (c *Client) Version() int {
+	return int(c.version)
+}
+
+// Call calls a method and waits for its reply, an error of the method is returned as a ServerError.
+// When the context ends the server is told to cancel the call.
+func (c *Client) Call(ctx context.Context, method string, args, reply any) error {
+	data, err := encode(args)
+	if err != nil {
+		return fmt.Errorf("transport: encode arguments error: %w", err)
+	}
+
+	id, replies, err := c.start(method, 0, data, 1)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case f := <-replies:
+		switch f.typ {
+		case frameReply:
+			return decode(f.payload, reply)
+		case frameError:
+			return ServerError(f.payload)
+		default:
+			return fmt.Errorf("transport: unexpected frame %d", f.typ)
+		}
+	case <-ctx.Done():
+		c.cancel(id)
+		return ctx.Err()
+	case <-c.done:
+		return c.err
+	}
+}
+
+// Stream calls a method that streams items, they are read with Recv.
+// The stream should be closed when it isn't read until the end.
+func (c *Client) Stream(ctx context.Context, method string, args any) (*Stream, error) {
+	data, err := encode(args)
+	if err != nil {
+		return nil, fmt.Errorf("transport: encode arguments error: %w", err)
+	}
+
+	// the server never sends more items than the window, so the reader never waits for the stream
+	id, items, err := c.start(method, DefaultWindow, data, DefaultWindow+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{ctx: ctx, client: c, id: id, items: items, window: DefaultWindow}, nil
+}
+
+// Close closes the connection, the calls that wait fail with ErrClosed.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// closed tells if the connection is closed.
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// start sends a request, and returns the channel its frames arrive on.
+func (c *Client) start(method string, window uint32, args []byte, buffer int) (uint64, chan frame, error) {
+	frames := make(chan frame, buffer)
+
+	c.mu.Lock()
+	if c.closed() {
+		c.mu.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.calls[id] = frames
+	c.mu.Unlock()
+
+	req := request{method: method, window: window, args: args}
+	if err := c.write(frame{typ: frameRequest, id: id, payload: req.encode()}); err != nil {
+		c.forget(id)
+		return 0, nil, err
+	}
+
+	return id, frames, nil
+}
+
+// cancel tells the server that a call isn't waited for anymore.
+func (c *Client) cancel(id uint64) {
+	c.forget(id)
+	_ = c.write(frame{typ: frameCancel, id: id})
+}
+
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.calls, id)
+}
+
+func (c *Client) write(f frame) error {
+	data, err := encodeFrame(f)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if _, err := c.conn.Write(data); err != nil {
+		return fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+
+	return nil
+}
+
+// read passes the frames to their calls, until the connection fails.
+func (c *Client) read(reader *bufio.Reader) {
+	err := c.dispatch(reader)
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("%w: %w", ErrClosed, err)
+	close(c.done)
+	c.mu.Unlock()
+
+	c.conn.Close()
+}
+
+func (c *Client) dispatch(reader *bufio.Reader) error {
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		frames, ok := c.calls[f.id]
+		if ok && f.typ != frameItem {
+			delete(c.calls, f.id)
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		select {
+		case frames <- f:
+		default:
+			return errors.New("transport: the server sent more items than the window")
+		}
+	}
+}
+
+// Recv decodes the next item, it returns io.EOF at the end of the stream.
+func (s *Stream) Recv(item any) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	select {
+	case f := <-s.items:
+		switch f.typ {
+		case frameItem:
+			s.consumed++
+			if s.consumed >= s.window/2 {
+				_ = s.client.write(frame{typ: frameCredit, id: s.id, payload: binary.BigEndian.AppendUint32(nil, uint32(s.consumed))})
+				s.consumed = 0
+			}
+
+			return decode(f.payload, item)
+		case frameEnd:
+			s.err = io.EOF
+		case frameError:
+			s.err = ServerError(f.payload)
+		default:
+			s.err = fmt.Errorf("transport: unexpected frame %d", f.typ)
+		}
+	case <-s.ctx.Done():
+		s.client.cancel(s.id)
+		s.err = s.ctx.Err()
+	case <-s.client.done:
+		s.err = s.client.err
+	}
+
+	return s.err
+}
+
+// Close stops the stream, the server is told to cancel it when it didn't end yet.
+func (s *Stream) Close() error {
+	if s.err == nil {
+		s.client.cancel(s.id)
+		s.err = ErrClosed
+	}
+
+	return nil
+}
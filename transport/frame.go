@@ -0,0 +1,172 @@
+// Package transport is a binary protocol for the calls between the nodes and their clients. It multiplexes
+// many calls over one connection, and streams the items of a call with flow control.
+//
+// A connection starts with a handshake: the client sends the magic bytes and the highest version it speaks,
+// the server answers with the magic bytes and the version they use. After that both sides send frames:
+// a header with the length of the payload, the type of the frame and the id of the call, and the payload.
+// The arguments, replies and items are encoded with gob, like net/rpc does.
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Version is the highest version of the protocol this package speaks, MinVersion the lowest.
+	Version    = 1
+	MinVersion = 1
+
+	// MaxFrameSize is the largest payload of a frame.
+	MaxFrameSize = 16 << 20
+
+	// DefaultWindow is the number of items a server may stream before the client asks for more.
+	DefaultWindow = 64
+
+	headerSize = 13
+)
+
+// magic starts a handshake. Its first byte is never the start of a gob stream,
+// so a net/rpc server drops the connection at once, and a server can tell both apart.
+var magic = [4]byte{0x80, 'F', 'D', 'B'}
+
+// frameType is the kind of a frame.
+type frameType uint8
+
+const (
+	frameRequest frameType = iota + 1 // client: method, window (0 for a unary call) and arguments
+	frameReply                        // server: the reply of a unary call
+	frameError                        // server: the error that ends a call
+	frameItem                         // server: an item of a stream
+	frameEnd                          // server: the end of a stream
+	frameCredit                       // client: the number of items a stream may send more
+	frameCancel                       // client: the call isn't waited for anymore
+)
+
+var (
+	// ErrHandshake is returned when the peer doesn't speak the protocol, or no version both sides speak.
+	ErrHandshake = errors.New("transport: handshake failed")
+
+	// ErrClosed is returned by the calls of a client after its connection is closed.
+	ErrClosed = errors.New("transport: connection closed")
+
+	// errFrameSize is returned when a frame is larger than MaxFrameSize.
+	errFrameSize = errors.New("transport: frame too large")
+)
+
+// ServerError is an error returned by the method on the server.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// frame is one message on a connection.
+type frame struct {
+	typ     frameType
+	id      uint64
+	payload []byte
+}
+
+// writeHandshake sends the magic bytes and a version.
+func writeHandshake(w io.Writer, version byte) error {
+	_, err := w.Write(append(magic[:], version))
+	return err
+}
+
+// readHandshake reads the magic bytes and the version of the peer.
+func readHandshake(r io.Reader) (byte, error) {
+	var hello [len(magic) + 1]byte
+	if _, err := io.ReadFull(r, hello[:]); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	if !bytes.Equal(hello[:len(magic)], magic[:]) {
+		return 0, fmt.Errorf("%w: not a transport peer", ErrHandshake)
+	}
+
+	return hello[len(magic)], nil
+}
+
+// readFrame reads the next frame.
+func readFrame(r io.Reader) (frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > MaxFrameSize {
+		return frame{}, errFrameSize
+	}
+
+	f := frame{typ: frameType(header[4]), id: binary.BigEndian.Uint64(header[5:13]), payload: make([]byte, size)}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+
+	return f, nil
+}
+
+// encodeFrame returns the bytes of a frame.
+func encodeFrame(f frame) ([]byte, error) {
+	if len(f.payload) > MaxFrameSize {
+		return nil, errFrameSize
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(f.payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(f.payload)))
+	buf[4] = byte(f.typ)
+	binary.BigEndian.PutUint64(buf[5:13], f.id)
+
+	return append(buf, f.payload...), nil
+}
+
+// request is the payload of a request frame.
+type request struct {
+	method string
+	window uint32
+	args   []byte
+}
+
+func (r request) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(r.method)))
+	buf = append(buf, r.method...)
+	buf = binary.BigEndian.AppendUint32(buf, r.window)
+
+	return append(buf, r.args...)
+}
+
+func decodeRequest(payload []byte) (request, error) {
+	size, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < size+4 {
+		return request{}, errors.New("transport: malformed request")
+	}
+
+	payload = payload[n:]
+
+	return request{
+		method: string(payload[:size]),
+		window: binary.BigEndian.Uint32(payload[size : size+4]),
+		args:   payload[size+4:],
+	}, nil
+}
+
+// encode returns the gob encoding of a value.
+func encode(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode decodes the gob encoding of a value, into a pointer.
+func decode(data []byte, value any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync"
+)
+
+// Pool keeps one client per address, so the calls to a peer share a connection.
+// A peer that doesn't speak the protocol is called with net/rpc, one connection per call.
+type Pool struct {
+	clients map[string]*Client
+	legacy  map[string]bool
+	config  dialConfig
+	mu      sync.Mutex
+}
+
+// NewPool returns a pool without connections, the options apply to the connections it makes.
+func NewPool(opts ...DialOption) *Pool {
+	return &Pool{clients: map[string]*Client{}, legacy: map[string]bool{}, config: newDialConfig(opts)}
+}
+
+// Call calls a method of the peer at the address, see Client.Call.
+func (p *Pool) Call(ctx context.Context, addr, method string, args, reply any) error {
+	client, err := p.client(ctx, addr)
+	if errors.Is(err, ErrHandshake) {
+		return callRPC(ctx, addr, p.config, method, args, reply)
+	}
+	if err != nil {
+		return err
+	}
+
+	return client.Call(ctx, method, args, reply)
+}
+
+// Stream calls a method of the peer at the address that streams items, see Client.Stream.
+func (p *Pool) Stream(ctx context.Context, addr, method string, args any) (*Stream, error) {
+	client, err := p.client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Stream(ctx, method, args)
+}
+
+// Close closes the connections.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, client := range p.clients {
+		client.Close()
+		delete(p.clients, addr)
+	}
+
+	return nil
+}
+
+// client returns the client of an address, it connects when there is none or its connection is closed.
+func (p *Pool) client(ctx context.Context, addr string) (*Client, error) {
+	p.mu.Lock()
+	client, legacy := p.clients[addr], p.legacy[addr]
+	p.mu.Unlock()
+
+	if legacy {
+		return nil, ErrHandshake
+	}
+	if client != nil && !client.closed() {
+		return client, nil
+	}
+
+	client, err := dialClient(ctx, addr, p.config)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if errors.Is(err, ErrHandshake) {
+		p.legacy[addr] = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// another call may have connected in the meantime
+	if other := p.clients[addr]; other != nil && !other.closed() {
+		client.Close()
+		return other, nil
+	}
+
+	p.clients[addr] = client
+	return client, nil
+}
+
+// callRPC dials a peer and calls one of its net/rpc methods, both respect the deadline of the context.
+func callRPC(ctx context.Context, addr string, config dialConfig, method string, args, reply any) error {
+	conn, err := dial(ctx, addr, config)
+	if err != nil {
+		return err
+	}
+
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	select {
+	case result := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		return result.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+)
+
+// rpcCodec is the gob codec of net/rpc, that tracks the calls it reads for Shutdown of the owner.
+// Every request that is read is answered with one response, which ends the call.
+type rpcCodec struct {
+	owner  *Server
+	conn   io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newRPCCodec(conn io.ReadWriteCloser, owner *Server) *rpcCodec {
+	encBuf := bufio.NewWriter(conn)
+
+	return &rpcCodec{owner: owner, conn: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(encBuf), encBuf: encBuf}
+}
+
+// ReadRequestHeader reads the header of a call and tracks the call. A call while the server shuts down
+// ends the connection, net/rpc has no way to refuse one.
+func (c *rpcCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+
+	if !c.owner.startCall() {
+		return ErrServerClosed
+	}
+
+	return nil
+}
+
+func (c *rpcCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+// WriteResponse writes the response of a call, and ends it.
+func (c *rpcCodec) WriteResponse(r *rpc.Response, body any) error {
+	defer c.owner.calls.Done()
+
+	if err := c.enc.Encode(r); err != nil {
+		c.conn.Close()
+		return err
+	}
+
+	if err := c.enc.Encode(body); err != nil {
+		c.conn.Close()
+		return err
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *rpcCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,566 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("transport: server closed")
+
+// Server answers the calls of clients, with the methods of the registered receivers and the stream handlers.
+type Server struct {
+	methods      map[string]*method
+	streams      map[string]streamHandler
+	fallback     func(io.ReadWriteCloser)
+	rpcFallback  *rpc.Server
+	authenticate Authenticator
+	selectServer Selector
+	listeners    map[net.Listener]struct{}
+	conns        map[net.Conn]struct{}
+	calls        sync.WaitGroup  // the calls that are running, for Shutdown
+	done         context.Context // ends with Shutdown and Close, so do the streams
+	stopStreams  context.CancelFunc
+	mu           sync.Mutex
+	closed       bool
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// method is a method of a receiver, with the signature of a net/rpc method.
+type method struct {
+	fn        reflect.Value
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+// streamHandler streams the items of a call, the arguments are still gob encoded.
+type streamHandler func(ctx context.Context, args []byte, send func(item any) error) error
+
+// serverConn is a connection of a client, its calls run concurrently.
+// The methods are those of server, the server that accepted the connection is owner (they differ after authentication).
+type serverConn struct {
+	server  *Server
+	owner   *Server
+	conn    net.Conn
+	reader  *bufio.Reader
+	calls   map[uint64]*serverCall
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// serverCall is a call that is running.
+type serverCall struct {
+	cancel context.CancelFunc
+	window *window
+}
+
+// bufferedConn is a connection of which the first bytes were already read into the reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+var errorType = reflect.TypeFor[error]()
+
+// WithFallback passes the connections that don't start with a handshake to serve, like rpc.ServeConn.
+// That way a server answers the older net/rpc clients on the same address.
+func WithFallback(serve func(conn io.ReadWriteCloser)) Option {
+	return func(s *Server) {
+		s.fallback = serve
+	}
+}
+
+// WithRPCFallback answers the connections that don't start with a handshake with the net/rpc server,
+// like WithFallback(server.ServeConn), but Shutdown waits for their calls like for the others.
+func WithRPCFallback(server *rpc.Server) Option {
+	return func(s *Server) {
+		s.rpcFallback = server
+	}
+}
+
+// Selector returns the server that answers the calls of a connection that doesn't authenticate,
+// like by the certificate of a *tls.Conn. The connections it returns an error for are closed.
+type Selector func(conn net.Conn) (*Server, error)
+
+// WithSelector passes every connection to the server the selector returns, WithAuthenticator goes first.
+func WithSelector(selectServer Selector) Option {
+	return func(s *Server) {
+		s.selectServer = selectServer
+	}
+}
+
+// NewServer returns a server without methods.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		methods:   map[string]*method{},
+		streams:   map[string]streamHandler{},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	s.done, s.stopStreams = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// RegisterName registers the methods of the receiver as "name.Method", like rpc.RegisterName does:
+// the exported methods with an argument, a pointer to the reply and an error result.
+func (s *Server) RegisterName(name string, rcvr any) error {
+	value := reflect.ValueOf(rcvr)
+	typ := value.Type()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for i := range typ.NumMethod() {
+		fn := typ.Method(i)
+		fnType := fn.Type
+
+		if !fn.IsExported() || fnType.NumIn() != 3 || fnType.NumOut() != 1 ||
+			fnType.In(2).Kind() != reflect.Pointer || fnType.Out(0) != errorType {
+			continue
+		}
+
+		s.methods[name+"."+fn.Name] = &method{fn: value.Method(i), argType: fnType.In(1), replyType: fnType.In(2).Elem()}
+		count++
+	}
+
+	if count == 0 {
+		return fmt.Errorf("transport: %s has no methods to register", name)
+	}
+
+	return nil
+}
+
+// HandleStream registers a method that streams items, it calls send for every item.
+// Send blocks while the client doesn't want more items, and fails when the call ends.
+func HandleStream[Req, Item any](s *Server, name string, fn func(ctx context.Context, req Req, send func(Item) error) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams[name] = func(ctx context.Context, args []byte, send func(item any) error) error {
+		var req Req
+		if err := decode(args, &req); err != nil {
+			return fmt.Errorf("transport: decode arguments error: %w", err)
+		}
+
+		return fn(ctx, req, func(item Item) error {
+			return send(item)
+		})
+	}
+}
+
+// Serve answers the connections of the listener until Close, it always returns an error.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.addListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the calls of one connection until it is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	if !s.addConn(conn) {
+		conn.Close()
+		return
+	}
+	defer s.removeConn(conn)
+	defer conn.Close()
+
+	server := s
+
+	var err error
+	switch {
+	case s.authenticate != nil:
+		server, err = s.authenticateConn(conn)
+	case s.selectServer != nil:
+		server, err = s.selectServer(conn)
+	}
+	if err != nil {
+		return
+	}
+
+	s.serveConn(conn, server)
+}
+
+// serveConn answers the calls of a connection with the methods of the server (s itself,
+// or the server of the authenticated or selected client), or passes it to its fallback when it doesn't start with a handshake.
+func (s *Server) serveConn(conn net.Conn, server *Server) {
+	reader := bufio.NewReader(conn)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if first[0] != magic[0] {
+		switch {
+		case server.rpcFallback != nil:
+			server.rpcFallback.ServeCodec(newRPCCodec(&bufferedConn{Conn: conn, reader: reader}, s))
+		case server.fallback != nil:
+			server.fallback(&bufferedConn{Conn: conn, reader: reader})
+		}
+		return
+	}
+
+	version, err := readHandshake(reader)
+	if err != nil || version < MinVersion {
+		_ = writeHandshake(conn, 0)
+		return
+	}
+
+	if err := writeHandshake(conn, min(version, Version)); err != nil {
+		return
+	}
+
+	sc := &serverConn{server: server, owner: s, conn: conn, reader: reader, calls: map[uint64]*serverCall{}}
+	sc.serve()
+}
+
+// Close stops the listeners and closes the connections, the running calls are canceled.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.stopStreams()
+
+	for listener := range s.listeners {
+		listener.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// Shutdown stops the listeners, waits for the running calls to finish (or for the context to end)
+// and then closes the connections. The streams are canceled right away, because they don't end
+// by themselves, and the new calls on the open connections are answered with ErrServerClosed.
+// The calls of WithRPCFallback are waited for too, a net/rpc connection that makes a new call is closed.
+// The connections of WithFallback are closed with the others, their calls aren't waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.mu.Unlock()
+
+	s.stopStreams()
+
+	drained := make(chan struct{})
+	go func() {
+		s.calls.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("transport: calls are still running: %w", ctx.Err())
+	}
+
+	s.Close()
+	return err
+}
+
+// startCall tracks a call for Shutdown, it returns false when the server is shutting down.
+func (s *Server) startCall() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.calls.Add(1)
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// addListener tracks a listener for Close, it returns false when the server is closed.
+func (s *Server) addListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, listener)
+}
+
+// addConn tracks a connection for Close, it returns false when the server is closed.
+func (s *Server) addConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *Server) lookup(name string) (*method, streamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.methods[name], s.streams[name]
+}
+
+// serve reads the frames of the connection, until it fails.
+func (sc *serverConn) serve() {
+	defer func() {
+		sc.mu.Lock()
+		for _, call := range sc.calls {
+			call.cancel()
+		}
+		sc.mu.Unlock()
+
+		sc.wg.Wait()
+	}()
+
+	for {
+		f, err := readFrame(sc.reader)
+		if err != nil {
+			return
+		}
+
+		switch f.typ {
+		case frameRequest:
+			sc.start(f)
+		case frameCredit:
+			if call := sc.call(f.id); call != nil && len(f.payload) == 4 {
+				call.window.add(int(binary.BigEndian.Uint32(f.payload)))
+			}
+		case frameCancel:
+			if call := sc.call(f.id); call != nil {
+				call.cancel()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (sc *serverConn) call(id uint64) *serverCall {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.calls[id]
+}
+
+// start runs a call in its own goroutine.
+func (sc *serverConn) start(f frame) {
+	req, err := decodeRequest(f.payload)
+	if err != nil {
+		sc.writeError(f.id, err)
+		return
+	}
+
+	if !sc.owner.startCall() {
+		sc.writeError(f.id, ErrServerClosed)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(sc.owner.done)
+	call := &serverCall{cancel: cancel, window: newWindow(int(req.window))}
+
+	sc.mu.Lock()
+	sc.calls[f.id] = call
+	sc.mu.Unlock()
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer sc.owner.calls.Done()
+		defer func() {
+			sc.mu.Lock()
+			delete(sc.calls, f.id)
+			sc.mu.Unlock()
+			cancel()
+		}()
+
+		method, stream := sc.server.lookup(req.method)
+		switch {
+		case req.window == 0 && method != nil:
+			sc.runMethod(f.id, method, req.args)
+		case req.window > 0 && stream != nil:
+			sc.runStream(ctx, f.id, call.window, stream, req.args)
+		default:
+			sc.writeError(f.id, fmt.Errorf("transport: can't find method %s", req.method))
+		}
+	}()
+}
+
+func (sc *serverConn) runMethod(id uint64, m *method, args []byte) {
+	var argv reflect.Value
+	if m.argType.Kind() == reflect.Pointer {
+		argv = reflect.New(m.argType.Elem())
+	} else {
+		argv = reflect.New(m.argType)
+	}
+
+	if err := decode(args, argv.Interface()); err != nil {
+		sc.writeError(id, fmt.Errorf("transport: decode arguments error: %w", err))
+		return
+	}
+
+	if m.argType.Kind() != reflect.Pointer {
+		argv = argv.Elem()
+	}
+
+	replyv := reflect.New(m.replyType)
+	if err, _ := m.fn.Call([]reflect.Value{argv, replyv})[0].Interface().(error); err != nil {
+		sc.writeError(id, err)
+		return
+	}
+
+	reply, err := encode(replyv.Interface())
+	if err != nil {
+		sc.writeError(id, fmt.Errorf("transport: encode reply error: %w", err))
+		return
+	}
+
+	_ = sc.write(frame{typ: frameReply, id: id, payload: reply})
+}
+
+func (sc *serverConn) runStream(ctx context.Context, id uint64, credits *window, handler streamHandler, args []byte) {
+	send := func(item any) error {
+		if err := credits.take(ctx); err != nil {
+			return err
+		}
+
+		data, err := encode(item)
+		if err != nil {
+			return fmt.Errorf("transport: encode item error: %w", err)
+		}
+
+		return sc.write(frame{typ: frameItem, id: id, payload: data})
+	}
+
+	if err := handler(ctx, args, send); err != nil {
+		sc.writeError(id, err)
+		return
+	}
+
+	_ = sc.write(frame{typ: frameEnd, id: id})
+}
+
+func (sc *serverConn) writeError(id uint64, err error) {
+	_ = sc.write(frame{typ: frameError, id: id, payload: []byte(err.Error())})
+}
+
+func (sc *serverConn) write(f frame) error {
+	data, err := encodeFrame(f)
+	if err != nil {
+		return err
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	_, err = sc.conn.Write(data)
+	return err
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// window counts the items a stream may still send.
+type window struct {
+	notify chan struct{}
+	credit int
+	mu     sync.Mutex
+}
+
+func newWindow(credit int) *window {
+	return &window{credit: credit, notify: make(chan struct{}, 1)}
+}
+
+// take waits for a credit and uses it.
+func (w *window) take(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// add gives credits, and wakes up a waiting take.
+func (w *window) add(credit int) {
+	w.mu.Lock()
+	w.credit += credit
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,483 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Arith is a receiver with net/rpc methods.
+type Arith struct {
+	release chan struct{}
+}
+
+type Args struct {
+	A, B int
+}
+
+func (a *Arith) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (a *Arith) Div(args *Args, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+
+	*reply = args.A / args.B
+	return nil
+}
+
+// Wait answers when release is closed.
+func (a *Arith) Wait(_ int, reply *bool) error {
+	<-a.release
+	*reply = true
+	return nil
+}
+
+// startServer starts a server with Arith and a stream of the numbers up to the argument.
+// The stream reports how many numbers it sent on sent, and when it ended on ended.
+func startServer(t *testing.T, opts ...Option) (string, *Arith, *atomic.Int64, chan error) {
+	t.Helper()
+
+	arith := &Arith{release: make(chan struct{})}
+	sent := &atomic.Int64{}
+	ended := make(chan error, 1)
+
+	server := NewServer(opts...)
+	require.NoError(t, server.RegisterName("Arith", arith))
+	HandleStream(server, "Arith.Count", func(ctx context.Context, to int, send func(int) error) error {
+		for i := 1; i <= to; i++ {
+			if err := send(i); err != nil {
+				ended <- err
+				return err
+			}
+			sent.Add(1)
+		}
+
+		ended <- nil
+		return nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		close(arith.release)
+		server.Close()
+	})
+
+	return listener.Addr().String(), arith, sent, ended
+}
+
+func TestClient_Call(t *testing.T) {
+	addr, _, _, _ := startServer(t)
+
+	client, err := Dial(context.Background(), addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	assert.Equal(t, Version, client.Version())
+
+	var sum int
+	require.NoError(t, client.Call(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &sum))
+	assert.Equal(t, 3, sum)
+
+	var quotient int
+	require.NoError(t, client.Call(context.Background(), "Arith.Div", Args{A: 6, B: 3}, &quotient))
+	assert.Equal(t, 2, quotient)
+
+	err = client.Call(context.Background(), "Arith.Div", Args{A: 6}, &quotient)
+	assert.Equal(t, ServerError("divide by zero"), err)
+
+	err = client.Call(context.Background(), "Arith.Mul", Args{A: 6}, &quotient)
+	require.ErrorContains(t, err, "can't find method Arith.Mul")
+}
+
+func TestClient_multiplexing(t *testing.T) {
+	addr, arith, _, _ := startServer(t)
+
+	client, err := Dial(context.Background(), addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// a call that waits doesn't hold up the others on the connection
+	waited := make(chan error, 1)
+	go func() {
+		var reply bool
+		waited <- client.Call(context.Background(), "Arith.Wait", 0, &reply)
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var sum int
+			assert.NoError(t, client.Call(context.Background(), "Arith.Add", Args{A: i, B: i}, &sum))
+			assert.Equal(t, 2*i, sum)
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-waited:
+		t.Fatal("the waiting call answered too soon")
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var reply bool
+	require.ErrorIs(t, client.Call(ctx, "Arith.Wait", 0, &reply), context.DeadlineExceeded)
+
+	arith.release <- struct{}{}
+	require.NoError(t, <-waited)
+}
+
+func TestClient_Stream(t *testing.T) {
+	addr, _, sent, ended := startServer(t)
+
+	client, err := Dial(context.Background(), addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.Stream(context.Background(), "Arith.Count", 3*DefaultWindow)
+	require.NoError(t, err)
+
+	// the server stops at the window, until the items are read
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(DefaultWindow), sent.Load())
+
+	for want := 1; want <= 3*DefaultWindow; want++ {
+		var number int
+		require.NoError(t, stream.Recv(&number))
+		require.Equal(t, want, number)
+	}
+
+	var number int
+	require.ErrorIs(t, stream.Recv(&number), io.EOF)
+	require.NoError(t, <-ended)
+
+	// closing a stream cancels it on the server
+	stream, err = client.Stream(context.Background(), "Arith.Count", 3*DefaultWindow)
+	require.NoError(t, err)
+	require.NoError(t, stream.Recv(&number))
+	require.NoError(t, stream.Close())
+	require.ErrorIs(t, <-ended, context.Canceled)
+
+	_, err = client.Stream(context.Background(), "Arith.Add", Args{})
+	require.NoError(t, err, "the error comes with the first item")
+}
+
+func TestClient_closed(t *testing.T) {
+	addr, _, _, _ := startServer(t)
+
+	client, err := Dial(context.Background(), addr)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	var sum int
+	require.ErrorIs(t, client.Call(context.Background(), "Arith.Add", Args{A: 1}, &sum), ErrClosed)
+}
+
+func TestNewClient_handshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// a server that only speaks a version that doesn't exist
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = readHandshake(conn)
+		_ = writeHandshake(conn, Version+1)
+	}()
+
+	_, err = Dial(context.Background(), listener.Addr().String())
+	require.ErrorIs(t, err, ErrHandshake)
+}
+
+func TestServer_fallback(t *testing.T) {
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.RegisterName("Arith", &Arith{}))
+
+	addr, _, _, _ := startServer(t, WithFallback(rpcServer.ServeConn))
+
+	// a net/rpc client on the same address
+	client, err := rpc.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var sum int
+	require.NoError(t, client.Call("Arith.Add", Args{A: 2, B: 2}, &sum))
+	assert.Equal(t, 4, sum)
+}
+
+func TestPool_Call(t *testing.T) {
+	addr, _, _, _ := startServer(t)
+
+	// a server that only speaks net/rpc
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.RegisterName("Arith", &Arith{}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go rpcServer.Accept(listener)
+
+	pool := NewPool()
+	defer pool.Close()
+
+	for _, target := range []string{addr, listener.Addr().String()} {
+		for range 2 {
+			var sum int
+			require.NoError(t, pool.Call(context.Background(), target, "Arith.Add", Args{A: 1, B: 2}, &sum))
+			assert.Equal(t, 3, sum)
+		}
+	}
+
+	assert.Len(t, pool.clients, 1, "one connection to the transport server")
+	assert.True(t, pool.legacy[listener.Addr().String()])
+
+	_, err = pool.Stream(context.Background(), listener.Addr().String(), "Arith.Count", 1)
+	require.ErrorIs(t, err, ErrHandshake)
+
+	// a closed connection is replaced
+	pool.clients[addr].Close()
+	<-pool.clients[addr].done
+
+	var sum int
+	require.NoError(t, pool.Call(context.Background(), addr, "Arith.Add", Args{A: 1, B: 2}, &sum))
+}
+
+func TestServer_authentication(t *testing.T) {
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.RegisterName("Arith", &Arith{}))
+
+	inner := NewServer(WithFallback(rpcServer.ServeConn))
+	require.NoError(t, inner.RegisterName("Inner", &Arith{}))
+
+	addr, _, _, _ := startServer(t, WithAuthenticator(func(_ net.Conn, challenge, credentials []byte) (*Server, error) {
+		if string(credentials) != string(challenge)+"letmein" {
+			return nil, errors.New("wrong password")
+		}
+
+		return inner, nil
+	}))
+
+	good := WithCredentials(func(challenge []byte) []byte { return append(challenge, "letmein"...) })
+	wrong := WithCredentials(func([]byte) []byte { return []byte("letmein") })
+
+	client, err := Dial(context.Background(), addr, good)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the calls go to the server of the authenticator
+	var sum int
+	require.NoError(t, client.Call(context.Background(), "Inner.Add", Args{A: 1, B: 2}, &sum))
+	assert.Equal(t, 3, sum)
+
+	err = client.Call(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &sum)
+	require.ErrorContains(t, err, "can't find method Arith.Add")
+
+	_, err = Dial(context.Background(), addr, wrong)
+	require.ErrorIs(t, err, ErrAuthentication)
+	require.ErrorContains(t, err, "wrong password")
+
+	_, err = Dial(context.Background(), addr)
+	require.Error(t, err, "a connection without credentials is closed")
+
+	// a net/rpc client authenticates its connection first
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, Authenticate(conn, func(challenge []byte) []byte { return append(challenge, "letmein"...) }))
+
+	rpcClient := rpc.NewClient(conn)
+	defer rpcClient.Close()
+
+	require.NoError(t, rpcClient.Call("Arith.Add", Args{A: 2, B: 2}, &sum))
+	assert.Equal(t, 4, sum)
+
+	pool := NewPool(good)
+	defer pool.Close()
+
+	require.NoError(t, pool.Call(context.Background(), addr, "Inner.Add", Args{A: 3, B: 2}, &sum))
+	assert.Equal(t, 5, sum)
+}
+
+func TestServer_selector(t *testing.T) {
+	inner := NewServer()
+	require.NoError(t, inner.RegisterName("Inner", &Arith{}))
+
+	addr, _, _, _ := startServer(t, WithSelector(func(conn net.Conn) (*Server, error) {
+		if conn.RemoteAddr() == nil {
+			return nil, errors.New("no address")
+		}
+
+		return inner, nil
+	}))
+
+	client, err := Dial(context.Background(), addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the calls go to the server of the selector, without a handshake
+	var sum int
+	require.NoError(t, client.Call(context.Background(), "Inner.Add", Args{A: 1, B: 2}, &sum))
+	assert.Equal(t, 3, sum)
+
+	err = client.Call(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &sum)
+	require.ErrorContains(t, err, "can't find method Arith.Add")
+
+	// a connection the selector refuses is closed
+	refused, _, _, _ := startServer(t, WithSelector(func(net.Conn) (*Server, error) {
+		return nil, errors.New("refused")
+	}))
+
+	_, err = Dial(context.Background(), refused)
+	require.Error(t, err)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	arith := &Arith{release: make(chan struct{})}
+	ended := make(chan error, 1)
+
+	server := NewServer()
+	require.NoError(t, server.RegisterName("Arith", arith))
+	HandleStream(server, "Arith.Forever", func(ctx context.Context, _ int, send func(int) error) error {
+		<-ctx.Done()
+		ended <- ctx.Err()
+		return ctx.Err()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	client, err := Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	waited := make(chan error, 1)
+	go func() {
+		var released bool
+		waited <- client.Call(context.Background(), "Arith.Wait", 0, &released)
+	}()
+
+	_, err = client.Stream(context.Background(), "Arith.Forever", 0)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	require.ErrorIs(t, <-ended, context.Canceled, "a stream is canceled right away")
+
+	var sum int
+	require.ErrorContains(t, client.Call(context.Background(), "Arith.Add", Args{A: 1}, &sum), "server closed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = Dial(ctx, listener.Addr().String())
+	require.Error(t, err, "the listener is closed")
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the call ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(arith.release)
+	require.NoError(t, <-waited, "a running call gets its reply")
+	require.NoError(t, <-shutdown)
+}
+
+func TestServer_Shutdown_rpcFallback(t *testing.T) {
+	arith := &Arith{release: make(chan struct{})}
+
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.RegisterName("Arith", arith))
+
+	server := NewServer(WithRPCFallback(rpcServer))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	client, err := rpc.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	var sum int
+	require.NoError(t, client.Call("Arith.Add", Args{A: 1, B: 2}, &sum))
+	assert.Equal(t, 3, sum)
+
+	var released bool
+	waiting := client.Go("Arith.Wait", 0, &released, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the net/rpc call ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(arith.release)
+	require.NoError(t, (<-waiting.Done).Error, "a running net/rpc call gets its reply")
+	assert.True(t, released)
+	require.NoError(t, <-shutdown)
+}
+
+func TestServer_Shutdown_deadline(t *testing.T) {
+	arith := &Arith{release: make(chan struct{})}
+	defer close(arith.release)
+
+	server := NewServer()
+	require.NoError(t, server.RegisterName("Arith", arith))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	client, err := Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	waited := make(chan error, 1)
+	go func() {
+		var released bool
+		waited <- client.Call(context.Background(), "Arith.Wait", 0, &released)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	require.Error(t, <-waited, "the connection is closed at the deadline")
+}
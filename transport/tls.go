@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair is a certificate with its key, from files. The files are loaded again when they change,
+// so a renewed certificate is used for the next connections without a restart.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	mu       sync.Mutex
+}
+
+// LoadKeyPair loads a certificate and its key, in PEM.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	pair := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := pair.Certificate(); err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+// Certificate returns the certificate, it is loaded again when one of the files changed.
+// When the new files can't be loaded (they may be written right now), the old certificate is kept.
+func (k *KeyPair) Certificate() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	certMod, certErr := modTime(k.certFile)
+	keyMod, keyErr := modTime(k.keyFile)
+
+	if k.cert != nil && (certErr != nil || keyErr != nil || (certMod.Equal(k.certMod) && keyMod.Equal(k.keyMod))) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("transport: load key pair error: %w", err)
+	}
+
+	k.cert, k.certMod, k.keyMod = &cert, certMod, keyMod
+	return k.cert, nil
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// LoadCertPool loads the certificates of the authorities that are trusted, in PEM.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("transport: load certificate authority error: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("transport: no certificate in " + file)
+	}
+
+	return pool, nil
+}
+
+// ServerTLS returns the TLS config of a server with the key pair. With client authorities the clients
+// may show a certificate, which is verified against them (a node shows one to the other nodes).
+func ServerTLS(pair *KeyPair, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return pair.Certificate()
+		},
+	}
+
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
+
+// ClientTLS returns the TLS config of a client that trusts the authorities, it shows the key pair
+// to the server when it isn't nil. The ServerName is left for WithTLS to fill in.
+func ClientTLS(pair *KeyPair, rootCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: rootCAs}
+
+	if pair != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return pair.Certificate()
+		}
+	}
+
+	return config
+}
+
+// WithTLS makes the connections with TLS, config returns the config for the address of a server.
+// A config without a ServerName verifies the host of the address.
+func WithTLS(config func(addr string) *tls.Config) DialOption {
+	return func(c *dialConfig) {
+		c.tls = config
+	}
+}
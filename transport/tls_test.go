@@ -0,0 +1,194 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority that is made for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the certificate in PEM
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fastdb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate for the names and its key, for servers and clients, and returns their files.
+func (ca *testCA) issue(t *testing.T, dir string, names ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+// leafName returns the first DNS name of a certificate.
+func leafName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	return leaf.DNSNames[0]
+}
+
+func TestKeyPair_reload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	certFile, keyFile := ca.issue(t, dir, "node-1")
+	pair, err := LoadKeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	cert, err := pair.Certificate()
+	require.NoError(t, err)
+	assert.Equal(t, "node-1", leafName(t, cert))
+
+	// a renewed certificate is used without loading it again
+	ca.issue(t, dir, "node-1-renewed")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	cert, err = pair.Certificate()
+	require.NoError(t, err)
+	assert.Equal(t, "node-1-renewed", leafName(t, cert))
+
+	// a file that is being written keeps the old certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("half a cert"), 0o600))
+
+	cert, err = pair.Certificate()
+	require.NoError(t, err)
+	assert.Equal(t, "node-1-renewed", leafName(t, cert))
+
+	_, err = LoadKeyPair(filepath.Join(dir, "missing.pem"), keyFile)
+	require.Error(t, err)
+
+	_, err = LoadCertPool(keyFile)
+	require.Error(t, err, "a key isn't a certificate")
+}
+
+func TestServer_tls(t *testing.T) {
+	ca := newTestCA(t)
+	authorities, err := LoadCertPool(ca.file)
+	require.NoError(t, err)
+
+	serverPair, err := LoadKeyPair(ca.issue(t, t.TempDir(), "node-1"))
+	require.NoError(t, err)
+
+	clientPair, err := LoadKeyPair(ca.issue(t, t.TempDir(), "node-2"))
+	require.NoError(t, err)
+
+	verified := make(chan string, 1)
+	inner := NewServer()
+	require.NoError(t, inner.RegisterName("Arith", &Arith{}))
+
+	server := NewServer(WithAuthenticator(func(conn net.Conn, _, _ []byte) (*Server, error) {
+		if chains := conn.(*tls.Conn).ConnectionState().VerifiedChains; len(chains) > 0 {
+			verified <- chains[0][0].DNSNames[0]
+		}
+		return inner, nil
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(tls.NewListener(listener, ServerTLS(serverPair, authorities)))
+	t.Cleanup(func() { server.Close() })
+
+	addr := listener.Addr().String()
+	credentials := WithCredentials(func([]byte) []byte { return []byte("me") })
+
+	nodeTLS := func(name string, pair *KeyPair, authorities *x509.CertPool) DialOption {
+		return WithTLS(func(string) *tls.Config {
+			config := ClientTLS(pair, authorities)
+			config.ServerName = name
+			return config
+		})
+	}
+
+	client, err := Dial(context.Background(), addr, nodeTLS("node-1", clientPair, authorities), credentials)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var sum int
+	require.NoError(t, client.Call(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &sum))
+	assert.Equal(t, 3, sum)
+	assert.Equal(t, "node-2", <-verified, "the server sees the certificate of the client")
+
+	_, err = Dial(context.Background(), addr, nodeTLS("node-3", clientPair, authorities), credentials)
+	require.ErrorContains(t, err, "tls handshake", "the server isn't node-3")
+
+	_, err = Dial(context.Background(), addr, nodeTLS("node-1", nil, x509.NewCertPool()), credentials)
+	require.ErrorContains(t, err, "tls handshake", "the authority of the server isn't trusted")
+
+	// without a ServerName the host of the address is verified, the certificate has 127.0.0.1 too
+	pool := NewPool(WithTLS(func(string) *tls.Config { return ClientTLS(nil, authorities) }), credentials)
+	defer pool.Close()
+
+	require.NoError(t, pool.Call(context.Background(), addr, "Arith.Add", Args{A: 2, B: 2}, &sum))
+	assert.Equal(t, 4, sum)
+}
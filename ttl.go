@@ -0,0 +1,348 @@
+package fastdb
+
+/* ------------------------------- Imports --------------------------- */
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marcelloh/fastdb/persist"
+)
+
+/* ---------------------- Constants/Types/Variables ------------------ */
+
+// NoExpiry is the TTL of a key that doesn't expire.
+const NoExpiry time.Duration = -1
+
+// expireInterval is the pause between two runs that delete the expired keys.
+var expireInterval = 100 * time.Millisecond
+
+// UpdateFunc gets the current value of a key (found is false when it doesn't exist),
+// and returns its new value. A nil value deletes the key.
+type UpdateFunc func(value []byte, found bool) ([]byte, error)
+
+/* -------------------------- Methods/Functions ---------------------- */
+
+/*
+SetUntil stores one map value in a bucket like Set, the key expires at the given moment.
+The zero time stores a value that doesn't expire.
+An expired key can't be read anymore, and is deleted shortly after it expires.
+*/
+func (fdb *DB) SetUntil(bucket string, key int, value []byte, expires time.Time) error {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	return fdb.setEntry(context.Background(), sh, bucket, key, Entry{Value: value, Expires: expires})
+}
+
+/*
+Expire makes an existing key expire after the ttl, a ttl that isn't positive deletes the key.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) Expire(bucket string, key int, ttl time.Duration) (bool, error) {
+	return fdb.ExpireAt(bucket, key, time.Now().Add(ttl))
+}
+
+/*
+ExpireAt makes an existing key expire at the given moment, a moment that has passed deletes the key.
+The zero time removes the expiry, like Persist.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) ExpireAt(bucket string, key int, expires time.Time) (bool, error) {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	now := time.Now()
+
+	if !sh.exists(bucket, key, now) {
+		return false, nil
+	}
+
+	if !expires.IsZero() && !now.Before(expires) {
+		return fdb.del(sh, bucket, key)
+	}
+
+	err := fdb.writeExpiry(sh, bucket, key, expires, now)
+	if err != nil {
+		return false, fmt.Errorf("expire->%w", err)
+	}
+
+	return true, nil
+}
+
+/*
+Persist removes the expiry of a key, it returns false when the key doesn't exist or doesn't expire.
+*/
+func (fdb *DB) Persist(bucket string, key int) (bool, error) {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	now := time.Now()
+
+	if !sh.exists(bucket, key, now) || sh.expiry(bucket, key).IsZero() {
+		return false, nil
+	}
+
+	err := fdb.writeExpiry(sh, bucket, key, time.Time{}, now)
+	if err != nil {
+		return false, fmt.Errorf("persist->%w", err)
+	}
+
+	return true, nil
+}
+
+/*
+TTL returns the time a key has left before it expires, NoExpiry when it doesn't expire.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) TTL(bucket string, key int) (time.Duration, bool) {
+	expires, found := fdb.ExpiresAt(bucket, key)
+	if !found {
+		return 0, false
+	}
+
+	if expires.IsZero() {
+		return NoExpiry, true
+	}
+
+	return time.Until(expires), true
+}
+
+/*
+ExpiresAt returns the moment a key expires, the zero time when it doesn't expire.
+It returns false when the key doesn't exist.
+*/
+func (fdb *DB) ExpiresAt(bucket string, key int) (time.Time, bool) {
+	sh := fdb.shardFor(bucket)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if !sh.exists(bucket, key, time.Now()) {
+		return time.Time{}, false
+	}
+
+	return sh.expiry(bucket, key), true
+}
+
+/*
+Update changes the value of a key with a function, while no one else can change the bucket.
+When the function returns an error, the key is left alone and the error is returned.
+The key keeps its expiry and attributes.
+*/
+func (fdb *DB) Update(bucket string, key int, update UpdateFunc) error {
+	sh := fdb.shardFor(bucket)
+	defer sh.lockUnlock()()
+
+	value, found := sh.keys[bucket][key]
+	if found && sh.expired(bucket, key, time.Now()) {
+		value, found = nil, false
+	}
+
+	newValue, err := update(value, found)
+	if err != nil {
+		return err
+	}
+
+	if newValue == nil {
+		if found {
+			_, err = fdb.del(sh, bucket, key)
+		}
+
+		return err
+	}
+
+	entry := sh.entry(bucket, key)
+	entry.Value = newValue
+
+	return fdb.setEntry(context.Background(), sh, bucket, key, entry)
+}
+
+/*
+writeExpiry writes the moment a key expires and keeps it, the caller should hold the lock of the shard.
+*/
+func (fdb *DB) writeExpiry(sh *shard, bucket string, key int, expires, now time.Time) error {
+	if fdb.aof != nil {
+		err := fdb.aof.Append(persist.ExpireInstruction(bucket, key, expires, now))
+		if err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+	}
+
+	fdb.setExpiry(sh, bucket, key, expires)
+
+	return nil
+}
+
+/*
+setExpiry keeps the moment a key expires in memory, the zero time removes it.
+The caller should hold the lock of the shard.
+*/
+func (fdb *DB) setExpiry(sh *shard, bucket string, key int, expires time.Time) {
+	if expires.IsZero() {
+		if _, found := sh.expires[bucket][key]; !found {
+			return
+		}
+
+		delete(sh.expires[bucket], key)
+
+		if len(sh.expires[bucket]) == 0 {
+			delete(sh.expires, bucket)
+		}
+	} else {
+		if _, found := sh.expires[bucket]; !found {
+			sh.expires[bucket] = map[int]time.Time{}
+		}
+
+		sh.expires[bucket][key] = expires
+
+		fdb.startExpiring()
+	}
+
+	if fdb.aof != nil {
+		fdb.aof.SetExpire(bucket, key, expires)
+	}
+}
+
+/*
+loadExpires keeps the moments the keys that were read from the file expire.
+*/
+func (fdb *DB) loadExpires(expires map[string]map[int]time.Time) {
+	for bucket, moments := range expires {
+		sh := fdb.shardFor(bucket)
+
+		for key, moment := range moments {
+			if _, found := sh.keys[bucket][key]; found {
+				fdb.setExpiry(sh, bucket, key, moment)
+			}
+		}
+	}
+}
+
+/*
+startExpiring starts the routine that deletes the expired keys, once.
+*/
+func (fdb *DB) startExpiring() {
+	fdb.expiring.Do(func() {
+		go fdb.expireLoop()
+	})
+}
+
+/*
+expireLoop deletes the expired keys regularly, until the database is closed.
+*/
+func (fdb *DB) expireLoop() {
+	tick := time.NewTicker(expireInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-fdb.closed:
+			return
+		case <-tick.C:
+			fdb.deleteExpired()
+		}
+	}
+}
+
+/*
+deleteExpired deletes the keys that have expired, in all the shards.
+The before del hooks aren't called, an expired key can't be kept.
+A key that can't be deleted now (because writing failed) is tried again the next time.
+*/
+func (fdb *DB) deleteExpired() {
+	for _, sh := range fdb.shards {
+		sh.mu.RLock()
+		waiting := len(sh.expires)
+		sh.mu.RUnlock()
+
+		if waiting == 0 {
+			continue
+		}
+
+		sh.mu.Lock()
+
+		now := time.Now()
+		hks := fdb.hooks.Load()
+
+		for bucket, moments := range sh.expires {
+			for key, moment := range moments {
+				if now.Before(moment) {
+					continue
+				}
+
+				if fdb.aof != nil && fdb.aof.Append(persist.DelInstruction(bucket, key, now)) != nil {
+					continue
+				}
+
+				fdb.applyDel(sh, hks, bucket, key, now)
+			}
+		}
+
+		sh.mu.Unlock()
+	}
+}
+
+/*
+exists tells if a key exists and hasn't expired, the caller should hold the lock of the shard.
+*/
+func (sh *shard) exists(bucket string, key int, now time.Time) bool {
+	_, found := sh.keys[bucket][key]
+
+	return found && !sh.expired(bucket, key, now)
+}
+
+/*
+expired tells if a key has expired, the caller should hold the lock of the shard.
+*/
+func (sh *shard) expired(bucket string, key int, now time.Time) bool {
+	expires, found := sh.expires[bucket][key]
+
+	return found && !now.Before(expires)
+}
+
+/*
+live returns the values of a bucket without the keys that have expired, but aren't deleted yet.
+It's the map of the bucket itself when none have expired. The caller should hold the lock of the shard.
+*/
+func (sh *shard) live(bucket string, now time.Time) map[int][]byte {
+	values := sh.keys[bucket]
+	if sh.expiredIn(bucket, now) == 0 {
+		return values
+	}
+
+	live := make(map[int][]byte, len(values))
+
+	for key, value := range values {
+		if !sh.expired(bucket, key, now) {
+			live[key] = value
+		}
+	}
+
+	return live
+}
+
+/*
+expiry returns the moment a key expires, the zero time when it doesn't.
+The caller should hold the lock of the shard.
+*/
+func (sh *shard) expiry(bucket string, key int) time.Time {
+	return sh.expires[bucket][key]
+}
+
+/*
+expiredIn returns the number of keys of a bucket that have expired, but aren't deleted yet.
+The caller should hold the lock of the shard.
+*/
+func (sh *shard) expiredIn(bucket string, now time.Time) int {
+	count := 0
+
+	for _, moment := range sh.expires[bucket] {
+		if !now.Before(moment) {
+			count++
+		}
+	}
+
+	return count
+}
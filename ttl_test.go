@@ -0,0 +1,195 @@
+package fastdb_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marcelloh/fastdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Expire(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	require.NoError(t, store.Set("text", 1, []byte("one")))
+	require.NoError(t, store.Set("text", 2, []byte("two")))
+
+	ttl, found := store.TTL("text", 1)
+	assert.True(t, found)
+	assert.Equal(t, fastdb.NoExpiry, ttl)
+
+	expired, err := store.Expire("text", 1, 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, expired)
+
+	expired, err = store.Expire("text", 3, time.Second)
+	require.NoError(t, err)
+	assert.False(t, expired, "the key doesn't exist")
+
+	ttl, found = store.TTL("text", 1)
+	assert.True(t, found)
+	assert.InDelta(t, 50*time.Millisecond, ttl, float64(10*time.Millisecond))
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, found = store.Get("text", 1)
+	assert.False(t, found, "an expired key can't be read")
+	assert.Equal(t, []int{2}, store.Keys("text", 0, 0))
+	assert.Equal(t, 1, store.Count("text"))
+
+	all, err := store.GetAll("text")
+	require.NoError(t, err)
+	assert.Equal(t, map[int][]byte{2: []byte("two")}, all, "an expired key isn't in a bulk read")
+
+	sorted, err := store.GetAllSorted("text")
+	require.NoError(t, err)
+	require.Len(t, sorted, 1)
+	assert.Equal(t, 2, sorted[0].SortField)
+
+	results, err := store.Query("text").Run()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, 2, results[0].Key)
+
+	_, found = store.TTL("text", 1)
+	assert.False(t, found)
+
+	// the expired key is deleted
+	require.Eventually(t, func() bool {
+		return store.Info() == "1 record(s) in 1 bucket(s)"
+	}, time.Second, 10*time.Millisecond)
+
+	// a ttl that isn't positive deletes the key
+	expired, err = store.Expire("text", 2, 0)
+	require.NoError(t, err)
+	assert.True(t, expired)
+
+	_, found = store.Get("text", 2)
+	assert.False(t, found)
+}
+
+func Test_SetUntil_Persist(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, store.SetUntil("text", 1, []byte("one"), later))
+
+	expires, found := store.ExpiresAt("text", 1)
+	assert.True(t, found)
+	assert.True(t, later.Equal(expires))
+
+	persisted, err := store.Persist("text", 1)
+	require.NoError(t, err)
+	assert.True(t, persisted)
+
+	persisted, err = store.Persist("text", 1)
+	require.NoError(t, err)
+	assert.False(t, persisted, "the key doesn't expire anymore")
+
+	// a set removes the expiry
+	require.NoError(t, store.SetUntil("text", 1, []byte("one"), later))
+	require.NoError(t, store.Set("text", 1, []byte("one again")))
+
+	ttl, _ := store.TTL("text", 1)
+	assert.Equal(t, fastdb.NoExpiry, ttl)
+}
+
+func Test_Update(t *testing.T) {
+	store, err := fastdb.Open(memory, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	incr := func(value []byte, found bool) ([]byte, error) {
+		if !found {
+			return []byte("1"), nil
+		}
+
+		number, err := strconv.Atoi(string(value))
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(number + 1)), nil
+	}
+
+	require.NoError(t, store.Update("counter", 1, incr))
+	require.NoError(t, store.Update("counter", 1, incr))
+
+	value, _ := store.Get("counter", 1)
+	assert.Equal(t, "2", string(value))
+
+	// the key keeps its expiry
+	_, err = store.Expire("counter", 1, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.Update("counter", 1, incr))
+
+	ttl, _ := store.TTL("counter", 1)
+	assert.Greater(t, ttl, time.Minute)
+
+	errStop := errors.New("stop")
+	err = store.Update("counter", 1, func([]byte, bool) ([]byte, error) { return nil, errStop })
+	require.ErrorIs(t, err, errStop)
+
+	value, _ = store.Get("counter", 1)
+	assert.Equal(t, "3", string(value))
+
+	// a nil value deletes the key
+	require.NoError(t, store.Update("counter", 1, func([]byte, bool) ([]byte, error) { return nil, nil }))
+
+	_, found := store.Get("counter", 1)
+	assert.False(t, found)
+}
+
+func Test_Expire_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expire.db")
+
+	store, err := fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Hour).Round(0)
+	require.NoError(t, store.SetUntil("text", 1, []byte("one"), later))
+	require.NoError(t, store.SetUntil("text", 2, []byte("two"), time.Now().Add(20*time.Millisecond)))
+	require.NoError(t, store.Set("text", 3, []byte("three")))
+	require.NoError(t, store.Close())
+
+	time.Sleep(30 * time.Millisecond)
+
+	store, err = fastdb.Open(path, syncIime)
+	require.NoError(t, err)
+
+	defer func() {
+		err = store.Close()
+		require.NoError(t, err)
+	}()
+
+	expires, found := store.ExpiresAt("text", 1)
+	assert.True(t, found)
+	assert.True(t, later.Equal(expires))
+
+	_, found = store.Get("text", 2)
+	assert.False(t, found, "the key expired while the database was closed")
+
+	ttl, found := store.TTL("text", 3)
+	assert.True(t, found)
+	assert.Equal(t, fastdb.NoExpiry, ttl)
+}